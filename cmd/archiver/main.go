@@ -0,0 +1,17 @@
+package main
+
+import (
+	"context"
+
+	app "github.com/LastSprint/pipetank/internal/apps/archiver"
+)
+
+var Version = "0.0.1"
+
+func main() {
+	ctx := context.Background()
+	err := app.Run(ctx)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	app "github.com/LastSprint/pipetank/internal/apps/dlq_admin"
+)
+
+var Version = "0.0.1"
+
+func main() {
+	ctx := context.Background()
+
+	err := app.Run(ctx, os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"testing"
 
 	"github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/client"
+	testConsumer "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/consumer"
 	testGrpcAPI "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/grpc_api"
 	mgo2 "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/mgo"
+	appGrpcAPI "github.com/LastSprint/pipetank/internal/apps/grpc_api"
 	"github.com/LastSprint/pipetank/pkg/mdb"
 )
 
@@ -18,11 +20,30 @@ type TestEnv struct {
 }
 
 func RunTestEnv(t *testing.T, clients ...string) *TestEnv {
+	return RunIngestionTestEnv(t, appGrpcAPI.IngestionDirect, clients...)
+}
+
+// RunIngestionTestEnv runs the API with the ingestion mode,
+// the consumer is started too if the mode writes raw events.
+func RunIngestionTestEnv(t *testing.T, mode appGrpcAPI.IngestionMode, clients ...string) *TestEnv {
 	dbName := "e2e_test_db"
-	mdbDsn := mgo2.RunSingleContainer(t)
+
+	var mdbDsn string
+
+	if mode == appGrpcAPI.IngestionDirect {
+		mdbDsn = mgo2.RunSingleContainer(t)
+	} else {
+		// the consumer watches a change stream, so it needs a replica set
+		mdbDsn = mgo2.RunReplicaSetContainer(t)
+	}
+
 	mdbClient := mgo2.InitTestMDBClient(t, mdbDsn, dbName)
 
-	srvAddr := testGrpcAPI.Run(t, mdbDsn, dbName)
+	srvAddr := testGrpcAPI.RunWithIngestionMode(t, mdbDsn, dbName, mode)
+
+	if mode != appGrpcAPI.IngestionDirect {
+		testConsumer.Run(t, mdbClient, client.NewTestClient(t, srvAddr).API())
+	}
 
 	clientsMap := make(map[string]*client.TestClient, len(clients))
 
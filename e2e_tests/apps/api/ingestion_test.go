@@ -0,0 +1,117 @@
+//go:build test
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	appGrpcAPI "github.com/LastSprint/pipetank/internal/apps/grpc_api"
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestIngestionModes(t *testing.T) {
+	tests := []struct {
+		mode appGrpcAPI.IngestionMode
+		// rawEvents is how many events must be in the raw events log.
+		rawEvents int64
+	}{
+		{mode: appGrpcAPI.IngestionDirect, rawEvents: 0},
+		{mode: appGrpcAPI.IngestionRaw, rawEvents: 3},
+		{mode: appGrpcAPI.IngestionBoth, rawEvents: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			var (
+				worker1          = "w1"
+				processID        = "p1"
+				executionID      = "e1"
+				stageExecutionID = "s1"
+			)
+
+			testEnv := RunIngestionTestEnv(t, tt.mode, worker1)
+			cl := testEnv.Clients[worker1]
+
+			tsStart := time.Now()
+
+			cl.SendRawEvent(
+				t,
+				ingestionEvent(processID, executionID, stageExecutionID, tsStart, proto.EventKind_EventKindStageStarted),
+				ingestionEvent(
+					processID, executionID, stageExecutionID,
+					tsStart.Add(time.Second),
+					proto.EventKind_EventKindGenericUpdate,
+				),
+				ingestionEvent(
+					processID, executionID, stageExecutionID,
+					tsStart.Add(time.Second*2),
+					proto.EventKind_EventKindStageFinished,
+				),
+			)
+
+			ref := &proto.StageExecutionRef{
+				ProcessID:        &processID,
+				ExecutionID:      &executionID,
+				StageExecutionID: &stageExecutionID,
+			}
+
+			require.Eventually(t, func() bool {
+				stage, err := cl.API().GetStageExecution(t.Context(), ref)
+				return err == nil && stage.GetIsFinished()
+			}, time.Second*10, time.Millisecond*100)
+
+			// the consumer must not aggregate events which are already aggregated by the API
+			assert.Never(t, func() bool {
+				stage, err := cl.API().GetStageExecution(t.Context(), ref)
+				return err != nil || len(stage.GetUpdates()) != 1
+			}, time.Second, time.Millisecond*100)
+
+			rawEvents := testEnv.MdbClient.DB().Collection("executions")
+
+			count, err := rawEvents.CountDocuments(t.Context(), bson.M{repo.RawEventProcessIDFieldName(): processID})
+			require.NoError(t, err)
+			assert.Equal(t, tt.rawEvents, count)
+
+			aggregated, err := rawEvents.CountDocuments(t.Context(), bson.M{
+				repo.RawEventProcessIDFieldName():  processID,
+				repo.RawEventAggregatedFieldName(): true,
+			})
+			require.NoError(t, err)
+
+			if tt.mode == appGrpcAPI.IngestionBoth {
+				assert.Equal(t, tt.rawEvents, aggregated)
+			} else {
+				assert.Zero(t, aggregated)
+			}
+		})
+	}
+}
+
+func ingestionEvent(
+	processID, executionID, stageExecutionID string,
+	ts time.Time,
+	kind proto.EventKind,
+) *proto.RawEvent {
+	stageName, description := "stage_1", "stage 1 description"
+	status := proto.EventStatus_EventStatusUnknown
+
+	if kind == proto.EventKind_EventKindStageFinished {
+		status = proto.EventStatus_EventStatusSuccess
+	}
+
+	return &proto.RawEvent{
+		ProcessID:        &processID,
+		ExecutionID:      &executionID,
+		StageExecutionID: &stageExecutionID,
+		Stage:            &proto.RawStage{Name: &stageName, Description: &description},
+		Ts:               timestamppb.New(ts),
+		Kind:             &kind,
+		Status:           &status,
+	}
+}
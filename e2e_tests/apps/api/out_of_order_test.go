@@ -0,0 +1,71 @@
+//go:build test
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	appGrpcAPI "github.com/LastSprint/pipetank/internal/apps/grpc_api"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutOfOrderBatches(t *testing.T) {
+	var (
+		worker1          = "w1"
+		processID        = "p1"
+		executionID      = "e1"
+		stageExecutionID = "s1"
+	)
+
+	testEnv := RunIngestionTestEnv(t, appGrpcAPI.IngestionDirect, worker1)
+	cl := testEnv.Clients[worker1]
+
+	tsStart := time.Now().Truncate(time.Millisecond)
+
+	// every batch holds one event, the finish comes first and the start comes last
+	cl.SendRawEvent(t, ingestionEvent(
+		processID, executionID, stageExecutionID,
+		tsStart.Add(time.Second*3),
+		proto.EventKind_EventKindStageFinished,
+	))
+	cl.SendRawEvent(t, ingestionEvent(
+		processID, executionID, stageExecutionID,
+		tsStart.Add(time.Second*2),
+		proto.EventKind_EventKindGenericUpdate,
+	))
+	cl.SendRawEvent(t, ingestionEvent(
+		processID, executionID, stageExecutionID,
+		tsStart.Add(time.Second),
+		proto.EventKind_EventKindGenericUpdate,
+	))
+	cl.SendRawEvent(t, ingestionEvent(
+		processID, executionID, stageExecutionID,
+		tsStart,
+		proto.EventKind_EventKindStageStarted,
+	))
+	// a retried start is later than the stored one, it must be ignored
+	cl.SendRawEvent(t, ingestionEvent(
+		processID, executionID, stageExecutionID,
+		tsStart.Add(time.Second*4),
+		proto.EventKind_EventKindStageStarted,
+	))
+
+	stage, err := cl.API().GetStageExecution(t.Context(), &proto.StageExecutionRef{
+		ProcessID:        &processID,
+		ExecutionID:      &executionID,
+		StageExecutionID: &stageExecutionID,
+	})
+	require.NoError(t, err)
+
+	assert.True(t, stage.GetIsFinished())
+	assert.True(t, stage.GetIsSuccess())
+	assert.True(t, tsStart.Equal(stage.GetStart().GetTs().AsTime()))
+	assert.True(t, tsStart.Add(time.Second*3).Equal(stage.GetEnd().GetTs().AsTime()))
+
+	require.Len(t, stage.GetUpdates(), 2)
+	assert.True(t, tsStart.Add(time.Second).Equal(stage.GetUpdates()[0].GetTs().AsTime()))
+	assert.True(t, tsStart.Add(time.Second*2).Equal(stage.GetUpdates()[1].GetTs().AsTime()))
+}
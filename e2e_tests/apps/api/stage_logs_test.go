@@ -0,0 +1,74 @@
+//go:build test
+
+package api
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestStageLogs(t *testing.T) {
+	var (
+		worker1          = "w1"
+		processID        = "p1"
+		executionID      = "e1"
+		stageExecutionID = "s1"
+	)
+
+	testEnv := RunTestEnv(t, worker1)
+	cl := testEnv.Clients[worker1]
+
+	ref := &proto.StageExecutionRef{
+		ProcessID:        &processID,
+		ExecutionID:      &executionID,
+		StageExecutionID: &stageExecutionID,
+	}
+
+	tsStart := time.Now()
+	level := proto.LogLevel_LogLevelInfo
+
+	// the server is configured to keep 100 lines per stage
+	lines := make([]*proto.StageLogLine, 0, 150)
+	for i := range 150 {
+		msg := "line " + strconv.Itoa(i)
+		lines = append(lines, &proto.StageLogLine{
+			ProcessID:        &processID,
+			ExecutionID:      &executionID,
+			StageExecutionID: &stageExecutionID,
+			Level:            &level,
+			Message:          &msg,
+			Ts:               timestamppb.New(tsStart.Add(time.Millisecond * time.Duration(i))),
+			Attributes:       map[string]string{"stream": "stdout"},
+		})
+	}
+
+	cl.SendStageLogLines(t, worker1, lines...)
+
+	limit := int32(60)
+
+	require.Eventually(t, func() bool {
+		page, err := cl.API().GetStageLogs(t.Context(), &proto.GetStageLogsRequest{Stage: ref, Limit: &limit})
+		return err == nil && len(page.GetLines()) == int(limit)
+	}, time.Second*5, time.Millisecond*100)
+
+	page, err := cl.API().GetStageLogs(t.Context(), &proto.GetStageLogsRequest{Stage: ref, Limit: &limit})
+	require.NoError(t, err)
+	assert.Equal(t, "line 0", page.GetLines()[0].GetMessage())
+	assert.Equal(t, "stdout", page.GetLines()[0].GetAttributes()["stream"])
+
+	nextSeq := page.GetNextSeq()
+	page, err = cl.API().GetStageLogs(
+		t.Context(),
+		&proto.GetStageLogsRequest{Stage: ref, FromSeq: &nextSeq, Limit: &limit},
+	)
+	require.NoError(t, err)
+	require.Len(t, page.GetLines(), 40)
+	assert.Equal(t, "line 99", page.GetLines()[39].GetMessage())
+	assert.Equal(t, int64(100), page.GetNextSeq())
+}
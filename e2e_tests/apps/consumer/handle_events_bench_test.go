@@ -0,0 +1,232 @@
+//go:build test
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	mgo2 "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/mgo"
+	"github.com/LastSprint/pipetank/internal/repo"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// updatesPerStage is the number of updates between the start and the finish of every stage execution.
+const updatesPerStage = 8
+
+// Collections of the aggregates, the old path writes to them directly.
+const (
+	stageExecutionsCollection = "single_stage_exec"
+	executionsCollection      = "execution_aggregates"
+)
+
+type eventsHandler interface {
+	HandleEvents(ctx context.Context, events []repo.Event) error
+}
+
+// perEventHandler is the path before writes were batched: an UpdateOne of the execution, and a start,
+// an update with all updates and a finish of every stage execution, each in its own round trip.
+type perEventHandler struct {
+	client *mdb.Client
+}
+
+func (h perEventHandler) HandleEvents(ctx context.Context, events []repo.Event) error {
+	executions := map[string]repo.ExecutionAggregate{}
+	stageExecutions := map[string][]repo.Event{}
+
+	for _, event := range events {
+		execution, ok := executions[event.ExecutionID]
+		if !ok {
+			execution = repo.ExecutionAggregate{
+				ProcessID:    event.ProcessID,
+				ExecutionID:  event.ExecutionID,
+				FirstEventAt: event.Ts,
+			}
+		}
+
+		execution.WorkerID = event.WorkerID
+		execution.FirstEventAt = minTime(execution.FirstEventAt, event.Ts)
+		execution.LastEventAt = maxTime(execution.LastEventAt, event.Ts)
+		executions[event.ExecutionID] = execution
+
+		stageExecutions[event.StageExecutionID] = append(stageExecutions[event.StageExecutionID], event)
+	}
+
+	for _, execution := range executions {
+		_, err := h.client.DB().Collection(executionsCollection).UpdateOne(
+			ctx,
+			bson.M{
+				repo.ExecutionAggregateProcessIDFieldName():   execution.ProcessID,
+				repo.ExecutionAggregateExecutionIDFieldName(): execution.ExecutionID,
+			},
+			bson.M{
+				"$set": bson.M{
+					repo.ExecutionAggregateWorkerIDFieldName():  execution.WorkerID,
+					repo.ExecutionAggregateUpdatedAtFieldName(): time.Now(),
+				},
+				"$min": bson.M{repo.ExecutionAggregateFirstEventAtFieldName(): execution.FirstEventAt},
+				"$max": bson.M{repo.ExecutionAggregateLastEventAtFieldName(): execution.LastEventAt},
+			},
+			options.UpdateOne().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, events := range stageExecutions {
+		err := h.writeStageExecution(ctx, events)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h perEventHandler) writeStageExecution(ctx context.Context, events []repo.Event) error {
+	collection := h.client.DB().Collection(stageExecutionsCollection)
+	filter := bson.M{
+		repo.SingleStageExecutionEventProcessIDFieldName():        events[0].ProcessID,
+		repo.SingleStageExecutionEventExecutionIDFieldName():      events[0].ExecutionID,
+		repo.SingleStageExecutionEventStageExecutionIDFieldName(): events[0].StageExecutionID,
+	}
+
+	var updates []repo.Event
+
+	for _, event := range events {
+		switch event.Kind {
+		case repo.EventKindStageStarted:
+			_, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+				repo.SingleStageExecutionEventUpdateAtFieldName(): time.Now(),
+				repo.SingleStageExecutionEventWorkerIDFieldName(): event.WorkerID,
+				repo.SingleStageExecutionEventRawStageFieldName(): event.Stage,
+				repo.SingleStageExecutionEventStartFieldName():    event,
+			}}, options.UpdateOne().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+		case repo.EventKindGenericUpdate:
+			updates = append(updates, event)
+		}
+	}
+
+	if len(updates) > 0 {
+		_, err := collection.UpdateOne(ctx, filter, bson.M{
+			"$set":      bson.M{repo.SingleStageExecutionEventUpdateAtFieldName(): time.Now()},
+			"$addToSet": bson.M{repo.SingleStageExecutionEventUpdatesFieldName(): bson.M{"$each": updates}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, event := range events {
+		if event.Kind != repo.EventKindStageFinished {
+			continue
+		}
+
+		_, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+			repo.SingleStageExecutionEventUpdateAtFieldName():   time.Now(),
+			repo.SingleStageExecutionEventEndFieldName():        event,
+			repo.SingleStageExecutionEventIsFinishedFieldName(): true,
+			repo.SingleStageExecutionEventIsSuccessFieldName():  true,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// BenchmarkHandleEvents compares one bulk write per batch with the round trips per stage execution
+// of the path before writes were batched.
+//
+//	go test -tags test -run '^$' -bench HandleEvents ./e2e_tests/apps/consumer/
+func BenchmarkHandleEvents(b *testing.B) {
+	mdbDsn := mgo2.RunSingleContainer(b)
+	mdbClient := mgo2.InitTestMDBClient(b, mdbDsn, "e2e_bench_db")
+
+	rep, err := repo.NewRepo(b.Context(), mdbClient, utils.UTCClock())
+	require.NoError(b, err)
+
+	handlers := []struct {
+		name    string
+		handler eventsHandler
+	}{
+		{name: "bulk", handler: raweventsconsumer.NewService(rep)},
+		{name: "per_event", handler: perEventHandler{client: mdbClient}},
+	}
+
+	for _, size := range []int{100, 1000} {
+		for _, h := range handlers {
+			b.Run(fmt.Sprintf("%s/%d", h.name, size), func(b *testing.B) {
+				for i := 0; b.Loop(); i++ {
+					events := benchEvents(fmt.Sprintf("%s_%d_%d", h.name, size, i), size)
+
+					require.NoError(b, h.handler.HandleEvents(b.Context(), events))
+				}
+
+				b.ReportMetric(float64(size), "events/op")
+			})
+		}
+	}
+}
+
+// benchEvents returns events of one execution: stage executions with a start, updates and a finish.
+func benchEvents(executionID string, size int) []repo.Event {
+	events := make([]repo.Event, 0, size)
+	ts := time.Now()
+
+	for i := 0; len(events) < size; i++ {
+		stageExecutionID := fmt.Sprintf("s_%d", i)
+
+		for j := range updatesPerStage + 2 {
+			kind := repo.EventKindGenericUpdate
+
+			switch j {
+			case 0:
+				kind = repo.EventKindStageStarted
+			case updatesPerStage + 1:
+				kind = repo.EventKindStageFinished
+			}
+
+			events = append(events, repo.Event{
+				ProcessID:        "bench",
+				ExecutionID:      executionID,
+				StageExecutionID: stageExecutionID,
+				WorkerID:         "w1",
+				Stage:            repo.RawStage{Name: fmt.Sprintf("stage_%d", i)},
+				Ts:               ts.Add(time.Millisecond * time.Duration(len(events))),
+				Kind:             kind,
+				Metrics:          map[string]repo.Metric{"rows": {Value: float64(j)}},
+			})
+		}
+	}
+
+	return events
+}
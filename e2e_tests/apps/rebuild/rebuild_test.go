@@ -0,0 +1,111 @@
+//go:build test
+
+package rebuild
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/e2e_tests/toolkit/builders"
+	mgo2 "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/mgo"
+	rebuildaggregates "github.com/LastSprint/pipetank/internal/apps/rebuild_aggregates"
+	"github.com/LastSprint/pipetank/internal/repo"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildProcess(t *testing.T) {
+	const db = "e2e_rebuild_db"
+
+	mdbDsn := mgo2.RunSingleContainer(t)
+	mdbClient := mgo2.InitTestMDBClient(t, mdbDsn, db)
+
+	t.Setenv("MDB_DSN", mdbDsn)
+	t.Setenv("MDB_DB", db)
+	t.Setenv("MDB_MAX_CONNECTIONS", "10")
+	t.Setenv("APP_NAME", "e2e_rebuild")
+
+	rep, err := repo.NewRepo(t.Context(), mdbClient, utils.UTCClock())
+	require.NoError(t, err)
+
+	ts := time.Now().Truncate(time.Millisecond)
+	rebuilt := builders.StageExecutionEvents("p1", "e1", ts)
+	kept := builders.StageExecutionEvents("p2", "e1", ts)
+
+	require.NoError(t, rep.AppendRawEvents(t.Context(), append(rebuilt, kept...)))
+
+	// the live aggregate of p1 misses the update and the finish, as if they were lost by a bug
+	srv := raweventsconsumer.NewService(rep)
+	require.NoError(t, srv.HandleEvents(t.Context(), rebuilt[:1]))
+	require.NoError(t, srv.HandleEvents(t.Context(), kept))
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+
+		require.NoError(t, rebuildaggregates.Run(t.Context(), args, &out))
+
+		return out.String()
+	}
+
+	run("start", "-process", "p1")
+
+	status, err := rep.GetRebuildStatus(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), status.Executions)
+	assert.Equal(t, int64(1), status.RebuiltExecutions)
+	assert.Equal(t, int64(0), status.Live.FinishedStageExecutions)
+	assert.Equal(t, int64(1), status.Shadow.FinishedStageExecutions)
+
+	// nothing is left to rebuild, so resume only reports the status
+	assert.Contains(t, run("resume"), `"RebuiltExecutions": 1`)
+
+	// the live aggregates are not touched until the swap
+	stage, err := rep.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+	assert.False(t, stage.IsFinished)
+
+	paused, err := rep.AggregateWritesPaused(t.Context())
+	require.NoError(t, err)
+	assert.False(t, paused)
+
+	// a swap interrupted during the drain keeps writers paused, and the rebuild can't be aborted anymore
+	ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond*100)
+	defer cancel()
+
+	require.ErrorIs(t, rep.SwapRebuild(ctx, time.Minute), context.DeadlineExceeded)
+
+	paused, err = rep.AggregateWritesPaused(t.Context())
+	require.NoError(t, err)
+	assert.True(t, paused)
+
+	require.ErrorIs(t, rep.AbortRebuild(t.Context()), oerrs.ErrBadInput)
+
+	run("swap", "-drain", "0s")
+
+	// writers are paused only while the swap runs
+	paused, err = rep.AggregateWritesPaused(t.Context())
+	require.NoError(t, err)
+	assert.False(t, paused)
+
+	stage, err = rep.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+	assert.True(t, stage.IsFinished)
+	assert.Len(t, stage.Updates, 1)
+
+	// aggregates out of the rebuild are kept
+	stage, err = rep.GetSingleStageExecution(t.Context(), "p2", "e1", "s1")
+	require.NoError(t, err)
+	assert.True(t, stage.IsFinished)
+
+	executions, err := rep.ListExecutions(t.Context(), repo.ExecutionsQuery{Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, executions, 2)
+
+	_, err = rep.GetRebuild(t.Context())
+	require.Error(t, err)
+}
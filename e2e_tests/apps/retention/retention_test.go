@@ -0,0 +1,126 @@
+//go:build test
+
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/e2e_tests/toolkit/builders"
+	mgo2 "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/mgo"
+	"github.com/LastSprint/pipetank/internal/repo"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	"github.com/LastSprint/pipetank/internal/reusable/retention"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// defaultPeriod is the retention of mgo.InitTestMDBClient.
+const defaultPeriod = time.Hour * 24 * 30
+
+func TestProcessPolicy(t *testing.T) {
+	const db = "e2e_retention_db"
+
+	mdbDsn := mgo2.RunSingleContainer(t)
+	mdbClient := mgo2.InitTestMDBClient(t, mdbDsn, db)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	clock := func() time.Time { return now }
+
+	rep, err := repo.NewRepo(t.Context(), mdbClient, clock)
+	require.NoError(t, err)
+
+	ts := now.Add(-time.Minute)
+	// only starts, so every process has one raw event
+	events := append(
+		builders.StageExecutionEvents("p1", "e1", ts)[:1],
+		builders.StageExecutionEvents("p2", "e1", ts)[:1]...,
+	)
+
+	require.NoError(t, rep.AppendRawEvents(t.Context(), events))
+	require.NoError(t, raweventsconsumer.NewService(rep).HandleEvents(t.Context(), events))
+
+	assert.Equal(t, []time.Time{ts.Add(defaultPeriod)}, expiries(t, mdbClient, "executions", "p1"))
+
+	_, err = rep.SetRetentionPolicy(t.Context(), repo.RetentionPolicy{
+		ProcessID:       "p1",
+		RawEvents:       time.Hour,
+		StageExecutions: time.Hour * 2,
+	})
+	require.NoError(t, err)
+
+	stamper := retention.NewStamper(rep, clock)
+
+	// writers may use the old policy for a minute, so the policy is not stamped yet
+	require.NoError(t, stamper.Stamp(t.Context()))
+	assert.Equal(t, []time.Time{ts.Add(defaultPeriod)}, expiries(t, mdbClient, "executions", "p1"))
+
+	now = now.Add(repo.RetentionRefreshPeriod)
+	require.NoError(t, stamper.Stamp(t.Context()))
+
+	assert.Equal(t, []time.Time{ts.Add(time.Hour)}, expiries(t, mdbClient, "executions", "p1"))
+	assert.Equal(t, []time.Time{ts.Add(defaultPeriod)}, expiries(t, mdbClient, "executions", "p2"))
+
+	stage, err := rep.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{stage.UpdatedAt.Add(time.Hour * 2)}, expiries(t, mdbClient, "single_stage_exec", "p1"))
+
+	policies, err := rep.ListRetentionPolicies(t.Context())
+	require.NoError(t, err)
+	require.Len(t, policies, 2)
+	assert.True(t, policies[1].IsStamped())
+
+	// new events get the policy right away
+	laterTs := now
+	later := builders.StageExecutionEvents("p1", "e2", laterTs)[:1]
+	require.NoError(t, rep.AppendRawEvents(t.Context(), later))
+	assert.Equal(
+		t,
+		[]time.Time{ts.Add(time.Hour), laterTs.Add(time.Hour)},
+		expiries(t, mdbClient, "executions", "p1"),
+	)
+
+	require.NoError(t, rep.DeleteRetentionPolicy(t.Context(), "p1"))
+
+	now = now.Add(repo.RetentionRefreshPeriod)
+	require.NoError(t, stamper.Stamp(t.Context()))
+
+	assert.Equal(
+		t,
+		[]time.Time{ts.Add(defaultPeriod), laterTs.Add(defaultPeriod)},
+		expiries(t, mdbClient, "executions", "p1"),
+	)
+
+	policies, err = rep.ListRetentionPolicies(t.Context())
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+	assert.Empty(t, policies[0].ProcessID)
+}
+
+// expiries returns sorted expiries of documents of the process.
+func expiries(t *testing.T, client *mdb.Client, collection, processID string) []time.Time {
+	t.Helper()
+
+	cur, err := client.DB().Collection(collection).Find(
+		t.Context(),
+		bson.M{"pid": processID},
+		options.Find().SetSort(bson.D{{Key: "xa", Value: 1}}),
+	)
+	require.NoError(t, err)
+
+	var docs []struct {
+		ExpireAt time.Time `bson:"xa"`
+	}
+
+	require.NoError(t, cur.All(t.Context(), &docs))
+
+	result := make([]time.Time, 0, len(docs))
+	for _, doc := range docs {
+		result = append(result, doc.ExpireAt.UTC())
+	}
+
+	return result
+}
@@ -0,0 +1,107 @@
+//go:build test
+
+package transfer
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/e2e_tests/toolkit/builders"
+	mgo2 "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/mgo"
+	executiontransfer "github.com/LastSprint/pipetank/internal/apps/execution_transfer"
+	"github.com/LastSprint/pipetank/internal/repo"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestExportImport(t *testing.T) {
+	const db = "e2e_transfer_db"
+
+	mdbDsn := mgo2.RunSingleContainer(t)
+	mdbClient := mgo2.InitTestMDBClient(t, mdbDsn, db)
+
+	t.Setenv("MDB_DSN", mdbDsn)
+	t.Setenv("MDB_DB", db)
+	t.Setenv("MDB_MAX_CONNECTIONS", "10")
+	t.Setenv("APP_NAME", "e2e_transfer")
+
+	rep, err := repo.NewRepo(t.Context(), mdbClient, utils.UTCClock())
+	require.NoError(t, err)
+
+	ts := time.Now().Truncate(time.Millisecond)
+	exported := builders.StageExecutionEvents("p1", "e1", ts)
+	other := builders.StageExecutionEvents("p1", "e2", ts)
+	exported[0].Input, other[0].Input = stageInput(t), stageInput(t)
+
+	require.NoError(t, rep.AppendRawEvents(t.Context(), append(exported, other...)))
+	require.NoError(t, raweventsconsumer.NewService(rep).HandleEvents(t.Context(), append(exported, other...)))
+
+	file := filepath.Join(t.TempDir(), "bundle.jsonl")
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+
+		require.NoError(t, executiontransfer.Run(t.Context(), args, &out))
+
+		return out.String()
+	}
+
+	assert.JSONEq(
+		t,
+		`{"executions": 1, "events": 3}`,
+		run("export", "-file", file, "-process", "p1", "-executions", "e1"),
+	)
+
+	importArgs := []string{
+		"import", "-file", file,
+		"-map-process", "p1=staging", "-map-worker", "w1=w2", "-shift", "1h",
+		"-anonymize", "-anonymize-key", "key",
+	}
+
+	assert.JSONEq(t, `{"executions": 1, "events": 3}`, run(importArgs...))
+	// the import replaces the execution, so it can be repeated
+	run(importArgs...)
+
+	stage, err := rep.GetSingleStageExecution(t.Context(), "staging", "e1", "s1")
+	require.NoError(t, err)
+	assert.True(t, stage.IsFinished)
+	assert.Len(t, stage.Updates, 1)
+	assert.Equal(t, "w2", stage.WorkerID)
+	assert.True(t, stage.Start.Ts.Equal(ts.Add(time.Hour)))
+	assert.NotEqual(t, "input", stage.Start.Input.Lookup("type").StringValue())
+	assert.Equal(t, int32(10), stage.Start.Input.Lookup("rows").Int32())
+
+	events, err := rep.GetRawExecutionEvents(t.Context(), "staging", "e1")
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	for _, event := range events {
+		assert.True(t, event.Aggregated)
+	}
+
+	executions, err := rep.ListExecutions(t.Context(), repo.ExecutionsQuery{ProcessID: "staging", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, executions, 1)
+	assert.Equal(t, "w2", executions[0].WorkerID)
+
+	// the source execution is not changed
+	stage, err = rep.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+	assert.Equal(t, "w1", stage.WorkerID)
+	assert.Equal(t, "input", stage.Start.Input.Lookup("type").StringValue())
+}
+
+func stageInput(t *testing.T) bson.Raw {
+	t.Helper()
+
+	input, err := mdb.MarshalBson(bson.D{{Key: "type", Value: "input"}, {Key: "rows", Value: int32(10)}})
+	require.NoError(t, err)
+
+	return input
+}
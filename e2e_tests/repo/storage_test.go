@@ -0,0 +1,33 @@
+//go:build test
+
+package repo
+
+import (
+	"fmt"
+	"testing"
+
+	mgo2 "github.com/LastSprint/pipetank/e2e_tests/toolkit/dependencies/mgo"
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/storagetest"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance(t *testing.T) {
+	// the suite watches raw events, change streams need a replica set
+	mdbDsn := mgo2.RunReplicaSetContainer(t)
+	databases := 0
+
+	storagetest.Run(t, func(t *testing.T, clock utils.Clock) repo.Storage {
+		t.Helper()
+
+		// every test gets an empty database
+		databases++
+		mdbClient := mgo2.InitTestMDBClient(t, mdbDsn, fmt.Sprintf("e2e_storage_%d", databases))
+
+		rep, err := repo.NewRepo(t.Context(), mdbClient, clock)
+		require.NoError(t, err)
+
+		return rep
+	})
+}
@@ -171,6 +171,24 @@ func (b *RawEventBuilder) WithMetadata() *RawEventBuilder {
 	return b
 }
 
+func (b *RawEventBuilder) WithMetric(name string, value float64, unit string) *RawEventBuilder {
+	if b.Event.Metrics == nil {
+		b.Event.Metrics = map[string]repo.Metric{}
+	}
+
+	b.Event.Metrics[name] = repo.Metric{Value: value, Unit: unit}
+	return b
+}
+
+func (b *RawEventBuilder) WithLabel(key, value string) *RawEventBuilder {
+	if b.Event.Labels == nil {
+		b.Event.Labels = map[string]string{}
+	}
+
+	b.Event.Labels[key] = value
+	return b
+}
+
 /// ------- Stage
 
 func (b *RawEventBuilder) WithStageName(v string) *RawEventBuilder {
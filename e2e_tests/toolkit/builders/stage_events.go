@@ -0,0 +1,29 @@
+//go:build test
+
+package builders
+
+import (
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+)
+
+// StageExecutionEvents returns the start, an update and the successful finish of stage execution "s1"
+// of the execution, a second apart starting at ts.
+func StageExecutionEvents(processID, executionID string, ts time.Time) []repo.Event {
+	event := repo.Event{
+		ProcessID:        processID,
+		ExecutionID:      executionID,
+		StageExecutionID: "s1",
+		WorkerID:         "w1",
+		Stage:            repo.RawStage{Name: "stage_1"},
+	}
+
+	start, update, finish := event, event, event
+
+	start.Kind, start.Ts = repo.EventKindStageStarted, ts
+	update.Kind, update.Ts = repo.EventKindGenericUpdate, ts.Add(time.Second)
+	finish.Kind, finish.Ts, finish.Status = repo.EventKindStageFinished, ts.Add(time.Second*2), repo.EventStatusSuccess
+
+	return []repo.Event{start, update, finish}
+}
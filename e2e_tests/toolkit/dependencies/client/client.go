@@ -54,3 +54,20 @@ func (c *TestClient) SendRawEvent(t *testing.T, events ...*proto.RawEvent) {
 	err := c.eventsStream.Send(&val)
 	require.NoError(t, err)
 }
+
+func (c *TestClient) SendStageLogLines(t *testing.T, workerID string, lines ...*proto.StageLogLine) {
+	t.Helper()
+	batch := &proto.StageLogs{
+		WorkerID: &workerID,
+		Lines:    lines,
+	}
+
+	val := proto.ClientCommand{Cmd: &proto.ClientCommand_Logs{Logs: batch}}
+
+	err := c.eventsStream.Send(&val)
+	require.NoError(t, err)
+}
+
+func (c *TestClient) API() proto.APIClient {
+	return c.apiClient
+}
@@ -0,0 +1,69 @@
+//go:build test
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/e2e_tests/toolkit/utils"
+	appConsumer "github.com/LastSprint/pipetank/internal/apps/mongodb_change_stream_consumer"
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// rawEventsCollection is where producers append raw events.
+	rawEventsCollection = "executions"
+
+	probeProcessID = "e2e_consumer_probe"
+	probeID        = "probe"
+)
+
+// Run starts the change stream consumer which aggregates raw events of the database
+// and waits until it aggregates a probe event, so events inserted after Run are not missed.
+// MongoDB connection variables must already be set (e.g. by grpc_api.Run).
+func Run(t *testing.T, mdbClient *mdb.Client, api proto.APIClient) {
+	t.Helper()
+
+	t.Setenv("CONSUMER_KEY", "e2e")
+	t.Setenv("MAX_BUFFER_SIZE", "100")
+	t.Setenv("BUFFER_CLEANUP_PERIOD", "100ms")
+	t.Setenv("METRICS_ADDR", fmt.Sprintf("localhost:%d", utils.RandomOpenPort(t)))
+	t.Setenv("HEALTH_CHECK_ADDR", fmt.Sprintf("localhost:%d", utils.RandomOpenPort(t)))
+
+	go func() {
+		err := appConsumer.Run(t.Context())
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		require.NoError(t, err)
+	}()
+
+	processID, id := probeProcessID, probeID
+	ref := &proto.StageExecutionRef{ProcessID: &processID, ExecutionID: &id, StageExecutionID: &id}
+
+	// the stream starts from now, so the probe is inserted until the consumer sees one
+	require.Eventually(t, func() bool {
+		_, err := mdbClient.DB().Collection(rawEventsCollection).InsertOne(t.Context(), repo.Event{
+			ProcessID:        probeProcessID,
+			ExecutionID:      probeID,
+			StageExecutionID: probeID,
+			WorkerID:         probeID,
+			Stage:            repo.RawStage{Name: probeID},
+			Ts:               time.Now(),
+			Kind:             repo.EventKindStageStarted,
+		})
+		require.NoError(t, err)
+
+		_, err = api.GetStageExecution(t.Context(), ref)
+
+		return err == nil
+	}, time.Second*15, time.Millisecond*300)
+}
@@ -24,9 +24,19 @@ func Run(
 	mdbDSN, mdbDBName string,
 ) string {
 	t.Helper()
+
+	return RunWithIngestionMode(t, mdbDSN, mdbDBName, appGrpcAPI.IngestionDirect)
+}
+
+func RunWithIngestionMode(
+	t *testing.T,
+	mdbDSN, mdbDBName string,
+	mode appGrpcAPI.IngestionMode,
+) string {
+	t.Helper()
 	port := utils.RandomOpenPort(t)
 	srvAddr := fmt.Sprintf("localhost:%d", port)
-	go run(t, port, mdbDSN, mdbDBName)
+	go run(t, port, mdbDSN, mdbDBName, mode)
 
 	nc, err := grpc.NewClient(srvAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	require.NoError(t, err)
@@ -48,8 +58,13 @@ func Run(
 	}
 }
 
-func run(t *testing.T, port int, mdbDSN, mdbDBName string) {
-	appCfg := appGrpcAPI.Config{Port: port}
+func run(t *testing.T, port int, mdbDSN, mdbDBName string, mode appGrpcAPI.IngestionMode) {
+	appCfg := appGrpcAPI.Config{
+		Port:                port,
+		IngestionMode:       mode,
+		MaxLogLinesPerStage: 100,
+		LogsTailPollPeriod:  time.Millisecond * 100,
+	}
 
 	t.Setenv("MDB_DSN", mdbDSN)
 	t.Setenv("MDB_DB", mdbDBName)
@@ -61,6 +76,7 @@ func run(t *testing.T, port int, mdbDSN, mdbDBName string) {
 	t.Setenv("MDB_MIN_POOL_SIZE", "100")
 	t.Setenv("STAGE_EXECUTIONS_TTL_SECONDS", strconv.Itoa(60*60*24*30))
 	t.Setenv("RAW_EVENTS_TTL_SECONDS", strconv.Itoa(60*60*24*30))
+	t.Setenv("STAGE_LOGS_TTL_SECONDS", strconv.Itoa(60*60*24*30))
 
 	err := appGrpcAPI.RunWithConfig(t.Context(), appCfg)
 	if errors.Is(err, context.Canceled) {
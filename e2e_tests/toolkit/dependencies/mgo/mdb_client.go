@@ -12,7 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func InitTestMDBClient(t *testing.T, dsn, db string) *mdb.Client {
+func InitTestMDBClient(t testing.TB, dsn, db string) *mdb.Client {
 	t.Helper()
 	cfg := mdb.Config{
 		DSN:               dsn,
@@ -27,6 +27,7 @@ func InitTestMDBClient(t *testing.T, dsn, db string) *mdb.Client {
 
 	t.Setenv("STAGE_EXECUTIONS_TTL_SECONDS", strconv.Itoa(60*60*24*30))
 	t.Setenv("RAW_EVENTS_TTL_SECONDS", strconv.Itoa(60*60*24*30))
+	t.Setenv("STAGE_LOGS_TTL_SECONDS", strconv.Itoa(60*60*24*30))
 
 	client, err := mdb.NewClientWithConfig(cfg)
 	require.NoError(t, err)
@@ -10,7 +10,7 @@ import (
 	"github.com/testcontainers/testcontainers-go/modules/mongodb"
 )
 
-func RunSingleContainer(t *testing.T) string {
+func RunSingleContainer(t testing.TB) string {
 	t.Helper()
 	container, err := mongodb.Run(t.Context(), "mongo:8")
 	require.NoError(t, err)
@@ -24,3 +24,19 @@ func RunSingleContainer(t *testing.T) string {
 
 	return dsn
 }
+
+// RunReplicaSetContainer starts a single node replica set, it is needed for change streams.
+func RunReplicaSetContainer(t *testing.T) string {
+	t.Helper()
+	container, err := mongodb.Run(t.Context(), "mongo:8", mongodb.WithReplicaSet(replicaSetName))
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = container.Terminate(context.Background())
+	})
+
+	dsn, err := container.ConnectionString(t.Context())
+	require.NoError(t, err)
+
+	return dsn
+}
@@ -0,0 +1,52 @@
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/reusable/alerting"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+func Run(ctx context.Context) error {
+	cfg, err := parseConfig()
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	rules, err := alerting.LoadRules(cfg.RulesFile)
+	if err != nil {
+		return err
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	notifier := alerting.NewWebhookNotifier(
+		cfg.WebhookURL,
+		cfg.WebhookHeaders,
+		&http.Client{Timeout: cfg.WebhookTimeout},
+	)
+
+	engine := alerting.NewEngine(rep, notifier, rules, utils.UTCClock())
+
+	return utils.DieWithGrace(
+		ctx,
+		func(ctx context.Context) error {
+			return engine.Run(ctx, cfg.EvaluationPeriod)
+		},
+		func(ctx context.Context) error {
+			return mdbClinet.Close(ctx)
+		},
+	)
+}
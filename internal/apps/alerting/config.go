@@ -0,0 +1,26 @@
+package alerting
+
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type config struct {
+	RulesFile        string        `env:"ALERT_RULES_FILE,required"`
+	EvaluationPeriod time.Duration `env:"ALERT_EVALUATION_PERIOD"   envDefault:"30s"`
+
+	WebhookURL string `env:"ALERT_WEBHOOK_URL,required"`
+	// WebhookHeaders are sent with every webhook request, format: `key1:value1,key2:value2`.
+	WebhookHeaders map[string]string `env:"ALERT_WEBHOOK_HEADERS"`
+	WebhookTimeout time.Duration     `env:"ALERT_WEBHOOK_TIMEOUT" envDefault:"10s"`
+}
+
+func parseConfig() (config, error) {
+	cfg, err := env.ParseAs[config]()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,155 @@
+// Package allinone runs ingestion, the consumer and the read API in one process for small setups
+// which don't want to run `grpc_api` and `mongodb_change_stream_consumer` separately.
+//
+// Components share the storage, tracing, metrics and health checks. They start in order: the storage,
+// health checks and metrics, the consumer and the API. Shutdown goes in reverse: the API drains ingestion,
+// then the consumer flushes aggregated events and saves its tokens, and then the storage is closed.
+package allinone
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	appGrpcAPI "github.com/LastSprint/pipetank/internal/apps/grpc_api"
+	appConsumer "github.com/LastSprint/pipetank/internal/apps/mongodb_change_stream_consumer"
+	"github.com/LastSprint/pipetank/pkg/app"
+	"github.com/LastSprint/pipetank/pkg/health"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
+)
+
+const serviceName = "pipetank-all-in-one"
+
+func Run(ctx context.Context) error {
+	cfg, err := parseConfig()
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	p := newProcess(cfg)
+
+	return app.New(cfg.ShutdownTimeout, p.components()...).Run(ctx)
+}
+
+// process is what components share, every field is set by Start of the component which owns it.
+type process struct {
+	cfg     config
+	checker *health.Checker
+
+	shutdownTracing func(context.Context) error
+	storage         appConsumer.Storage
+	closeStorage    func(context.Context) error
+	stopHealth      func(context.Context) error
+	consumers       *appConsumer.Group
+	server          *appGrpcAPI.Server
+}
+
+func newProcess(cfg config) *process {
+	return &process{
+		cfg:     cfg,
+		checker: health.NewChecker(cfg.API.HealthCheckTimeout),
+	}
+}
+
+// components are in the order of startup.
+func (p *process) components() []app.Component {
+	return []app.Component{
+		{
+			Name:  "tracing",
+			Start: p.startTracing,
+			Stop:  func(ctx context.Context) error { return p.shutdownTracing(ctx) },
+		},
+		{
+			Name:  "storage",
+			Start: p.openStorage,
+			Stop:  func(ctx context.Context) error { return p.closeStorage(ctx) },
+		},
+		{
+			Name:  "health",
+			Start: p.startHealth,
+			Stop:  func(ctx context.Context) error { return p.stopHealth(ctx) },
+		},
+		{
+			Name: "metrics",
+			Run: func(ctx context.Context) error {
+				return metrics.Serve(ctx, p.cfg.API.MetricsAddr)
+			},
+		},
+		{
+			Name:  "consumer",
+			Start: p.startConsumer,
+			// canceling the group flushes buffered events and releases partitions
+			Run: func(ctx context.Context) error { return p.consumers.Run(ctx) },
+		},
+		{
+			Name:  "api",
+			Start: p.startServer,
+			Run:   func(ctx context.Context) error { return p.server.Serve(ctx) },
+			Stop: func(ctx context.Context) error {
+				p.server.Shutdown(ctx)
+				return nil
+			},
+		},
+	}
+}
+
+func (p *process) startTracing(ctx context.Context) error {
+	shutdownTracing, err := tracing.Setup(ctx, p.cfg.API.Tracing, serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to setup tracing: %w", err)
+	}
+
+	p.shutdownTracing = shutdownTracing
+
+	return nil
+}
+
+func (p *process) openStorage(ctx context.Context) error {
+	storage, closeStorage, err := appConsumer.OpenStorage(ctx, p.cfg.API.StorageBackend, p.cfg.API.SQLite, p.checker)
+	if err != nil {
+		return err
+	}
+
+	p.storage = storage
+	p.closeStorage = closeStorage
+
+	return nil
+}
+
+func (p *process) startHealth(ctx context.Context) error {
+	stopHealth, err := health.Start(ctx, p.cfg.HealthCheckAddr, p.checker)
+	if err != nil {
+		return err
+	}
+
+	p.stopHealth = stopHealth
+
+	return nil
+}
+
+func (p *process) startConsumer(context.Context) error {
+	consumers, err := appConsumer.NewConsumerGroup(p.cfg.Consumer, p.storage, p.checker)
+	if err != nil {
+		return err
+	}
+
+	p.consumers = consumers
+
+	return nil
+}
+
+func (p *process) startServer(ctx context.Context) error {
+	server, err := appGrpcAPI.NewServer(ctx, p.cfg.API, p.storage, p.checker)
+	if err != nil {
+		return err
+	}
+
+	p.server = server
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package allinone
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	appGrpcAPI "github.com/LastSprint/pipetank/internal/apps/grpc_api"
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/app"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigDefaultsToRawIngestion(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "sqlite")
+
+	cfg, err := parseConfig()
+	require.NoError(t, err)
+
+	assert.Equal(t, appGrpcAPI.IngestionRaw, cfg.API.IngestionMode)
+	assert.Equal(t, repo.StorageSQLite, cfg.API.StorageBackend)
+
+	t.Setenv(ingestionModeEnv, "both")
+
+	cfg, err = parseConfig()
+	require.NoError(t, err)
+
+	assert.Equal(t, appGrpcAPI.IngestionBoth, cfg.API.IngestionMode)
+}
+
+func TestParseConfigRejectsMemoryStorage(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "memory")
+
+	_, err := parseConfig()
+	require.EqualError(t, err, `STORAGE_BACKEND must be one of mongodb, sqlite, got "memory"`)
+}
+
+func TestRunStartsAndStopsAllComponents(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "sqlite")
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "pipetank.db"))
+	t.Setenv("PORT", "0")
+	t.Setenv("METRICS_ADDR", "")
+	t.Setenv("HEALTH_CHECK_ADDR", "")
+
+	cfg, err := parseConfig()
+	require.NoError(t, err)
+
+	p := newProcess(cfg)
+
+	started := make(chan struct{})
+	probe := app.Component{
+		Name: "probe",
+		Start: func(context.Context) error {
+			close(started)
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- app.New(cfg.ShutdownTimeout, append(p.components(), probe)...).Run(ctx)
+	}()
+
+	<-started
+
+	require.Eventually(t, func() bool {
+		return p.checker.Ready(ctx).OK()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "the process didn't stop")
+	}
+
+	assert.False(t, p.checker.Ready(t.Context()).OK())
+}
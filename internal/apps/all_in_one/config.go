@@ -0,0 +1,49 @@
+package allinone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	appGrpcAPI "github.com/LastSprint/pipetank/internal/apps/grpc_api"
+	appConsumer "github.com/LastSprint/pipetank/internal/apps/mongodb_change_stream_consumer"
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/caarlos0/env/v11"
+)
+
+// ingestionModeEnv is the variable of grpc_api.Config.IngestionMode.
+const ingestionModeEnv = "INGESTION_MODE"
+
+type config struct {
+	// API is the config of ingestion and the read API, it has the settings shared by the whole process:
+	// the storage, tracing, metrics and health checks.
+	API appGrpcAPI.Config
+	// Consumer is the config of the consumer group which aggregates raw events.
+	Consumer appConsumer.GroupConfig
+
+	// HealthCheckAddr is an address of `/healthz` and `/readyz` endpoints, empty value disables them.
+	// The same checks are served by `grpc.health.v1` of the API.
+	HealthCheckAddr string `env:"HEALTH_CHECK_ADDR" envDefault:":8081"`
+	// ShutdownTimeout limits the whole shutdown: draining ingestion, flushing the consumer and closing the storage.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+}
+
+func parseConfig() (config, error) {
+	cfg, err := env.ParseAs[config]()
+	if err != nil {
+		return cfg, err
+	}
+
+	// the consumer runs in the same process, so events are only appended to the raw events log by default
+	if _, ok := os.LookupEnv(ingestionModeEnv); !ok {
+		cfg.API.IngestionMode = appGrpcAPI.IngestionRaw
+	}
+
+	// the consumer needs partition leases which the in-memory storage doesn't have
+	if cfg.API.StorageBackend != repo.StorageMongoDB && cfg.API.StorageBackend != repo.StorageSQLite {
+		return cfg, fmt.Errorf("STORAGE_BACKEND must be one of mongodb, sqlite, got %q", cfg.API.StorageBackend)
+	}
+
+	return cfg, errors.Join(cfg.API.Validate(), cfg.Consumer.Validate())
+}
@@ -0,0 +1,119 @@
+// Package archiverestore implements a command line tool which loads archives written by the archiver back into MongoDB.
+//
+// Usage:
+//
+//	archive_restore -dir DIR [-from DAY] [-to DAY] [-process ID] [-kinds KIND,...] [-batch N]
+//
+// DAY is YYYY-MM-DD, both bounds are inclusive. KIND is one of raw_events, stage_executions and executions.
+// Documents are restored into the database of MDB_DB without creating indexes: TTL indexes of the apps
+// would delete restored documents again, so restore into a separate database unless the documents are recent.
+package archiverestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/reusable/archive"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+const defaultBatchSize = 1000
+
+var errNoDir = errors.New("-dir is required")
+
+// Run restores the archive selected by args (without the program name) and writes the result to out as JSON.
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	cmd, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	defer func() {
+		_ = mdbClinet.Close(context.WithoutCancel(ctx))
+	}()
+
+	rep := repo.NewRepoWithoutIndexes(mdbClinet, utils.UTCClock())
+
+	result, err := archive.Restore(ctx, archive.NewDirStore(cmd.dir), rep, cmd.query, cmd.batchSize)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+type command struct {
+	dir       string
+	query     archive.RestoreQuery
+	batchSize int
+}
+
+func parseFlags(args []string) (command, error) {
+	var (
+		cmd   command
+		kinds string
+	)
+
+	flags := flag.NewFlagSet("archive_restore", flag.ContinueOnError)
+	flags.StringVar(&cmd.dir, "dir", "", "archive directory")
+	flags.StringVar(&cmd.query.FromDay, "from", "", "optional first day, YYYY-MM-DD")
+	flags.StringVar(&cmd.query.ToDay, "to", "", "optional last day, YYYY-MM-DD")
+	flags.StringVar(&cmd.query.ProcessID, "process", "", "optional ProcessID filter")
+	flags.StringVar(&kinds, "kinds", "", "optional comma separated kinds, all kinds by default")
+	flags.IntVar(&cmd.batchSize, "batch", defaultBatchSize, "max number of documents written at once")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return cmd, err
+	}
+
+	if len(cmd.dir) == 0 {
+		return cmd, errNoDir
+	}
+
+	if cmd.batchSize <= 0 {
+		return cmd, fmt.Errorf("invalid -batch %d: must be positive", cmd.batchSize)
+	}
+
+	for name, day := range map[string]string{"from": cmd.query.FromDay, "to": cmd.query.ToDay} {
+		if len(day) == 0 {
+			continue
+		}
+
+		_, err = time.Parse(time.DateOnly, day)
+		if err != nil {
+			return cmd, fmt.Errorf("invalid -%s %q: %w", name, day, err)
+		}
+	}
+
+	for kind := range strings.SplitSeq(kinds, ",") {
+		kind = strings.TrimSpace(kind)
+		if len(kind) == 0 {
+			continue
+		}
+
+		if !repo.ArchiveKind(kind).IsValid() {
+			return cmd, fmt.Errorf("invalid kind %q", kind)
+		}
+
+		cmd.query.Kinds = append(cmd.query.Kinds, repo.ArchiveKind(kind))
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,26 @@
+package archiver
+
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type config struct {
+	// Dir is the directory archive files are written to.
+	Dir string `env:"ARCHIVE_DIR,required"`
+	// After is the age of days which are archived, it must be less than the TTL of archived collections.
+	After  time.Duration `env:"ARCHIVE_AFTER"  envDefault:"168h"`
+	Period time.Duration `env:"ARCHIVE_PERIOD" envDefault:"1h"`
+	// Key is the key the progress of the archiver is saved under.
+	Key string `env:"ARCHIVE_KEY" envDefault:"archiver"`
+}
+
+func parseConfig() (config, error) {
+	cfg, err := env.ParseAs[config]()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
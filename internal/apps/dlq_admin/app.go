@@ -0,0 +1,300 @@
+// Package dlqadmin implements a command line tool which inspects, replays and purges dead letters of the consumer.
+//
+// Usage:
+//
+//	dlq_admin list [-consumer KEY] [-process ID] [-from TIME] [-to TIME] [-limit N]
+//	dlq_admin show -id ID
+//	dlq_admin replay (-id ID | [-consumer KEY] [-process ID] [-from TIME] [-to TIME] [-limit N])
+//	dlq_admin purge (-id ID | -all | [-consumer KEY] [-process ID] [-from TIME] [-to TIME])
+//
+// TIME is RFC 3339 and limits the last failure time. Replayed dead letters are handled
+// by the same service as the consumer uses; succeeded ones are deleted, failed ones get one more attempt.
+package dlqadmin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var (
+	errUsage    = errors.New("usage: dlq_admin list|show|replay|purge [flags]")
+	errNoFilter = errors.New("purge requires -id, -all or at least one filter")
+)
+
+// Run executes the command from args (without the program name) and writes the result to out as JSON.
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	defer func() {
+		_ = mdbClinet.Close(context.WithoutCancel(ctx))
+	}()
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	var result any
+
+	switch args[0] {
+	case "list":
+		result, err = list(ctx, rep, args[1:])
+	case "show":
+		result, err = show(ctx, rep, args[1:])
+	case "replay":
+		result, err = replay(ctx, rep, raweventsconsumer.NewService(rep), args[1:])
+	case "purge":
+		result, err = purge(ctx, rep, args[1:])
+	default:
+		return errUsage
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+type deadLetterView struct {
+	ID               string          `json:"id"`
+	ConsumerKey      string          `json:"consumerKey"`
+	EventID          string          `json:"eventId"`
+	ProcessID        string          `json:"processId"`
+	ExecutionID      string          `json:"executionId"`
+	StageExecutionID string          `json:"stageExecutionId"`
+	Error            string          `json:"error"`
+	Attempts         int             `json:"attempts"`
+	FirstFailedAt    time.Time       `json:"firstFailedAt"`
+	LastFailedAt     time.Time       `json:"lastFailedAt"`
+	Event            json.RawMessage `json:"event,omitempty"`
+}
+
+func newDeadLetterView(deadLetter repo.DeadLetter) deadLetterView {
+	return deadLetterView{
+		ID:               deadLetter.ID,
+		ConsumerKey:      deadLetter.ConsumerKey,
+		EventID:          deadLetter.Event.ID.Hex(),
+		ProcessID:        deadLetter.Event.ProcessID,
+		ExecutionID:      deadLetter.Event.ExecutionID,
+		StageExecutionID: deadLetter.Event.StageExecutionID,
+		Error:            deadLetter.Error,
+		Attempts:         deadLetter.Attempts,
+		FirstFailedAt:    deadLetter.FirstFailedAt,
+		LastFailedAt:     deadLetter.LastFailedAt,
+	}
+}
+
+func list(ctx context.Context, rep *repo.Repo, args []string) ([]deadLetterView, error) {
+	cmd, err := parseFlags("list", args, 50)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := rep.ListDeadLetters(ctx, cmd.query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]deadLetterView, 0, len(stored))
+	for _, deadLetter := range stored {
+		result = append(result, newDeadLetterView(deadLetter))
+	}
+
+	return result, nil
+}
+
+// show returns the dead letter with the whole event as MongoDB extended JSON.
+func show(ctx context.Context, rep *repo.Repo, args []string) (deadLetterView, error) {
+	cmd, err := parseFlags("show", args, 0)
+	if err != nil {
+		return deadLetterView{}, err
+	}
+
+	if len(cmd.id) == 0 {
+		return deadLetterView{}, errors.New("show requires -id")
+	}
+
+	deadLetter, err := rep.GetDeadLetter(ctx, cmd.id)
+	if err != nil {
+		return deadLetterView{}, err
+	}
+
+	view := newDeadLetterView(deadLetter)
+
+	view.Event, err = bson.MarshalExtJSON(deadLetter.Event, false, false)
+	if err != nil {
+		return deadLetterView{}, fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	return view, nil
+}
+
+type replayFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+type replayResult struct {
+	Replayed []string        `json:"replayed"`
+	Failed   []replayFailure `json:"failed"`
+}
+
+type eventHandler interface {
+	HandleEvents(context.Context, []repo.Event) error
+}
+
+// replay handles dead letters one by one, so one broken event doesn't fail the others.
+func replay(ctx context.Context, rep *repo.Repo, handler eventHandler, args []string) (replayResult, error) {
+	result := replayResult{Replayed: []string{}, Failed: []replayFailure{}}
+
+	cmd, err := parseFlags("replay", args, 0)
+	if err != nil {
+		return result, err
+	}
+
+	var deadLetters []repo.DeadLetter
+
+	if len(cmd.id) > 0 {
+		deadLetter, err := rep.GetDeadLetter(ctx, cmd.id)
+		if err != nil {
+			return result, err
+		}
+
+		deadLetters = append(deadLetters, deadLetter)
+	} else {
+		deadLetters, err = rep.ListDeadLetters(ctx, cmd.query)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for _, deadLetter := range deadLetters {
+		events := []repo.Event{deadLetter.Event}
+
+		handleErr := handler.HandleEvents(ctx, events)
+		if handleErr != nil {
+			result.Failed = append(result.Failed, replayFailure{ID: deadLetter.ID, Error: handleErr.Error()})
+
+			err = rep.SendToDeadLetters(ctx, deadLetter.ConsumerKey, events, handleErr)
+			if err != nil {
+				return result, err
+			}
+
+			continue
+		}
+
+		err = rep.DeleteDeadLetter(ctx, deadLetter.ID)
+		if err != nil {
+			return result, err
+		}
+
+		result.Replayed = append(result.Replayed, deadLetter.ID)
+	}
+
+	return result, nil
+}
+
+func purge(ctx context.Context, rep *repo.Repo, args []string) (map[string]int64, error) {
+	cmd, err := parseFlags("purge", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cmd.id) > 0 {
+		err = rep.DeleteDeadLetter(ctx, cmd.id)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]int64{"deleted": 1}, nil
+	}
+
+	// the limit is not a filter, purge ignores it
+	filter := cmd.query
+	filter.Limit = 0
+
+	if !cmd.all && filter == (repo.DeadLettersQuery{}) {
+		return nil, errNoFilter
+	}
+
+	deleted, err := rep.PurgeDeadLetters(ctx, cmd.query)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]int64{"deleted": deleted}, nil
+}
+
+type command struct {
+	id    string
+	all   bool
+	query repo.DeadLettersQuery
+}
+
+func parseFlags(name string, args []string, defaultLimit int64) (command, error) {
+	var (
+		cmd      command
+		from, to string
+	)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&cmd.id, "id", "", "dead letter ID")
+	flags.BoolVar(&cmd.all, "all", false, "purge all dead letters")
+	flags.StringVar(&cmd.query.ConsumerKey, "consumer", "", "optional consumer key filter")
+	flags.StringVar(&cmd.query.ProcessID, "process", "", "optional ProcessID filter")
+	flags.StringVar(&from, "from", "", "optional RFC 3339 time, dead letters which failed last at or after it")
+	flags.StringVar(&to, "to", "", "optional RFC 3339 time, dead letters which failed last before it")
+	flags.Int64Var(&cmd.query.Limit, "limit", defaultLimit, "max number of dead letters, 0 means no limit")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return cmd, err
+	}
+
+	cmd.query.FailedFrom, err = parseTime("from", from)
+	if err != nil {
+		return cmd, err
+	}
+
+	cmd.query.FailedTo, err = parseTime("to", to)
+	if err != nil {
+		return cmd, err
+	}
+
+	return cmd, nil
+}
+
+func parseTime(name, value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s %q: %w", name, value, err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,356 @@
+// Package executiontransfer implements a command line tool which copies executions between environments,
+// e.g. to reproduce a production issue in staging.
+//
+// Usage:
+//
+//	execution_transfer export -file FILE -process ID [-executions a,b] [-labels SELECTOR] [-from TIME] [-to TIME]
+//	                          [-limit N] [TRANSFORM]
+//	execution_transfer import -file FILE [TRANSFORM]
+//
+// TRANSFORM flags change executions on the way: -map-process old=new,... and -map-worker old=new,...
+// remap IDs, -shift DURATION moves all timestamps, -anonymize replaces strings of payloads
+// by their HMAC-SHA256 with -anonymize-key (a random key by default).
+// TIME is RFC 3339 and limits the first event of executions.
+//
+// Export writes raw events and aggregates of every selected execution as a line of a JSONL bundle.
+// Import replaces everything stored about every execution of the bundle, raw events are not aggregated again.
+package executiontransfer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/reusable/bundle"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+const (
+	defaultLimit = 100
+
+	anonymizeKeySize = 32
+)
+
+var (
+	errUsage     = errors.New("usage: execution_transfer export|import -file FILE [flags]")
+	errNoFile    = errors.New("-file is required")
+	errNoProcess = errors.New("-process is required")
+)
+
+type transferStore interface {
+	ListExecutions(ctx context.Context, query repo.ExecutionsQuery) ([]repo.ExecutionAggregate, error)
+	GetExecutionSnapshot(ctx context.Context, processID, executionID string) (repo.ExecutionSnapshot, error)
+	ReplaceExecutionSnapshot(ctx context.Context, snapshot repo.ExecutionSnapshot) error
+}
+
+// Result is a summary of an export or an import.
+type Result struct {
+	Executions int `json:"executions"`
+	Events     int `json:"events"`
+}
+
+// Run executes the command from args (without the program name) and writes the result to out as JSON.
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		return errUsage
+	}
+
+	cmd, err := parseFlags(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	defer func() {
+		_ = mdbClinet.Close(context.WithoutCancel(ctx))
+	}()
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	var result Result
+
+	if args[0] == "export" {
+		result, err = exportFile(ctx, rep, cmd)
+	} else {
+		result, err = importFile(ctx, rep, cmd)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+func exportFile(ctx context.Context, store transferStore, cmd command) (result Result, err error) {
+	file, err := os.Create(cmd.file)
+	if err != nil {
+		return result, err
+	}
+
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+
+	return export(ctx, store, cmd, bundle.NewWriter(file))
+}
+
+func export(ctx context.Context, store transferStore, cmd command, writer *bundle.Writer) (Result, error) {
+	var result Result
+
+	executionIDs := cmd.executionIDs
+
+	if len(executionIDs) == 0 {
+		executions, err := store.ListExecutions(ctx, cmd.query)
+		if err != nil {
+			return result, err
+		}
+
+		for _, execution := range executions {
+			executionIDs = append(executionIDs, execution.ExecutionID)
+		}
+	}
+
+	for _, executionID := range executionIDs {
+		snapshot, err := store.GetExecutionSnapshot(ctx, cmd.query.ProcessID, executionID)
+		if err != nil {
+			return result, err
+		}
+
+		execution, err := bundle.FromSnapshot(snapshot)
+		if err != nil {
+			return result, fmt.Errorf("failed to export %s/%s: %w", snapshot.ProcessID, executionID, err)
+		}
+
+		err = cmd.transform.Apply(&execution)
+		if err != nil {
+			return result, fmt.Errorf("failed to transform %s/%s: %w", snapshot.ProcessID, executionID, err)
+		}
+
+		err = writer.Write(execution)
+		if err != nil {
+			return result, err
+		}
+
+		result.Executions++
+		result.Events += len(execution.Events)
+	}
+
+	return result, nil
+}
+
+func importFile(ctx context.Context, store transferStore, cmd command) (Result, error) {
+	file, err := os.Open(cmd.file)
+	if err != nil {
+		return Result{}, err
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return importBundle(ctx, store, cmd.transform, file)
+}
+
+func importBundle(ctx context.Context, store transferStore, transform bundle.Transform, r io.Reader) (Result, error) {
+	var result Result
+
+	err := bundle.Read(ctx, r, func(ctx context.Context, execution bundle.Execution) error {
+		err := transform.Apply(&execution)
+		if err != nil {
+			return fmt.Errorf("failed to transform %s/%s: %w", execution.ProcessID, execution.ExecutionID, err)
+		}
+
+		snapshot, err := bundle.ToSnapshot(execution)
+		if err != nil {
+			return fmt.Errorf("failed to import %s/%s: %w", execution.ProcessID, execution.ExecutionID, err)
+		}
+
+		err = store.ReplaceExecutionSnapshot(ctx, snapshot)
+		if err != nil {
+			return err
+		}
+
+		result.Executions++
+		result.Events += len(snapshot.Events)
+
+		return nil
+	})
+
+	return result, err
+}
+
+type command struct {
+	file         string
+	query        repo.ExecutionsQuery
+	executionIDs []string
+	transform    bundle.Transform
+}
+
+func parseFlags(name string, args []string) (command, error) {
+	var (
+		cmd                command
+		from, to           string
+		executions, labels string
+		transform          transformFlags
+	)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&cmd.file, "file", "", "bundle file")
+	transform.register(flags)
+
+	if name == "export" {
+		flags.StringVar(&cmd.query.ProcessID, "process", "", "ProcessID of exported executions")
+		flags.StringVar(&executions, "executions", "", "optional comma separated ExecutionIDs")
+		flags.StringVar(&labels, "labels", "", "optional label selector, e.g. env=prod")
+		flags.StringVar(&from, "from", "", "optional RFC 3339 time, executions started at or after it")
+		flags.StringVar(&to, "to", "", "optional RFC 3339 time, executions started before it")
+		flags.Int64Var(&cmd.query.Limit, "limit", defaultLimit, "max number of selected executions")
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return cmd, err
+	}
+
+	if len(cmd.file) == 0 {
+		return cmd, errNoFile
+	}
+
+	if name == "export" && len(cmd.query.ProcessID) == 0 {
+		return cmd, errNoProcess
+	}
+
+	cmd.executionIDs = splitList(executions)
+
+	cmd.query.Labels, err = repo.ParseLabelSelector(labels)
+	if err != nil {
+		return cmd, fmt.Errorf("invalid -labels %q: %w", labels, err)
+	}
+
+	cmd.query.StartedFrom, err = parseTime("from", from)
+	if err != nil {
+		return cmd, err
+	}
+
+	cmd.query.StartedTo, err = parseTime("to", to)
+	if err != nil {
+		return cmd, err
+	}
+
+	cmd.transform, err = transform.parse()
+
+	return cmd, err
+}
+
+type transformFlags struct {
+	processMap   string
+	workerMap    string
+	shift        time.Duration
+	anonymize    bool
+	anonymizeKey string
+}
+
+func (f *transformFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.processMap, "map-process", "", "optional comma separated old=new ProcessIDs")
+	flags.StringVar(&f.workerMap, "map-worker", "", "optional comma separated old=new WorkerIDs")
+	flags.DurationVar(&f.shift, "shift", 0, "optional duration added to all timestamps")
+	flags.BoolVar(&f.anonymize, "anonymize", false, "replace strings of payloads by their HMAC")
+	flags.StringVar(&f.anonymizeKey, "anonymize-key", "", "optional HMAC key of -anonymize, random by default")
+}
+
+func (f *transformFlags) parse() (bundle.Transform, error) {
+	result := bundle.Transform{Shift: f.shift}
+
+	var err error
+
+	result.ProcessIDs, err = parseMapping("map-process", f.processMap)
+	if err != nil {
+		return result, err
+	}
+
+	result.WorkerIDs, err = parseMapping("map-worker", f.workerMap)
+	if err != nil {
+		return result, err
+	}
+
+	if f.anonymize {
+		result.AnonymizeKey, err = parseAnonymizeKey(f.anonymizeKey)
+	}
+
+	return result, err
+}
+
+func splitList(value string) []string {
+	var result []string
+
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+func parseMapping(name, value string) (map[string]string, error) {
+	result := map[string]string{}
+
+	for _, pair := range splitList(value) {
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || len(from) == 0 || len(to) == 0 {
+			return nil, fmt.Errorf("invalid -%s %q: expected old=new", name, pair)
+		}
+
+		result[from] = to
+	}
+
+	return result, nil
+}
+
+func parseAnonymizeKey(value string) ([]byte, error) {
+	if len(value) > 0 {
+		return []byte(value), nil
+	}
+
+	key := make([]byte, anonymizeKeySize)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func parseTime(name, value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s %q: %w", name, value, err)
+	}
+
+	return result, nil
+}
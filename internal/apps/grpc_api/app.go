@@ -2,15 +2,22 @@ package grpc_api
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"time"
 
 	"github.com/LastSprint/pipetank/internal/repo"
-	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
-	"github.com/LastSprint/pipetank/pkg/client/proto"
-	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/health"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
 	"github.com/LastSprint/pipetank/pkg/utils"
-	"google.golang.org/grpc"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	serviceName = "pipetank-api"
+
+	defaultHealthCheckTimeout = 2 * time.Second
 )
 
 func Run(ctx context.Context) error {
@@ -23,37 +30,72 @@ func Run(ctx context.Context) error {
 }
 
 func RunWithConfig(ctx context.Context, cfg Config) error {
-	mdbClinet, err := mdb.NewClient()
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing, serviceName)
 	if err != nil {
-		return fmt.Errorf("failed to create mongodb client: %w", err)
+		return fmt.Errorf("failed to setup tracing: %w", err)
 	}
 
-	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	checker := health.NewChecker(healthCheckTimeout(cfg))
+
+	storage, closeStorage, err := openStorage(ctx, cfg, checker)
 	if err != nil {
 		return err
 	}
 
-	srv := raweventsconsumer.NewService(rep)
-
-	hdnls := newHandlers(srv)
-	var lc net.ListenConfig
-	listener, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", cfg.Port))
+	server, err := NewServer(ctx, cfg, storage, checker)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", cfg.Port, err)
+		return errors.Join(err, closeStorage())
 	}
 
-	grpcServer := grpc.NewServer()
-
-	proto.RegisterAPIServer(grpcServer, hdnls)
-
 	return utils.DieWithGrace(
 		ctx,
 		func(ctx context.Context) error {
-			return grpcServer.Serve(listener)
+			group, ctx := errgroup.WithContext(ctx)
+
+			group.Go(func() error {
+				err := metrics.Serve(ctx, cfg.MetricsAddr)
+				if err != nil {
+					// the API must not keep serving without metrics
+					server.Stop()
+				}
+
+				return err
+			})
+
+			group.Go(func() error {
+				return server.Serve(ctx)
+			})
+
+			return group.Wait()
 		},
 		func(ctx context.Context) error {
-			grpcServer.GracefulStop()
-			return nil
+			server.Shutdown(ctx)
+
+			return errors.Join(closeStorage(), shutdownTracing(ctx))
 		},
 	)
 }
+
+func ingestionMode(cfg Config) IngestionMode {
+	if len(cfg.IngestionMode) == 0 {
+		return IngestionDirect
+	}
+
+	return cfg.IngestionMode
+}
+
+func storageBackend(cfg Config) repo.StorageBackend {
+	if len(cfg.StorageBackend) == 0 {
+		return repo.StorageMongoDB
+	}
+
+	return cfg.StorageBackend
+}
+
+func healthCheckTimeout(cfg Config) time.Duration {
+	if cfg.HealthCheckTimeout <= 0 {
+		return defaultHealthCheckTimeout
+	}
+
+	return cfg.HealthCheckTimeout
+}
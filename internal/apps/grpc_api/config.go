@@ -1,9 +1,39 @@
 package grpc_api
 
-import "github.com/caarlos0/env/v11"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/sqlite"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
+	"github.com/caarlos0/env/v11"
+)
 
 type Config struct {
-	Port int `env:"PORT" default:"50051"`
+	Port int `env:"PORT" envDefault:"50051"`
+	// MetricsAddr is an address of the Prometheus `/metrics` endpoint, empty value disables it.
+	MetricsAddr string `env:"METRICS_ADDR" envDefault:":9090"`
+
+	Tracing tracing.Config
+
+	// HealthCheckPeriod is how often the serving status of `grpc.health.v1` is refreshed.
+	HealthCheckPeriod  time.Duration `env:"HEALTH_CHECK_PERIOD"  envDefault:"5s"`
+	HealthCheckTimeout time.Duration `env:"HEALTH_CHECK_TIMEOUT" envDefault:"2s"`
+	// ShutdownDelay is how long the server keeps serving as NOT_SERVING before it stops,
+	// so load balancers notice it and stop sending new streams.
+	ShutdownDelay time.Duration `env:"SHUTDOWN_DELAY" envDefault:"0s"`
+
+	// StorageBackend is mongodb, sqlite or memory. Memory needs no database and is meant for local development.
+	StorageBackend repo.StorageBackend `env:"STORAGE_BACKEND" envDefault:"mongodb"`
+	SQLite         sqlite.Config
+
+	// IngestionMode is direct, raw or both, see IngestionMode constants for trade-offs.
+	IngestionMode IngestionMode `env:"INGESTION_MODE" envDefault:"direct"`
+
+	MaxLogLinesPerStage int64         `env:"MAX_LOG_LINES_PER_STAGE" envDefault:"10000"`
+	LogsTailPollPeriod  time.Duration `env:"LOGS_TAIL_POLL_PERIOD"   envDefault:"1s"`
 }
 
 func parseConfig() (Config, error) {
@@ -12,5 +42,23 @@ func parseConfig() (Config, error) {
 		return cfg, err
 	}
 
-	return cfg, nil
+	return cfg, cfg.Validate()
+}
+
+// Validate checks values which env tags can't.
+func (c Config) Validate() error {
+	if !c.IngestionMode.IsValid() {
+		return fmt.Errorf("INGESTION_MODE must be one of direct, raw, both, got %q", c.IngestionMode)
+	}
+
+	if !isValidStorageBackend(c.StorageBackend) {
+		return fmt.Errorf("STORAGE_BACKEND must be one of mongodb, sqlite, memory, got %q", c.StorageBackend)
+	}
+
+	// nothing consumes the raw events log of the in-memory storage
+	if c.StorageBackend == repo.StorageMemory && c.IngestionMode == IngestionRaw {
+		return errors.New("INGESTION_MODE=raw requires STORAGE_BACKEND=mongodb or sqlite")
+	}
+
+	return nil
 }
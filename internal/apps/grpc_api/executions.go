@@ -0,0 +1,97 @@
+package grpc_api
+
+import (
+	"context"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *handlers) ListExecutions(
+	ctx context.Context,
+	req *proto.ListExecutionsRequest,
+) (*proto.Executions, error) {
+	selector, err := repo.ParseLabelSelector(req.GetLabelSelector())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	executions, err := h.stageStore.ListExecutions(ctx, repo.ExecutionsQuery{
+		ProcessID:   req.GetProcessID(),
+		Labels:      selector,
+		StartedFrom: optionalTime(req.GetStartedFrom()),
+		StartedTo:   optionalTime(req.GetStartedTo()),
+		Limit:       int64(pageSize(req.GetLimit())),
+	})
+	if err != nil {
+		return nil, statusFromErr(err)
+	}
+
+	result := &proto.Executions{
+		Executions: make([]*proto.Execution, 0, len(executions)),
+	}
+
+	for _, execution := range executions {
+		result.Executions = append(result.Executions, &proto.Execution{
+			ProcessID:    &execution.ProcessID,
+			ExecutionID:  &execution.ExecutionID,
+			WorkerID:     &execution.WorkerID,
+			Labels:       execution.Labels,
+			FirstEventAt: timestamppb.New(execution.FirstEventAt),
+			LastEventAt:  timestamppb.New(execution.LastEventAt),
+		})
+	}
+
+	return result, nil
+}
+
+func (h *handlers) ListStageExecutions(
+	ctx context.Context,
+	req *proto.ListStageExecutionsRequest,
+) (*proto.StageExecutions, error) {
+	selector, err := repo.ParseLabelSelector(req.GetLabelSelector())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	stages, err := h.stageStore.ListStageExecutions(ctx, repo.StageExecutionsQuery{
+		ProcessID:   req.GetProcessID(),
+		ExecutionID: req.GetExecutionID(),
+		StageName:   req.GetStageName(),
+		Labels:      selector,
+		StartedFrom: optionalTime(req.GetStartedFrom()),
+		StartedTo:   optionalTime(req.GetStartedTo()),
+		Limit:       int64(pageSize(req.GetLimit())),
+	})
+	if err != nil {
+		return nil, statusFromErr(err)
+	}
+
+	result := &proto.StageExecutions{
+		StageExecutions: make([]*proto.StageExecution, 0, len(stages)),
+	}
+
+	for _, stage := range stages {
+		converted, err := stageExecutionToProto(stage)
+		if err != nil {
+			return nil, err
+		}
+
+		result.StageExecutions = append(result.StageExecutions, converted)
+	}
+
+	return result, nil
+}
+
+// optionalTime converts an optional timestamp, returning zero time if it is not set.
+func optionalTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+
+	return ts.AsTime()
+}
@@ -5,42 +5,115 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"time"
 
 	"github.com/LastSprint/pipetank/internal/repo"
 	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/LastSprint/pipetank/pkg/health"
 	"github.com/LastSprint/pipetank/pkg/mdb"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
 type eventHandler interface {
 	HandleEvents(context.Context, []repo.Event) error
 }
 
+type stageStore interface {
+	GetSingleStageExecution(
+		ctx context.Context,
+		processID, executionID, stageExecutionID string,
+	) (repo.SingleStageExecutionEvent, error)
+
+	AppendStageLogLines(
+		ctx context.Context,
+		lines []repo.StageLogLine,
+		maxLinesPerStage int64,
+	) (int, error)
+
+	GetStageLogLines(
+		ctx context.Context,
+		processID, executionID, stageExecutionID string,
+		fromSeq int64,
+		limit int64,
+	) ([]repo.StageLogLine, error)
+
+	AggregateStageMetrics(ctx context.Context, query repo.StageMetricsQuery) ([]repo.StageMetricBucket, error)
+
+	ListStageExecutions(
+		ctx context.Context,
+		query repo.StageExecutionsQuery,
+	) ([]repo.SingleStageExecutionEvent, error)
+
+	ListExecutions(ctx context.Context, query repo.ExecutionsQuery) ([]repo.ExecutionAggregate, error)
+
+	SearchStageExecutions(
+		ctx context.Context,
+		query repo.StageExecutionsSearchQuery,
+	) ([]repo.StageExecutionSearchResult, error)
+}
+
+type readiness interface {
+	Ready(ctx context.Context) health.Report
+}
+
 type handlers struct {
 	proto.UnimplementedAPIServer
 
 	eventHandler eventHandler
+	stageStore   stageStore
+	readiness    readiness
+
+	maxLogLinesPerStage int64
+	logsTailPollPeriod  time.Duration
 }
 
 func newHandlers(
 	eventHandler eventHandler,
+	stageStore stageStore,
+	readiness readiness,
+	maxLogLinesPerStage int64,
+	logsTailPollPeriod time.Duration,
 ) *handlers {
-	return &handlers{eventHandler: eventHandler}
+	return &handlers{
+		eventHandler:        eventHandler,
+		stageStore:          stageStore,
+		readiness:           readiness,
+		maxLogLinesPerStage: maxLogLinesPerStage,
+		logsTailPollPeriod:  logsTailPollPeriod,
+	}
 }
 
+// HealthCheck is kept for existing clients, it fails with Unavailable if the API is not ready.
+// New clients should use `grpc.health.v1.Health`.
 func (h *handlers) HealthCheck(
 	ctx context.Context,
 	req *emptypb.Empty,
 ) (*emptypb.Empty, error) {
+	err := h.readiness.Ready(ctx).Err()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "not ready: %v", err)
+	}
+
 	return &emptypb.Empty{}, nil
 }
 
 func (h *handlers) Stream(
 	stream grpc.ClientStreamingServer[proto.ClientCommand, emptypb.Empty],
 ) error {
+	activeStreams.Inc()
+	defer activeStreams.Dec()
+
 	for {
 		batch, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
@@ -52,23 +125,13 @@ func (h *handlers) Stream(
 			return status.Errorf(codes.Internal, "recv error: %v", err)
 		}
 
-		events := batch.GetEvents()
-		if events == nil {
-			continue
-		}
-
-		if len(events.Events) == 0 {
-			continue
-		}
-
-		converted := make([]repo.Event, 0, len(events.Events))
-
-		err = convertEventsRaw(events, converted)
-		if err != nil {
-			return err
+		switch cmd := batch.GetCmd().(type) {
+		case *proto.ClientCommand_Events:
+			err = h.handleRawEvents(stream.Context(), cmd.Events)
+		case *proto.ClientCommand_Logs:
+			err = h.handleStageLogs(stream.Context(), cmd.Logs)
 		}
 
-		err = h.eventHandler.HandleEvents(stream.Context(), converted)
 		if err != nil {
 			return err
 		}
@@ -81,23 +144,61 @@ func (h *handlers) Stream(
 	return nil
 }
 
-func convertEventsRaw(batch *proto.RawEvents, converted []repo.Event) error {
+func (h *handlers) handleRawEvents(ctx context.Context, events *proto.RawEvents) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "API.Stream/"+commandTypeRawEvents)
+	defer func() { tracing.End(span, err) }()
+
+	receivedCommands.WithLabelValues(commandTypeRawEvents).Inc()
+
+	if len(events.GetEvents()) == 0 {
+		return nil
+	}
+
+	receivedItems.WithLabelValues(commandTypeRawEvents).Add(float64(len(events.GetEvents())))
+	batchSize.WithLabelValues(commandTypeRawEvents).Observe(float64(len(events.GetEvents())))
+
+	converted, err := convertEventsRaw(events)
+	if err != nil {
+		rejectedItems.WithLabelValues(commandTypeRawEvents, rejectReasonConvert).Add(float64(len(events.GetEvents())))
+		return err
+	}
+
+	rejectedItems.
+		WithLabelValues(commandTypeRawEvents, rejectReasonInvalid).
+		Add(float64(len(events.GetEvents()) - len(converted)))
+
+	start := time.Now()
+
+	err = h.eventHandler.HandleEvents(ctx, converted)
+
+	metrics.ObserveDuration(handleDuration, start, err, commandTypeRawEvents)
+
+	if err != nil {
+		rejectedItems.WithLabelValues(commandTypeRawEvents, rejectReasonHandling).Add(float64(len(converted)))
+	}
+
+	return err
+}
+
+func convertEventsRaw(batch *proto.RawEvents) ([]repo.Event, error) {
+	converted := make([]repo.Event, 0, len(batch.Events))
+
 	for _, ev := range batch.Events {
 		bsonInput, err := mdb.JSONtoBSON(ev.Input)
 		if err != nil {
-			return status.Errorf(codes.Internal, "bson conversion error: %v", err)
+			return nil, status.Errorf(codes.Internal, "bson conversion error: %v", err)
 		}
 		bsonOutput, err := mdb.JSONtoBSON(ev.Output)
 		if err != nil {
-			return status.Errorf(codes.Internal, "bson conversion error: %v", err)
+			return nil, status.Errorf(codes.Internal, "bson conversion error: %v", err)
 		}
 		bsonFailure, err := mdb.JSONtoBSON(ev.Failure)
 		if err != nil {
-			return status.Errorf(codes.Internal, "bson conversion error: %v", err)
+			return nil, status.Errorf(codes.Internal, "bson conversion error: %v", err)
 		}
 		bsonMetadata, err := mdb.JSONtoBSON(ev.Metadata)
 		if err != nil {
-			return status.Errorf(codes.Internal, "bson conversion error: %v", err)
+			return nil, status.Errorf(codes.Internal, "bson conversion error: %v", err)
 		}
 
 		it := repo.Event{
@@ -116,6 +217,8 @@ func convertEventsRaw(batch *proto.RawEvents, converted []repo.Event) error {
 			Output:   bsonOutput,
 			Failure:  bsonFailure,
 			Metadata: bsonMetadata,
+			Metrics:  metricsFromProto(ev.GetMetrics()),
+			Labels:   ev.GetLabels(),
 		}
 
 		err = it.Validate()
@@ -131,5 +234,24 @@ func convertEventsRaw(batch *proto.RawEvents, converted []repo.Event) error {
 		converted = append(converted, it)
 	}
 
-	return nil
+	return converted, nil
+}
+
+func statusFromErr(err error) error {
+	switch {
+	case errors.Is(err, oerrs.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, oerrs.ErrBadInput):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func pageSize(limit int32) int32 {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+
+	return min(limit, maxPageSize)
 }
@@ -0,0 +1,80 @@
+package grpc_api
+
+import (
+	"context"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+)
+
+// IngestionMode is how the API handles received events.
+type IngestionMode string
+
+const (
+	// IngestionDirect aggregates events synchronously, they are visible once the batch is acknowledged.
+	// Nothing is written to the raw events log, so aggregates can't be rebuilt and events are lost
+	// if the aggregation fails after the client gave up retrying.
+	IngestionDirect IngestionMode = "direct"
+	// IngestionRaw only appends events to the raw events log, the consumer builds aggregates from it.
+	// A batch is acknowledged once it is durable, aggregates lag behind by the consumer's flush period.
+	IngestionRaw IngestionMode = "raw"
+	// IngestionBoth appends events to the raw events log marked as aggregated and aggregates them synchronously.
+	// Aggregates are visible at once and the log keeps every event, the consumer skips marked events.
+	IngestionBoth IngestionMode = "both"
+)
+
+func (m IngestionMode) IsValid() bool {
+	switch m {
+	case IngestionDirect, IngestionRaw, IngestionBoth:
+		return true
+	default:
+		return false
+	}
+}
+
+type rawEventsLog interface {
+	AppendRawEvents(ctx context.Context, events []repo.Event) error
+}
+
+// ingester routes received events according to the ingestion mode.
+type ingester struct {
+	mode       IngestionMode
+	log        rawEventsLog
+	aggregator eventHandler
+}
+
+func newIngester(mode IngestionMode, log rawEventsLog, aggregator eventHandler) *ingester {
+	return &ingester{
+		mode:       mode,
+		log:        log,
+		aggregator: aggregator,
+	}
+}
+
+func (i *ingester) HandleEvents(ctx context.Context, events []repo.Event) error {
+	switch i.mode {
+	case IngestionRaw:
+		return i.log.AppendRawEvents(ctx, events)
+	case IngestionBoth:
+		// the log is written first, so an event which failed to aggregate can still be rebuilt from it
+		err := i.log.AppendRawEvents(ctx, markAggregated(events))
+		if err != nil {
+			return err
+		}
+
+		return i.aggregator.HandleEvents(ctx, events)
+	default:
+		return i.aggregator.HandleEvents(ctx, events)
+	}
+}
+
+// markAggregated returns copies of events, the mark must not get into aggregates.
+func markAggregated(events []repo.Event) []repo.Event {
+	result := make([]repo.Event, len(events))
+
+	for i, event := range events {
+		result[i] = event
+		result[i].Aggregated = true
+	}
+
+	return result
+}
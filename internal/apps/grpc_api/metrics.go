@@ -0,0 +1,64 @@
+package grpc_api
+
+import (
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	commandTypeRawEvents = "raw_events"
+	commandTypeStageLogs = "stage_logs"
+
+	rejectReasonInvalid  = "invalid"
+	rejectReasonConvert  = "conversion"
+	rejectReasonHandling = "handling"
+	// rejectReasonLimit is used for log lines dropped because of the per stage limit.
+	rejectReasonLimit = "limit"
+)
+
+var (
+	activeStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "api",
+		Name:      "active_streams",
+		Help:      "Number of open client streams.",
+	})
+
+	receivedCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "api",
+		Name:      "received_commands_total",
+		Help:      "Commands received through the Stream by command type.",
+	}, []string{"type"})
+
+	receivedItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "api",
+		Name:      "received_items_total",
+		Help:      "Events and log lines received through the Stream by command type.",
+	}, []string{"type"})
+
+	rejectedItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "api",
+		Name:      "rejected_items_total",
+		Help:      "Events and log lines which were not stored by command type and reason.",
+	}, []string{"type", "reason"})
+
+	batchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "api",
+		Name:      "batch_size",
+		Help:      "Number of events or log lines in one command by command type.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"type"})
+
+	handleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "api",
+		Name:      "handle_duration_seconds",
+		Help:      "Duration of storing one command (HandleEvents for events) by command type and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type", "status"})
+)
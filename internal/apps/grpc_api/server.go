@@ -0,0 +1,107 @@
+package grpc_api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/LastSprint/pipetank/pkg/health"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Server serves the API and `grpc.health.v1` on the storage.
+type Server struct {
+	cfg          Config
+	checker      *health.Checker
+	listener     net.Listener
+	grpcServer   *grpc.Server
+	healthServer *grpchealth.Server
+}
+
+// NewServer listens on Config.Port, requests are served by Serve.
+// The serving status of `grpc.health.v1` is the readiness of the checker.
+func NewServer(ctx context.Context, cfg Config, storage repo.Storage, checker *health.Checker) (*Server, error) {
+	srv := newIngester(ingestionMode(cfg), storage, raweventsconsumer.NewService(storage))
+
+	hdnls := newHandlers(srv, storage, checker, cfg.MaxLogLinesPerStage, cfg.LogsTailPollPeriod)
+
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", cfg.Port, err)
+	}
+
+	grpcServer := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+
+	healthServer := grpchealth.NewServer()
+
+	proto.RegisterAPIServer(grpcServer, hdnls)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	return &Server{
+		cfg:          cfg,
+		checker:      checker,
+		listener:     listener,
+		grpcServer:   grpcServer,
+		healthServer: healthServer,
+	}, nil
+}
+
+// Serve serves requests until Shutdown or Stop, the serving status is refreshed meanwhile.
+func (s *Server) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	updaterDone := make(chan struct{})
+
+	go func() {
+		defer close(updaterDone)
+		s.checker.UpdateGRPC(ctx, s.healthServer, s.cfg.HealthCheckPeriod, proto.API_ServiceDesc.ServiceName)
+	}()
+
+	err := s.grpcServer.Serve(s.listener)
+
+	cancel()
+	<-updaterDone
+
+	return err
+}
+
+// Shutdown reports NOT_SERVING, keeps serving for Config.ShutdownDelay so load balancers notice it,
+// and then stops accepting requests and waits for in-flight ones, so received events are handled.
+// Requests which are still running when the context is done are canceled.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.checker.SetShuttingDown()
+	s.healthServer.Shutdown()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(s.cfg.ShutdownDelay):
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		s.grpcServer.GracefulStop()
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		<-stopped
+	}
+}
+
+// Stop cancels in-flight requests and stops the server at once.
+func (s *Server) Stop() {
+	s.grpcServer.Stop()
+}
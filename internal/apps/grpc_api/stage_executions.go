@@ -0,0 +1,162 @@
+package grpc_api
+
+import (
+	"context"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *handlers) GetStageExecution(
+	ctx context.Context,
+	req *proto.StageExecutionRef,
+) (*proto.StageExecution, error) {
+	stage, err := h.stageStore.GetSingleStageExecution(
+		ctx,
+		req.GetProcessID(),
+		req.GetExecutionID(),
+		req.GetStageExecutionID(),
+	)
+	if err != nil {
+		return nil, statusFromErr(err)
+	}
+
+	result, err := stageExecutionToProto(stage)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Logs, err = h.getStageLogsPage(ctx, req, 0, defaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (h *handlers) SearchStageExecutions(
+	ctx context.Context,
+	req *proto.SearchStageExecutionsRequest,
+) (*proto.StageExecutionSearchResults, error) {
+	found, err := h.stageStore.SearchStageExecutions(ctx, repo.StageExecutionsSearchQuery{
+		Text:        req.GetQuery(),
+		ProcessID:   req.GetProcessID(),
+		StartedFrom: optionalTime(req.GetStartedFrom()),
+		StartedTo:   optionalTime(req.GetStartedTo()),
+		Limit:       int64(pageSize(req.GetLimit())),
+	})
+	if err != nil {
+		return nil, statusFromErr(err)
+	}
+
+	result := &proto.StageExecutionSearchResults{
+		Results: make([]*proto.StageExecutionSearchResult, 0, len(found)),
+	}
+
+	for _, it := range found {
+		converted, err := stageExecutionToProto(it.Stage)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Results = append(result.Results, &proto.StageExecutionSearchResult{
+			StageExecution: converted,
+			Score:          &it.Score,
+		})
+	}
+
+	return result, nil
+}
+
+func stageExecutionToProto(stage repo.SingleStageExecutionEvent) (*proto.StageExecution, error) {
+	result := &proto.StageExecution{
+		Ref: &proto.StageExecutionRef{
+			ProcessID:        &stage.ProcessID,
+			ExecutionID:      &stage.ExecutionID,
+			StageExecutionID: &stage.StageExecutionID,
+		},
+		Stage:      rawStageToProto(stage.RawStage),
+		IsFinished: &stage.IsFinished,
+		IsSuccess:  &stage.IsSuccess,
+		UpdatedAt:  timestamppb.New(stage.UpdatedAt),
+		Updates:    make([]*proto.RawEvent, 0, len(stage.Updates)),
+		Metrics:    stageMetricsToProto(stage.Metrics),
+		Labels:     stage.Labels,
+	}
+
+	var err error
+
+	if !stage.Start.Ts.IsZero() {
+		result.Start, err = rawEventToProto(stage.Start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, update := range stage.Updates {
+		converted, err := rawEventToProto(update)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Updates = append(result.Updates, converted)
+	}
+
+	if stage.IsFinished {
+		result.End, err = rawEventToProto(stage.End)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func rawStageToProto(stage repo.RawStage) *proto.RawStage {
+	return &proto.RawStage{
+		Name:        &stage.Name,
+		Description: &stage.Description,
+	}
+}
+
+func rawEventToProto(event repo.Event) (*proto.RawEvent, error) {
+	input, err := mdb.BsonToJSON(event.Input)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "json conversion error: %v", err)
+	}
+	output, err := mdb.BsonToJSON(event.Output)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "json conversion error: %v", err)
+	}
+	failure, err := mdb.BsonToJSON(event.Failure)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "json conversion error: %v", err)
+	}
+	metadata, err := mdb.BsonToJSON(event.Metadata)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "json conversion error: %v", err)
+	}
+
+	kind := proto.EventKind(event.Kind)
+	eventStatus := proto.EventStatus(event.Status)
+
+	return &proto.RawEvent{
+		ProcessID:        &event.ProcessID,
+		ExecutionID:      &event.ExecutionID,
+		StageExecutionID: &event.StageExecutionID,
+		Stage:            rawStageToProto(event.Stage),
+		Ts:               timestamppb.New(event.Ts),
+		Kind:             &kind,
+		Status:           &eventStatus,
+		Input:            input,
+		Output:           output,
+		Failure:          failure,
+		Metadata:         metadata,
+		Metrics:          metricsToProto(event.Metrics),
+		Labels:           event.Labels,
+	}, nil
+}
@@ -0,0 +1,194 @@
+package grpc_api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *handlers) handleStageLogs(ctx context.Context, logs *proto.StageLogs) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "API.Stream/"+commandTypeStageLogs)
+	defer func() { tracing.End(span, err) }()
+
+	receivedCommands.WithLabelValues(commandTypeStageLogs).Inc()
+
+	if len(logs.GetLines()) == 0 {
+		return nil
+	}
+
+	receivedItems.WithLabelValues(commandTypeStageLogs).Add(float64(len(logs.GetLines())))
+	batchSize.WithLabelValues(commandTypeStageLogs).Observe(float64(len(logs.GetLines())))
+
+	converted := convertStageLogLines(logs)
+
+	rejectedItems.
+		WithLabelValues(commandTypeStageLogs, rejectReasonInvalid).
+		Add(float64(len(logs.GetLines()) - len(converted)))
+
+	if len(converted) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+
+	dropped, err := h.stageStore.AppendStageLogLines(ctx, converted, h.maxLogLinesPerStage)
+
+	metrics.ObserveDuration(handleDuration, start, err, commandTypeStageLogs)
+
+	if err != nil {
+		rejectedItems.WithLabelValues(commandTypeStageLogs, rejectReasonHandling).Add(float64(len(converted)))
+		return statusFromErr(err)
+	}
+
+	rejectedItems.WithLabelValues(commandTypeStageLogs, rejectReasonLimit).Add(float64(dropped))
+
+	if dropped > 0 {
+		slog.WarnContext(
+			ctx,
+			"stage log lines dropped because of the per stage limit",
+			slog.String("worker_id", logs.GetWorkerID()),
+			slog.Int("dropped", dropped),
+		)
+	}
+
+	return nil
+}
+
+func (h *handlers) GetStageLogs(
+	ctx context.Context,
+	req *proto.GetStageLogsRequest,
+) (*proto.StageLogLines, error) {
+	return h.getStageLogsPage(ctx, req.GetStage(), req.GetFromSeq(), req.GetLimit())
+}
+
+func (h *handlers) TailStageLogs(
+	req *proto.GetStageLogsRequest,
+	stream grpc.ServerStreamingServer[proto.StageLogLine],
+) error {
+	ctx := stream.Context()
+	fromSeq := req.GetFromSeq()
+	limit := pageSize(req.GetLimit())
+
+	for {
+		page, err := h.getStageLogsPage(ctx, req.GetStage(), fromSeq, limit)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range page.GetLines() {
+			err = stream.Send(line)
+			if err != nil {
+				return status.Errorf(codes.Internal, "send error: %v", err)
+			}
+		}
+
+		fromSeq = page.GetNextSeq()
+
+		if len(page.GetLines()) == int(limit) {
+			// there might be more lines right away
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(h.logsTailPollPeriod):
+		}
+	}
+}
+
+func (h *handlers) getStageLogsPage(
+	ctx context.Context,
+	ref *proto.StageExecutionRef,
+	fromSeq int64,
+	limit int32,
+) (*proto.StageLogLines, error) {
+	if ref == nil {
+		return nil, status.Error(codes.InvalidArgument, "stage must be set")
+	}
+
+	lines, err := h.stageStore.GetStageLogLines(
+		ctx,
+		ref.GetProcessID(),
+		ref.GetExecutionID(),
+		ref.GetStageExecutionID(),
+		fromSeq,
+		int64(pageSize(limit)),
+	)
+	if err != nil {
+		return nil, statusFromErr(err)
+	}
+
+	result := &proto.StageLogLines{
+		Lines:   make([]*proto.StageLogLine, 0, len(lines)),
+		NextSeq: &fromSeq,
+	}
+
+	for _, line := range lines {
+		result.Lines = append(result.Lines, stageLogLineToProto(line))
+	}
+
+	if len(lines) > 0 {
+		nextSeq := lines[len(lines)-1].Seq + 1
+		result.NextSeq = &nextSeq
+	}
+
+	return result, nil
+}
+
+func convertStageLogLines(logs *proto.StageLogs) []repo.StageLogLine {
+	converted := make([]repo.StageLogLine, 0, len(logs.GetLines()))
+
+	for _, line := range logs.GetLines() {
+		it := repo.StageLogLine{
+			ProcessID:        line.GetProcessID(),
+			ExecutionID:      line.GetExecutionID(),
+			StageExecutionID: line.GetStageExecutionID(),
+			WorkerID:         logs.GetWorkerID(),
+			Level:            repo.LogLevel(line.GetLevel()),
+			Message:          line.GetMessage(),
+			Ts:               line.GetTs().AsTime(),
+			Attributes:       line.GetAttributes(),
+			LineID:           line.GetLineID(),
+		}
+
+		err := it.Validate()
+		if err != nil {
+			slog.Info(
+				"invalid stage log line",
+				slog.String("line", line.String()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		converted = append(converted, it)
+	}
+
+	return converted
+}
+
+func stageLogLineToProto(line repo.StageLogLine) *proto.StageLogLine {
+	level := proto.LogLevel(line.Level)
+
+	return &proto.StageLogLine{
+		ProcessID:        &line.ProcessID,
+		ExecutionID:      &line.ExecutionID,
+		StageExecutionID: &line.StageExecutionID,
+		Level:            &level,
+		Message:          &line.Message,
+		Ts:               timestamppb.New(line.Ts),
+		Attributes:       line.Attributes,
+		Seq:              &line.Seq,
+		LineID:           &line.LineID,
+	}
+}
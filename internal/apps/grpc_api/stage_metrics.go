@@ -0,0 +1,95 @@
+package grpc_api
+
+import (
+	"context"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/client/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *handlers) GetStageMetrics(
+	ctx context.Context,
+	req *proto.GetStageMetricsRequest,
+) (*proto.StageMetricBuckets, error) {
+	buckets, err := h.stageStore.AggregateStageMetrics(ctx, repo.StageMetricsQuery{
+		ProcessID: req.GetProcessID(),
+		StageName: req.GetStageName(),
+		From:      req.GetFrom().AsTime(),
+		To:        req.GetTo().AsTime(),
+		Bucket:    req.GetBucket().AsDuration(),
+	})
+	if err != nil {
+		return nil, statusFromErr(err)
+	}
+
+	result := &proto.StageMetricBuckets{
+		Buckets: make([]*proto.StageMetricBucket, 0, len(buckets)),
+	}
+
+	for _, bucket := range buckets {
+		result.Buckets = append(result.Buckets, &proto.StageMetricBucket{
+			Ts:         timestamppb.New(bucket.Ts),
+			StageName:  &bucket.StageName,
+			Name:       &bucket.Name,
+			Unit:       &bucket.Unit,
+			Executions: &bucket.Executions,
+			Sum:        &bucket.Sum,
+			Avg:        &bucket.Avg,
+			Min:        &bucket.Min,
+			Max:        &bucket.Max,
+		})
+	}
+
+	return result, nil
+}
+
+func metricsFromProto(metrics map[string]*proto.Metric) map[string]repo.Metric {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	result := make(map[string]repo.Metric, len(metrics))
+	for name, metric := range metrics {
+		result[name] = repo.Metric{
+			Value: metric.GetValue(),
+			Unit:  metric.GetUnit(),
+		}
+	}
+
+	return result
+}
+
+func metricsToProto(metrics map[string]repo.Metric) map[string]*proto.Metric {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	result := make(map[string]*proto.Metric, len(metrics))
+	for name, metric := range metrics {
+		result[name] = &proto.Metric{
+			Value: &metric.Value,
+			Unit:  &metric.Unit,
+		}
+	}
+
+	return result
+}
+
+func stageMetricsToProto(metrics map[string]repo.StageMetric) map[string]*proto.StageMetric {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	result := make(map[string]*proto.StageMetric, len(metrics))
+	for name, metric := range metrics {
+		result[name] = &proto.StageMetric{
+			Last:  &metric.Last,
+			Sum:   &metric.Sum,
+			Count: &metric.Count,
+			Unit:  &metric.Unit,
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,57 @@
+package grpc_api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/memory"
+	"github.com/LastSprint/pipetank/internal/repo/sqlite"
+	"github.com/LastSprint/pipetank/pkg/health"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+func isValidStorageBackend(backend repo.StorageBackend) bool {
+	switch backend {
+	case repo.StorageMongoDB, repo.StorageMemory, repo.StorageSQLite:
+		return true
+	default:
+		return false
+	}
+}
+
+// openStorage opens the configured storage and registers its readiness check.
+// Returns the storage and the function which closes it.
+func openStorage(ctx context.Context, cfg Config, checker *health.Checker) (repo.Storage, func() error, error) {
+	switch storageBackend(cfg) {
+	case repo.StorageMemory:
+		slog.WarnContext(ctx, "events are kept in memory, they are lost when the API stops")
+
+		return memory.New(utils.UTCClock()), func() error { return nil }, nil
+	case repo.StorageSQLite:
+		storage, err := sqlite.Open(ctx, cfg.SQLite, utils.UTCClock())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		checker.AddReadiness("sqlite", storage.Ping)
+
+		return storage, storage.Close, nil
+	default:
+		client, err := mdb.NewClient()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create mongodb client: %w", err)
+		}
+
+		checker.AddReadiness("mongodb", client.Ping)
+
+		rep, err := repo.NewRepo(ctx, client, utils.UTCClock())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return rep, func() error { return nil }, nil
+	}
+}
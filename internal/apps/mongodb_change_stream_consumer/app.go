@@ -3,47 +3,168 @@ package mongodbchangestreamconsumer
 import (
 	"context"
 	"fmt"
+	"os/signal"
+	"syscall"
 
 	"github.com/LastSprint/pipetank/internal/repo"
 	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
-	"github.com/LastSprint/pipetank/pkg/mdb"
-	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/LastSprint/pipetank/pkg/app"
+	"github.com/LastSprint/pipetank/pkg/health"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
 )
 
+const serviceName = "pipetank-consumer"
+
 func Run(ctx context.Context) error {
 	cfg, err := parseConfig()
 	if err != nil {
 		return fmt.Errorf("failed to parse config: %w", err)
 	}
 
-	mdbClinet, err := mdb.NewClient()
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	p := &process{
+		cfg:     cfg,
+		checker: health.NewChecker(cfg.HealthCheckTimeout),
+	}
+
+	return app.New(cfg.ShutdownTimeout, p.components()...).Run(ctx)
+}
+
+// process is what components share, every field is set by Start of the component which owns it.
+type process struct {
+	cfg     config
+	checker *health.Checker
+
+	shutdownTracing func(context.Context) error
+	storage         Storage
+	closeStorage    func(context.Context) error
+	stopHealth      func(context.Context) error
+	consumers       *Group
+}
+
+// components are in the order of startup. The storage is closed after the group is stopped,
+// so partitions are flushed and released on shutdown.
+func (p *process) components() []app.Component {
+	return []app.Component{
+		{
+			Name:  "tracing",
+			Start: p.startTracing,
+			Stop:  func(ctx context.Context) error { return p.shutdownTracing(ctx) },
+		},
+		{
+			Name:  "storage",
+			Start: p.openStorage,
+			Stop:  func(ctx context.Context) error { return p.closeStorage(ctx) },
+		},
+		{
+			Name:  "health",
+			Start: p.startHealth,
+			Stop:  func(ctx context.Context) error { return p.stopHealth(ctx) },
+		},
+		{
+			Name: "metrics",
+			Run: func(ctx context.Context) error {
+				return metrics.Serve(ctx, p.cfg.MetricsAddr)
+			},
+		},
+		{
+			Name:  "consumer",
+			Start: p.startConsumer,
+			// canceling the group flushes buffered events and releases partitions
+			Run: func(ctx context.Context) error { return p.consumers.Run(ctx) },
+			Stop: func(context.Context) error {
+				p.checker.SetShuttingDown()
+				return nil
+			},
+		},
+	}
+}
+
+func (p *process) startTracing(ctx context.Context) error {
+	shutdownTracing, err := tracing.Setup(ctx, p.cfg.Tracing, serviceName)
 	if err != nil {
-		return fmt.Errorf("failed to create mongodb client: %w", err)
+		return fmt.Errorf("failed to setup tracing: %w", err)
 	}
 
-	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	p.shutdownTracing = shutdownTracing
+
+	return nil
+}
+
+func (p *process) openStorage(ctx context.Context) error {
+	storage, closeStorage, err := OpenStorage(ctx, p.cfg.StorageBackend, p.cfg.SQLite, p.checker)
 	if err != nil {
 		return err
 	}
 
-	srv := raweventsconsumer.NewService(rep)
+	p.storage = storage
+	p.closeStorage = closeStorage
 
-	consumer := New(
-		rep,
-		srv,
-		cfg.ErrorHandlingStrategy,
-		cfg.MaxBufferSize,
-		cfg.BufferCleanUpPeriod,
-		cfg.ConsumerKey,
-	)
+	return nil
+}
 
-	return utils.DieWithGrace(
-		ctx,
-		func(ctx context.Context) error {
-			return consumer.Start(ctx)
-		},
-		func(ctx context.Context) error {
-			return mdbClinet.Close(ctx)
+func (p *process) startHealth(ctx context.Context) error {
+	stopHealth, err := health.Start(ctx, p.cfg.HealthCheckAddr, p.checker)
+	if err != nil {
+		return err
+	}
+
+	p.stopHealth = stopHealth
+
+	return nil
+}
+
+func (p *process) startConsumer(context.Context) error {
+	consumers, err := NewConsumerGroup(p.cfg.GroupConfig, p.storage, p.checker)
+	if err != nil {
+		return err
+	}
+
+	p.consumers = consumers
+
+	return nil
+}
+
+// NewConsumerGroup creates the consumer group which aggregates raw events of the storage
+// and registers its health checks. The InstanceID is generated if it is empty.
+func NewConsumerGroup(cfg GroupConfig, storage Storage, checker *health.Checker) (*Group, error) {
+	if len(cfg.InstanceID) == 0 {
+		instanceID, err := generateInstanceID()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.InstanceID = instanceID
+	}
+
+	srv := raweventsconsumer.NewService(storage)
+
+	consumers := NewGroup(
+		storage,
+		func(partition repo.Partition) partitionConsumer {
+			return New(
+				storage,
+				srv,
+				cfg.ErrorHandlingStrategy,
+				cfg.MaxBufferSize,
+				cfg.BufferCleanUpPeriod,
+				cfg.ConsumerKey,
+				cfg.OnExpiredToken,
+				cfg.FallbackFrom,
+				partition,
+			)
 		},
+		cfg.ConsumerKey,
+		cfg.InstanceID,
+		cfg.Partitions,
+		cfg.LeaseTTL,
 	)
+
+	checker.AddLiveness("change_stream", consumers.CheckStream)
+	checker.AddReadiness("token_age", consumers.CheckTokenAge(cfg.MaxTokenAge))
+
+	return consumers, nil
 }
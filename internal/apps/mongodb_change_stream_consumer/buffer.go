@@ -0,0 +1,132 @@
+package mongodbchangestreamconsumer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// batch is a part of the change stream: events and the resume token of the last of them.
+type batch struct {
+	events []repo.Event
+	token  bson.Raw
+	// since is when the first event of the batch was received.
+	since time.Time
+}
+
+// empty reports whether the batch has neither events nor a token to save.
+func (b batch) empty() bool {
+	return len(b.events) == 0 && len(b.token) == 0
+}
+
+// doubleBuffer collects events into the active batch while the other batch is flushed.
+//
+// The flushing batch is swapped with the active one only after it's handled, so at most two batches
+// of capacity events are in memory. Append blocks while the active batch is full, so a slow flush
+// slows the change stream down instead of growing the memory.
+type doubleBuffer struct {
+	capacity int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	active   batch
+	flushing batch
+}
+
+func newDoubleBuffer(capacity int) *doubleBuffer {
+	b := &doubleBuffer{
+		capacity: capacity,
+		active:   batch{events: make([]repo.Event, 0, capacity)},
+		flushing: batch{events: make([]repo.Event, 0, capacity)},
+	}
+
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+// Append adds the event to the active batch, waiting for a free space until the context is done.
+func (b *doubleBuffer) Append(ctx context.Context, event repo.Event, token bson.Raw) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.active.events) >= b.capacity {
+		stop := context.AfterFunc(ctx, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			b.cond.Broadcast()
+		})
+		defer stop()
+
+		for len(b.active.events) >= b.capacity {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			b.cond.Wait()
+		}
+	}
+
+	if len(b.active.events) == 0 {
+		b.active.since = time.Now()
+	}
+
+	b.active.events = append(b.active.events, event)
+	b.active.token = token
+
+	return nil
+}
+
+// Advance moves the token of the active batch forward without an event, e.g. when the change stream is idle.
+func (b *doubleBuffer) Advance(token bson.Raw) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.active.token = token
+}
+
+// Flushing returns the batch to flush. If the previous batch is handled, the active batch becomes the flushing one,
+// otherwise the previous batch is returned again. Only one caller may flush at a time.
+func (b *doubleBuffer) Flushing() batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.flushing.empty() {
+		b.active, b.flushing = batch{events: b.flushing.events[:0]}, b.active
+		b.cond.Broadcast()
+	}
+
+	return b.flushing
+}
+
+// Done marks the flushing batch as handled, its memory is reused by the next active batch.
+func (b *doubleBuffer) Done() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushing = batch{events: b.flushing.events[:0]}
+}
+
+// Len returns the number of events which are not handled yet and the number of them in the active batch.
+func (b *doubleBuffer) Len() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.active.events) + len(b.flushing.events), len(b.active.events)
+}
+
+// PendingSince returns when the oldest not handled event was received, or zero time if there is none.
+func (b *doubleBuffer) PendingSince() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.flushing.events) > 0 {
+		return b.flushing.since
+	}
+
+	return b.active.since
+}
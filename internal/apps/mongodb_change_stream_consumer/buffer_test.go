@@ -0,0 +1,128 @@
+package mongodbchangestreamconsumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func appendEvents(t *testing.T, b *doubleBuffer, ids ...string) {
+	t.Helper()
+
+	for _, id := range ids {
+		require.NoError(t, b.Append(context.Background(), repo.Event{ProcessID: id}, bson.Raw(id)))
+	}
+}
+
+func processIDs(events []repo.Event) []string {
+	result := make([]string, 0, len(events))
+	for _, event := range events {
+		result = append(result, event.ProcessID)
+	}
+
+	return result
+}
+
+func TestDoubleBufferSwapsBatches(t *testing.T) {
+	b := newDoubleBuffer(3)
+
+	appendEvents(t, b, "1", "2")
+
+	flushing := b.Flushing()
+	assert.Equal(t, []string{"1", "2"}, processIDs(flushing.events))
+	assert.Equal(t, bson.Raw("2"), flushing.token)
+
+	// the change stream keeps appending while the batch is flushed
+	appendEvents(t, b, "3")
+
+	// not handled batch is returned again
+	assert.Equal(t, []string{"1", "2"}, processIDs(b.Flushing().events))
+
+	total, active := b.Len()
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 1, active)
+
+	b.Done()
+
+	flushing = b.Flushing()
+	assert.Equal(t, []string{"3"}, processIDs(flushing.events))
+	assert.Equal(t, bson.Raw("3"), flushing.token)
+
+	b.Done()
+
+	assert.Empty(t, b.Flushing().events)
+	assert.True(t, b.PendingSince().IsZero())
+}
+
+func TestDoubleBufferAdvancesIdleToken(t *testing.T) {
+	b := newDoubleBuffer(3)
+
+	// the idle token moves the token of buffered events forward
+	appendEvents(t, b, "1")
+	b.Advance(bson.Raw("idle-1"))
+
+	flushing := b.Flushing()
+	assert.Equal(t, []string{"1"}, processIDs(flushing.events))
+	assert.Equal(t, bson.Raw("idle-1"), flushing.token)
+
+	b.Done()
+
+	// a batch without events is flushed to save its token
+	b.Advance(bson.Raw("idle-2"))
+
+	flushing = b.Flushing()
+	assert.Empty(t, flushing.events)
+	assert.Equal(t, bson.Raw("idle-2"), flushing.token)
+
+	b.Done()
+
+	assert.True(t, b.Flushing().empty())
+}
+
+func TestDoubleBufferAppliesBackpressure(t *testing.T) {
+	b := newDoubleBuffer(1)
+
+	appendEvents(t, b, "1")
+	b.Flushing()
+	appendEvents(t, b, "2")
+
+	appended := make(chan error)
+
+	go func() {
+		appended <- b.Append(context.Background(), repo.Event{ProcessID: "3"}, nil)
+	}()
+
+	select {
+	case <-appended:
+		require.FailNow(t, "append must wait while both batches are full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Done()
+	assert.Equal(t, []string{"2"}, processIDs(b.Flushing().events))
+
+	require.NoError(t, <-appended)
+}
+
+func TestDoubleBufferAppendIsCanceled(t *testing.T) {
+	b := newDoubleBuffer(1)
+
+	appendEvents(t, b, "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	appended := make(chan error)
+
+	go func() {
+		appended <- b.Append(ctx, repo.Event{ProcessID: "2"}, nil)
+	}()
+
+	cancel()
+
+	assert.ErrorIs(t, <-appended, context.Canceled)
+}
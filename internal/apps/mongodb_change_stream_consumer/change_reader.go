@@ -2,20 +2,35 @@ package mongodbchangestreamconsumer
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
-	"weak"
 
 	"github.com/LastSprint/pipetank/internal/repo"
 	"github.com/LastSprint/pipetank/pkg/common"
 	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type store interface {
+	SendToDeadLetters(ctx context.Context, consumerKey string, events []repo.Event, cause error) error
+	LoadChangeStreamTokens(context.Context, string) (map[string]bson.Raw, error)
+	CompareChangeStreamTokens(a, b bson.Raw) int
 	SaveChangeStreamToken(context.Context, string, bson.Raw) error
-	WatchRawEvents(context.Context, common.CallbackFailable[repo.RawEventWatchModel]) error
+	AggregateWritesPaused(ctx context.Context) (bool, error)
+	WatchRawEvents(
+		ctx context.Context,
+		from repo.ChangeStreamPosition,
+		partition repo.Partition,
+		action common.CallbackFailable[repo.RawEventWatchModel],
+	) error
 }
 
 type handler interface {
@@ -32,18 +47,47 @@ const (
 	TickFrequency time.Duration = time.Millisecond * 100
 )
 
+// ExpiredTokenFallback is what the consumer does if the saved token is not in the oplog anymore.
+type ExpiredTokenFallback string
+
+const (
+	// FallbackFail stops the consumer, so an operator decides what to do with the lost events.
+	FallbackFail ExpiredTokenFallback = "fail"
+	// FallbackNow starts from now, events inserted while the consumer was down are skipped.
+	FallbackNow ExpiredTokenFallback = "now"
+	// FallbackTimestamp starts from the configured time, it must be inside the oplog window.
+	FallbackTimestamp ExpiredTokenFallback = "timestamp"
+)
+
+func (f ExpiredTokenFallback) IsValid() bool {
+	switch f {
+	case FallbackFail, FallbackNow, FallbackTimestamp:
+		return true
+	default:
+		return false
+	}
+}
+
 type Consumer struct {
 	repo    store
 	handler handler
 
-	buffered      []repo.Event
-	bufferMx      *sync.RWMutex
-	tokenProvider weak.Pointer[mdb.ResumeTokenProvider]
+	buffer *doubleBuffer
+	// flushMx makes flushes of the flusher and Flush sequential.
+	flushMx sync.Mutex
+	// streamRunning is true while the change stream is watched.
+	streamRunning atomic.Bool
 
 	errorHandlingStrategy ErrorHandlingStrategy
 	maxBufferSize         int
 	bufferCleanUpPeriod   time.Duration
-	key                   string
+	// key is the consumer group key, tokenKey is the key of the partition's token.
+	key       string
+	tokenKey  string
+	partition repo.Partition
+
+	onExpiredToken ExpiredTokenFallback
+	fallbackFrom   time.Time
 }
 
 func New(
@@ -53,7 +97,12 @@ func New(
 	maxBufferSize int,
 	bufferCleanUpPeriod time.Duration,
 	key string,
+	onExpiredToken ExpiredTokenFallback,
+	fallbackFrom time.Time,
+	partition repo.Partition,
 ) *Consumer {
+	bufferCapacity.Set(float64(maxBufferSize))
+
 	return &Consumer{
 		repo:                  r,
 		handler:               h,
@@ -61,36 +110,188 @@ func New(
 		bufferCleanUpPeriod:   bufferCleanUpPeriod,
 		maxBufferSize:         maxBufferSize,
 		key:                   key,
+		tokenKey:              partition.TokenKey(key),
+		partition:             partition,
+		onExpiredToken:        onExpiredToken,
+		fallbackFrom:          fallbackFrom,
 
-		bufferMx: &sync.RWMutex{},
-		buffered: make([]repo.Event, 0, maxBufferSize),
+		buffer: newDoubleBuffer(maxBufferSize),
 	}
 }
 
+// Start watches raw events and flushes them in background until the context is done,
+// or until a flush fails with the Fail strategy. It returns once the background flush is stopped,
+// events buffered by then are handled by Flush.
 func (c *Consumer) Start(ctx context.Context) error {
-	// ctx, cancelFn := context.WithCancelCause()
+	consumeCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	flusherDone := make(chan struct{})
+
 	go func() {
+		defer close(flusherDone)
+
 		for {
-			err := c.bufferFlusher(ctx)
-			if err == nil {
-				continue
-			}
-			err = c.onError(ctx, err)
-			if err == nil {
-				continue
+			err := c.bufferFlusher(consumeCtx)
+			if consumeCtx.Err() != nil {
+				return
 			}
 
-			// TODO: handle error respecting the strategy
-			// cancelFn(err)
+			err = c.onError(consumeCtx, err)
+			if err != nil {
+				cancel(err)
+				return
+			}
 		}
 	}()
 
+	err := c.consume(consumeCtx)
+
+	// the flusher failed, the change stream was stopped because of it
+	if consumeCtx.Err() != nil && ctx.Err() == nil {
+		err = context.Cause(consumeCtx)
+	}
+
+	// the final Flush must not run next to a background one, and nothing may use the storage after return
+	cancel(nil)
+	<-flusherDone
+
+	return err
+}
+
+func (c *Consumer) consume(ctx context.Context) error {
+	c.streamRunning.Store(true)
+	defer c.streamRunning.Store(false)
+
+	token, err := c.loadToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.watch(ctx, repo.ChangeStreamPosition{Token: token})
+	if len(token) == 0 || !mdb.IsHistoryLost(err) {
+		return err
+	}
+
+	switch c.onExpiredToken {
+	case FallbackNow:
+		slog.WarnContext(
+			ctx,
+			"saved change stream token is expired, starting from now; events inserted since the token are skipped",
+			slog.String("key", c.tokenKey),
+		)
+
+		return c.watch(ctx, repo.ChangeStreamPosition{})
+	case FallbackTimestamp:
+		slog.WarnContext(
+			ctx,
+			"saved change stream token is expired, starting from the fallback time",
+			slog.String("key", c.tokenKey),
+			slog.Time("from", c.fallbackFrom),
+		)
+
+		return c.watch(ctx, repo.ChangeStreamPosition{StartAt: c.fallbackFrom})
+	default:
+		return fmt.Errorf("saved change stream token %q is expired: %w", c.tokenKey, err)
+	}
+}
+
+// loadToken loads the token of the partition. Tokens saved with another number of partitions (a previous
+// CONSUMER_PARTITIONS, or the group key of a single consumer) form another layout. If the partition has no token yet,
+// or the most recent other layout is ahead of it, the partition starts from the oldest token of that layout:
+// all its partitions handled events up to there, so changing the number of partitions neither skips events
+// nor resumes from a token which is stale by then.
+func (c *Consumer) loadToken(ctx context.Context) (bson.Raw, error) {
+	tokens, err := c.repo.LoadChangeStreamTokens(ctx, c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	own, hasOwn := tokens[c.tokenKey]
+	layoutKey, layoutToken := c.otherLayoutToken(tokens)
+
+	if len(layoutToken) > 0 && (!hasOwn || c.repo.CompareChangeStreamTokens(own, layoutToken) < 0) {
+		slog.InfoContext(
+			ctx,
+			"resuming change stream from the token of other partitions",
+			slog.String("key", layoutKey),
+			slog.String("partition", c.partition.String()),
+		)
+
+		return layoutToken, nil
+	}
+
+	if hasOwn {
+		slog.InfoContext(
+			ctx,
+			"resuming change stream",
+			slog.String("key", c.tokenKey),
+			slog.String("partition", c.partition.String()),
+		)
+
+		return own, nil
+	}
+
+	slog.InfoContext(ctx, "no saved change stream token, starting from now", slog.String("key", c.tokenKey))
+
+	return nil, nil
+}
+
+// otherLayoutToken returns the oldest token of the most recent layout with another number of partitions,
+// the most recent layout is the one with the newest token.
+func (c *Consumer) otherLayoutToken(tokens map[string]bson.Raw) (string, bson.Raw) {
+	type layout struct {
+		oldestKey      string
+		oldest, newest bson.Raw
+	}
+
+	layouts := map[int]*layout{}
+
+	for key, token := range tokens {
+		count, ok := repo.TokenKeyPartitions(c.key, key)
+		if !ok || count == max(c.partition.Count, 1) {
+			continue
+		}
+
+		l, ok := layouts[count]
+		if !ok {
+			layouts[count] = &layout{oldestKey: key, oldest: token, newest: token}
+			continue
+		}
+
+		if c.repo.CompareChangeStreamTokens(token, l.oldest) < 0 {
+			l.oldestKey, l.oldest = key, token
+		}
+
+		if c.repo.CompareChangeStreamTokens(token, l.newest) > 0 {
+			l.newest = token
+		}
+	}
+
+	var recent *layout
+
+	for _, l := range layouts {
+		if recent == nil || c.repo.CompareChangeStreamTokens(l.newest, recent.newest) > 0 {
+			recent = l
+		}
+	}
+
+	if recent == nil {
+		return "", nil
+	}
+
+	return recent.oldestKey, recent.oldest
+}
+
+func (c *Consumer) watch(ctx context.Context, from repo.ChangeStreamPosition) error {
 	return c.repo.WatchRawEvents(
 		ctx,
+		from,
+		c.partition,
 		func(ctx context.Context, event repo.RawEventWatchModel) error {
 			err := c.handleEventAction(ctx, event)
-			if err == nil {
-				return nil
+			if err == nil || ctx.Err() != nil {
+				return err
 			}
 
 			err = c.onError(ctx, err)
@@ -104,23 +305,31 @@ func (c *Consumer) Start(ctx context.Context) error {
 }
 
 func (c *Consumer) handleEventAction(ctx context.Context, event repo.RawEventWatchModel) error {
-	c.tokenProvider = weak.Make[mdb.ResumeTokenProvider](&event.Token)
-	err := c.handleRecord(ctx, event.Record)
-	if err != nil {
-		return c.onError(ctx, err)
+	// the token is copied, the change stream reuses it for next events
+	token := slices.Clone(event.Token.ResumeToken())
+
+	// the token of an idle stream is saved by the next flush, so a quiet partition doesn't fall out of the oplog
+	if event.Idle {
+		c.buffer.Advance(token)
+		return nil
 	}
 
-	return nil
+	return c.handleRecord(ctx, event.Record, token)
 }
 
 func (c *Consumer) onError(ctx context.Context, err error) error {
+	handlingErrors.WithLabelValues(c.errorHandlingStrategy.String()).Inc()
+
 	switch c.errorHandlingStrategy {
 	case Fail:
 		return err
 	case LogAndSkip:
 		slog.WarnContext(ctx, "failed to process with error", slog.Any("error", err))
+		return nil
 	case SendToDLQ:
-		panic("not implemented")
+		// failed flushes are sent to the DLQ by flushBuffer, other errors are not bound to events
+		slog.ErrorContext(ctx, "failed to process with error", slog.Any("error", err))
+		return nil
 	}
 
 	slog.Warn(
@@ -131,7 +340,7 @@ func (c *Consumer) onError(ctx context.Context, err error) error {
 	return nil
 }
 
-func (c *Consumer) onSuccess(ctx context.Context, events []repo.Event) error {
+func (c *Consumer) onSuccess(ctx context.Context, events []repo.Event, token bson.Raw) error {
 	eventsIDs := make([]string, 0, len(events))
 	for _, event := range events {
 		eventsIDs = append(eventsIDs, event.ID.String())
@@ -139,73 +348,176 @@ func (c *Consumer) onSuccess(ctx context.Context, events []repo.Event) error {
 
 	slog.InfoContext(ctx, "processing events", slog.Any("events", eventsIDs))
 
-	tp := c.tokenProvider.Value()
+	return c.repo.SaveChangeStreamToken(ctx, c.tokenKey, token)
+}
 
-	if tp == nil {
-		slog.Error("Weak ref to token provider is nil, cannot save token")
-		return nil
+// handleRecord buffers the event, it blocks while the buffer is full.
+func (c *Consumer) handleRecord(ctx context.Context, event repo.Event, token bson.Raw) error {
+	err := c.buffer.Append(ctx, event, token)
+	if err != nil {
+		return err
 	}
 
-	ttp := *tp
-
-	return c.repo.SaveChangeStreamToken(ctx, c.key, ttp.ResumeToken())
-}
-
-func (c *Consumer) handleRecord(_ context.Context, event repo.Event) error { //nolint:unparam
-	c.bufferMx.Lock()
-	c.buffered = append(c.buffered, event)
-	c.bufferMx.Unlock()
+	size, _ := c.buffer.Len()
+	bufferSize.WithLabelValues(c.partition.String()).Set(float64(size))
+	receivedEvents.Inc()
 
 	return nil
 }
 
+// bufferFlusher flushes the buffer when it is full or every bufferCleanUpPeriod.
 func (c *Consumer) bufferFlusher(ctx context.Context) error {
+	ticker := time.NewTicker(TickFrequency)
+	defer ticker.Stop()
+
+	flushedAt := time.Now()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(TickFrequency):
-			c.bufferMx.RLock()
-			count := len(c.buffered)
-			c.bufferMx.RUnlock()
+		case <-ticker.C:
+		}
 
-			if count < c.maxBufferSize {
-				break
-			}
+		_, active := c.buffer.Len()
+		if active < c.maxBufferSize && time.Since(flushedAt) < c.bufferCleanUpPeriod {
+			continue
+		}
 
-			err := c.flushBuffer(ctx)
-			if err != nil {
-				return err
-			}
+		flushedAt = time.Now()
 
-		case <-time.After(c.bufferCleanUpPeriod):
-			err := c.flushBuffer(ctx)
-			if err != nil {
-				return err
-			}
+		err := c.flushBuffer(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Flush handles buffered events and saves the token, e.g. before the partition is given up.
+func (c *Consumer) Flush(ctx context.Context) error {
+	// the flushing batch may be a retried one, then the active batch is flushed by the second call
+	for range 2 {
+		err := c.flushBuffer(ctx)
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
-func (c *Consumer) flushBuffer(ctx context.Context) error {
-	if len(c.buffered) == 0 {
+// flushBuffer handles the flushing batch outside of the buffer lock, so the change stream keeps
+// filling the active batch meanwhile. A failed batch is retried by the next flush, unless
+// the error handling strategy skips it.
+func (c *Consumer) flushBuffer(ctx context.Context) (err error) {
+	c.flushMx.Lock()
+	defer c.flushMx.Unlock()
+
+	flushing := c.buffer.Flushing()
+	if flushing.empty() {
+		return nil
+	}
+
+	// the stream was idle, only its position is saved
+	if len(flushing.events) == 0 {
+		err = c.repo.SaveChangeStreamToken(ctx, c.tokenKey, flushing.token)
+		if err != nil {
+			return err
+		}
+
+		c.buffer.Done()
+
+		return nil
+	}
+
+	paused, err := c.repo.AggregateWritesPaused(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the batch stays in the buffer until aggregates are swapped by a rebuild, the stream waits when it's full
+	if paused {
 		return nil
 	}
 
-	// POTENTIAL OPTIMISATION
-	// Use rolling buffers, in order to prevent data loss between copying and handling data
-	// when we start flushing - this object must start writing data to another buffer
-	c.bufferMx.Lock()
-	defer c.bufferMx.Unlock()
-	cp := make([]repo.Event, len(c.buffered))
-	copy(cp, c.buffered)
+	ctx, span := tracing.Tracer().Start(ctx, "Consumer.flushBuffer")
+	defer func() { tracing.End(span, err) }()
 
-	err := c.handler.HandleEvents(ctx, cp)
+	flushBatchSize.Observe(float64(len(flushing.events)))
+	span.SetAttributes(attribute.Int("pipetank.events.count", len(flushing.events)))
+
+	start := time.Now()
+
+	err = c.handler.HandleEvents(ctx, flushing.events)
+
+	metrics.ObserveDuration(flushDuration, start, err)
+
+	// a canceled flush is retried by Flush, its events are not broken
+	if err != nil && ctx.Err() == nil {
+		err = c.skipFailed(ctx, flushing.events, err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = c.onSuccess(ctx, flushing.events, flushing.token)
 	if err != nil {
 		return err
 	}
 
-	c.buffered = c.buffered[:0]
+	c.buffer.Done()
+
+	size, _ := c.buffer.Len()
+	bufferSize.WithLabelValues(c.partition.String()).Set(float64(size))
+
+	return nil
+}
+
+// skipFailed skips events of a failed flush according to the error handling strategy.
+// It returns the error if the batch must be retried.
+func (c *Consumer) skipFailed(ctx context.Context, events []repo.Event, cause error) error {
+	switch c.errorHandlingStrategy {
+	case SendToDLQ:
+		return c.sendToDLQ(ctx, events, cause)
+	case LogAndSkip:
+		handlingErrors.WithLabelValues(c.errorHandlingStrategy.String()).Inc()
+		slog.WarnContext(
+			ctx,
+			"failed to process events, skipped them",
+			slog.Int("events", len(events)),
+			slog.Any("error", cause),
+		)
+
+		return nil
+	default:
+		return cause
+	}
+}
+
+// sendToDLQ saves events of a failed flush as dead letters, so the consumer moves on.
+// If the failed writes are known, only their events are dead letters, the rest is already applied.
+// If the DLQ is not available too, events stay in the buffer and the flush is retried.
+func (c *Consumer) sendToDLQ(ctx context.Context, events []repo.Event, cause error) error {
+	handlingErrors.WithLabelValues(c.errorHandlingStrategy.String()).Inc()
 
-	return c.onSuccess(ctx, cp)
+	if failed, ok := repo.FailedEvents(cause); ok {
+		events = failed
+	}
+
+	err := c.repo.SendToDeadLetters(ctx, c.key, events, cause)
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("failed to send events to the DLQ: %w", err))
+	}
+
+	deadLetters.Add(float64(len(events)))
+
+	slog.WarnContext(
+		ctx,
+		"failed to process events, sent them to the DLQ",
+		slog.Int("events", len(events)),
+		slog.Any("error", cause),
+	)
+
+	return nil
 }
@@ -0,0 +1,342 @@
+package mongodbchangestreamconsumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/memory"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const testConsumerKey = "consumer"
+
+// memoryStore is the in-memory storage with an in-memory DLQ.
+type memoryStore struct {
+	*memory.Storage
+
+	mu          sync.Mutex
+	deadLetters []repo.Event
+	paused      atomic.Bool
+}
+
+func (s *memoryStore) AggregateWritesPaused(context.Context) (bool, error) {
+	return s.paused.Load(), nil
+}
+
+func (s *memoryStore) SendToDeadLetters(_ context.Context, _ string, events []repo.Event, _ error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deadLetters = append(s.deadLetters, events...)
+
+	return nil
+}
+
+func (s *memoryStore) DeadLetters() []repo.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deadLetters
+}
+
+type failingHandler struct{}
+
+func (failingHandler) HandleEvents(context.Context, []repo.Event) error {
+	return errors.New("failed")
+}
+
+func testRawEvent(executionID string, kind repo.EventKind, ts time.Time) repo.Event {
+	return repo.Event{
+		ProcessID:        "p1",
+		ExecutionID:      executionID,
+		StageExecutionID: "s1",
+		WorkerID:         "w1",
+		Stage:            repo.RawStage{Name: "stage_1"},
+		Ts:               ts,
+		Kind:             kind,
+		Status:           repo.EventStatusSuccess,
+	}
+}
+
+// startConsumer saves a token before the events appended after it and runs the consumer until the test ends.
+func startConsumer(t *testing.T, store *memoryStore, h handler, strategy ErrorHandlingStrategy) {
+	t.Helper()
+
+	startAt := time.Now()
+	marker := testRawEvent("e0", repo.EventKindStageStarted, startAt)
+	require.NoError(t, store.AppendRawEvents(t.Context(), []repo.Event{marker}))
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	var token bson.Raw
+
+	_ = store.WatchRawEvents(ctx, repo.ChangeStreamPosition{StartAt: startAt}, repo.Partition{},
+		func(_ context.Context, event repo.RawEventWatchModel) error {
+			token = event.Token.ResumeToken()
+			cancel()
+
+			return nil
+		},
+	)
+	require.NoError(t, store.SaveChangeStreamToken(t.Context(), testConsumerKey, token))
+
+	ctx, cancel = context.WithCancel(t.Context())
+	done := make(chan error, 1)
+
+	consumer := New(
+		store, h, strategy, 10, time.Millisecond*10, testConsumerKey, FallbackFail, time.Time{}, repo.Partition{},
+	)
+
+	go func() {
+		done <- consumer.Start(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestConsumerAggregatesRawEvents(t *testing.T) {
+	store := &memoryStore{Storage: memory.New(utils.UTCClock())}
+	startConsumer(t, store, raweventsconsumer.NewService(store), Fail)
+
+	ts := time.Now().UTC()
+	require.NoError(t, store.AppendRawEvents(t.Context(), []repo.Event{
+		testRawEvent("e1", repo.EventKindStageFinished, ts.Add(time.Second)),
+		testRawEvent("e1", repo.EventKindStageStarted, ts),
+	}))
+
+	require.Eventually(t, func() bool {
+		stage, err := store.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+		return err == nil && stage.IsFinished && stage.IsSuccess && !stage.Start.Ts.IsZero()
+	}, time.Second*5, time.Millisecond*10)
+
+	// the event before the token is not consumed
+	_, err := store.GetSingleStageExecution(t.Context(), "p1", "e0", "s1")
+	require.Error(t, err)
+}
+
+func TestConsumerSendsFailedEventsToDLQ(t *testing.T) {
+	store := &memoryStore{Storage: memory.New(utils.UTCClock())}
+	startConsumer(t, store, failingHandler{}, SendToDLQ)
+
+	token, err := store.LoadChangeStreamToken(t.Context(), testConsumerKey)
+	require.NoError(t, err)
+
+	require.NoError(t, store.AppendRawEvents(t.Context(), []repo.Event{
+		testRawEvent("e1", repo.EventKindStageStarted, time.Now().UTC()),
+	}))
+
+	require.Eventually(t, func() bool {
+		return len(store.DeadLetters()) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	assert.Equal(t, "e1", store.DeadLetters()[0].ExecutionID)
+
+	// the consumer moves on
+	require.Eventually(t, func() bool {
+		saved, err := store.LoadChangeStreamToken(t.Context(), testConsumerKey)
+		return err == nil && !assert.ObjectsAreEqual(token, saved)
+	}, time.Second*5, time.Millisecond*10)
+}
+
+type recordingHandler struct {
+	mu      sync.Mutex
+	batches [][]repo.Event
+}
+
+func (h *recordingHandler) HandleEvents(_ context.Context, events []repo.Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.batches = append(h.batches, slices.Clone(events))
+
+	return nil
+}
+
+func TestConsumerFlushHandlesBothBatches(t *testing.T) {
+	store := &memoryStore{Storage: memory.New(utils.UTCClock())}
+	h := &recordingHandler{}
+
+	consumer := New(
+		store, h, Fail, 10, time.Minute, testConsumerKey, FallbackFail, time.Time{}, repo.Partition{},
+	)
+
+	ts := time.Now().UTC()
+	first := testRawEvent("e1", repo.EventKindStageStarted, ts)
+	second := testRawEvent("e2", repo.EventKindStageStarted, ts)
+
+	// the first event is in the flushing batch, e.g. its flush was canceled on shutdown
+	require.NoError(t, consumer.handleRecord(t.Context(), first, bson.Raw("1")))
+	consumer.buffer.Flushing()
+	require.NoError(t, consumer.handleRecord(t.Context(), second, bson.Raw("2")))
+
+	require.NoError(t, consumer.Flush(t.Context()))
+
+	require.Len(t, h.batches, 2)
+	assert.Equal(t, "e1", h.batches[0][0].ExecutionID)
+	assert.Equal(t, "e2", h.batches[1][0].ExecutionID)
+
+	token, err := store.LoadChangeStreamToken(t.Context(), testConsumerKey)
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw("2"), token)
+
+	pending, _ := consumer.buffer.Len()
+	assert.Zero(t, pending)
+}
+
+// seqToken is a token of the memory storage.
+func seqToken(t *testing.T, seq int64) bson.Raw {
+	t.Helper()
+
+	token, err := bson.Marshal(bson.D{{Key: "seq", Value: seq}})
+	require.NoError(t, err)
+
+	return token
+}
+
+func TestConsumerLoadsTokenOfOtherPartitions(t *testing.T) {
+	partition := repo.Partition{Index: 0, Count: 3}
+
+	tests := []struct {
+		name   string
+		tokens map[string]int64
+		want   int64
+	}{
+		{
+			name: "no tokens start from now",
+		},
+		{
+			name:   "switch from a single consumer",
+			tokens: map[string]int64{testConsumerKey: 5},
+			want:   5,
+		},
+		{
+			name:   "resize starts from the oldest token of the previous partitions",
+			tokens: map[string]int64{testConsumerKey + "/0-of-2": 7, testConsumerKey + "/1-of-2": 4},
+			want:   4,
+		},
+		{
+			name: "own token is ahead of other partitions",
+			tokens: map[string]int64{
+				testConsumerKey + "/0-of-3": 9,
+				testConsumerKey + "/0-of-2": 7,
+				testConsumerKey + "/1-of-2": 4,
+			},
+			want: 9,
+		},
+		{
+			name: "stale own token of an earlier resize",
+			tokens: map[string]int64{
+				testConsumerKey:             2,
+				testConsumerKey + "/0-of-3": 3,
+				testConsumerKey + "/0-of-2": 8,
+				testConsumerKey + "/1-of-2": 6,
+			},
+			want: 6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memoryStore{Storage: memory.New(utils.UTCClock())}
+			for key, seq := range tt.tokens {
+				require.NoError(t, store.SaveChangeStreamToken(t.Context(), key, seqToken(t, seq)))
+			}
+
+			// tokens of other groups are ignored
+			require.NoError(t, store.SaveChangeStreamToken(t.Context(), "other/0-of-2", seqToken(t, 1)))
+
+			consumer := New(
+				store, &recordingHandler{}, Fail, 10, time.Minute, testConsumerKey, FallbackFail, time.Time{}, partition,
+			)
+
+			token, err := consumer.loadToken(t.Context())
+			require.NoError(t, err)
+
+			if tt.want == 0 {
+				assert.Empty(t, token)
+				return
+			}
+
+			assert.Equal(t, seqToken(t, tt.want), token)
+		})
+	}
+}
+
+func TestConsumerSavesTokenOfIdlePartition(t *testing.T) {
+	store := &memoryStore{Storage: memory.New(utils.UTCClock())}
+	partition := repo.Partition{Index: 0, Count: 2}
+
+	consumer := New(
+		store, &recordingHandler{}, Fail, 10, time.Millisecond*10, testConsumerKey, FallbackFail, time.Time{}, partition,
+	)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- consumer.Start(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// the event is of another partition, but the token still moves past it
+	event := testRawEvent("e1", repo.EventKindStageStarted, time.Now().UTC())
+	for i := 0; partition.Contains(event.ProcessID); i++ {
+		event.ProcessID = fmt.Sprintf("p%d", i)
+	}
+
+	// the consumer starts from now, so the event is appended until the token moves past it
+	require.Eventually(t, func() bool {
+		require.NoError(t, store.AppendRawEvents(t.Context(), []repo.Event{event}))
+
+		token, err := store.LoadChangeStreamToken(t.Context(), partition.TokenKey(testConsumerKey))
+
+		return err == nil && len(token) > 0
+	}, time.Second*5, time.Millisecond*50)
+}
+
+func TestConsumerWaitsWhileAggregateWritesArePaused(t *testing.T) {
+	store := &memoryStore{Storage: memory.New(utils.UTCClock())}
+	h := &recordingHandler{}
+
+	consumer := New(
+		store, h, Fail, 10, time.Minute, testConsumerKey, FallbackFail, time.Time{}, repo.Partition{},
+	)
+
+	store.paused.Store(true)
+
+	event := testRawEvent("e1", repo.EventKindStageStarted, time.Now())
+	require.NoError(t, consumer.handleRecord(t.Context(), event, bson.Raw("1")))
+
+	// the batch is kept and its token is not saved
+	require.NoError(t, consumer.Flush(t.Context()))
+	assert.Empty(t, h.batches)
+
+	_, err := store.LoadChangeStreamToken(t.Context(), testConsumerKey)
+	require.Error(t, err)
+
+	store.paused.Store(false)
+	require.NoError(t, consumer.Flush(t.Context()))
+	require.Len(t, h.batches, 1)
+
+	token, err := store.LoadChangeStreamToken(t.Context(), testConsumerKey)
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw("1"), token)
+}
@@ -1,18 +1,58 @@
 package mongodbchangestreamconsumer
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
 	"time"
 
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/sqlite"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
 	"github.com/caarlos0/env/v11"
 )
 
 type config struct {
-	HealthCheckAddr string `env:"HEALTH_CHECK_ADDR"`
+	// HealthCheckAddr is an address of `/healthz` and `/readyz` endpoints, empty value disables them.
+	HealthCheckAddr    string        `env:"HEALTH_CHECK_ADDR"    envDefault:":8081"`
+	HealthCheckTimeout time.Duration `env:"HEALTH_CHECK_TIMEOUT" envDefault:"2s"`
+	// MetricsAddr is an address of the Prometheus `/metrics` endpoint, empty value disables it.
+	MetricsAddr string `env:"METRICS_ADDR" envDefault:":9090"`
+	// ShutdownTimeout limits the flush and release of partitions and closing the storage on shutdown.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
 
-	ErrorHandlingStrategy ErrorHandlingStrategy `env:"ERROR_HANDLING_STRATEGY,default:0"`
-	MaxBufferSize         int                   `env:"MAX_BUFFER_SIZE,default:1000"`
-	BufferCleanUpPeriod   time.Duration         `env:"BUFFER_CLEANUP_PERIOD,default:5s"`
-	ConsumerKey           string                `env:"CONSUMER_KEY,default:all_in_one"`
+	Tracing tracing.Config
+
+	// StorageBackend is mongodb or sqlite, it must be the storage of the API.
+	StorageBackend repo.StorageBackend `env:"STORAGE_BACKEND" envDefault:"mongodb"`
+	SQLite         sqlite.Config
+
+	GroupConfig
+}
+
+// GroupConfig configures the consumer group, see NewConsumerGroup.
+type GroupConfig struct {
+	// MaxTokenAge is how long received events may stay not flushed before the consumer is not ready.
+	MaxTokenAge time.Duration `env:"HEALTH_MAX_TOKEN_AGE" envDefault:"1m"`
+
+	ErrorHandlingStrategy ErrorHandlingStrategy `env:"ERROR_HANDLING_STRATEGY" envDefault:"0"`
+	MaxBufferSize         int                   `env:"MAX_BUFFER_SIZE"         envDefault:"1000"`
+	BufferCleanUpPeriod   time.Duration         `env:"BUFFER_CLEANUP_PERIOD"   envDefault:"5s"`
+	ConsumerKey           string                `env:"CONSUMER_KEY"            envDefault:"all_in_one"`
+
+	// Partitions is the number of ProcessID hash ranges, every instance consumes the partitions it leases.
+	// Changing it starts new partitions from the oldest token of the previous number of partitions.
+	Partitions int `env:"PARTITIONS" envDefault:"1"`
+	// InstanceID identifies the instance in the group, it is generated if empty.
+	InstanceID string        `env:"INSTANCE_ID"`
+	LeaseTTL   time.Duration `env:"LEASE_TTL"   envDefault:"15s"`
+
+	// OnExpiredToken is what to do if the saved token is not in the oplog anymore: fail, now or timestamp.
+	OnExpiredToken ExpiredTokenFallback `env:"ON_EXPIRED_TOKEN" envDefault:"fail"`
+	// FallbackFrom is where the stream starts for the `timestamp` fallback (RFC 3339).
+	FallbackFrom time.Time `env:"FALLBACK_FROM"`
 }
 
 func parseConfig() (config, error) {
@@ -21,5 +61,38 @@ func parseConfig() (config, error) {
 		return cfg, err
 	}
 
-	return cfg, nil
+	if !isValidStorageBackend(cfg.StorageBackend) {
+		return cfg, fmt.Errorf("STORAGE_BACKEND must be one of mongodb, sqlite, got %q", cfg.StorageBackend)
+	}
+
+	return cfg, cfg.GroupConfig.Validate()
+}
+
+// Validate checks values which env tags can't.
+func (c GroupConfig) Validate() error {
+	if c.Partitions < 1 {
+		return fmt.Errorf("PARTITIONS must be positive, got %d", c.Partitions)
+	}
+
+	if !c.OnExpiredToken.IsValid() {
+		return fmt.Errorf("ON_EXPIRED_TOKEN must be one of fail, now, timestamp, got %q", c.OnExpiredToken)
+	}
+
+	if c.OnExpiredToken == FallbackTimestamp && c.FallbackFrom.IsZero() {
+		return errors.New("FALLBACK_FROM must be set for the timestamp fallback")
+	}
+
+	return nil
+}
+
+func generateInstanceID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return hostname + "-" + hex.EncodeToString(suffix), nil
 }
@@ -0,0 +1,36 @@
+package mongodbchangestreamconsumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CheckStream fails if the change stream is not watched.
+func (c *Consumer) CheckStream(context.Context) error {
+	if !c.streamRunning.Load() {
+		return errors.New("change stream is not running")
+	}
+
+	return nil
+}
+
+// CheckTokenAge returns a check which fails if received events are not flushed (and so the token is not saved)
+// for longer than maxAge. An idle consumer has nothing to flush, so its token may be of any age.
+func (c *Consumer) CheckTokenAge(maxAge time.Duration) func(context.Context) error {
+	return func(context.Context) error {
+		pendingSince := c.buffer.PendingSince()
+
+		if pendingSince.IsZero() {
+			return nil
+		}
+
+		age := time.Since(pendingSince)
+		if age > maxAge {
+			return fmt.Errorf("events are not flushed for %s, max is %s", age.Round(time.Second), maxAge)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,87 @@
+package mongodbchangestreamconsumer
+
+import (
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	receivedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "received_events_total",
+		Help:      "Raw events received from the change stream.",
+	})
+
+	bufferSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "buffer_size",
+		Help:      "Number of events waiting in the buffer by partition.",
+	}, []string{"partition"})
+
+	ownedPartitions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "owned_partitions",
+		Help:      "Number of partitions leased by this instance.",
+	})
+
+	lostLeases = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "lost_leases_total",
+		Help:      "Partitions which were taken over before this instance released them.",
+	})
+
+	bufferCapacity = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "buffer_capacity",
+		Help:      "Number of buffered events which triggers a flush.",
+	})
+
+	flushBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "flush_batch_size",
+		Help:      "Number of events handled by one flush.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	})
+
+	flushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "flush_duration_seconds",
+		Help:      "Duration of HandleEvents of one flush by status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"status"})
+
+	deadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "dead_letters_total",
+		Help:      "Events sent to the DLQ.",
+	})
+
+	handlingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "consumer",
+		Name:      "errors_total",
+		Help:      "Errors of events handling by the configured error handling strategy.",
+	}, []string{"strategy"})
+)
+
+func (s ErrorHandlingStrategy) String() string {
+	switch s {
+	case LogAndSkip:
+		return "log_and_skip"
+	case SendToDLQ:
+		return "send_to_dlq"
+	case Fail:
+		return "fail"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,359 @@
+package mongodbchangestreamconsumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+)
+
+type leaseStore interface {
+	AcquireConsumerLease(
+		ctx context.Context,
+		consumerKey string,
+		partition int,
+		owner string,
+		ttl time.Duration,
+	) (bool, error)
+	ReleaseConsumerLease(ctx context.Context, consumerKey string, partition int, owner string) error
+	HeartbeatConsumerMember(ctx context.Context, consumerKey, instance string, ttl time.Duration) error
+	ListConsumerMembers(ctx context.Context, consumerKey string) ([]repo.ConsumerMember, error)
+	LeaveConsumerGroup(ctx context.Context, consumerKey, instance string) error
+}
+
+type partitionConsumer interface {
+	Start(ctx context.Context) error
+	Flush(ctx context.Context) error
+	CheckStream(ctx context.Context) error
+	CheckTokenAge(maxAge time.Duration) func(context.Context) error
+}
+
+// Group runs a consumer per partition leased by this instance.
+//
+// Every instance heartbeats its membership in the group, partitions are spread over live members
+// (the partition p belongs to the (p mod N)-th member by instance ID), so the group rebalances
+// when instances join or leave. A lease guarantees that a partition is consumed by one instance at a time:
+// an instance gives up a partition (flushing its buffer first) before another one takes it,
+// and a crashed instance's partitions are taken after its leases expire.
+type Group struct {
+	leases      leaseStore
+	newConsumer func(partition repo.Partition) partitionConsumer
+
+	key        string
+	instance   string
+	partitions int
+	leaseTTL   time.Duration
+
+	mu      sync.Mutex
+	owned   map[int]*ownedPartition
+	failed  chan error
+	running atomic.Bool
+}
+
+type ownedPartition struct {
+	consumer  partitionConsumer
+	cancel    context.CancelFunc
+	done      chan struct{}
+	renewedAt time.Time
+}
+
+func NewGroup(
+	leases leaseStore,
+	newConsumer func(partition repo.Partition) partitionConsumer,
+	key, instance string,
+	partitions int,
+	leaseTTL time.Duration,
+) *Group {
+	return &Group{
+		leases:      leases,
+		newConsumer: newConsumer,
+		key:         key,
+		instance:    instance,
+		partitions:  max(partitions, 1),
+		leaseTTL:    leaseTTL,
+		owned:       map[int]*ownedPartition{},
+		failed:      make(chan error, 1),
+	}
+}
+
+// Run rebalances partitions every third of the lease TTL until the context is done
+// or a partition consumer fails. On exit all partitions are flushed and released.
+func (g *Group) Run(ctx context.Context) error {
+	g.running.Store(true)
+	defer g.running.Store(false)
+
+	defer g.leave(context.WithoutCancel(ctx))
+
+	ticker := time.NewTicker(g.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		err := g.rebalance(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "failed to rebalance partitions", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-g.failed:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *Group) rebalance(ctx context.Context) error {
+	defer g.dropExpired(ctx)
+
+	err := g.leases.HeartbeatConsumerMember(ctx, g.key, g.instance, g.leaseTTL)
+	if err != nil {
+		return err
+	}
+
+	members, err := g.leases.ListConsumerMembers(ctx, g.key)
+	if err != nil {
+		return err
+	}
+
+	instances := make([]string, 0, len(members))
+	for _, member := range members {
+		instances = append(instances, member.Instance)
+	}
+
+	assigned := assignedPartitions(instances, g.instance, g.partitions)
+
+	g.mu.Lock()
+	owned := make([]int, 0, len(g.owned))
+	for partition := range g.owned {
+		owned = append(owned, partition)
+	}
+	g.mu.Unlock()
+
+	slices.Sort(owned)
+
+	for _, partition := range owned {
+		if !slices.Contains(assigned, partition) {
+			g.release(ctx, partition)
+			continue
+		}
+
+		ok, err := g.leases.AcquireConsumerLease(ctx, g.key, partition, g.instance, g.leaseTTL)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			g.drop(ctx, partition)
+			continue
+		}
+
+		g.mu.Lock()
+		g.owned[partition].renewedAt = time.Now()
+		g.mu.Unlock()
+	}
+
+	for _, partition := range assigned {
+		if slices.Contains(owned, partition) {
+			continue
+		}
+
+		// the previous owner may still flush the partition, it is acquired on one of the next rebalances
+		ok, err := g.leases.AcquireConsumerLease(ctx, g.key, partition, g.instance, g.leaseTTL)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			g.start(ctx, partition)
+		}
+	}
+
+	return nil
+}
+
+// assignedPartitions spreads partitions over instances, the instance is a member even if it is not listed yet.
+func assignedPartitions(instances []string, instance string, partitions int) []int {
+	if !slices.Contains(instances, instance) {
+		instances = append(slices.Clone(instances), instance)
+	}
+
+	slices.Sort(instances)
+	index := slices.Index(instances, instance)
+
+	var result []int
+
+	for partition := range partitions {
+		if partition%len(instances) == index {
+			result = append(result, partition)
+		}
+	}
+
+	return result
+}
+
+func (g *Group) start(ctx context.Context, partition int) {
+	// the consumer outlives the rebalance, it is stopped by release, drop or leave
+	partitionCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	consumer := g.newConsumer(repo.Partition{Index: partition, Count: g.partitions})
+
+	owned := &ownedPartition{
+		consumer:  consumer,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		renewedAt: time.Now(),
+	}
+
+	g.mu.Lock()
+	g.owned[partition] = owned
+	ownedPartitions.Set(float64(len(g.owned)))
+	g.mu.Unlock()
+
+	slog.InfoContext(ctx, "partition acquired", slog.Int("partition", partition), slog.String("instance", g.instance))
+
+	go func() {
+		defer close(owned.done)
+
+		err := consumer.Start(partitionCtx)
+		if partitionCtx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			err = errors.New("change stream is closed")
+		}
+
+		select {
+		case g.failed <- fmt.Errorf("consumer of partition %d failed: %w", partition, err):
+		default:
+		}
+	}()
+}
+
+// stop stops the consumer of the partition and forgets it, the lease is left as is.
+func (g *Group) stop(partition int) (partitionConsumer, bool) {
+	g.mu.Lock()
+	owned, ok := g.owned[partition]
+	delete(g.owned, partition)
+	ownedPartitions.Set(float64(len(g.owned)))
+	g.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	owned.cancel()
+	<-owned.done
+
+	return owned.consumer, true
+}
+
+// release flushes the partition and gives its lease up.
+// If the flush fails, the next owner handles the events again from the last saved token.
+func (g *Group) release(ctx context.Context, partition int) {
+	consumer, ok := g.stop(partition)
+	if !ok {
+		return
+	}
+
+	err := consumer.Flush(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to flush released partition", slog.Int("partition", partition), slog.Any("error", err))
+	}
+
+	err = g.leases.ReleaseConsumerLease(ctx, g.key, partition, g.instance)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to release partition", slog.Int("partition", partition), slog.Any("error", err))
+	}
+
+	slog.InfoContext(ctx, "partition released", slog.Int("partition", partition), slog.String("instance", g.instance))
+}
+
+// drop stops the partition without flushing, its lease is owned by another instance already.
+func (g *Group) drop(ctx context.Context, partition int) {
+	_, ok := g.stop(partition)
+	if !ok {
+		return
+	}
+
+	lostLeases.Inc()
+
+	slog.WarnContext(ctx, "partition lease is lost", slog.Int("partition", partition), slog.String("instance", g.instance))
+}
+
+// dropExpired drops partitions which were not renewed for two thirds of the TTL,
+// so they are stopped before another instance may take them.
+func (g *Group) dropExpired(ctx context.Context) {
+	g.mu.Lock()
+	var expired []int
+	for partition, owned := range g.owned {
+		if time.Since(owned.renewedAt) > g.leaseTTL*2/3 {
+			expired = append(expired, partition)
+		}
+	}
+	g.mu.Unlock()
+
+	for _, partition := range expired {
+		g.drop(ctx, partition)
+	}
+}
+
+func (g *Group) leave(ctx context.Context) {
+	g.mu.Lock()
+	owned := make([]int, 0, len(g.owned))
+	for partition := range g.owned {
+		owned = append(owned, partition)
+	}
+	g.mu.Unlock()
+
+	for _, partition := range owned {
+		g.release(ctx, partition)
+	}
+
+	err := g.leases.LeaveConsumerGroup(ctx, g.key, g.instance)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to leave consumer group", slog.Any("error", err))
+	}
+}
+
+// CheckStream fails if the group doesn't run or any of its partitions is not watched.
+func (g *Group) CheckStream(ctx context.Context) error {
+	if !g.running.Load() {
+		return errors.New("consumer group is not running")
+	}
+
+	return g.checkPartitions(func(consumer partitionConsumer) error {
+		return consumer.CheckStream(ctx)
+	})
+}
+
+// CheckTokenAge returns a check which fails if any partition doesn't flush its events for longer than maxAge.
+func (g *Group) CheckTokenAge(maxAge time.Duration) func(context.Context) error {
+	return func(ctx context.Context) error {
+		return g.checkPartitions(func(consumer partitionConsumer) error {
+			return consumer.CheckTokenAge(maxAge)(ctx)
+		})
+	}
+}
+
+func (g *Group) checkPartitions(check func(consumer partitionConsumer) error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var result error
+
+	for partition, owned := range g.owned {
+		err := check(owned.consumer)
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("partition %d: %w", partition, err))
+		}
+	}
+
+	return result
+}
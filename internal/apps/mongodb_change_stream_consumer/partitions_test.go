@@ -0,0 +1,205 @@
+package mongodbchangestreamconsumer
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/app"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignedPartitions(t *testing.T) {
+	assert.Equal(t, []int{0, 1, 2, 3}, assignedPartitions(nil, "a", 4))
+	assert.Equal(t, []int{0, 2}, assignedPartitions([]string{"b", "a"}, "a", 4))
+	assert.Equal(t, []int{1, 3}, assignedPartitions([]string{"a", "b"}, "b", 4))
+	assert.Equal(t, []int{2}, assignedPartitions([]string{"a", "b"}, "c", 4))
+}
+
+type fakeLeases struct {
+	mu      sync.Mutex
+	members []string
+	// owners of partitions, other instances are simulated by setting them directly
+	owners map[int]string
+}
+
+func (s *fakeLeases) AcquireConsumerLease(
+	_ context.Context,
+	_ string,
+	partition int,
+	owner string,
+	_ time.Duration,
+) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.owners[partition]; ok && current != owner {
+		return false, nil
+	}
+
+	s.owners[partition] = owner
+
+	return true, nil
+}
+
+func (s *fakeLeases) ReleaseConsumerLease(_ context.Context, _ string, partition int, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.owners[partition] == owner {
+		delete(s.owners, partition)
+	}
+
+	return nil
+}
+
+func (s *fakeLeases) HeartbeatConsumerMember(context.Context, string, string, time.Duration) error {
+	return nil
+}
+
+func (s *fakeLeases) ListConsumerMembers(context.Context, string) ([]repo.ConsumerMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]repo.ConsumerMember, 0, len(s.members))
+	for _, member := range s.members {
+		result = append(result, repo.ConsumerMember{Instance: member})
+	}
+
+	return result, nil
+}
+
+func (s *fakeLeases) LeaveConsumerGroup(context.Context, string, string) error {
+	return nil
+}
+
+type fakeConsumer struct {
+	mu      sync.Mutex
+	flushed bool
+}
+
+func (c *fakeConsumer) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *fakeConsumer) Flush(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushed = true
+
+	return nil
+}
+
+func (c *fakeConsumer) CheckStream(context.Context) error {
+	return nil
+}
+
+func (c *fakeConsumer) CheckTokenAge(time.Duration) func(context.Context) error {
+	return func(context.Context) error { return nil }
+}
+
+func TestGroupRebalances(t *testing.T) {
+	leases := &fakeLeases{members: []string{"a"}, owners: map[int]string{}}
+	consumers := map[int]*fakeConsumer{}
+
+	group := NewGroup(
+		leases,
+		func(partition repo.Partition) partitionConsumer {
+			assert.Equal(t, 4, partition.Count)
+
+			consumer := &fakeConsumer{}
+			consumers[partition.Index] = consumer
+
+			return consumer
+		},
+		"key",
+		"a",
+		4,
+		time.Minute,
+	)
+
+	ctx := context.Background()
+
+	require.NoError(t, group.rebalance(ctx))
+	assert.Equal(t, map[int]string{0: "a", 1: "a", 2: "a", 3: "a"}, leases.owners)
+
+	// b joins, a gives up partitions 1 and 3 after flushing them
+	leases.members = []string{"a", "b"}
+
+	require.NoError(t, group.rebalance(ctx))
+	assert.Equal(t, map[int]string{0: "a", 2: "a"}, leases.owners)
+	assert.True(t, consumers[1].flushed)
+	assert.False(t, consumers[0].flushed)
+
+	// b takes partition 0 over, a stops it without flushing
+	leases.owners[0] = "b"
+
+	require.NoError(t, group.rebalance(ctx))
+	assert.Len(t, group.owned, 1)
+	assert.False(t, consumers[0].flushed)
+
+	group.leave(ctx)
+	assert.Equal(t, map[int]string{0: "b"}, leases.owners)
+	assert.True(t, consumers[2].flushed)
+}
+
+func TestGroupIsReleasedBeforeStorageIsClosed(t *testing.T) {
+	leases := &fakeLeases{members: []string{"a"}, owners: map[int]string{}}
+	consumers := map[int]*fakeConsumer{}
+
+	group := NewGroup(
+		leases,
+		func(partition repo.Partition) partitionConsumer {
+			consumer := &fakeConsumer{}
+			consumers[partition.Index] = consumer
+
+			return consumer
+		},
+		"key",
+		"a",
+		2,
+		time.Minute,
+	)
+
+	var closedOwners map[int]string
+
+	storage := app.Component{
+		Name: "storage",
+		Stop: func(context.Context) error {
+			leases.mu.Lock()
+			defer leases.mu.Unlock()
+
+			closedOwners = maps.Clone(leases.owners)
+
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- app.New(time.Second, storage, app.Component{Name: "consumer", Run: group.Run}).Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		leases.mu.Lock()
+		defer leases.mu.Unlock()
+
+		return len(leases.owners) == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	assert.Empty(t, closedOwners)
+	assert.True(t, consumers[0].flushed)
+	assert.True(t, consumers[1].flushed)
+}
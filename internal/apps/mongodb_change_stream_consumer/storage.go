@@ -0,0 +1,64 @@
+package mongodbchangestreamconsumer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/sqlite"
+	"github.com/LastSprint/pipetank/pkg/health"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+// Storage is what the consumer needs: the raw events feed, aggregates, dead letters and partition leases.
+// It is a repo.Storage, so the API may share it within one process.
+type Storage interface {
+	repo.Storage
+	store
+	leaseStore
+}
+
+var (
+	_ Storage = (*repo.Repo)(nil)
+	_ Storage = (*sqlite.Storage)(nil)
+)
+
+func isValidStorageBackend(backend repo.StorageBackend) bool {
+	// the in-memory storage of the API is not reachable from another process
+	return backend == repo.StorageMongoDB || backend == repo.StorageSQLite
+}
+
+// OpenStorage opens the storage of the backend, mongodb or sqlite, and registers its readiness check.
+// Returns the storage and the function which closes it.
+func OpenStorage(
+	ctx context.Context,
+	backend repo.StorageBackend,
+	sqliteCfg sqlite.Config,
+	checker *health.Checker,
+) (Storage, func(context.Context) error, error) {
+	if backend == repo.StorageSQLite {
+		storage, err := sqlite.Open(ctx, sqliteCfg, utils.UTCClock())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		checker.AddReadiness("sqlite", storage.Ping)
+
+		return storage, func(context.Context) error { return storage.Close() }, nil
+	}
+
+	client, err := mdb.NewClient()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	checker.AddReadiness("mongodb", client.Ping)
+
+	rep, err := repo.NewRepo(ctx, client, utils.UTCClock())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rep, client.Close, nil
+}
@@ -0,0 +1,74 @@
+package pipelineexporter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	pipelineexporter "github.com/LastSprint/pipetank/internal/reusable/pipeline_exporter"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+func Run(ctx context.Context) error {
+	cfg, err := parseConfig()
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	for _, label := range cfg.Labels {
+		if label != "process" && label != "stage" {
+			return fmt.Errorf("unknown label %q, supported labels are process and stage", label)
+		}
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	exporter, err := pipelineexporter.NewExporter(
+		rep,
+		prometheus.DefaultRegisterer,
+		pipelineexporter.LabelsConfig{
+			Process:           slices.Contains(cfg.Labels, "process"),
+			Stage:             slices.Contains(cfg.Labels, "stage"),
+			ExecutionLabels:   cfg.ExecutionLabels,
+			MaxValuesPerLabel: cfg.MaxValuesPerLabel,
+			Processes:         cfg.Processes,
+		},
+		cfg.DurationBuckets,
+	)
+	if err != nil {
+		return fmt.Errorf("invalid exporter config: %w", err)
+	}
+
+	return utils.DieWithGrace(
+		ctx,
+		func(ctx context.Context) error {
+			group, ctx := errgroup.WithContext(ctx)
+
+			group.Go(func() error {
+				return metrics.Serve(ctx, cfg.MetricsAddr)
+			})
+
+			group.Go(func() error {
+				return exporter.Run(ctx, cfg.InFlightPeriod)
+			})
+
+			return group.Wait()
+		},
+		func(ctx context.Context) error {
+			return mdbClinet.Close(ctx)
+		},
+	)
+}
@@ -0,0 +1,32 @@
+package pipelineexporter
+
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type config struct {
+	// MetricsAddr is an address of the Prometheus `/metrics` endpoint.
+	MetricsAddr string `env:"METRICS_ADDR" envDefault:":9090"`
+
+	// Labels is a subset of `process,stage` which are exported as labels of pipeline metrics.
+	Labels []string `env:"EXPORTER_LABELS" envDefault:"process,stage"`
+	// ExecutionLabels are keys of execution labels which are exported as `label_<key>`.
+	ExecutionLabels   []string `env:"EXPORTER_EXECUTION_LABELS"`
+	MaxValuesPerLabel int      `env:"EXPORTER_MAX_VALUES_PER_LABEL" envDefault:"200"`
+	// Processes is an optional allow list of exported processes.
+	Processes []string `env:"EXPORTER_PROCESSES"`
+
+	DurationBuckets []float64     `env:"EXPORTER_DURATION_BUCKETS" envDefault:"1,5,15,30,60,120,300,600,1800,3600,7200,14400"`
+	InFlightPeriod  time.Duration `env:"EXPORTER_IN_FLIGHT_PERIOD" envDefault:"15s"`
+}
+
+func parseConfig() (config, error) {
+	cfg, err := env.ParseAs[config]()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
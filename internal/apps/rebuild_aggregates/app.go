@@ -0,0 +1,258 @@
+// Package rebuildaggregates implements a command line tool which rebuilds aggregates from the raw events log.
+//
+// Usage:
+//
+//	rebuild_aggregates start [-process ID] [-from TIME] [-to TIME] [-batch N]
+//	rebuild_aggregates resume [-batch N]
+//	rebuild_aggregates status
+//	rebuild_aggregates swap [-drain DURATION]
+//	rebuild_aggregates abort
+//
+// TIME is RFC 3339 and limits the Ts of raw events. Every execution which has a matching raw event
+// is rebuilt from all its raw events into shadow collections, one execution at a time,
+// so an interrupted rebuild is resumed from the execution it stopped at.
+// status compares the shadow aggregates with the live ones, swap replaces the live aggregates by the shadow ones.
+// swap pauses flushes of raw_events_collector and waits DURATION for the started ones before it copies
+// aggregates, an interrupted swap is finished by running it again.
+package rebuildaggregates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	raweventsconsumer "github.com/LastSprint/pipetank/internal/reusable/raw_events_consumer"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+const (
+	defaultBatchSize = 1000
+	// defaultDrain is longer than a flush of raw_events_collector takes.
+	defaultDrain = time.Second * 10
+)
+
+var errUsage = errors.New("usage: rebuild_aggregates start|resume|status|swap|abort [flags]")
+
+// Run executes the command from args (without the program name) and writes the result to out as JSON.
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	defer func() {
+		_ = mdbClinet.Close(context.WithoutCancel(ctx))
+	}()
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	cmd, err := parseFlags(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	var result any
+
+	switch args[0] {
+	case "start":
+		_, err = rep.StartRebuild(ctx, cmd.query)
+		if err == nil {
+			result, err = rebuild(ctx, rep, cmd.batchSize)
+		}
+	case "resume":
+		result, err = rebuild(ctx, rep, cmd.batchSize)
+	case "status":
+		result, err = rep.GetRebuildStatus(ctx)
+	case "swap":
+		err = rep.SwapRebuild(ctx, cmd.drain)
+		result = map[string]bool{"swapped": err == nil}
+	case "abort":
+		err = rep.AbortRebuild(ctx)
+		result = map[string]bool{"aborted": err == nil}
+	default:
+		return errUsage
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+type rebuildStore interface {
+	GetRebuild(ctx context.Context) (repo.Rebuild, error)
+	GetRebuildStatus(ctx context.Context) (repo.RebuildStatus, error)
+	NextRebuildExecution(ctx context.Context) (repo.RebuildExecution, error)
+	ResetRebuildExecution(ctx context.Context, execution repo.RebuildExecution) error
+	GetRawExecutionEvents(ctx context.Context, processID, executionID string) ([]repo.Event, error)
+	WriteRebuildAggregates(ctx context.Context, writes []repo.AggregateWrite) error
+	FinishRebuildExecution(ctx context.Context, execution repo.RebuildExecution) error
+}
+
+// shadowStore makes the service write aggregates into the shadow collections.
+type shadowStore struct {
+	store rebuildStore
+}
+
+func (s shadowStore) WriteAggregates(ctx context.Context, writes []repo.AggregateWrite) error {
+	return s.store.WriteRebuildAggregates(ctx, writes)
+}
+
+// rebuild rebuilds executions which are not rebuilt yet, it is the same aggregation as the consumer does.
+func rebuild(ctx context.Context, store rebuildStore, batchSize int) (repo.RebuildStatus, error) {
+	_, err := store.GetRebuild(ctx)
+	if err != nil {
+		return repo.RebuildStatus{}, err
+	}
+
+	service := raweventsconsumer.NewService(shadowStore{store: store})
+
+	for {
+		execution, err := store.NextRebuildExecution(ctx)
+		if errors.Is(err, oerrs.ErrNotFound) {
+			break
+		}
+
+		if err != nil {
+			return repo.RebuildStatus{}, err
+		}
+
+		err = rebuildExecution(ctx, store, service, execution, batchSize)
+		if err != nil {
+			return repo.RebuildStatus{}, fmt.Errorf(
+				"failed to rebuild %s/%s: %w",
+				execution.ProcessID,
+				execution.ExecutionID,
+				err,
+			)
+		}
+	}
+
+	return store.GetRebuildStatus(ctx)
+}
+
+func rebuildExecution(
+	ctx context.Context,
+	store rebuildStore,
+	service *raweventsconsumer.Service,
+	execution repo.RebuildExecution,
+	batchSize int,
+) error {
+	// the execution may be partially rebuilt by an interrupted run
+	err := store.ResetRebuildExecution(ctx, execution)
+	if err != nil {
+		return err
+	}
+
+	events, err := store.GetRawExecutionEvents(ctx, execution.ProcessID, execution.ExecutionID)
+	if err != nil {
+		return err
+	}
+
+	for i := range events {
+		// events which were aggregated by the API are aggregated again, the mark must not get into aggregates
+		events[i].Aggregated = false
+	}
+
+	for batch := range slices.Chunk(events, batchSize) {
+		err = service.HandleEvents(ctx, batch)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = store.FinishRebuildExecution(ctx, execution)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(
+		ctx,
+		"rebuilt execution",
+		slog.String("process_id", execution.ProcessID),
+		slog.String("execution_id", execution.ExecutionID),
+		slog.Int("events", len(events)),
+	)
+
+	return nil
+}
+
+type command struct {
+	query     repo.RebuildQuery
+	batchSize int
+	drain     time.Duration
+}
+
+func parseFlags(name string, args []string) (command, error) {
+	var (
+		cmd      command
+		from, to string
+	)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.IntVar(&cmd.batchSize, "batch", defaultBatchSize, "max number of events aggregated at once")
+
+	if name == "swap" {
+		flags.DurationVar(&cmd.drain, "drain", defaultDrain, "time flushes started before the pause are given")
+	}
+
+	if name == "start" {
+		flags.StringVar(&cmd.query.ProcessID, "process", "", "optional ProcessID filter")
+		flags.StringVar(&from, "from", "", "optional RFC 3339 time, raw events at or after it")
+		flags.StringVar(&to, "to", "", "optional RFC 3339 time, raw events before it")
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return cmd, err
+	}
+
+	if cmd.batchSize <= 0 {
+		return cmd, fmt.Errorf("invalid -batch %d: must be positive", cmd.batchSize)
+	}
+
+	cmd.query.From, err = parseTime("from", from)
+	if err != nil {
+		return cmd, err
+	}
+
+	cmd.query.To, err = parseTime("to", to)
+	if err != nil {
+		return cmd, err
+	}
+
+	return cmd, nil
+}
+
+func parseTime(name, value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s %q: %w", name, value, err)
+	}
+
+	return result, nil
+}
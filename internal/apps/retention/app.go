@@ -0,0 +1,40 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/reusable/retention"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+func Run(ctx context.Context) error {
+	cfg, err := parseConfig()
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	stamper := retention.NewStamper(rep, utils.UTCClock())
+
+	return utils.DieWithGrace(
+		ctx,
+		func(ctx context.Context) error {
+			return stamper.Run(ctx, cfg.Period)
+		},
+		func(ctx context.Context) error {
+			return mdbClinet.Close(ctx)
+		},
+	)
+}
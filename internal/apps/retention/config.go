@@ -0,0 +1,21 @@
+package retention
+
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type config struct {
+	// Period is how often changed retention policies are looked for.
+	Period time.Duration `env:"RETENTION_STAMP_PERIOD" envDefault:"1m"`
+}
+
+func parseConfig() (config, error) {
+	cfg, err := env.ParseAs[config]()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
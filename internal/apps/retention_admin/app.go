@@ -0,0 +1,155 @@
+// Package retentionadmin implements a command line tool which manages per-process retention policies.
+//
+// Usage:
+//
+//	retention_admin set -process ID [-raw-events DURATION] [-stage-executions DURATION]
+//	retention_admin list
+//	retention_admin delete -process ID
+//
+// A missing period is taken from the default policy (RAW_EVENTS_TTL_SECONDS and STAGE_EXECUTIONS_TTL_SECONDS).
+// New documents get the changed policy within a minute, existing ones are stamped by the retention app.
+// Policies don't apply to stage logs, they always expire after STAGE_LOGS_TTL_SECONDS.
+package retentionadmin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+var (
+	errUsage     = errors.New("usage: retention_admin set|list|delete [flags]")
+	errNoProcess = errors.New("-process is required")
+)
+
+// Run executes the command from args (without the program name) and writes the result to out as JSON.
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	defer func() {
+		_ = mdbClinet.Close(context.WithoutCancel(ctx))
+	}()
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	var result any
+
+	switch args[0] {
+	case "set":
+		result, err = set(ctx, rep, args[1:])
+	case "list":
+		result, err = list(ctx, rep)
+	case "delete":
+		result, err = deletePolicy(ctx, rep, args[1:])
+	default:
+		return errUsage
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+// policyView is a policy with human readable periods, zero periods are the default ones.
+type policyView struct {
+	ProcessID       string    `json:"processId"`
+	RawEvents       string    `json:"rawEvents"`
+	StageExecutions string    `json:"stageExecutions"`
+	Deleted         bool      `json:"deleted,omitempty"`
+	Stamped         bool      `json:"stamped"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+func newPolicyView(policy repo.RetentionPolicy) policyView {
+	return policyView{
+		ProcessID:       policy.ProcessID,
+		RawEvents:       policy.RawEvents.String(),
+		StageExecutions: policy.StageExecutions.String(),
+		Deleted:         policy.Deleted,
+		Stamped:         policy.IsStamped(),
+		UpdatedAt:       policy.UpdatedAt,
+	}
+}
+
+func set(ctx context.Context, rep *repo.Repo, args []string) (policyView, error) {
+	var policy repo.RetentionPolicy
+
+	flags := flag.NewFlagSet("set", flag.ContinueOnError)
+	flags.StringVar(&policy.ProcessID, "process", "", "ProcessID")
+	flags.DurationVar(&policy.RawEvents, "raw-events", 0, "optional retention of raw events, e.g. 8760h")
+	flags.DurationVar(
+		&policy.StageExecutions, "stage-executions", 0, "optional retention of aggregates, not stage logs, e.g. 72h",
+	)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return policyView{}, err
+	}
+
+	policy, err = rep.SetRetentionPolicy(ctx, policy)
+	if err != nil {
+		return policyView{}, err
+	}
+
+	return newPolicyView(policy), nil
+}
+
+func list(ctx context.Context, rep *repo.Repo) ([]policyView, error) {
+	policies, err := rep.ListRetentionPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]policyView, 0, len(policies))
+	for _, policy := range policies {
+		result = append(result, newPolicyView(policy))
+	}
+
+	return result, nil
+}
+
+func deletePolicy(ctx context.Context, rep *repo.Repo, args []string) (map[string]bool, error) {
+	var processID string
+
+	flags := flag.NewFlagSet("delete", flag.ContinueOnError)
+	flags.StringVar(&processID, "process", "", "ProcessID")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(processID) == 0 {
+		return nil, errNoProcess
+	}
+
+	err = rep.DeleteRetentionPolicy(ctx, processID)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]bool{"deleted": true}, nil
+}
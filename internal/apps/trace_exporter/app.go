@@ -0,0 +1,56 @@
+package traceexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	traceexporter "github.com/LastSprint/pipetank/internal/reusable/trace_exporter"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+const serviceName = "pipetank-executions"
+
+func Run(ctx context.Context) error {
+	cfg, err := parseConfig()
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	spanExporter, err := tracing.NewSpanExporter(ctx, cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("failed to create span exporter: %w", err)
+	}
+
+	if spanExporter == nil {
+		return fmt.Errorf("TRACING_EXPORTER must not be %q", tracing.ExporterNone)
+	}
+
+	res, err := tracing.NewResource(serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	exporter := traceexporter.NewExporter(rep, spanExporter, res, cfg.ConsumerKey)
+
+	return utils.DieWithGrace(
+		ctx,
+		exporter.Run,
+		func(ctx context.Context) error {
+			return errors.Join(exporter.Shutdown(ctx), mdbClinet.Close(ctx))
+		},
+	)
+}
@@ -0,0 +1,23 @@
+package traceexporter
+
+import (
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
+	"github.com/caarlos0/env/v11"
+)
+
+type config struct {
+	// Tracing configures where execution traces are sent, `none` is not allowed.
+	Tracing tracing.Config
+
+	// ConsumerKey is a key of the saved change stream token, exporters with the same key share progress.
+	ConsumerKey string `env:"TRACE_EXPORTER_CONSUMER_KEY" envDefault:"trace_exporter"`
+}
+
+func parseConfig() (config, error) {
+	cfg, err := env.ParseAs[config]()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
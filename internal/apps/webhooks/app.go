@@ -0,0 +1,66 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/reusable/webhooks"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"golang.org/x/sync/errgroup"
+)
+
+func Run(ctx context.Context) error {
+	cfg, err := parseConfig()
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	dispatcher := webhooks.NewDispatcher(
+		rep,
+		utils.UTCClock(),
+		cfg.ConsumerKey,
+		cfg.SubscriptionsRefreshPeriod,
+	)
+
+	sender := webhooks.NewSender(
+		rep,
+		&http.Client{Timeout: cfg.Timeout},
+		utils.UTCClock(),
+		webhooks.Backoff{Initial: cfg.BackoffInitial, Max: cfg.BackoffMax},
+		cfg.MaxAttempts,
+		2*cfg.Timeout,
+	)
+
+	return utils.DieWithGrace(
+		ctx,
+		func(ctx context.Context) error {
+			group, ctx := errgroup.WithContext(ctx)
+
+			group.Go(func() error {
+				return dispatcher.Run(ctx)
+			})
+
+			group.Go(func() error {
+				return sender.Run(ctx, cfg.Workers, cfg.PollPeriod)
+			})
+
+			return group.Wait()
+		},
+		func(ctx context.Context) error {
+			return mdbClinet.Close(ctx)
+		},
+	)
+}
@@ -0,0 +1,30 @@
+package webhooks
+
+import (
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type config struct {
+	// ConsumerKey is a key of the saved change stream token, deliveries are resumed from it after a restart.
+	ConsumerKey                string        `env:"WEBHOOKS_CONSUMER_KEY"                envDefault:"webhooks"`
+	SubscriptionsRefreshPeriod time.Duration `env:"WEBHOOKS_SUBSCRIPTIONS_REFRESH_PERIOD" envDefault:"10s"`
+
+	Workers     int           `env:"WEBHOOKS_WORKERS"      envDefault:"4"`
+	PollPeriod  time.Duration `env:"WEBHOOKS_POLL_PERIOD"  envDefault:"1s"`
+	Timeout     time.Duration `env:"WEBHOOKS_TIMEOUT"      envDefault:"10s"`
+	MaxAttempts int           `env:"WEBHOOKS_MAX_ATTEMPTS" envDefault:"10"`
+
+	BackoffInitial time.Duration `env:"WEBHOOKS_BACKOFF_INITIAL" envDefault:"5s"`
+	BackoffMax     time.Duration `env:"WEBHOOKS_BACKOFF_MAX"     envDefault:"1h"`
+}
+
+func parseConfig() (config, error) {
+	cfg, err := env.ParseAs[config]()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
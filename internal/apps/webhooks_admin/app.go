@@ -0,0 +1,251 @@
+// Package webhooksadmin implements a command line tool which manages webhook subscriptions
+// and shows their delivery log.
+//
+// Usage:
+//
+//	webhooks_admin add -name NAME -url URL -secret SECRET [-process ID] [-stage NAME] [-events a,b] [-labels SELECTOR]
+//	webhooks_admin list
+//	webhooks_admin delete -id ID
+//	webhooks_admin deliveries -id ID [-limit N]
+package webhooksadmin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var errUsage = errors.New("usage: webhooks_admin add|list|delete|deliveries [flags]")
+
+// Run executes the command from args (without the program name) and writes the result to out as JSON.
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	mdbClinet, err := mdb.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	defer func() {
+		_ = mdbClinet.Close(context.WithoutCancel(ctx))
+	}()
+
+	rep, err := repo.NewRepo(ctx, mdbClinet, utils.UTCClock())
+	if err != nil {
+		return err
+	}
+
+	var result any
+
+	switch args[0] {
+	case "add":
+		result, err = add(ctx, rep, args[1:])
+	case "list":
+		result, err = list(ctx, rep)
+	case "delete":
+		result, err = deleteSubscription(ctx, rep, args[1:])
+	case "deliveries":
+		result, err = deliveries(ctx, rep, args[1:])
+	default:
+		return errUsage
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+// subscriptionView is a subscription without its secret.
+type subscriptionView struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	URL           string    `json:"url"`
+	ProcessID     string    `json:"processId,omitempty"`
+	StageName     string    `json:"stageName,omitempty"`
+	Events        []string  `json:"events,omitempty"`
+	LabelSelector string    `json:"labelSelector,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+func newSubscriptionView(subscription repo.WebhookSubscription) subscriptionView {
+	view := subscriptionView{
+		ID:            subscription.ID.Hex(),
+		Name:          subscription.Name,
+		URL:           subscription.URL,
+		ProcessID:     subscription.ProcessID,
+		StageName:     subscription.StageName,
+		LabelSelector: subscription.LabelSelector,
+		CreatedAt:     subscription.CreatedAt,
+	}
+
+	for _, event := range subscription.Events {
+		view.Events = append(view.Events, string(event))
+	}
+
+	return view
+}
+
+func list(ctx context.Context, rep *repo.Repo) ([]subscriptionView, error) {
+	stored, err := rep.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]subscriptionView, 0, len(stored))
+	for _, subscription := range stored {
+		result = append(result, newSubscriptionView(subscription))
+	}
+
+	return result, nil
+}
+
+func add(ctx context.Context, rep *repo.Repo, args []string) (subscriptionView, error) {
+	var (
+		subscription repo.WebhookSubscription
+		events       string
+	)
+
+	flags := flag.NewFlagSet("add", flag.ContinueOnError)
+	flags.StringVar(&subscription.Name, "name", "", "name of the subscription")
+	flags.StringVar(&subscription.URL, "url", "", "endpoint which receives webhooks")
+	flags.StringVar(&subscription.Secret, "secret", "", "key of HMAC-SHA256 payload signature")
+	flags.StringVar(&subscription.ProcessID, "process", "", "optional ProcessID filter")
+	flags.StringVar(&subscription.StageName, "stage", "", "optional stage name filter")
+	flags.StringVar(&events, "events", "", "optional comma separated events filter, e.g. stage.failed,execution.failed")
+	flags.StringVar(&subscription.LabelSelector, "labels", "", "optional label selector, e.g. env=prod")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return subscriptionView{}, err
+	}
+
+	for event := range strings.SplitSeq(events, ",") {
+		event = strings.TrimSpace(event)
+		if len(event) > 0 {
+			subscription.Events = append(subscription.Events, repo.WebhookEventType(event))
+		}
+	}
+
+	subscription, err = rep.CreateWebhookSubscription(ctx, subscription)
+	if err != nil {
+		return subscriptionView{}, err
+	}
+
+	return newSubscriptionView(subscription), nil
+}
+
+func deleteSubscription(ctx context.Context, rep *repo.Repo, args []string) (map[string]string, error) {
+	id, _, err := parseIDFlags("delete", args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rep.DeleteWebhookSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"deleted": id.Hex()}, nil
+}
+
+type deliveryView struct {
+	ID             string          `json:"id"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt,omitzero"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DeliveredAt    time.Time       `json:"deliveredAt,omitzero"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+func deliveries(ctx context.Context, rep *repo.Repo, args []string) ([]deliveryView, error) {
+	id, limit, err := parseIDFlags("deliveries", args)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := rep.ListWebhookDeliveries(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]deliveryView, 0, len(stored))
+
+	for _, delivery := range stored {
+		view := deliveryView{
+			ID:             delivery.ID,
+			Event:          string(delivery.Event),
+			Status:         deliveryStatusName(delivery.Status),
+			Attempts:       delivery.Attempts,
+			LastStatusCode: delivery.LastStatusCode,
+			LastError:      delivery.LastError,
+			CreatedAt:      delivery.CreatedAt,
+			DeliveredAt:    delivery.DeliveredAt,
+			Payload:        delivery.Payload,
+		}
+
+		if delivery.Status == repo.WebhookDeliveryPending {
+			view.NextAttemptAt = delivery.NextAttemptAt
+		}
+
+		result = append(result, view)
+	}
+
+	return result, nil
+}
+
+func parseIDFlags(command string, args []string) (bson.ObjectID, int64, error) {
+	var (
+		id    string
+		limit int64
+	)
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&id, "id", "", "subscription ID")
+	flags.Int64Var(&limit, "limit", 50, "max number of records")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return bson.ObjectID{}, 0, err
+	}
+
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return bson.ObjectID{}, 0, fmt.Errorf("invalid subscription id %q: %w", id, err)
+	}
+
+	return objectID, limit, nil
+}
+
+func deliveryStatusName(status repo.WebhookDeliveryStatus) string {
+	switch status {
+	case repo.WebhookDeliveryPending:
+		return "pending"
+	case repo.WebhookDeliveryDelivered:
+		return "delivered"
+	case repo.WebhookDeliveryFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
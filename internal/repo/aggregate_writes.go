@@ -0,0 +1,262 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// AggregateWriteKind is the kind of AggregateWrite.
+type AggregateWriteKind string
+
+const (
+	// AggregateWriteMergeExecution creates or updates the execution aggregate:
+	// labels are merged, FirstEventAt and LastEventAt are widened to include the given ones.
+	AggregateWriteMergeExecution AggregateWriteKind = "merge_execution"
+	// AggregateWriteMergeStageExecution creates or updates the stage execution aggregate with the events
+	// of one stage execution, the result doesn't depend on the order the events arrive in.
+	AggregateWriteMergeStageExecution AggregateWriteKind = "merge_stage_execution"
+)
+
+// aggregateCollections are the collections WriteAggregates writes to.
+type aggregateCollections struct {
+	stageExecutions string
+	executions      string
+}
+
+var (
+	liveAggregateCollections = aggregateCollections{
+		stageExecutions: collectionNameSingleStageExec,
+		executions:      collectionNameExecutionAggregates,
+	}
+	rebuildAggregateCollections = aggregateCollections{
+		stageExecutions: collectionNameRebuildSingleStageExec,
+		executions:      collectionNameRebuildExecutionAggregates,
+	}
+)
+
+// AggregateWrite is one operation of WriteAggregates.
+type AggregateWrite struct {
+	Kind AggregateWriteKind
+	// Events are the events of the stage execution sorted by Ts, the write is built from them.
+	// They are reported by AggregateWriteError if the write fails. AggregateWriteMergeExecution has no events:
+	// stage writes of the execution follow it, so its events are reported by them once.
+	Events []Event
+	// Execution is set for AggregateWriteMergeExecution.
+	Execution ExecutionAggregate
+}
+
+func MergeExecutionWrite(execution ExecutionAggregate) AggregateWrite {
+	return AggregateWrite{Kind: AggregateWriteMergeExecution, Execution: execution}
+}
+
+func MergeStageExecutionWrite(events []Event) AggregateWrite {
+	return AggregateWrite{Kind: AggregateWriteMergeStageExecution, Events: events}
+}
+
+func (w AggregateWrite) String() string {
+	if w.Kind == AggregateWriteMergeExecution {
+		return fmt.Sprintf("%s %s/%s", w.Kind, w.Execution.ProcessID, w.Execution.ExecutionID)
+	}
+
+	if len(w.Events) == 0 {
+		return string(w.Kind)
+	}
+
+	event := w.Events[0]
+
+	return fmt.Sprintf("%s %s/%s/%s", w.Kind, event.ProcessID, event.ExecutionID, event.StageExecutionID)
+}
+
+// AggregateWriteError is the error of one write of WriteAggregates.
+type AggregateWriteError struct {
+	// Index is the index of the write in the batch.
+	Index int
+	Write AggregateWrite
+	Err   error
+}
+
+func (e *AggregateWriteError) Error() string {
+	return fmt.Sprintf("write %d (%s): %v", e.Index, e.Write, e.Err)
+}
+
+func (e *AggregateWriteError) Unwrap() error {
+	return e.Err
+}
+
+// FailedEvents returns events of the failed writes if err consists of AggregateWriteError only.
+// Otherwise it returns false, and it is unknown which events are applied.
+// It returns false if the failed writes have no events too, e.g. only the merge of an execution failed.
+func FailedEvents(err error) ([]Event, bool) {
+	events, ok := failedEvents(err)
+	if !ok || len(events) == 0 {
+		return nil, false
+	}
+
+	return events, true
+}
+
+func failedEvents(err error) ([]Event, bool) {
+	//nolint:errorlint // it walks the errors returned by WriteAggregates, they are not wrapped
+	switch err := err.(type) {
+	case *AggregateWriteError:
+		return err.Write.Events, true
+	case interface{ Unwrap() []error }:
+		var result []Event
+
+		for _, err := range err.Unwrap() {
+			events, ok := failedEvents(err)
+			if !ok {
+				return nil, false
+			}
+
+			result = append(result, events...)
+		}
+
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
+// WriteAggregates applies the writes in the given order in one round trip (a client bulk write, MongoDB 8.0+).
+// A failed write stops the batch, so the following writes fail too.
+// Errors:
+// - joined *AggregateWriteError: the writes which failed or were not applied.
+// - oerrs.ErrBadInput: if the default retention periods are not configured.
+// - oerrs.ErrInternal: if the batch failed as a whole.
+func (r *Repo) WriteAggregates(ctx context.Context, writes []AggregateWrite) error {
+	return r.writeAggregates(ctx, liveAggregateCollections, writes)
+}
+
+func (r *Repo) writeAggregates(ctx context.Context, collections aggregateCollections, writes []AggregateWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	retention, err := r.retentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := r.clock()
+	db := r.client.DB().Name()
+	models := make([]mongo.ClientBulkWrite, 0, len(writes))
+
+	for _, write := range writes {
+		models = append(models, aggregateWriteModel(db, collections, write, now, retention))
+	}
+
+	result, err := r.client.
+		Client().
+		BulkWrite(ctx, models, options.ClientBulkWrite().SetOrdered(true).SetVerboseResults(true))
+
+	return aggregateWriteErrors(ctx, writes, result, err)
+}
+
+func aggregateWriteModel(
+	db string,
+	collections aggregateCollections,
+	write AggregateWrite,
+	now time.Time,
+	retention retentionPolicies,
+) mongo.ClientBulkWrite {
+	if write.Kind == AggregateWriteMergeExecution {
+		expireAt := now.Add(retention.of(write.Execution.ProcessID).StageExecutions)
+
+		return mongo.ClientBulkWrite{
+			Database:   db,
+			Collection: collections.executions,
+			Model: mongo.NewClientUpdateOneModel().
+				SetFilter(executionAggregateFilter(write.Execution.ProcessID, write.Execution.ExecutionID)).
+				SetUpdate(mergeExecutionUpdate(write.Execution, now, expireAt)).
+				SetUpsert(true),
+		}
+	}
+
+	event := write.Events[0]
+	expireAt := now.Add(retention.of(event.ProcessID).StageExecutions)
+	model := mongo.NewClientUpdateOneModel().
+		SetFilter(getSingleStageExecutionFilter(event.ProcessID, event.ExecutionID, event.StageExecutionID)).
+		SetUpdate(stageExecutionUpdate(write.Events, now, expireAt)).
+		SetUpsert(true)
+
+	return mongo.ClientBulkWrite{
+		Database:   db,
+		Collection: collections.stageExecutions,
+		Model:      model,
+	}
+}
+
+// aggregateWriteErrors maps results of the bulk write back to the writes.
+func aggregateWriteErrors(
+	ctx context.Context,
+	writes []AggregateWrite,
+	result *mongo.ClientBulkWriteResult,
+	err error,
+) error {
+	var writeErrors map[int]mongo.WriteError
+
+	// the batch is ordered, so it stops at the first failed write
+	stoppedAt := len(writes)
+
+	if err != nil {
+		var bulkErr mongo.ClientBulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		writeErrors = bulkErr.WriteErrors
+		result = bulkErr.PartialResult
+
+		for index := range writeErrors {
+			stoppedAt = min(stoppedAt, index)
+		}
+	}
+
+	var errs []error
+
+	for i, write := range writes {
+		var writeErr error
+
+		switch {
+		case i == stoppedAt:
+			writeErr = oerrs.NewTErr(ctx, writeErrors[i], oerrs.ErrInternal)
+		case i > stoppedAt:
+			writeErr = oerrs.NewTErrf(ctx, "not applied because write %d failed: %w", stoppedAt, oerrs.ErrInternal)
+		default:
+			writeErr = checkAggregateWriteResult(ctx, i, result)
+		}
+
+		if writeErr != nil {
+			errs = append(errs, &AggregateWriteError{Index: i, Write: write, Err: writeErr})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkAggregateWriteResult fails if the write neither matched nor upserted a document.
+func checkAggregateWriteResult(ctx context.Context, index int, result *mongo.ClientBulkWriteResult) error {
+	var updateResult mongo.ClientBulkWriteUpdateResult
+
+	ok := false
+	if result != nil {
+		updateResult, ok = result.UpdateResults[index]
+	}
+
+	if !ok {
+		return oerrs.NewTErrf(ctx, "no result of the write: %w", oerrs.ErrInternal)
+	}
+
+	if updateResult.MatchedCount == 0 && updateResult.UpsertedID == nil {
+		return oerrs.NewTErrf(ctx, "the write matched nothing: %w", oerrs.ErrInternal)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func testAggregateWrites() []AggregateWrite {
+	start := Event{ProcessID: "p1", ExecutionID: "e1", StageExecutionID: "s1", Kind: EventKindStageStarted}
+	update := Event{ProcessID: "p1", ExecutionID: "e1", StageExecutionID: "s1", Kind: EventKindGenericUpdate}
+	finish := Event{ProcessID: "p1", ExecutionID: "e1", StageExecutionID: "s2", Kind: EventKindStageFinished}
+	other := Event{ProcessID: "p1", ExecutionID: "e2", StageExecutionID: "s1", Kind: EventKindStageStarted}
+
+	return []AggregateWrite{
+		MergeExecutionWrite(ExecutionAggregate{ProcessID: "p1", ExecutionID: "e1"}),
+		MergeStageExecutionWrite([]Event{start, update}),
+		MergeStageExecutionWrite([]Event{finish}),
+		MergeExecutionWrite(ExecutionAggregate{ProcessID: "p1", ExecutionID: "e2"}),
+		MergeStageExecutionWrite([]Event{other}),
+	}
+}
+
+func TestAggregateWriteErrors(t *testing.T) {
+	ctx := context.Background()
+	writes := testAggregateWrites()
+
+	t.Run("all applied", func(t *testing.T) {
+		result := &mongo.ClientBulkWriteResult{UpdateResults: map[int]mongo.ClientBulkWriteUpdateResult{
+			0: {UpsertedID: "id"},
+			1: {MatchedCount: 1},
+			2: {MatchedCount: 1},
+			3: {UpsertedID: "id"},
+			4: {MatchedCount: 1},
+		}}
+
+		assert.NoError(t, aggregateWriteErrors(ctx, writes, result, nil))
+	})
+
+	t.Run("matched nothing", func(t *testing.T) {
+		result := &mongo.ClientBulkWriteResult{UpdateResults: map[int]mongo.ClientBulkWriteUpdateResult{
+			0: {MatchedCount: 1},
+			1: {MatchedCount: 1},
+			2: {MatchedCount: 1},
+			3: {MatchedCount: 1},
+			4: {},
+		}}
+
+		err := aggregateWriteErrors(ctx, writes, result, nil)
+		require.ErrorIs(t, err, oerrs.ErrInternal)
+
+		var writeErr *AggregateWriteError
+		require.ErrorAs(t, err, &writeErr)
+		assert.Equal(t, 4, writeErr.Index)
+
+		failed, ok := FailedEvents(err)
+		require.True(t, ok)
+		assert.Equal(t, writes[4].Events, failed)
+	})
+
+	t.Run("failed write stops the batch", func(t *testing.T) {
+		err := mongo.ClientBulkWriteException{
+			WriteErrors: map[int]mongo.WriteError{2: {Code: 2, Message: "bad update"}},
+			PartialResult: &mongo.ClientBulkWriteResult{UpdateResults: map[int]mongo.ClientBulkWriteUpdateResult{
+				0: {MatchedCount: 1},
+				1: {MatchedCount: 1},
+			}},
+		}
+
+		result := aggregateWriteErrors(ctx, writes, nil, err)
+		require.ErrorIs(t, result, oerrs.ErrInternal)
+
+		failed, ok := FailedEvents(result)
+		require.True(t, ok)
+		assert.Equal(t, slices.Concat(writes[2].Events, writes[4].Events), failed)
+	})
+
+	t.Run("failed execution write in the middle of the batch", func(t *testing.T) {
+		err := mongo.ClientBulkWriteException{
+			WriteErrors: map[int]mongo.WriteError{3: {Code: 2, Message: "bad update"}},
+			PartialResult: &mongo.ClientBulkWriteResult{UpdateResults: map[int]mongo.ClientBulkWriteUpdateResult{
+				0: {MatchedCount: 1},
+				1: {MatchedCount: 1},
+				2: {MatchedCount: 1},
+			}},
+		}
+
+		result := aggregateWriteErrors(ctx, writes, nil, err)
+		require.ErrorIs(t, result, oerrs.ErrInternal)
+
+		// events of the applied writes are not reported, the others are reported once
+		failed, ok := FailedEvents(result)
+		require.True(t, ok)
+		assert.Equal(t, writes[4].Events, failed)
+	})
+
+	t.Run("only the execution write failed", func(t *testing.T) {
+		result := &mongo.ClientBulkWriteResult{UpdateResults: map[int]mongo.ClientBulkWriteUpdateResult{
+			0: {},
+			1: {MatchedCount: 1},
+			2: {MatchedCount: 1},
+			3: {MatchedCount: 1},
+			4: {MatchedCount: 1},
+		}}
+
+		_, ok := FailedEvents(aggregateWriteErrors(ctx, writes, result, nil))
+		assert.False(t, ok)
+	})
+
+	t.Run("failed batch", func(t *testing.T) {
+		err := aggregateWriteErrors(ctx, writes, nil, errors.New("connection reset"))
+		require.ErrorIs(t, err, oerrs.ErrInternal)
+
+		_, ok := FailedEvents(err)
+		assert.False(t, ok)
+	})
+}
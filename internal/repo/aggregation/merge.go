@@ -0,0 +1,208 @@
+// Package aggregation implements the semantics of repo.Repo aggregates in Go
+// for storages which can't run MongoDB aggregation pipelines.
+package aggregation
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// MergeExecution merges the write into the stored execution aggregate, nil if there is none:
+// labels are merged, FirstEventAt and LastEventAt are widened and the latest WorkerID is set.
+func MergeExecution(
+	stored *repo.ExecutionAggregate,
+	write repo.ExecutionAggregate,
+	now time.Time,
+) repo.ExecutionAggregate {
+	execution := repo.ExecutionAggregate{
+		ProcessID:    write.ProcessID,
+		ExecutionID:  write.ExecutionID,
+		FirstEventAt: write.FirstEventAt,
+		LastEventAt:  write.LastEventAt,
+	}
+
+	if stored != nil {
+		execution = *stored
+		execution.Labels = maps.Clone(stored.Labels)
+	}
+
+	if write.FirstEventAt.Before(execution.FirstEventAt) {
+		execution.FirstEventAt = write.FirstEventAt
+	}
+
+	if write.LastEventAt.After(execution.LastEventAt) {
+		execution.LastEventAt = write.LastEventAt
+	}
+
+	execution.WorkerID = write.WorkerID
+	execution.UpdatedAt = now
+	execution.Labels = mergeLabels(execution.Labels, write.Labels)
+
+	return execution
+}
+
+// MergeStageExecution merges events of one stage execution sorted by Ts into the stored aggregate,
+// nil if there is none: the earliest start and the latest finish win, updates are kept sorted by Ts,
+// metrics of new events are folded and the first WorkerID and RawStage are kept. The stored aggregate is not modified.
+func MergeStageExecution(
+	stored *repo.SingleStageExecutionEvent,
+	events []repo.Event,
+	now time.Time,
+) repo.SingleStageExecutionEvent {
+	var stage repo.SingleStageExecutionEvent
+
+	if stored != nil {
+		stage = CloneStageExecution(*stored)
+	} else {
+		first := events[0]
+		stage = repo.SingleStageExecutionEvent{
+			ProcessID:        first.ProcessID,
+			WorkerID:         first.WorkerID,
+			ExecutionID:      first.ExecutionID,
+			StageExecutionID: first.StageExecutionID,
+			RawStage:         first.Stage,
+		}
+	}
+
+	started := false
+
+	for _, event := range events {
+		mergeMetrics(&stage, event)
+		stage.Labels = mergeLabels(stage.Labels, event.Labels)
+
+		switch event.Kind {
+		case repo.EventKindStageStarted:
+			// events are sorted, so the first start of the batch is the earliest one
+			if !started && (stage.Start.Ts.IsZero() || event.Ts.Before(stage.Start.Ts)) {
+				stage.Start = event.Copy()
+			}
+
+			started = true
+		case repo.EventKindStageFinished:
+			if stage.End.Ts.IsZero() || !event.Ts.Before(stage.End.Ts) {
+				stage.End = event.Copy()
+			}
+		case repo.EventKindGenericUpdate:
+			stage.Updates = appendUpdate(stage.Updates, event)
+		}
+	}
+
+	slices.SortStableFunc(stage.Updates, func(a, b repo.Event) int {
+		return a.Ts.Compare(b.Ts)
+	})
+
+	failureText, metadataText := repo.SearchText(events...)
+	stage.FailureText = union(stage.FailureText, failureText)
+	stage.MetadataText = union(stage.MetadataText, metadataText)
+	stage.IsFinished = !stage.End.Ts.IsZero()
+	stage.IsSuccess = stage.End.Status == repo.EventStatusSuccess
+	stage.UpdatedAt = now
+
+	return stage
+}
+
+// CloneStageExecution returns a deep copy of the stage execution.
+func CloneStageExecution(stage repo.SingleStageExecutionEvent) repo.SingleStageExecutionEvent {
+	stage.Start = stage.Start.Copy()
+	stage.End = stage.End.Copy()
+	stage.Metrics = maps.Clone(stage.Metrics)
+	stage.Labels = maps.Clone(stage.Labels)
+	stage.MetricEvents = slices.Clone(stage.MetricEvents)
+	stage.FailureText = slices.Clone(stage.FailureText)
+	stage.MetadataText = slices.Clone(stage.MetadataText)
+
+	if stage.Updates != nil {
+		updates := make([]repo.Event, 0, len(stage.Updates))
+		for _, update := range stage.Updates {
+			updates = append(updates, update.Copy())
+		}
+
+		stage.Updates = updates
+	}
+
+	return stage
+}
+
+// mergeMetrics folds metrics of the event: sums and counts are added,
+// the last value is of the latest event, the last reported unit wins.
+// An event whose key is in MetricEvents is folded already, so it is skipped.
+func mergeMetrics(stage *repo.SingleStageExecutionEvent, event repo.Event) {
+	if len(event.Metrics) == 0 {
+		return
+	}
+
+	key := event.Key()
+	if slices.Contains(stage.MetricEvents, key) {
+		return
+	}
+
+	stage.MetricEvents = union(stage.MetricEvents, []string{key})
+
+	for name, metric := range event.Metrics {
+		if stage.Metrics == nil {
+			stage.Metrics = map[string]repo.StageMetric{}
+		}
+
+		stored := stage.Metrics[name]
+
+		if len(metric.Unit) > 0 {
+			stored.Unit = metric.Unit
+		}
+
+		stored.Sum += metric.Value
+		stored.Count++
+
+		if stored.LastAt.IsZero() || !event.Ts.Before(stored.LastAt) {
+			stored.Last = metric.Value
+			stored.LastAt = event.Ts
+		}
+
+		stage.Metrics[name] = stored
+	}
+}
+
+// appendUpdate appends the update unless an equal one is stored already, so redelivered events are not duplicated.
+func appendUpdate(updates []repo.Event, update repo.Event) []repo.Event {
+	encoded, err := bson.Marshal(update)
+	if err == nil {
+		for _, stored := range updates {
+			storedEncoded, err := bson.Marshal(stored)
+			if err == nil && bytes.Equal(encoded, storedEncoded) {
+				return updates
+			}
+		}
+	}
+
+	return append(updates, update.Copy())
+}
+
+// union returns sorted unique strings of both sorted sets, nil if both are empty.
+func union(stored, values []string) []string {
+	if len(values) == 0 {
+		return stored
+	}
+
+	result := append(slices.Clone(stored), values...)
+	slices.Sort(result)
+
+	return slices.Compact(result)
+}
+
+func mergeLabels(stored, labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return stored
+	}
+
+	if stored == nil {
+		stored = map[string]string{}
+	}
+
+	maps.Copy(stored, labels)
+
+	return stored
+}
@@ -0,0 +1,145 @@
+package aggregation
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+)
+
+// MatchesStageExecution reports whether the stage execution matches the query, the limit is ignored.
+func MatchesStageExecution(query repo.StageExecutionsQuery, stage repo.SingleStageExecutionEvent) bool {
+	return matches(query.ProcessID, stage.ProcessID) &&
+		matches(query.ExecutionID, stage.ExecutionID) &&
+		matches(query.StageName, stage.RawStage.Name) &&
+		query.Labels.Matches(stage.Labels) &&
+		InTimeRange(stage.Start.Ts, query.StartedFrom, query.StartedTo)
+}
+
+// MatchesExecution reports whether the execution matches the query, the limit is ignored.
+func MatchesExecution(query repo.ExecutionsQuery, execution repo.ExecutionAggregate) bool {
+	return matches(query.ProcessID, execution.ProcessID) &&
+		query.Labels.Matches(execution.Labels) &&
+		InTimeRange(execution.FirstEventAt, query.StartedFrom, query.StartedTo)
+}
+
+// SortStageExecutions sorts stage executions by start time, the latest first.
+func SortStageExecutions(stages []repo.SingleStageExecutionEvent) {
+	slices.SortFunc(stages, func(a, b repo.SingleStageExecutionEvent) int {
+		return b.Start.Ts.Compare(a.Start.Ts)
+	})
+}
+
+// SortExecutions sorts executions by repo.ExecutionAggregate.FirstEventAt, the latest first.
+func SortExecutions(executions []repo.ExecutionAggregate) {
+	slices.SortFunc(executions, func(a, b repo.ExecutionAggregate) int {
+		return b.FirstEventAt.Compare(a.FirstEventAt)
+	})
+}
+
+// ValidateStageMetricsQuery checks the query as repo.Repo.AggregateStageMetrics does.
+// Errors:
+// - oerrs.ErrBadInput: if bucket size is less than a second or the time range is empty.
+func ValidateStageMetricsQuery(ctx context.Context, query repo.StageMetricsQuery) error {
+	if query.Bucket < time.Second {
+		return oerrs.NewTErrf(ctx, "bucket must be at least 1s: %w", oerrs.ErrBadInput)
+	}
+
+	if !query.From.Before(query.To) {
+		return oerrs.NewTErrf(ctx, "from must be before to: %w", oerrs.ErrBadInput)
+	}
+
+	return nil
+}
+
+// StageMetricBuckets aggregates metrics of the stage executions into time buckets of their start time,
+// see repo.Repo.AggregateStageMetrics. The unit of the latest stage execution wins.
+func StageMetricBuckets(stages []repo.SingleStageExecutionEvent, bucketSize time.Duration) []repo.StageMetricBucket {
+	stages = slices.Clone(stages)
+	slices.SortStableFunc(stages, func(a, b repo.SingleStageExecutionEvent) int {
+		return a.Start.Ts.Compare(b.Start.Ts)
+	})
+
+	buckets := map[bucketKey]*repo.StageMetricBucket{}
+
+	for _, stage := range stages {
+		ts := truncateToBucket(stage.Start.Ts, bucketSize)
+
+		for name, metric := range stage.Metrics {
+			key := bucketKey{ts: ts, stageName: stage.RawStage.Name, name: name}
+
+			bucket, ok := buckets[key]
+			if !ok {
+				bucket = &repo.StageMetricBucket{Ts: ts, StageName: key.stageName, Name: name, Min: metric.Sum}
+				bucket.Max = metric.Sum
+				buckets[key] = bucket
+			}
+
+			bucket.Unit = metric.Unit
+			bucket.Executions++
+			bucket.Sum += metric.Sum
+			bucket.Min = min(bucket.Min, metric.Sum)
+			bucket.Max = max(bucket.Max, metric.Sum)
+			bucket.Avg = bucket.Sum / float64(bucket.Executions)
+		}
+	}
+
+	result := make([]repo.StageMetricBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		result = append(result, *bucket)
+	}
+
+	slices.SortFunc(result, func(a, b repo.StageMetricBucket) int {
+		return cmp.Or(a.Ts.Compare(b.Ts), strings.Compare(a.StageName, b.StageName), strings.Compare(a.Name, b.Name))
+	})
+
+	return result
+}
+
+type bucketKey struct {
+	ts        time.Time
+	stageName string
+	name      string
+}
+
+// bucketsOrigin is the reference date of MongoDB `$dateTrunc`, buckets are aligned to it.
+var bucketsOrigin = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func truncateToBucket(ts time.Time, bucket time.Duration) time.Time {
+	offset := ts.Sub(bucketsOrigin)
+
+	truncated := offset - offset%bucket
+	if offset < 0 && truncated != offset {
+		truncated -= bucket
+	}
+
+	return bucketsOrigin.Add(truncated)
+}
+
+// matches reports whether an optional filter value matches the value.
+func matches(filter, value string) bool {
+	return len(filter) == 0 || filter == value
+}
+
+// InTimeRange reports whether the time is within the optional range, from is inclusive, to is exclusive.
+// A missing time matches only an empty range.
+func InTimeRange(ts, from, to time.Time) bool {
+	if from.IsZero() && to.IsZero() {
+		return true
+	}
+
+	return !ts.IsZero() && !ts.Before(from) && (to.IsZero() || ts.Before(to))
+}
+
+// Limit returns the first n values, not positive n means no limit.
+func Limit[T any](values []T, n int64) []T {
+	if n <= 0 || int64(len(values)) <= n {
+		return values
+	}
+
+	return values[:n]
+}
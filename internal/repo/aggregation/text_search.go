@@ -0,0 +1,202 @@
+package aggregation
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+)
+
+// weights of the searched fields, they are the weights of the MongoDB text index.
+const (
+	textWeightFailure     = 10
+	textWeightMetadata    = 5
+	textWeightDescription = 1
+)
+
+// textQuery is a parsed MongoDB $text search string.
+type textQuery struct {
+	terms, phrases               []string
+	negatedTerms, negatedPhrases []string
+}
+
+// parseTextQuery splits the search string into lowercase words and "exact phrases", `-` negates both.
+func parseTextQuery(text string) textQuery {
+	var result textQuery
+
+	for i := 0; i < len(text); {
+		negated := text[i] == '-'
+		if negated {
+			i++
+		}
+
+		if i < len(text) && text[i] == '"' {
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				end = len(text) - i - 1
+			}
+
+			phrase := strings.ToLower(strings.TrimSpace(text[i+1 : i+1+end]))
+			if len(phrase) > 0 && negated {
+				result.negatedPhrases = append(result.negatedPhrases, phrase)
+			} else if len(phrase) > 0 {
+				result.phrases = append(result.phrases, phrase)
+			}
+
+			i += end + 2
+
+			continue
+		}
+
+		end := strings.IndexFunc(text[i:], unicode.IsSpace)
+		if end < 0 {
+			end = len(text) - i
+		}
+
+		for _, word := range words(text[i : i+end]) {
+			if negated {
+				result.negatedTerms = append(result.negatedTerms, word)
+			} else {
+				result.terms = append(result.terms, word)
+			}
+		}
+
+		i += end + 1
+	}
+
+	return result
+}
+
+// ValidateSearchQuery checks the query as repo.Repo.SearchStageExecutions does.
+// Errors:
+// - oerrs.ErrBadInput: if the search text is empty.
+func ValidateSearchQuery(ctx context.Context, query repo.StageExecutionsSearchQuery) error {
+	if len(strings.TrimSpace(query.Text)) == 0 {
+		return oerrs.NewTErrf(ctx, "search text must be set: %w", oerrs.ErrBadInput)
+	}
+
+	return nil
+}
+
+// SearchStageExecutions returns the stage executions whose failures, metadata or stage description match
+// the MongoDB $text search string, ranked by relevance, the most relevant first.
+// Unlike MongoDB, words are matched as they are, without stemming and stop words.
+func SearchStageExecutions(text string, stages []repo.SingleStageExecutionEvent) []repo.StageExecutionSearchResult {
+	query := parseTextQuery(text)
+
+	var result []repo.StageExecutionSearchResult
+
+	for _, stage := range stages {
+		texts := map[string]int{}
+		addText(texts, stage.FailureText, textWeightFailure)
+		addText(texts, stage.MetadataText, textWeightMetadata)
+		addText(texts, []string{stage.RawStage.Description}, textWeightDescription)
+
+		if score := query.score(texts); score > 0 {
+			result = append(result, repo.StageExecutionSearchResult{Stage: stage, Score: score})
+		}
+	}
+
+	slices.SortStableFunc(result, func(a, b repo.StageExecutionSearchResult) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return result
+}
+
+// score returns the relevance of the weighted texts, zero if they don't match.
+// Texts match if they contain all phrases, no negated terms and phrases and any term unless there are phrases.
+func (q textQuery) score(texts map[string]int) float64 {
+	var (
+		result    float64
+		termFound bool
+	)
+
+	for text, weight := range texts {
+		text = strings.ToLower(text)
+		textWords := words(text)
+
+		for _, negated := range q.negatedTerms {
+			if slices.Contains(textWords, negated) {
+				return 0
+			}
+		}
+
+		for _, negated := range q.negatedPhrases {
+			if strings.Contains(text, negated) {
+				return 0
+			}
+		}
+
+		for _, term := range q.terms {
+			if count := countWord(textWords, term); count > 0 {
+				termFound = true
+				result += float64(weight * count)
+			}
+		}
+
+		for _, phrase := range q.phrases {
+			result += float64(weight * strings.Count(text, phrase))
+		}
+	}
+
+	for _, phrase := range q.phrases {
+		if !containsPhrase(texts, phrase) {
+			return 0
+		}
+	}
+
+	if len(q.phrases) == 0 && !termFound {
+		return 0
+	}
+
+	return result
+}
+
+// addText adds the texts with the weight, a text of several fields gets the highest weight.
+func addText(texts map[string]int, values []string, weight int) {
+	for _, value := range values {
+		if len(value) > 0 {
+			texts[value] = max(texts[value], weight)
+		}
+	}
+}
+
+func containsPhrase(texts map[string]int, phrase string) bool {
+	for text := range texts {
+		if strings.Contains(strings.ToLower(text), phrase) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// words splits the text into lowercase words of letters and digits.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func countWord(words []string, word string) int {
+	count := 0
+
+	for _, w := range words {
+		if w == word {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,147 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameAlerts = "alerts"
+)
+
+// StageStatsQuery selects stage executions for StageStats.
+type StageStatsQuery struct {
+	// ProcessID and StageName are optional.
+	ProcessID string
+	StageName string
+
+	// Since is optional. If it is set, only stage executions updated since then are taken into account.
+	Since time.Time
+	// Now is used to compute the duration of running stage executions.
+	Now time.Time
+}
+
+// StageStats summarizes stage executions grouped by process and stage.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) StageStats(ctx context.Context, query StageStatsQuery) ([]StageStat, error) {
+	match := bson.M{}
+
+	if len(query.ProcessID) > 0 {
+		match[SingleStageExecutionEventProcessIDFieldName()] = query.ProcessID
+	}
+
+	if len(query.StageName) > 0 {
+		match[SingleStageExecutionEventRawStageNameFieldName()] = query.StageName
+	}
+
+	if !query.Since.IsZero() {
+		match[SingleStageExecutionEventUpdateAtFieldName()] = bson.M{"$gte": query.Since}
+	}
+
+	var (
+		isFinished = "$" + SingleStageExecutionEventIsFinishedFieldName()
+		isSuccess  = "$" + SingleStageExecutionEventIsSuccessFieldName()
+		startTs    = "$" + SingleStageExecutionEventStartTsFieldName()
+		endTs      = SingleStageExecutionEventEndFieldName() + "." + RawEventGetTsFieldName()
+	)
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"pid": "$" + SingleStageExecutionEventProcessIDFieldName(),
+				"sn":  "$" + SingleStageExecutionEventRawStageNameFieldName(),
+			},
+			"t":  bson.M{"$sum": 1},
+			"fn": bson.M{"$sum": bson.M{"$cond": bson.A{isFinished, 1, 0}}},
+			"fl": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$and": bson.A{isFinished, bson.M{"$not": bson.A{isSuccess}}}}, 1, 0,
+			}}},
+			"ls": bson.M{"$max": startTs},
+			"lf": bson.M{"$top": bson.M{
+				"sortBy": bson.M{endTs: -1},
+				"output": bson.M{"f": isFinished, "s": isSuccess, "ts": "$" + endTs},
+			}},
+			"md": bson.M{"$max": bson.M{"$cond": bson.A{
+				isFinished,
+				bson.M{"$subtract": bson.A{"$" + endTs, startTs}},
+				bson.M{"$subtract": bson.A{query.Now, startTs}},
+			}}},
+		}},
+		{"$project": bson.M{
+			"_id": 0,
+			"pid": "$_id.pid",
+			"sn":  "$_id.sn",
+			"t":   1,
+			"fn":  1,
+			"fl":  1,
+			"ls":  1,
+			"lf":  1,
+			"md":  bson.M{"$ifNull": bson.A{"$md", 0}},
+		}},
+	}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameSingleStageExec).
+		Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []StageStat
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// ListActiveAlerts returns all alerts in AlertStateFiring state.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListActiveAlerts(ctx context.Context) ([]Alert, error) {
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameAlerts).
+		Find(ctx, bson.M{AlertStateFieldName(): AlertStateFiring})
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []Alert
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// SaveAlert creates or replaces the alert with the same Alert.Fingerprint.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) SaveAlert(ctx context.Context, alert Alert) error {
+	_, err := r.client.
+		DB().
+		Collection(collectionNameAlerts).
+		ReplaceOne(
+			ctx,
+			bson.M{"_id": alert.Fingerprint},
+			alert,
+			options.Replace().SetUpsert(true),
+		)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/LastSprint/pipetank/pkg/common"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameArchiveProgress = "archive_progress"
+
+	idxNameSingleStageEnd            = "stage_exec_end"
+	idxNameExecutionAggregatesLastAt = "execution_aggregates_last_event"
+)
+
+// ArchiveKind is a kind of archived documents.
+type ArchiveKind string
+
+const (
+	// ArchiveKindRawEvents are raw events, archived by Event.Ts.
+	ArchiveKindRawEvents ArchiveKind = "raw_events"
+	// ArchiveKindStageExecutions are finished stage executions, archived by the Ts of the finish event.
+	ArchiveKindStageExecutions ArchiveKind = "stage_executions"
+	// ArchiveKindExecutions are execution aggregates, archived by ExecutionAggregate.LastEventAt.
+	ArchiveKindExecutions ArchiveKind = "executions"
+)
+
+// ArchiveKinds returns all kinds in the order they are archived and restored.
+func ArchiveKinds() []ArchiveKind {
+	return []ArchiveKind{ArchiveKindRawEvents, ArchiveKindStageExecutions, ArchiveKindExecutions}
+}
+
+func (k ArchiveKind) IsValid() bool {
+	switch k {
+	case ArchiveKindRawEvents, ArchiveKindStageExecutions, ArchiveKindExecutions:
+		return true
+	default:
+		return false
+	}
+}
+
+func (k ArchiveKind) collection() string {
+	switch k {
+	case ArchiveKindStageExecutions:
+		return collectionNameSingleStageExec
+	case ArchiveKindExecutions:
+		return collectionNameExecutionAggregates
+	default:
+		return collectionNameRawEvents
+	}
+}
+
+// tsField is the field documents of the kind are archived by.
+func (k ArchiveKind) tsField() string {
+	switch k {
+	case ArchiveKindStageExecutions:
+		return SingleStageExecutionEventEndFieldName() + "." + RawEventGetTsFieldName()
+	case ArchiveKindExecutions:
+		return ExecutionAggregateLastEventAtFieldName()
+	default:
+		return RawEventGetTsFieldName()
+	}
+}
+
+// filter selects documents of the kind archived in [from, to), processID is optional.
+func (k ArchiveKind) filter(processID string, from, to time.Time) bson.M {
+	filter := bson.M{k.tsField(): timeRangeFilter(from, to)}
+
+	if k == ArchiveKindStageExecutions {
+		filter[SingleStageExecutionEventIsFinishedFieldName()] = true
+	}
+
+	if len(processID) > 0 {
+		// all kinds use the same name of the ProcessID field
+		filter[RawEventProcessIDFieldName()] = processID
+	}
+
+	return filter
+}
+
+// createArchiveIndexes creates indexes which select aggregates by the time they are archived by,
+// raw events are selected by the index on Ts.
+func (r *Repo) createArchiveIndexes(ctx context.Context) error {
+	err := r.client.CreateIndexes(ctx, collectionNameSingleStageExec, []mongo.IndexModel{{
+		Keys: bson.D{{Key: ArchiveKindStageExecutions.tsField(), Value: 1}},
+		Options: options.Index().
+			SetName(idxNameSingleStageEnd).
+			SetPartialFilterExpression(bson.M{SingleStageExecutionEventIsFinishedFieldName(): true}),
+	}})
+	if err != nil {
+		return err
+	}
+
+	return r.client.CreateIndexes(ctx, collectionNameExecutionAggregates, []mongo.IndexModel{{
+		Keys:    bson.D{{Key: ArchiveKindExecutions.tsField(), Value: 1}},
+		Options: options.Index().SetName(idxNameExecutionAggregatesLastAt),
+	}})
+}
+
+// FirstArchiveTs returns the earliest time of documents of the kind.
+// Errors:
+// - oerrs.ErrNotFound: if there are no such documents.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) FirstArchiveTs(ctx context.Context, kind ArchiveKind) (time.Time, error) {
+	filter := bson.M{kind.tsField(): bson.M{"$exists": true}}
+	if kind == ArchiveKindStageExecutions {
+		filter[SingleStageExecutionEventIsFinishedFieldName()] = true
+	}
+
+	var result bson.Raw
+
+	err := r.client.
+		DB().
+		Collection(kind.collection()).
+		FindOne(
+			ctx,
+			filter,
+			options.FindOne().
+				SetSort(bson.D{{Key: kind.tsField(), Value: 1}}).
+				SetProjection(bson.M{kind.tsField(): 1}),
+		).
+		Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, oerrs.NewTErrf(ctx, "no %s to archive: %w", kind, oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return time.Time{}, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	ts, ok := result.Lookup(strings.Split(kind.tsField(), ".")...).DateTimeOK()
+	if !ok {
+		return time.Time{}, oerrs.NewTErrf(ctx, "%s of %s is not a date: %w", kind.tsField(), kind, oerrs.ErrInternal)
+	}
+
+	return time.UnixMilli(ts).UTC(), nil
+}
+
+// ListArchiveProcesses returns ProcessIDs of documents of the kind in [from, to).
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListArchiveProcesses(ctx context.Context, kind ArchiveKind, from, to time.Time) ([]string, error) {
+	var result []string
+
+	err := r.client.
+		DB().
+		Collection(kind.collection()).
+		Distinct(ctx, RawEventProcessIDFieldName(), kind.filter("", from, to)).
+		Decode(&result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// ReadArchiveDocuments calls action for every document of the kind and the process in [from, to) ordered by time.
+// Errors:
+// - oerrs.ErrInternal: on any error of MongoDB.
+// - any error of action.
+func (r *Repo) ReadArchiveDocuments(
+	ctx context.Context,
+	kind ArchiveKind,
+	processID string,
+	from, to time.Time,
+	action common.CallbackFailable[bson.Raw],
+) error {
+	cur, err := r.client.
+		DB().
+		Collection(kind.collection()).
+		Find(
+			ctx,
+			kind.filter(processID, from, to),
+			options.Find().SetSort(bson.D{{Key: kind.tsField(), Value: 1}}),
+		)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	defer func() {
+		_ = cur.Close(context.WithoutCancel(ctx))
+	}()
+
+	for cur.Next(ctx) {
+		err = action(ctx, cur.Current)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cur.Err()
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// RestoreArchiveDocuments inserts documents of the kind or replaces the existing ones with the same `_id`,
+// so an archive can be restored more than once.
+// Errors:
+// - oerrs.ErrBadInput: if a document has no `_id`.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) RestoreArchiveDocuments(ctx context.Context, kind ArchiveKind, docs []bson.Raw) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(docs))
+
+	for _, doc := range docs {
+		id, err := doc.LookupErr("_id")
+		if err != nil {
+			return oerrs.NewTErrf(ctx, "archived %s without _id: %w", kind, oerrs.ErrBadInput)
+		}
+
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetReplacement(doc).
+			SetUpsert(true))
+	}
+
+	_, err := r.client.
+		DB().
+		Collection(kind.collection()).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// LoadArchiveProgress returns the end of the last archived period of the archiver.
+// Errors:
+// - oerrs.ErrNotFound: if nothing is archived yet.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) LoadArchiveProgress(ctx context.Context, key string) (time.Time, error) {
+	var result struct {
+		ArchivedTo time.Time `bson:"to"`
+	}
+
+	err := r.client.DB().Collection(collectionNameArchiveProgress).FindOne(ctx, bson.M{"_id": key}).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, oerrs.NewTErrf(ctx, "nothing is archived by %q: %w", key, oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return time.Time{}, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result.ArchivedTo, nil
+}
+
+// SaveArchiveProgress saves the end of the last archived period of the archiver.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) SaveArchiveProgress(ctx context.Context, key string, archivedTo time.Time) error {
+	_, err := r.client.
+		DB().
+		Collection(collectionNameArchiveProgress).
+		UpdateOne(
+			ctx,
+			bson.M{"_id": key},
+			bson.M{"$set": bson.M{"to": archivedTo, "ua": r.clock()}},
+			options.UpdateOne().SetUpsert(true),
+		)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
@@ -2,6 +2,9 @@ package repo
 
 import (
 	"context"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/LastSprint/pipetank/pkg/common"
 	"github.com/LastSprint/pipetank/pkg/mdb"
@@ -11,19 +14,114 @@ import (
 type RawEventWatchModel struct {
 	Record Event
 	Token  mdb.ResumeTokenProvider
+	// Idle is true if there is no event to handle, Record is empty then. Token is the position of the feed
+	// after events skipped by the partition and aggregation filters, saving it moves a quiet partition forward.
+	Idle bool
 }
 
+// ChangeStreamPosition is where a change stream starts. Token has priority over StartAt,
+// the zero value starts the stream from now.
+type ChangeStreamPosition struct {
+	// Token resumes the stream right after the change with this token.
+	Token bson.Raw
+	// StartAt starts the stream from the first change at or after this time.
+	StartAt time.Time
+}
+
+func (p ChangeStreamPosition) options() []mdb.ChangeStreamOption {
+	if len(p.Token) > 0 {
+		return []mdb.ChangeStreamOption{mdb.WithResumeAfter(p.Token)}
+	}
+
+	return []mdb.ChangeStreamOption{mdb.WithStartAtOperationTime(p.StartAt)}
+}
+
+// WatchRawEvents watches inserted raw events of the partition from the given position,
+// events which are already aggregated (Event.Aggregated) are skipped. The action gets an Idle model
+// every time the change stream returns an empty batch.
+// Errors:
+// - mdb.IsHistoryLost: if the position is not in the oplog anymore.
 func (r *Repo) WatchRawEvents(
 	ctx context.Context,
+	from ChangeStreamPosition,
+	partition Partition,
 	action common.CallbackFailable[RawEventWatchModel],
 ) error {
+	pipeline := []bson.M{{"$match": bson.M{
+		"operationType": "insert",
+		"fullDocument." + RawEventAggregatedFieldName(): bson.M{"$ne": true},
+	}}}
+	if filter := partition.changeStreamFilter(); filter != nil {
+		pipeline = append(pipeline, filter)
+	}
+
 	return mdb.RunChangeStream(
 		ctx,
 		r.client,
 		collectionNameRawEvents,
-		[]bson.M{{"$match": bson.M{"operationType": "insert"}}},
+		pipeline,
 		func(ctx context.Context, token mdb.ResumeTokenProvider, doc Event) error {
 			return action(ctx, RawEventWatchModel{Record: doc, Token: token})
 		},
+		append(
+			from.options(),
+			mdb.WithIdle(func(ctx context.Context, token mdb.ResumeTokenProvider) error {
+				return action(ctx, RawEventWatchModel{Token: token, Idle: true})
+			}),
+		)...,
+	)
+}
+
+type StageExecutionWatchModel struct {
+	Record SingleStageExecutionEvent
+	// Inserted is true if the stage execution was created by the change.
+	Inserted bool
+	// UpdatedFields are top level fields changed by the change, it is empty for inserts.
+	UpdatedFields []string
+	Token         mdb.ResumeTokenProvider
+}
+
+// Started is true if the change starts the stage execution.
+func (m StageExecutionWatchModel) Started() bool {
+	return !m.Record.Start.Ts.IsZero() && m.changed(SingleStageExecutionEventStartFieldName())
+}
+
+// Finished is true if the change finishes the stage execution.
+// Later updates of a finished stage execution don't set the field again, so a finish is reported once.
+func (m StageExecutionWatchModel) Finished() bool {
+	return m.Record.IsFinished && m.changed(SingleStageExecutionEventIsFinishedFieldName())
+}
+
+func (m StageExecutionWatchModel) changed(field string) bool {
+	return m.Inserted || slices.Contains(m.UpdatedFields, field)
+}
+
+// WatchStageExecutions watches inserts and updates of stage executions.
+// If the token is not empty, watching is resumed right after the change with this token.
+func (r *Repo) WatchStageExecutions(
+	ctx context.Context,
+	token bson.Raw,
+	action common.CallbackFailable[StageExecutionWatchModel],
+) error {
+	return mdb.RunChangeStreamEvents(
+		ctx,
+		r.client,
+		collectionNameSingleStageExec,
+		[]bson.M{{"$match": bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}}}}},
+		func(ctx context.Context, token mdb.ResumeTokenProvider, event mdb.ChangeEvent[SingleStageExecutionEvent]) error {
+			updatedFields := make([]string, 0)
+			for _, field := range event.UpdatedFieldNames() {
+				top, _, _ := strings.Cut(field, ".")
+				updatedFields = append(updatedFields, top)
+			}
+
+			return action(ctx, StageExecutionWatchModel{
+				Record:        event.FullDocument,
+				Inserted:      event.OperationType != "update",
+				UpdatedFields: updatedFields,
+				Token:         token,
+			})
+		},
+		mdb.WithResumeAfter(token),
 	)
 }
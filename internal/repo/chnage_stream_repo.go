@@ -2,9 +2,13 @@ package repo
 
 import (
 	"context"
+	goerrors "errors"
+	"regexp"
+	"strings"
 
 	"github.com/LastSprint/pipetank/pkg/observability/errors"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
 	"go.mongodb.org/mongo-driver/v2/mongo/writeconcern"
@@ -23,7 +27,7 @@ func (r *Repo) SaveChangeStreamToken(ctx context.Context, key string, token bson
 
 	opResult := r.client.DB().
 		Collection(NamespaceChangeStreamTokenStorage, colOpts).
-		FindOneAndUpdate(ctx, bson.M{"key": key}, bson.M{"token": bson.M{"$set": token}}, opOpts)
+		FindOneAndUpdate(ctx, bson.M{"key": key}, bson.M{"$set": bson.M{"token": token}}, opOpts)
 
 	err := opResult.Err()
 	if err != nil {
@@ -32,3 +36,67 @@ func (r *Repo) SaveChangeStreamToken(ctx context.Context, key string, token bson
 
 	return nil
 }
+
+// LoadChangeStreamToken returns the token saved by SaveChangeStreamToken.
+// Errors:
+// - errors.ErrNotFound: if there is no token for the key.
+// - errors.ErrInternal: on any other error.
+func (r *Repo) LoadChangeStreamToken(ctx context.Context, key string) (bson.Raw, error) {
+	var result struct {
+		Token bson.Raw `bson:"token"`
+	}
+
+	err := r.client.DB().
+		Collection(NamespaceChangeStreamTokenStorage).
+		FindOne(ctx, bson.M{"key": key}).
+		Decode(&result)
+	if goerrors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errors.NewTErrf(ctx, "no change stream token for %q: %w", key, errors.ErrNotFound)
+	}
+
+	if err != nil {
+		return nil, errors.NewTErr(ctx, err, errors.ErrInternal)
+	}
+
+	return result.Token, nil
+}
+
+// LoadChangeStreamTokens returns tokens saved under the key and the keys of its partitions ("key/...").
+// Errors:
+// - errors.ErrInternal: on any error.
+func (r *Repo) LoadChangeStreamTokens(ctx context.Context, key string) (map[string]bson.Raw, error) {
+	cur, err := r.client.DB().
+		Collection(NamespaceChangeStreamTokenStorage).
+		Find(ctx, bson.M{"$or": bson.A{
+			bson.M{"key": key},
+			bson.M{"key": bson.M{"$regex": "^" + regexp.QuoteMeta(key+"/")}},
+		}})
+	if err != nil {
+		return nil, errors.NewTErr(ctx, err, errors.ErrInternal)
+	}
+
+	var docs []struct {
+		Key   string   `bson:"key"`
+		Token bson.Raw `bson:"token"`
+	}
+
+	err = cur.All(ctx, &docs)
+	if err != nil {
+		return nil, errors.NewTErr(ctx, err, errors.ErrInternal)
+	}
+
+	result := make(map[string]bson.Raw, len(docs))
+	for _, doc := range docs {
+		result[doc.Key] = doc.Token
+	}
+
+	return result, nil
+}
+
+// CompareChangeStreamTokens orders resume tokens by their `_data`, it sorts changes by their position in the oplog.
+func (r *Repo) CompareChangeStreamTokens(a, b bson.Raw) int {
+	dataA, _ := a.Lookup("_data").StringValueOK()
+	dataB, _ := b.Lookup("_data").StringValueOK()
+
+	return strings.Compare(dataA, dataB)
+}
@@ -0,0 +1,203 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameConsumerLeases  = "consumer_leases"
+	collectionNameConsumerMembers = "consumer_members"
+
+	idxNameConsumerLeasesTTL  = "ttl_consumer_leases"
+	idxNameConsumerMembersTTL = "ttl_consumer_members"
+)
+
+func consumerLeaseID(consumerKey string, partition int) string {
+	return fmt.Sprintf("%s/%d", consumerKey, partition)
+}
+
+func consumerMemberID(consumerKey, instance string) string {
+	return consumerKey + "/" + instance
+}
+
+// createConsumerLeaseIndexes removes expired leases and members, both expire by ConsumerLeaseExpiresAtFieldName.
+// Expired documents are ignored anyway, the TTL only keeps collections small.
+func (r *Repo) createConsumerLeaseIndexes(ctx context.Context) error {
+	for collection, name := range map[string]string{
+		collectionNameConsumerLeases:  idxNameConsumerLeasesTTL,
+		collectionNameConsumerMembers: idxNameConsumerMembersTTL,
+	} {
+		err := r.client.CreateOrUpdateTTLIndex(
+			ctx,
+			collection,
+			name,
+			0,
+			mongo.IndexModel{
+				Keys:    bson.M{ConsumerLeaseExpiresAtFieldName(): 1},
+				Options: options.Index().SetExpireAfterSeconds(0).SetName(name),
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AcquireConsumerLease takes the lease of the partition for the owner, or renews it if the owner holds it already.
+// It returns false if another owner holds a not expired lease.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) AcquireConsumerLease(
+	ctx context.Context,
+	consumerKey string,
+	partition int,
+	owner string,
+	ttl time.Duration,
+) (bool, error) {
+	now := r.clock()
+	id := consumerLeaseID(consumerKey, partition)
+
+	_, err := r.client.
+		DB().
+		Collection(collectionNameConsumerLeases).
+		UpdateOne(
+			ctx,
+			bson.M{
+				"_id": id,
+				"$or": bson.A{
+					bson.M{ConsumerLeaseOwnerFieldName(): owner},
+					bson.M{ConsumerLeaseExpiresAtFieldName(): bson.M{"$lte": now}},
+				},
+			},
+			bson.M{"$set": ConsumerLease{
+				ID:          id,
+				ConsumerKey: consumerKey,
+				Partition:   partition,
+				Owner:       owner,
+				ExpiresAt:   now.Add(ttl),
+			}},
+			options.UpdateOne().SetUpsert(true),
+		)
+	if mongo.IsDuplicateKeyError(err) {
+		// the lease exists and belongs to someone else
+		return false, nil
+	}
+
+	if err != nil {
+		return false, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return true, nil
+}
+
+// ReleaseConsumerLease gives the lease up, so another instance may take it right away.
+// Nothing happens if the owner doesn't hold the lease.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ReleaseConsumerLease(ctx context.Context, consumerKey string, partition int, owner string) error {
+	_, err := r.client.
+		DB().
+		Collection(collectionNameConsumerLeases).
+		DeleteOne(ctx, bson.M{"_id": consumerLeaseID(consumerKey, partition), ConsumerLeaseOwnerFieldName(): owner})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// ListConsumerLeases returns not expired leases of the consumer group.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListConsumerLeases(ctx context.Context, consumerKey string) ([]ConsumerLease, error) {
+	return findNotExpired[ConsumerLease](ctx, r, collectionNameConsumerLeases, consumerKey)
+}
+
+// HeartbeatConsumerMember registers the instance in the consumer group or prolongs its membership.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) HeartbeatConsumerMember(
+	ctx context.Context,
+	consumerKey, instance string,
+	ttl time.Duration,
+) error {
+	id := consumerMemberID(consumerKey, instance)
+
+	_, err := r.client.
+		DB().
+		Collection(collectionNameConsumerMembers).
+		UpdateOne(
+			ctx,
+			bson.M{"_id": id},
+			bson.M{"$set": ConsumerMember{
+				ID:          id,
+				ConsumerKey: consumerKey,
+				Instance:    instance,
+				ExpiresAt:   r.clock().Add(ttl),
+			}},
+			options.UpdateOne().SetUpsert(true),
+		)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// ListConsumerMembers returns live instances of the consumer group.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListConsumerMembers(ctx context.Context, consumerKey string) ([]ConsumerMember, error) {
+	return findNotExpired[ConsumerMember](ctx, r, collectionNameConsumerMembers, consumerKey)
+}
+
+// LeaveConsumerGroup removes the instance from the consumer group, so others rebalance without waiting for the TTL.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) LeaveConsumerGroup(ctx context.Context, consumerKey, instance string) error {
+	_, err := r.client.
+		DB().
+		Collection(collectionNameConsumerMembers).
+		DeleteOne(ctx, bson.M{"_id": consumerMemberID(consumerKey, instance)})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// findNotExpired finds not expired leases or members, they share names of these fields.
+func findNotExpired[T any](ctx context.Context, r *Repo, collection, consumerKey string) ([]T, error) {
+	cur, err := r.client.
+		DB().
+		Collection(collection).
+		Find(
+			ctx,
+			bson.M{
+				ConsumerLeaseConsumerKeyFieldName(): consumerKey,
+				ConsumerLeaseExpiresAtFieldName():   bson.M{"$gt": r.clock()},
+			},
+			options.Find().SetSort(bson.M{"_id": 1}),
+		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []T
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
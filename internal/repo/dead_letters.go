@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameDeadLetters = "dead_letters"
+
+	idxNameDeadLettersConsumer = "dead_letters_consumer"
+)
+
+// createDeadLetterIndexes creates indexes of dead letters.
+// Dead letters don't expire, they are kept until they are replayed or purged.
+func (r *Repo) createDeadLetterIndexes(ctx context.Context) error {
+	return r.client.CreateIndexes(ctx, collectionNameDeadLetters, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: DeadLetterConsumerKeyFieldName(), Value: 1},
+				{Key: DeadLetterLastFailedAtFieldName(), Value: -1},
+			},
+			Options: options.Index().SetName(idxNameDeadLettersConsumer),
+		},
+	})
+}
+
+// SendToDeadLetters saves the events as dead letters of the consumer with the error which caused the failure.
+// An event which is already a dead letter gets the new error and one more attempt.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) SendToDeadLetters(ctx context.Context, consumerKey string, events []Event, cause error) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	now := r.clock()
+	models := make([]mongo.WriteModel, 0, len(events))
+
+	for _, event := range events {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": DeadLetterID(consumerKey, event.ID)}).
+			SetUpdate(bson.M{
+				"$set": bson.M{
+					DeadLetterEventFieldName():        event,
+					DeadLetterErrorFieldName():        cause.Error(),
+					DeadLetterLastFailedAtFieldName(): now,
+				},
+				"$setOnInsert": bson.M{
+					DeadLetterConsumerKeyFieldName():   consumerKey,
+					DeadLetterFirstFailedAtFieldName(): now,
+				},
+				"$inc": bson.M{DeadLetterAttemptsFieldName(): 1},
+			}).
+			SetUpsert(true))
+	}
+
+	_, err := r.client.
+		DB().
+		Collection(collectionNameDeadLetters).
+		BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// DeadLettersQuery filters dead letters, all fields are optional.
+type DeadLettersQuery struct {
+	ConsumerKey string
+	ProcessID   string
+
+	// FailedFrom and FailedTo limit the last failure time.
+	FailedFrom time.Time
+	FailedTo   time.Time
+
+	Limit int64
+}
+
+func (q DeadLettersQuery) filter() bson.M {
+	filter := bson.M{}
+
+	if len(q.ConsumerKey) > 0 {
+		filter[DeadLetterConsumerKeyFieldName()] = q.ConsumerKey
+	}
+
+	if len(q.ProcessID) > 0 {
+		filter[DeadLetterEventProcessIDFieldName()] = q.ProcessID
+	}
+
+	if tsFilter := timeRangeFilter(q.FailedFrom, q.FailedTo); tsFilter != nil {
+		filter[DeadLetterLastFailedAtFieldName()] = tsFilter
+	}
+
+	return filter
+}
+
+// ListDeadLetters returns dead letters matching the query, the latest failed first.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListDeadLetters(ctx context.Context, query DeadLettersQuery) ([]DeadLetter, error) {
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameDeadLetters).
+		Find(
+			ctx,
+			query.filter(),
+			options.Find().
+				SetSort(bson.M{DeadLetterLastFailedAtFieldName(): -1}).
+				SetLimit(query.Limit),
+		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []DeadLetter
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// GetDeadLetter returns a dead letter by its ID.
+// Errors:
+// - oerrs.ErrNotFound: if there is no such dead letter.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) GetDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	var result DeadLetter
+
+	err := r.client.
+		DB().
+		Collection(collectionNameDeadLetters).
+		FindOne(ctx, bson.M{"_id": id}).
+		Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, oerrs.NewTErrf(ctx, "no such dead letter %s: %w", id, oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return result, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// DeleteDeadLetter deletes a dead letter, e.g. after it is replayed.
+// Errors:
+// - oerrs.ErrNotFound: if there is no such dead letter.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) DeleteDeadLetter(ctx context.Context, id string) error {
+	result, err := r.client.
+		DB().
+		Collection(collectionNameDeadLetters).
+		DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	if result.DeletedCount == 0 {
+		return oerrs.NewTErrf(ctx, "no such dead letter %s: %w", id, oerrs.ErrNotFound)
+	}
+
+	return nil
+}
+
+// PurgeDeadLetters deletes all dead letters matching the query (Limit is ignored)
+// and returns the number of deleted ones.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) PurgeDeadLetters(ctx context.Context, query DeadLettersQuery) (int64, error) {
+	result, err := r.client.
+		DB().
+		Collection(collectionNameDeadLetters).
+		DeleteMany(ctx, query.filter())
+	if err != nil {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,27 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestDeadLettersQueryFilter(t *testing.T) {
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, bson.M{}, DeadLettersQuery{Limit: 10}.filter())
+
+	assert.Equal(t, bson.M{
+		"ck":     "all_in_one",
+		"ev.pid": "p1",
+		"lf":     bson.M{"$gte": from},
+	}, DeadLettersQuery{ConsumerKey: "all_in_one", ProcessID: "p1", FailedFrom: from}.filter())
+}
+
+func TestDeadLetterID(t *testing.T) {
+	eventID := bson.NewObjectID()
+
+	assert.Equal(t, "all_in_one/"+eventID.Hex(), DeadLetterID("all_in_one", eventID))
+}
@@ -0,0 +1,163 @@
+package repo
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameExecutionAggregates = "execution_aggregates"
+
+	// idxNameExecutionAggregatesTTL is the replaced TTL index with a global period.
+	idxNameExecutionAggregatesTTL = "ttl_execution_aggregates"
+	idxNameExecutionAggregatesKey = "execution_aggregates_key"
+
+	// idxPrefixLabels is a prefix of configuration driven label indexes.
+	idxPrefixLabels         = "labels_"
+	idxNameLabelsWildcard   = idxPrefixLabels + "wildcard"
+	idxNameLabelsKeyPattern = idxPrefixLabels + "key_"
+)
+
+func (r *Repo) createExecutionAggregateIndexes(ctx context.Context) error {
+	err := r.createExpireAtIndex(
+		ctx,
+		collectionNameExecutionAggregates,
+		idxNameExecutionAggregatesExpireAt,
+		idxNameExecutionAggregatesTTL,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = r.client.CreateIndexes(ctx, collectionNameExecutionAggregates, []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: ExecutionAggregateProcessIDFieldName(), Value: 1},
+			{Key: ExecutionAggregateExecutionIDFieldName(), Value: 1},
+		},
+		Options: options.Index().SetName(idxNameExecutionAggregatesKey).SetUnique(true),
+	}})
+	if err != nil {
+		return err
+	}
+
+	return r.createLabelIndexes(ctx, collectionNameExecutionAggregates, ExecutionAggregateLabelsFieldName())
+}
+
+// createLabelIndexes creates a wildcard index over all labels
+// and a compound (ProcessID, label) index for every key from `INDEXED_LABEL_KEYS` (comma separated).
+// Indexes of keys which were removed from the configuration are dropped.
+func (r *Repo) createLabelIndexes(ctx context.Context, collection, labelsField string) error {
+	indexes := map[string]mongo.IndexModel{
+		idxNameLabelsWildcard: {
+			Keys: bson.D{{Key: labelsField + ".$**", Value: 1}},
+		},
+	}
+
+	for key := range strings.SplitSeq(os.Getenv("INDEXED_LABEL_KEYS"), ",") {
+		key = strings.TrimSpace(key)
+		if len(key) == 0 {
+			continue
+		}
+
+		err := ValidateLabelKey(key)
+		if err != nil {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
+		}
+
+		indexes[idxNameLabelsKeyPattern+key] = mongo.IndexModel{
+			Keys: bson.D{
+				{Key: SingleStageExecutionEventProcessIDFieldName(), Value: 1},
+				{Key: labelsField + "." + key, Value: 1},
+			},
+		}
+	}
+
+	return r.client.SyncIndexes(ctx, collection, idxPrefixLabels, indexes)
+}
+
+// mergeExecutionUpdate creates or updates the execution aggregate:
+// labels are merged, FirstEventAt and LastEventAt are widened to include the given ones.
+func mergeExecutionUpdate(execution ExecutionAggregate, updatedAt, expireAt time.Time) bson.M {
+	set := bson.M{
+		ExecutionAggregateWorkerIDFieldName():  execution.WorkerID,
+		ExecutionAggregateUpdatedAtFieldName(): updatedAt,
+		ExpireAtFieldName():                    expireAt,
+	}
+
+	for key, value := range execution.Labels {
+		set[ExecutionAggregateLabelsFieldName()+"."+key] = value
+	}
+
+	return bson.M{
+		"$set": set,
+		"$min": bson.M{ExecutionAggregateFirstEventAtFieldName(): execution.FirstEventAt},
+		"$max": bson.M{ExecutionAggregateLastEventAtFieldName(): execution.LastEventAt},
+	}
+}
+
+func executionAggregateFilter(processID, executionID string) bson.M {
+	return bson.M{
+		ExecutionAggregateProcessIDFieldName():   processID,
+		ExecutionAggregateExecutionIDFieldName(): executionID,
+	}
+}
+
+// ExecutionsQuery selects executions for ListExecutions.
+type ExecutionsQuery struct {
+	// ProcessID is optional.
+	ProcessID string
+
+	Labels LabelSelector
+
+	// StartedFrom and StartedTo are optional and limit ExecutionAggregate.FirstEventAt.
+	StartedFrom time.Time
+	StartedTo   time.Time
+
+	Limit int64
+}
+
+// ListExecutions returns executions matching the query ordered by ExecutionAggregate.FirstEventAt,
+// the latest first.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListExecutions(ctx context.Context, query ExecutionsQuery) ([]ExecutionAggregate, error) {
+	filter := query.Labels.Filter(ExecutionAggregateLabelsFieldName())
+
+	if len(query.ProcessID) > 0 {
+		filter[ExecutionAggregateProcessIDFieldName()] = query.ProcessID
+	}
+
+	if tsFilter := timeRangeFilter(query.StartedFrom, query.StartedTo); tsFilter != nil {
+		filter[ExecutionAggregateFirstEventAtFieldName()] = tsFilter
+	}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameExecutionAggregates).
+		Find(
+			ctx,
+			filter,
+			options.Find().
+				SetSort(bson.M{ExecutionAggregateFirstEventAtFieldName(): -1}).
+				SetLimit(query.Limit),
+		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []ExecutionAggregate
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
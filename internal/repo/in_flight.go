@@ -0,0 +1,79 @@
+package repo
+
+import (
+	"context"
+	"strconv"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// InFlightStageExecutions is a number of running stage executions of one stage of one process.
+type InFlightStageExecutions struct {
+	ProcessID string `bson:"pid"`
+	StageName string `bson:"sn"`
+	// Labels contains only requested label keys which are set.
+	Labels map[string]string `bson:"lb,omitempty"`
+
+	Count int64 `bson:"c"`
+}
+
+// CountInFlightStageExecutions counts not finished stage executions grouped by process, stage
+// and values of the given label keys.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) CountInFlightStageExecutions(
+	ctx context.Context,
+	labelKeys []string,
+) ([]InFlightStageExecutions, error) {
+	groupID := bson.M{
+		"pid": "$" + SingleStageExecutionEventProcessIDFieldName(),
+		"sn":  "$" + SingleStageExecutionEventRawStageNameFieldName(),
+	}
+
+	labels := bson.M{}
+
+	for i, key := range labelKeys {
+		// label keys may contain characters which are not allowed in field names of the group _id
+		field := "l" + strconv.Itoa(i)
+		groupID[field] = "$" + SingleStageExecutionEventLabelsFieldName() + "." + key
+		labels[key] = "$_id." + field
+	}
+
+	project := bson.M{
+		"_id": 0,
+		"pid": "$_id.pid",
+		"sn":  "$_id.sn",
+		"c":   1,
+	}
+
+	if len(labels) > 0 {
+		project["lb"] = labels
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{SingleStageExecutionEventIsFinishedFieldName(): false}},
+		{"$group": bson.M{
+			"_id": groupID,
+			"c":   bson.M{"$sum": 1},
+		}},
+		{"$project": project},
+	}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameSingleStageExec).
+		Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []InFlightStageExecutions
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,153 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type LabelOperator int
+
+const (
+	// LabelOperatorEquals matches if the label is set and equals to the value: `key=value` or `key==value`.
+	LabelOperatorEquals LabelOperator = 0
+	// LabelOperatorNotEquals matches if the label is not set or differs from the value: `key!=value`.
+	LabelOperatorNotEquals LabelOperator = 1
+	// LabelOperatorExists matches if the label is set: `key`.
+	LabelOperatorExists LabelOperator = 2
+	// LabelOperatorNotExists matches if the label is not set: `!key`.
+	LabelOperatorNotExists LabelOperator = 3
+)
+
+type LabelRequirement struct {
+	Key      string
+	Operator LabelOperator
+	Value    string
+}
+
+// LabelSelector is a conjunction of label requirements, e.g. `env=prod,region!=eu`.
+type LabelSelector []LabelRequirement
+
+// ValidateLabelKey checks that the key can be used as a key of a document field and in a LabelSelector.
+func ValidateLabelKey(key string) error {
+	if len(key) == 0 {
+		return errors.New("label key must be set")
+	}
+
+	if strings.ContainsAny(key, ".$,=! ") {
+		return fmt.Errorf("label key %q must not contain '.', '$', ',', '=', '!' or spaces", key)
+	}
+
+	return nil
+}
+
+// ParseLabelSelector parses a comma separated list of requirements.
+// Supported requirements are `key=value`, `key==value`, `key!=value`, `key` and `!key`.
+// Empty string is a valid selector which matches everything.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	result := LabelSelector{}
+
+	if len(strings.TrimSpace(selector)) == 0 {
+		return result, nil
+	}
+
+	var resultErr error
+
+	for part := range strings.SplitSeq(selector, ",") {
+		requirement, err := parseLabelRequirement(strings.TrimSpace(part))
+		if err != nil {
+			resultErr = errors.Join(resultErr, err)
+			continue
+		}
+
+		result = append(result, requirement)
+	}
+
+	return result, resultErr
+}
+
+func parseLabelRequirement(part string) (LabelRequirement, error) {
+	var requirement LabelRequirement
+
+	switch {
+	case strings.Contains(part, "!="):
+		key, value, _ := strings.Cut(part, "!=")
+		requirement = LabelRequirement{Key: key, Operator: LabelOperatorNotEquals, Value: value}
+	case strings.Contains(part, "=="):
+		key, value, _ := strings.Cut(part, "==")
+		requirement = LabelRequirement{Key: key, Operator: LabelOperatorEquals, Value: value}
+	case strings.Contains(part, "="):
+		key, value, _ := strings.Cut(part, "=")
+		requirement = LabelRequirement{Key: key, Operator: LabelOperatorEquals, Value: value}
+	case strings.HasPrefix(part, "!"):
+		requirement = LabelRequirement{Key: strings.TrimPrefix(part, "!"), Operator: LabelOperatorNotExists}
+	default:
+		requirement = LabelRequirement{Key: part, Operator: LabelOperatorExists}
+	}
+
+	requirement.Key = strings.TrimSpace(requirement.Key)
+	requirement.Value = strings.TrimSpace(requirement.Value)
+
+	err := ValidateLabelKey(requirement.Key)
+	if err != nil {
+		return requirement, fmt.Errorf("invalid label requirement %q: %w", part, err)
+	}
+
+	return requirement, nil
+}
+
+// Filter builds a MongoDB filter for documents which keep labels in the labelsField.
+func (s LabelSelector) Filter(labelsField string) bson.M {
+	if len(s) == 0 {
+		return bson.M{}
+	}
+
+	conditions := make(bson.A, 0, len(s))
+
+	for _, requirement := range s {
+		field := labelsField + "." + requirement.Key
+
+		switch requirement.Operator {
+		case LabelOperatorEquals:
+			conditions = append(conditions, bson.M{field: requirement.Value})
+		case LabelOperatorNotEquals:
+			conditions = append(conditions, bson.M{field: bson.M{"$ne": requirement.Value}})
+		case LabelOperatorExists:
+			conditions = append(conditions, bson.M{field: bson.M{"$exists": true}})
+		case LabelOperatorNotExists:
+			conditions = append(conditions, bson.M{field: bson.M{"$exists": false}})
+		}
+	}
+
+	return bson.M{"$and": conditions}
+}
+
+// Matches checks the selector against labels in memory, it is equivalent to Filter.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		value, ok := labels[requirement.Key]
+
+		switch requirement.Operator {
+		case LabelOperatorEquals:
+			if !ok || value != requirement.Value {
+				return false
+			}
+		case LabelOperatorNotEquals:
+			if ok && value == requirement.Value {
+				return false
+			}
+		case LabelOperatorExists:
+			if !ok {
+				return false
+			}
+		case LabelOperatorNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
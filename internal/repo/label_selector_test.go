@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	testCases := []struct {
+		name     string
+		selector string
+		expected LabelSelector
+		errParts []string
+	}{
+		{
+			name:     "empty selector",
+			selector: " ",
+			expected: LabelSelector{},
+		},
+		{
+			name:     "equals and not equals",
+			selector: "env=prod,region!=eu",
+			expected: LabelSelector{
+				{Key: "env", Operator: LabelOperatorEquals, Value: "prod"},
+				{Key: "region", Operator: LabelOperatorNotEquals, Value: "eu"},
+			},
+		},
+		{
+			name:     "double equals, exists and not exists with spaces",
+			selector: "customer == acme , sha, !canary",
+			expected: LabelSelector{
+				{Key: "customer", Operator: LabelOperatorEquals, Value: "acme"},
+				{Key: "sha", Operator: LabelOperatorExists},
+				{Key: "canary", Operator: LabelOperatorNotExists},
+			},
+		},
+		{
+			name:     "empty value",
+			selector: "env=",
+			expected: LabelSelector{
+				{Key: "env", Operator: LabelOperatorEquals, Value: ""},
+			},
+		},
+		{
+			name:     "invalid keys",
+			selector: "=prod,a.b=c,env=prod",
+			errParts: []string{"label key must be set", "must not contain"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selector, err := ParseLabelSelector(tc.selector)
+
+			if len(tc.errParts) == 0 {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, selector)
+				return
+			}
+
+			require.Error(t, err)
+
+			for _, expected := range tc.errParts {
+				assert.ErrorContains(t, err, expected)
+			}
+		})
+	}
+}
+
+func TestLabelSelectorFilter(t *testing.T) {
+	selector, err := ParseLabelSelector("env=prod,region!=eu,sha,!canary")
+	require.NoError(t, err)
+
+	assert.Equal(t, bson.M{"$and": bson.A{
+		bson.M{"lb.env": "prod"},
+		bson.M{"lb.region": bson.M{"$ne": "eu"}},
+		bson.M{"lb.sha": bson.M{"$exists": true}},
+		bson.M{"lb.canary": bson.M{"$exists": false}},
+	}}, selector.Filter("lb"))
+
+	assert.Equal(t, bson.M{}, LabelSelector{}.Filter("lb"))
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	selector, err := ParseLabelSelector("env=prod,region!=eu,sha,!canary")
+	require.NoError(t, err)
+
+	assert.True(t, selector.Matches(map[string]string{"env": "prod", "sha": "abc"}))
+	assert.True(t, selector.Matches(map[string]string{"env": "prod", "sha": "abc", "region": "us"}))
+	assert.False(t, selector.Matches(map[string]string{"env": "dev", "sha": "abc"}))
+	assert.False(t, selector.Matches(map[string]string{"env": "prod", "sha": "abc", "region": "eu"}))
+	assert.False(t, selector.Matches(map[string]string{"env": "prod"}))
+	assert.False(t, selector.Matches(map[string]string{"env": "prod", "sha": "abc", "canary": ""}))
+
+	assert.True(t, LabelSelector{}.Matches(nil))
+}
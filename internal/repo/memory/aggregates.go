@@ -0,0 +1,78 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/aggregation"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+)
+
+// AggregateWritesPaused is always false, aggregates of the storage are not rebuilt.
+func (s *Storage) AggregateWritesPaused(context.Context) (bool, error) {
+	return false, nil
+}
+
+// WriteAggregates applies the writes in the given order with the same semantics as repo.Repo.WriteAggregates.
+// A failed write stops the batch, so the following writes fail too.
+// Errors:
+// - joined *repo.AggregateWriteError: the writes which failed or were not applied.
+func (s *Storage) WriteAggregates(ctx context.Context, writes []repo.AggregateWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+
+	var errs []error
+
+	failedAt := -1
+
+	for i, write := range writes {
+		var err error
+
+		switch {
+		case failedAt >= 0:
+			err = oerrs.NewTErrf(ctx, "not applied because write %d failed: %w", failedAt, oerrs.ErrInternal)
+		case write.Kind == repo.AggregateWriteMergeExecution:
+			s.mergeExecution(write.Execution, now)
+		case write.Kind == repo.AggregateWriteMergeStageExecution && len(write.Events) > 0:
+			s.mergeStageExecution(write.Events, now)
+		default:
+			failedAt = i
+			err = oerrs.NewTErrf(ctx, "invalid write %s: %w", write, oerrs.ErrBadInput)
+		}
+
+		if err != nil {
+			errs = append(errs, &repo.AggregateWriteError{Index: i, Write: write, Err: err})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// mergeExecution merges the write into the stored execution aggregate.
+func (s *Storage) mergeExecution(write repo.ExecutionAggregate, now time.Time) {
+	key := executionKey{write.ProcessID, write.ExecutionID}
+
+	var stored *repo.ExecutionAggregate
+	if execution, ok := s.executions[key]; ok {
+		stored = &execution
+	}
+
+	s.executions[key] = aggregation.MergeExecution(stored, write, now)
+}
+
+// mergeStageExecution merges events of one stage execution sorted by Ts into its aggregate.
+func (s *Storage) mergeStageExecution(events []repo.Event, now time.Time) {
+	first := events[0]
+	key := stageKey{first.ProcessID, first.ExecutionID, first.StageExecutionID}
+
+	var stored *repo.SingleStageExecutionEvent
+	if stage, ok := s.stageExecutions[key]; ok {
+		stored = &stage
+	}
+
+	s.stageExecutions[key] = aggregation.MergeStageExecution(stored, events, now)
+}
@@ -0,0 +1,15 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/storagetest"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T, clock utils.Clock) repo.Storage {
+		return New(clock)
+	})
+}
@@ -0,0 +1,97 @@
+package memory
+
+import (
+	"context"
+	"maps"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/aggregation"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+)
+
+// GetSingleStageExecution returns the aggregate of a single stage execution
+// Errors:
+// - oerrs.ErrNotFound: if there is no such stage execution.
+func (s *Storage) GetSingleStageExecution(
+	ctx context.Context,
+	processID, executionID, stageExecutionID string,
+) (repo.SingleStageExecutionEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stage, ok := s.stageExecutions[stageKey{processID, executionID, stageExecutionID}]
+	if !ok {
+		return stage, oerrs.NewTErrf(ctx, "no such execution: %w", oerrs.ErrNotFound)
+	}
+
+	return aggregation.CloneStageExecution(stage), nil
+}
+
+// ListStageExecutions returns stage executions matching the query ordered by start time, the latest first.
+func (s *Storage) ListStageExecutions(
+	_ context.Context,
+	query repo.StageExecutionsQuery,
+) ([]repo.SingleStageExecutionEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []repo.SingleStageExecutionEvent
+
+	for _, stage := range s.stageExecutions {
+		if aggregation.MatchesStageExecution(query, stage) {
+			result = append(result, aggregation.CloneStageExecution(stage))
+		}
+	}
+
+	aggregation.SortStageExecutions(result)
+
+	return aggregation.Limit(result, query.Limit), nil
+}
+
+// ListExecutions returns executions matching the query ordered by repo.ExecutionAggregate.FirstEventAt,
+// the latest first.
+func (s *Storage) ListExecutions(_ context.Context, query repo.ExecutionsQuery) ([]repo.ExecutionAggregate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []repo.ExecutionAggregate
+
+	for _, execution := range s.executions {
+		if aggregation.MatchesExecution(query, execution) {
+			execution.Labels = maps.Clone(execution.Labels)
+			result = append(result, execution)
+		}
+	}
+
+	aggregation.SortExecutions(result)
+
+	return aggregation.Limit(result, query.Limit), nil
+}
+
+// AggregateStageMetrics aggregates metrics of stage executions of a process across executions
+// and groups them into time buckets, see repo.Repo.AggregateStageMetrics.
+// Errors:
+// - oerrs.ErrBadInput: if bucket size is less than a second or the time range is empty.
+func (s *Storage) AggregateStageMetrics(
+	ctx context.Context,
+	query repo.StageMetricsQuery,
+) ([]repo.StageMetricBucket, error) {
+	err := aggregation.ValidateStageMetricsQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// as in MongoDB, the ProcessID is required
+	if len(query.ProcessID) == 0 {
+		return make([]repo.StageMetricBucket, 0), nil
+	}
+
+	stages, _ := s.ListStageExecutions(ctx, repo.StageExecutionsQuery{
+		ProcessID:   query.ProcessID,
+		StageName:   query.StageName,
+		StartedFrom: query.From,
+		StartedTo:   query.To,
+	})
+
+	return aggregation.StageMetricBuckets(stages, query.Bucket), nil
+}
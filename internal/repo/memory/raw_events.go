@@ -0,0 +1,181 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const tokenSeqField = "seq"
+
+type rawEvent struct {
+	event      repo.Event
+	appendedAt time.Time
+}
+
+// token is a position in the raw events log, it resumes watching right after the event at seq.
+type token struct {
+	raw bson.Raw
+}
+
+func newToken(seq int) token {
+	raw, _ := bson.Marshal(bson.D{{Key: tokenSeqField, Value: int64(seq)}})
+
+	return token{raw: raw}
+}
+
+func (t token) ResumeToken() bson.Raw {
+	return t.raw
+}
+
+// AppendRawEvents appends events to the raw events log, events get new IDs if they have none.
+func (s *Storage) AppendRawEvents(_ context.Context, events []repo.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+
+	for _, event := range events {
+		event = event.Copy()
+		if event.ID.IsZero() {
+			event.ID = bson.NewObjectID()
+		}
+
+		s.rawEvents = append(s.rawEvents, rawEvent{event: event, appendedAt: now})
+	}
+
+	close(s.appended)
+	s.appended = make(chan struct{})
+
+	return nil
+}
+
+// GetRawExecutionEvents returns raw events of the execution sorted by Ts.
+func (s *Storage) GetRawExecutionEvents(_ context.Context, processID, executionID string) ([]repo.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []repo.Event
+
+	for _, raw := range s.rawEvents {
+		if raw.event.ProcessID == processID && raw.event.ExecutionID == executionID {
+			result = append(result, raw.event.Copy())
+		}
+	}
+
+	slices.SortStableFunc(result, func(a, b repo.Event) int {
+		return a.Ts.Compare(b.Ts)
+	})
+
+	return result, nil
+}
+
+// WatchRawEvents calls the action for every appended raw event of the partition from the given position
+// until the context is done, events which are already aggregated (Event.Aggregated) are skipped.
+// The action gets an Idle model once the feed is read up to skipped events.
+// Errors:
+// - oerrs.ErrBadInput: if the token is not a token of this storage.
+func (s *Storage) WatchRawEvents(
+	ctx context.Context,
+	from repo.ChangeStreamPosition,
+	partition repo.Partition,
+	action common.CallbackFailable[repo.RawEventWatchModel],
+) error {
+	next, err := s.watchStart(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	// delivered is the position of the last token given to the action
+	delivered := next
+
+	for {
+		events, appended := s.rawEventsFrom(next)
+
+		for _, event := range events {
+			next++
+
+			if event.Aggregated || !partition.Contains(event.ProcessID) {
+				continue
+			}
+
+			delivered = next
+
+			err := action(ctx, repo.RawEventWatchModel{Record: event, Token: newToken(next)})
+			if err != nil {
+				return err
+			}
+		}
+
+		// the last events are skipped, the action moves past them
+		if delivered != next {
+			delivered = next
+
+			err := action(ctx, repo.RawEventWatchModel{Token: newToken(next), Idle: true})
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// watchStart returns the index of the first raw event to watch.
+func (s *Storage) watchStart(ctx context.Context, from repo.ChangeStreamPosition) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(from.Token) > 0 {
+		seq, ok := from.Token.Lookup(tokenSeqField).AsInt64OK()
+		if !ok || seq < 0 || seq > int64(len(s.rawEvents)) {
+			return 0, oerrs.NewTErrf(ctx, "unknown change stream token %s: %w", from.Token, oerrs.ErrBadInput)
+		}
+
+		return int(seq), nil
+	}
+
+	if from.StartAt.IsZero() {
+		return len(s.rawEvents), nil
+	}
+
+	index := slices.IndexFunc(s.rawEvents, func(event rawEvent) bool {
+		return !event.appendedAt.Before(from.StartAt)
+	})
+	if index < 0 {
+		return len(s.rawEvents), nil
+	}
+
+	return index, nil
+}
+
+// rawEventsFrom returns copies of raw events from the index and a channel which is closed on the next append.
+func (s *Storage) rawEventsFrom(index int) ([]repo.Event, <-chan struct{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]repo.Event, 0, len(s.rawEvents)-index)
+	for _, raw := range s.rawEvents[index:] {
+		result = append(result, raw.event.Copy())
+	}
+
+	return result, s.appended
+}
+
+// CompareChangeStreamTokens orders tokens by the seq of the event they resume after.
+func (s *Storage) CompareChangeStreamTokens(a, b bson.Raw) int {
+	seqA, _ := a.Lookup(tokenSeqField).AsInt64OK()
+	seqB, _ := b.Lookup(tokenSeqField).AsInt64OK()
+
+	return cmp.Compare(seqA, seqB)
+}
@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/aggregation"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// AppendStageLogLines appends log lines to the logs of their stage executions.
+// Lines of one stage execution are ordered by Ts and get sequential repo.StageLogLine.Seq.
+// Only the first maxLinesPerStage lines of a stage execution are stored, the rest is dropped.
+// Lines with a repo.StageLogLine.LineID which is already stored are skipped, see repo.SkipStoredStageLogLines.
+//
+// Returns the amount of dropped lines.
+func (s *Storage) AppendStageLogLines(
+	_ context.Context,
+	lines []repo.StageLogLine,
+	maxLinesPerStage int64,
+) (int, error) {
+	grouped := map[stageKey][]repo.StageLogLine{}
+	for _, line := range lines {
+		key := stageKey{line.ProcessID, line.ExecutionID, line.StageExecutionID}
+		grouped[key] = append(grouped[key], line)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+	dropped := 0
+
+	for key, group := range grouped {
+		slices.SortStableFunc(group, func(a, b repo.StageLogLine) int {
+			return a.Ts.Compare(b.Ts)
+		})
+
+		storedIDs := map[string]struct{}{}
+		for _, line := range s.stageLogs[key] {
+			storedIDs[line.LineID] = struct{}{}
+		}
+
+		pending := repo.SkipStoredStageLogLines(group, storedIDs)
+
+		firstSeq := s.stageLogCounters[key]
+		s.stageLogCounters[key] += int64(len(pending))
+
+		for i, line := range pending {
+			seq := firstSeq + int64(i)
+			if seq >= maxLinesPerStage {
+				dropped += len(pending) - i
+				break
+			}
+
+			line.ID = bson.NewObjectID()
+			line.Seq = seq
+			line.CreatedAt = now
+			line.Attributes = maps.Clone(line.Attributes)
+			s.stageLogs[key] = append(s.stageLogs[key], line)
+		}
+	}
+
+	return dropped, nil
+}
+
+// GetStageLogLines returns up to limit log lines of the stage execution with repo.StageLogLine.Seq >= fromSeq
+// ordered by repo.StageLogLine.Seq.
+func (s *Storage) GetStageLogLines(
+	_ context.Context,
+	processID, executionID, stageExecutionID string,
+	fromSeq int64,
+	limitLines int64,
+) ([]repo.StageLogLine, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]repo.StageLogLine, 0)
+
+	// lines are appended in the order of their Seq
+	for _, line := range s.stageLogs[stageKey{processID, executionID, stageExecutionID}] {
+		if line.Seq >= fromSeq {
+			line.Attributes = maps.Clone(line.Attributes)
+			result = append(result, line)
+		}
+	}
+
+	return aggregation.Limit(result, limitLines), nil
+}
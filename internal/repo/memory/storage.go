@@ -0,0 +1,95 @@
+// Package memory implements repo.Storage in memory, e.g. for unit tests and for the dev mode
+// which doesn't need MongoDB. Nothing is persisted and nothing expires, retention policies are ignored.
+package memory
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var _ repo.Storage = (*Storage)(nil)
+
+type stageKey struct {
+	processID, executionID, stageExecutionID string
+}
+
+type executionKey struct {
+	processID, executionID string
+}
+
+// Storage is safe for concurrent use.
+type Storage struct {
+	clock utils.Clock
+
+	mu sync.RWMutex
+	// rawEvents is the raw events log in the order of appending, a position in it is a change feed token.
+	rawEvents []rawEvent
+	// appended is closed and replaced on every append, so watchers wake up.
+	appended chan struct{}
+
+	stageExecutions map[stageKey]repo.SingleStageExecutionEvent
+	executions      map[executionKey]repo.ExecutionAggregate
+	tokens          map[string]bson.Raw
+
+	stageLogs        map[stageKey][]repo.StageLogLine
+	stageLogCounters map[stageKey]int64
+}
+
+func New(clock utils.Clock) *Storage {
+	return &Storage{
+		clock:            clock,
+		appended:         make(chan struct{}),
+		stageExecutions:  map[stageKey]repo.SingleStageExecutionEvent{},
+		executions:       map[executionKey]repo.ExecutionAggregate{},
+		tokens:           map[string]bson.Raw{},
+		stageLogs:        map[stageKey][]repo.StageLogLine{},
+		stageLogCounters: map[stageKey]int64{},
+	}
+}
+
+func (s *Storage) SaveChangeStreamToken(_ context.Context, key string, token bson.Raw) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[key] = slices.Clone(token)
+
+	return nil
+}
+
+// LoadChangeStreamToken returns the token saved by SaveChangeStreamToken.
+// Errors:
+// - oerrs.ErrNotFound: if there is no token for the key.
+func (s *Storage) LoadChangeStreamToken(ctx context.Context, key string) (bson.Raw, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.tokens[key]
+	if !ok {
+		return nil, oerrs.NewTErrf(ctx, "no change stream token for %q: %w", key, oerrs.ErrNotFound)
+	}
+
+	return slices.Clone(token), nil
+}
+
+// LoadChangeStreamTokens returns tokens saved under the key and the keys of its partitions ("key/...").
+func (s *Storage) LoadChangeStreamTokens(_ context.Context, key string) (map[string]bson.Raw, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := map[string]bson.Raw{}
+
+	for tokenKey, token := range s.tokens {
+		if tokenKey == key || strings.HasPrefix(tokenKey, key+"/") {
+			result[tokenKey] = slices.Clone(token)
+		}
+	}
+
+	return result, nil
+}
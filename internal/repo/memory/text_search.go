@@ -0,0 +1,31 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/aggregation"
+)
+
+// SearchStageExecutions searches words and phrases in failures, metadata and stage descriptions
+// of stage executions. Results are ranked by relevance, the most relevant first.
+// Unlike MongoDB, words are matched as they are, without stemming and stop words.
+// Errors:
+// - oerrs.ErrBadInput: if the search text is empty.
+func (s *Storage) SearchStageExecutions(
+	ctx context.Context,
+	query repo.StageExecutionsSearchQuery,
+) ([]repo.StageExecutionSearchResult, error) {
+	err := aggregation.ValidateSearchQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	stages, _ := s.ListStageExecutions(ctx, repo.StageExecutionsQuery{
+		ProcessID:   query.ProcessID,
+		StartedFrom: query.StartedFrom,
+		StartedTo:   query.StartedTo,
+	})
+
+	return aggregation.Limit(aggregation.SearchStageExecutions(query.Text, stages), query.Limit), nil
+}
@@ -1,7 +1,14 @@
 package repo
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -20,12 +27,13 @@ const (
 	// EventKindGenericUpdate describes any other event that might happen during the execution.
 	EventKindGenericUpdate EventKind = 2
 
+	// EventStatusUnknown is used by events that do not carry a result, like EventKindStageStarted.
 	EventStatusUnknown EventStatus = 0
 	// EventStatusSuccess describes successful stage execution.
 	EventStatusSuccess EventStatus = 1
 	// EventStatusFailure describes failed stage execution
 	// If a stage has failed, the output field will be empty.
-	EventStatusFailure EventStatus = 1
+	EventStatusFailure EventStatus = 2
 )
 
 func (kind EventKind) IsValid() bool {
@@ -33,7 +41,7 @@ func (kind EventKind) IsValid() bool {
 }
 
 func (status EventStatus) IsValid() bool {
-	return status >= EventStatusSuccess && status <= EventStatusFailure
+	return status >= EventStatusUnknown && status <= EventStatusFailure
 }
 
 type RawStage struct {
@@ -55,6 +63,25 @@ func RawStageNameFieldName() string {
 	return "n"
 }
 
+// Metric is a single numeric value reported by a stage, e.g. rows processed or bytes written.
+type Metric struct {
+	Value float64 `bson:"v"`
+	Unit  string  `bson:"u,omitempty"`
+}
+
+// ValidateMetricName checks that the name can be used as a key of a document field.
+func ValidateMetricName(name string) error {
+	if len(name) == 0 {
+		return errors.New("metric name must be set")
+	}
+
+	if strings.ContainsAny(name, ".$") {
+		return fmt.Errorf("metric name %q must not contain '.' or '$'", name)
+	}
+
+	return nil
+}
+
 type Event struct {
 	ID bson.ObjectID `bson:"_id,omitempty"`
 
@@ -77,6 +104,13 @@ type Event struct {
 	Failure bson.Raw `bson:"f,omitempty"`
 	// Metadata is an optional field that can be used to store any additional information.
 	Metadata bson.Raw `bson:"m,omitempty"`
+	// Metrics is an optional set of numeric values reported by the stage, keyed by metric name.
+	Metrics map[string]Metric `bson:"mt,omitempty"`
+	// Labels is an optional set of tags (env, customer, git SHA, etc.) which are merged
+	// into the stage execution and the execution aggregates.
+	Labels map[string]string `bson:"lb,omitempty"`
+	// Aggregated is set on raw events which are already aggregated by the API, the consumer skips them.
+	Aggregated bool `bson:"agg,omitempty"`
 }
 
 func (e Event) Validate() error {
@@ -114,6 +148,14 @@ func (e Event) Validate() error {
 		resultErr = errors.Join(resultErr, errors.New(".Status must be valid"))
 	}
 
+	for name := range e.Metrics {
+		resultErr = errors.Join(resultErr, ValidateMetricName(name))
+	}
+
+	for key := range e.Labels {
+		resultErr = errors.Join(resultErr, ValidateLabelKey(key))
+	}
+
 	return errors.Join(resultErr, e.Stage.Validate())
 }
 
@@ -140,6 +182,16 @@ func (e Event) Copy() Event {
 		copy(metadataCp, e.Metadata)
 	}
 
+	var metricsCp map[string]Metric
+	if len(e.Metrics) > 0 {
+		metricsCp = maps.Clone(e.Metrics)
+	}
+
+	var labelsCp map[string]string
+	if len(e.Labels) > 0 {
+		labelsCp = maps.Clone(e.Labels)
+	}
+
 	return Event{
 		ID:               e.ID,
 		ProcessID:        e.ProcessID,
@@ -154,13 +206,55 @@ func (e Event) Copy() Event {
 		Output:           outputCp,
 		Failure:          failureCp,
 		Metadata:         metadataCp,
+		Metrics:          metricsCp,
+		Labels:           labelsCp,
+		Aggregated:       e.Aggregated,
 	}
 }
 
+// Key identifies the event by its content, so a redelivered, replayed or imported event has the same key
+// whatever its ID. Maps are hashed in the order of their keys, the encoding of maps is not stable.
+func (e Event) Key() string {
+	metrics, labels := e.Metrics, e.Labels
+	e.ID, e.Aggregated, e.Metrics, e.Labels = bson.ObjectID{}, false, nil, nil
+
+	hash := sha256.New()
+
+	// an event of valid fields is always encoded, a failure only weakens the key
+	encoded, _ := bson.Marshal(e)
+	hash.Write(encoded)
+
+	for _, name := range slices.Sorted(maps.Keys(metrics)) {
+		_, _ = fmt.Fprintf(hash, "m%d:%s%v:%s", len(name), name, metrics[name].Value, metrics[name].Unit)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		_, _ = fmt.Fprintf(hash, "l%d:%s%d:%s", len(key), key, len(labels[key]), labels[key])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
 func RawEventGetTsFieldName() string {
 	return "ts"
 }
 
+func RawEventProcessIDFieldName() string {
+	return "pid"
+}
+
+func RawEventExecutionIDFieldName() string {
+	return "eid"
+}
+
+func RawEventStatusFieldName() string {
+	return "st"
+}
+
+func RawEventAggregatedFieldName() string {
+	return "agg"
+}
+
 type SingleStageExecutionEvent struct {
 	ProcessID        string `bson:"pid"`
 	WorkerID         string `bson:"wid"`
@@ -176,15 +270,38 @@ type SingleStageExecutionEvent struct {
 	IsFinished bool `bson:"if"`
 	IsSuccess  bool `bson:"is"`
 
+	// Metrics contains the last and summed values of every metric reported by the stage execution.
+	Metrics map[string]StageMetric `bson:"mt,omitempty"`
+	// MetricEvents are sorted keys (Event.Key) of events whose metrics are summed in Metrics,
+	// so a redelivered event is not counted twice.
+	MetricEvents []string `bson:"mk,omitempty"`
+	// Labels are merged labels of all events of the stage execution.
+	Labels map[string]string `bson:"lb,omitempty"`
+
+	// FailureText and MetadataText are string values extracted from Event.Failure and Event.Metadata
+	// of all events of the stage execution. They exist only for the full-text search.
+	FailureText  []string `bson:"ft,omitempty"`
+	MetadataText []string `bson:"mx,omitempty"`
+
 	UpdatedAt time.Time `bson:"ua"`
 }
 
+// StageMetric is an aggregate of one metric across all events of a stage execution.
+type StageMetric struct {
+	Last float64 `bson:"l"`
+	// LastAt is the Ts of the event which reported Last.
+	LastAt time.Time `bson:"t,omitempty"`
+	Sum    float64   `bson:"s"`
+	Count  int64     `bson:"c"`
+	Unit   string    `bson:"u,omitempty"`
+}
+
 func SingleStageExecutionEventUpdateAtFieldName() string {
 	return "ua"
 }
 
 func SingleStageExecutionEventProcessIDFieldName() string {
-	return "oid"
+	return "pid"
 }
 
 func SingleStageExecutionEventExecutionIDFieldName() string {
@@ -214,3 +331,568 @@ func SingleStageExecutionEventEndFieldName() string {
 func SingleStageExecutionEventRawStageNameFieldName() string {
 	return "rs" + "." + RawStageNameFieldName()
 }
+
+func SingleStageExecutionEventMetricsFieldName() string {
+	return "mt"
+}
+
+func SingleStageExecutionEventMetricEventsFieldName() string {
+	return "mk"
+}
+
+func SingleStageExecutionEventStartTsFieldName() string {
+	return "s" + "." + RawEventGetTsFieldName()
+}
+
+func SingleStageExecutionEventWorkerIDFieldName() string {
+	return "wid"
+}
+
+func SingleStageExecutionEventRawStageFieldName() string {
+	return "rs"
+}
+
+func SingleStageExecutionEventStartFieldName() string {
+	return "s"
+}
+
+func SingleStageExecutionEventLabelsFieldName() string {
+	return "lb"
+}
+
+func SingleStageExecutionEventFailureTextFieldName() string {
+	return "ft"
+}
+
+func SingleStageExecutionEventMetadataTextFieldName() string {
+	return "mx"
+}
+
+func SingleStageExecutionEventRawStageDescriptionFieldName() string {
+	return "rs" + "." + "d"
+}
+
+// ExecutionAggregate describes one execution of a process across all its stages.
+type ExecutionAggregate struct {
+	ProcessID   string `bson:"pid"`
+	ExecutionID string `bson:"eid"`
+	WorkerID    string `bson:"wid"`
+
+	// Labels are merged labels of all events of the execution.
+	Labels map[string]string `bson:"lb,omitempty"`
+
+	// FirstEventAt is the Ts of the earliest event of the execution.
+	FirstEventAt time.Time `bson:"fa"`
+	// LastEventAt is the Ts of the latest event of the execution.
+	LastEventAt time.Time `bson:"la"`
+
+	UpdatedAt time.Time `bson:"ua"`
+}
+
+func ExecutionAggregateProcessIDFieldName() string {
+	return "pid"
+}
+
+func ExecutionAggregateExecutionIDFieldName() string {
+	return "eid"
+}
+
+func ExecutionAggregateWorkerIDFieldName() string {
+	return "wid"
+}
+
+func ExecutionAggregateLabelsFieldName() string {
+	return "lb"
+}
+
+func ExecutionAggregateFirstEventAtFieldName() string {
+	return "fa"
+}
+
+func ExecutionAggregateLastEventAtFieldName() string {
+	return "la"
+}
+
+func ExecutionAggregateUpdatedAtFieldName() string {
+	return "ua"
+}
+
+type LogLevel int
+
+const (
+	LogLevelUnknown LogLevel = 0
+	LogLevelDebug   LogLevel = 1
+	LogLevelInfo    LogLevel = 2
+	LogLevelWarn    LogLevel = 3
+	LogLevelError   LogLevel = 4
+)
+
+func (level LogLevel) IsValid() bool {
+	return level >= LogLevelUnknown && level <= LogLevelError
+}
+
+// StageLogLine is a single line of stdout/stderr (or any other log) produced by a stage execution.
+type StageLogLine struct {
+	ID bson.ObjectID `bson:"_id,omitempty"`
+
+	ProcessID        string `bson:"pid"`
+	ExecutionID      string `bson:"eid"`
+	StageExecutionID string `bson:"seid"`
+
+	WorkerID string `bson:"wid"`
+
+	// Seq is a position of the line within the stage execution. It is assigned by the repo on append.
+	Seq        int64             `bson:"sq"`
+	Level      LogLevel          `bson:"lv"`
+	Message    string            `bson:"msg"`
+	Ts         time.Time         `bson:"ts"`
+	Attributes map[string]string `bson:"a,omitempty"`
+
+	// CreatedAt is set by the repo on append and is used for TTL.
+	CreatedAt time.Time `bson:"ca"`
+
+	// LineID is an optional ID of the line within its stage execution given by the client,
+	// e.g. an offset in the log of the worker. A line with a LineID is stored once, a retried append skips it.
+	LineID string `bson:"lid,omitempty"`
+}
+
+func (l StageLogLine) Validate() error {
+	var resultErr error
+
+	if !l.ID.IsZero() {
+		resultErr = errors.Join(resultErr, errors.New("ID must be empty"))
+	}
+
+	if len(l.ProcessID) == 0 {
+		resultErr = errors.Join(resultErr, errors.New("ProcessID must be set"))
+	}
+
+	if len(l.WorkerID) == 0 {
+		resultErr = errors.Join(resultErr, errors.New("WorkerID must be set"))
+	}
+
+	if len(l.ExecutionID) == 0 {
+		resultErr = errors.Join(resultErr, errors.New("ExecutionID must be set"))
+	}
+
+	if len(l.StageExecutionID) == 0 {
+		resultErr = errors.Join(resultErr, errors.New("StageExecutionID must be set"))
+	}
+
+	if l.Ts.IsZero() {
+		resultErr = errors.Join(resultErr, errors.New("TS must be set"))
+	}
+
+	if !l.Level.IsValid() {
+		resultErr = errors.Join(resultErr, errors.New(".Level must be valid"))
+	}
+
+	return resultErr
+}
+
+// SkipStoredStageLogLines returns the lines of one stage execution whose StageLogLine.LineID is neither stored
+// nor repeats an earlier line. Lines without a LineID are always returned.
+func SkipStoredStageLogLines(lines []StageLogLine, storedIDs map[string]struct{}) []StageLogLine {
+	seen := maps.Clone(storedIDs)
+	if seen == nil {
+		seen = map[string]struct{}{}
+	}
+
+	return slices.DeleteFunc(lines, func(line StageLogLine) bool {
+		if len(line.LineID) == 0 {
+			return false
+		}
+
+		_, ok := seen[line.LineID]
+		seen[line.LineID] = struct{}{}
+
+		return ok
+	})
+}
+
+func StageLogLineSeqFieldName() string {
+	return "sq"
+}
+
+func StageLogLineCreatedAtFieldName() string {
+	return "ca"
+}
+
+func StageLogLineLineIDFieldName() string {
+	return "lid"
+}
+
+type AlertState int
+
+const (
+	AlertStateFiring   AlertState = 1
+	AlertStateResolved AlertState = 2
+)
+
+// Alert is a state of one alerting rule for one subject (process and stage).
+// There is at most one Alert per Fingerprint, so an alert that keeps firing is not duplicated.
+type Alert struct {
+	Fingerprint string `bson:"_id"`
+
+	Rule      string `bson:"r"`
+	RuleType  string `bson:"rt"`
+	ProcessID string `bson:"pid"`
+	StageName string `bson:"sn"`
+
+	State     AlertState `bson:"st"`
+	Value     float64    `bson:"v"`
+	Threshold float64    `bson:"th"`
+	Message   string     `bson:"msg"`
+
+	StartedAt       time.Time `bson:"sa"`
+	ResolvedAt      time.Time `bson:"ra,omitempty"`
+	LastEvaluatedAt time.Time `bson:"le"`
+}
+
+func AlertStateFieldName() string {
+	return "st"
+}
+
+// StageStat is a summary of stage executions of one stage of one process.
+type StageStat struct {
+	ProcessID string `bson:"pid"`
+	StageName string `bson:"sn"`
+
+	Total    int64 `bson:"t"`
+	Finished int64 `bson:"fn"`
+	Failed   int64 `bson:"fl"`
+
+	LastStartedAt time.Time `bson:"ls,omitempty"`
+
+	// LastFinished describes the stage execution which finished last.
+	LastFinished struct {
+		IsFinished bool      `bson:"f"`
+		IsSuccess  bool      `bson:"s"`
+		Ts         time.Time `bson:"ts,omitempty"`
+	} `bson:"lf"`
+
+	// MaxDurationMs is the longest duration of a stage execution in milliseconds.
+	// Running stage executions are taken into account with their current duration.
+	MaxDurationMs int64 `bson:"md"`
+}
+
+func (s StageStat) MaxDuration() time.Duration {
+	return time.Duration(s.MaxDurationMs) * time.Millisecond
+}
+
+// WebhookEventType is a state transition of a stage or an execution which webhooks are sent for.
+type WebhookEventType string
+
+const (
+	WebhookEventStageStarted       WebhookEventType = "stage.started"
+	WebhookEventStageSucceeded     WebhookEventType = "stage.succeeded"
+	WebhookEventStageFailed        WebhookEventType = "stage.failed"
+	WebhookEventExecutionSucceeded WebhookEventType = "execution.succeeded"
+	WebhookEventExecutionFailed    WebhookEventType = "execution.failed"
+)
+
+func (t WebhookEventType) IsValid() bool {
+	switch t {
+	case WebhookEventStageStarted,
+		WebhookEventStageSucceeded,
+		WebhookEventStageFailed,
+		WebhookEventExecutionSucceeded,
+		WebhookEventExecutionFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// WebhookSubscription is an HTTP endpoint which receives webhooks about stage and execution state transitions.
+// Empty filters match everything.
+type WebhookSubscription struct {
+	ID   bson.ObjectID `bson:"_id,omitempty"`
+	Name string        `bson:"n"`
+
+	URL string `bson:"url"`
+	// Secret is a key of HMAC-SHA256 signature of the payload.
+	Secret string `bson:"sec"`
+
+	ProcessID string             `bson:"pid,omitempty"`
+	StageName string             `bson:"sn,omitempty"`
+	Events    []WebhookEventType `bson:"ev,omitempty"`
+	// LabelSelector is a string in the format accepted by ParseLabelSelector.
+	LabelSelector string `bson:"ls,omitempty"`
+
+	CreatedAt time.Time `bson:"ca"`
+}
+
+func (s WebhookSubscription) Validate() error {
+	var err error
+
+	if len(s.Name) == 0 {
+		err = errors.Join(err, errors.New("name must be set"))
+	}
+
+	u, parseErr := url.Parse(s.URL)
+	if parseErr != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		err = errors.Join(err, fmt.Errorf("url %q must be an absolute http(s) url", s.URL))
+	}
+
+	if len(s.Secret) == 0 {
+		err = errors.Join(err, errors.New("secret must be set"))
+	}
+
+	for _, event := range s.Events {
+		if !event.IsValid() {
+			err = errors.Join(err, fmt.Errorf("unknown event %q", event))
+		}
+	}
+
+	_, selectorErr := ParseLabelSelector(s.LabelSelector)
+	if selectorErr != nil {
+		err = errors.Join(err, selectorErr)
+	}
+
+	return err
+}
+
+type WebhookDeliveryStatus int
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = 1
+	WebhookDeliveryDelivered WebhookDeliveryStatus = 2
+	// WebhookDeliveryFailed means all attempts are exhausted and the delivery won't be retried.
+	WebhookDeliveryFailed WebhookDeliveryStatus = 3
+)
+
+// WebhookDelivery is one webhook for one subscription.
+// Pending deliveries form a queue, so a delivery is retried even after a restart,
+// and all deliveries form a delivery log of the subscription.
+type WebhookDelivery struct {
+	// ID is derived from the subscription and the event, so the same event is never enqueued twice.
+	ID             string           `bson:"_id"`
+	SubscriptionID bson.ObjectID    `bson:"sid"`
+	Event          WebhookEventType `bson:"ev"`
+
+	ProcessID        string `bson:"pid"`
+	ExecutionID      string `bson:"eid"`
+	StageExecutionID string `bson:"seid,omitempty"`
+
+	// Payload is a body of the request, it is built once, so every attempt sends the same bytes.
+	Payload []byte `bson:"p"`
+
+	Status         WebhookDeliveryStatus `bson:"st"`
+	Attempts       int                   `bson:"at"`
+	LastStatusCode int                   `bson:"sc,omitempty"`
+	LastError      string                `bson:"le,omitempty"`
+	NextAttemptAt  time.Time             `bson:"na"`
+
+	CreatedAt   time.Time `bson:"ca"`
+	DeliveredAt time.Time `bson:"da,omitempty"`
+}
+
+func WebhookDeliverySubscriptionIDFieldName() string {
+	return "sid"
+}
+
+func WebhookDeliveryStatusFieldName() string {
+	return "st"
+}
+
+func WebhookDeliveryAttemptsFieldName() string {
+	return "at"
+}
+
+func WebhookDeliveryLastStatusCodeFieldName() string {
+	return "sc"
+}
+
+func WebhookDeliveryLastErrorFieldName() string {
+	return "le"
+}
+
+func WebhookDeliveryNextAttemptAtFieldName() string {
+	return "na"
+}
+
+func WebhookDeliveryCreatedAtFieldName() string {
+	return "ca"
+}
+
+func WebhookDeliveryDeliveredAtFieldName() string {
+	return "da"
+}
+
+// DeadLetter is a raw event which the consumer failed to handle.
+type DeadLetter struct {
+	// ID is derived from the consumer key and the event ID, so repeated failures update the same entry.
+	ID          string `bson:"_id"`
+	ConsumerKey string `bson:"ck"`
+	Event       Event  `bson:"ev"`
+
+	// Error is the error of the last failure.
+	Error    string `bson:"err"`
+	Attempts int    `bson:"at"`
+
+	FirstFailedAt time.Time `bson:"ff"`
+	LastFailedAt  time.Time `bson:"lf"`
+}
+
+func DeadLetterID(consumerKey string, eventID bson.ObjectID) string {
+	return consumerKey + "/" + eventID.Hex()
+}
+
+func DeadLetterConsumerKeyFieldName() string {
+	return "ck"
+}
+
+func DeadLetterEventFieldName() string {
+	return "ev"
+}
+
+func DeadLetterEventProcessIDFieldName() string {
+	return "ev.pid"
+}
+
+func DeadLetterErrorFieldName() string {
+	return "err"
+}
+
+func DeadLetterAttemptsFieldName() string {
+	return "at"
+}
+
+func DeadLetterFirstFailedAtFieldName() string {
+	return "ff"
+}
+
+func DeadLetterLastFailedAtFieldName() string {
+	return "lf"
+}
+
+// ConsumerLease is an exclusive right of an instance to consume a partition until ExpiresAt.
+type ConsumerLease struct {
+	ID          string    `bson:"_id"`
+	ConsumerKey string    `bson:"ck"`
+	Partition   int       `bson:"p"`
+	Owner       string    `bson:"o"`
+	ExpiresAt   time.Time `bson:"exp"`
+}
+
+// ConsumerMember is a live instance of a consumer group.
+type ConsumerMember struct {
+	ID          string    `bson:"_id"`
+	ConsumerKey string    `bson:"ck"`
+	Instance    string    `bson:"i"`
+	ExpiresAt   time.Time `bson:"exp"`
+}
+
+func ConsumerLeaseConsumerKeyFieldName() string {
+	return "ck"
+}
+
+func ConsumerLeaseOwnerFieldName() string {
+	return "o"
+}
+
+func ConsumerLeaseExpiresAtFieldName() string {
+	return "exp"
+}
+
+// RebuildQuery selects raw events of a rebuild, all fields are optional.
+// Every execution which has a matching event is rebuilt from all its raw events.
+type RebuildQuery struct {
+	ProcessID string `bson:"pid,omitempty"`
+
+	// From and To limit the Ts of raw events, From is inclusive, To is exclusive.
+	From time.Time `bson:"from,omitempty"`
+	To   time.Time `bson:"to,omitempty"`
+}
+
+// Rebuild is the state of a rebuild of aggregates from the raw events log into shadow collections.
+type Rebuild struct {
+	ID           string `bson:"_id"`
+	RebuildQuery `bson:",inline"`
+
+	StartedAt time.Time `bson:"sa"`
+	// SwapStartedAt is set when the swap starts, aggregate writers pause until the rebuild is finished.
+	SwapStartedAt time.Time `bson:"ssa,omitempty"`
+	// Swapped are the live collections which are replaced by their shadow ones already.
+	Swapped []string `bson:"sw,omitempty"`
+}
+
+// RebuildExecution is an execution which is rebuilt.
+type RebuildExecution struct {
+	ProcessID   string `bson:"pid"`
+	ExecutionID string `bson:"eid"`
+}
+
+// RebuildStatus is the progress of a rebuild.
+type RebuildStatus struct {
+	Rebuild
+
+	// Executions is the number of executions to rebuild, RebuiltExecutions of them are done.
+	Executions        int64
+	RebuiltExecutions int64
+
+	// Live counts live aggregates of the executions to rebuild, Shadow counts the rebuilt ones.
+	Live   RebuildAggregateCounts
+	Shadow RebuildAggregateCounts
+}
+
+type RebuildAggregateCounts struct {
+	StageExecutions         int64
+	FinishedStageExecutions int64
+	Executions              int64
+}
+
+// RetentionPolicy defines how long documents of one process are kept.
+// Every document stores its expiry, so a changed policy is applied to existing documents by StampRetentionPolicy.
+// Stage logs are not covered, they expire after STAGE_LOGS_TTL_SECONDS whatever the policy of their process.
+type RetentionPolicy struct {
+	// ProcessID is empty for the default policy of processes without their own policy,
+	// its periods come from RAW_EVENTS_TTL_SECONDS and STAGE_EXECUTIONS_TTL_SECONDS.
+	ProcessID string `bson:"_id"`
+
+	// RawEvents is a retention period of raw events counted from Event.Ts.
+	// StageExecutions is a retention period of stage execution and execution aggregates counted from their last update.
+	// Zero periods are taken from the default policy.
+	RawEvents       time.Duration `bson:"re"`
+	StageExecutions time.Duration `bson:"se"`
+
+	// Deleted policies are kept until documents of the process are stamped with the default policy.
+	Deleted bool `bson:"d,omitempty"`
+
+	UpdatedAt time.Time `bson:"ua"`
+	// StampedAt is the UpdatedAt of the policy existing documents are stamped with.
+	StampedAt time.Time `bson:"sa,omitempty"`
+}
+
+func (p RetentionPolicy) Validate() error {
+	var err error
+
+	if len(p.ProcessID) == 0 {
+		err = errors.Join(err, errors.New("ProcessID must be set"))
+	}
+
+	if p.RawEvents < 0 || p.StageExecutions < 0 {
+		err = errors.Join(err, errors.New("retention periods must not be negative"))
+	}
+
+	return err
+}
+
+// IsStamped is true if existing documents of the process are stamped with the current version of the policy.
+func (p RetentionPolicy) IsStamped() bool {
+	return p.StampedAt.Equal(p.UpdatedAt)
+}
+
+func RetentionPolicyUpdatedAtFieldName() string {
+	return "ua"
+}
+
+func RetentionPolicyStampedAtFieldName() string {
+	return "sa"
+}
+
+// ExpireAtFieldName is the field of raw events and aggregates which their TTL indexes expire by.
+func ExpireAtFieldName() string {
+	return "xa"
+}
@@ -12,15 +12,19 @@ import (
 
 func TestEventValidate(t *testing.T) {
 	validEvent := Event{
-		ExecID:     "exec-1",
-		ProcessID:  uuid.New(),
-		ExecutorID: "worker-42",
+		ExecutionID:      "exec-1",
+		ProcessID:        uuid.NewString(),
+		WorkerID:         "worker-42",
+		StageExecutionID: "stage-exec-1",
 		Stage: RawStage{
 			Name: "stage-name",
 		},
 		Ts:     time.Now(),
 		Kind:   EventKindStageStarted,
 		Status: EventStatusSuccess,
+		Metrics: map[string]Metric{
+			"rows": {Value: 10},
+		},
 	}
 
 	testCases := []struct {
@@ -41,28 +45,36 @@ func TestEventValidate(t *testing.T) {
 			errParts: []string{"ID must be empty"},
 		},
 		{
-			name: "empty exec id",
+			name: "empty execution id",
 			mutate: func(e Event) Event {
-				e.ExecID = ""
+				e.ExecutionID = ""
 				return e
 			},
-			errParts: []string{"ExecID must be set"},
+			errParts: []string{"ExecutionID must be set"},
 		},
 		{
-			name: "nil process id",
+			name: "empty process id",
 			mutate: func(e Event) Event {
-				e.ProcessID = uuid.Nil
+				e.ProcessID = ""
 				return e
 			},
 			errParts: []string{"ProcessID must be set"},
 		},
 		{
-			name: "empty executor id",
+			name: "empty worker id",
+			mutate: func(e Event) Event {
+				e.WorkerID = ""
+				return e
+			},
+			errParts: []string{"WorkerID must be set"},
+		},
+		{
+			name: "empty stage execution id",
 			mutate: func(e Event) Event {
-				e.ExecutorID = ""
+				e.StageExecutionID = ""
 				return e
 			},
-			errParts: []string{"ExecutorID must be set"},
+			errParts: []string{"StageExecutionID must be set"},
 		},
 		{
 			name: "empty stage name",
@@ -78,7 +90,7 @@ func TestEventValidate(t *testing.T) {
 				e.Ts = time.Time{}
 				return e
 			},
-			errParts: []string{"Ts must be set"},
+			errParts: []string{"TS must be set"},
 		},
 		{
 			name: "invalid kind",
@@ -96,16 +108,32 @@ func TestEventValidate(t *testing.T) {
 			},
 			errParts: []string{"Status must be valid"},
 		},
+		{
+			name: "metric name with dot",
+			mutate: func(e Event) Event {
+				e.Metrics = map[string]Metric{"rows.processed": {Value: 1}}
+				return e
+			},
+			errParts: []string{"must not contain '.' or '$'"},
+		},
+		{
+			name: "empty metric name",
+			mutate: func(e Event) Event {
+				e.Metrics = map[string]Metric{"": {Value: 1}}
+				return e
+			},
+			errParts: []string{"metric name must be set"},
+		},
 		{
 			name: "multiple validation errors",
 			mutate: func(e Event) Event {
-				e.ExecID = ""
+				e.ExecutionID = ""
 				e.Kind = EventKind(10)
 				e.Status = EventStatus(-5)
 				return e
 			},
 			errParts: []string{
-				"ExecID must be set",
+				"ExecutionID must be set",
 				"Kind must be valid",
 				"Status must be valid",
 			},
@@ -133,3 +161,21 @@ func TestEventValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestSkipStoredStageLogLines(t *testing.T) {
+	lines := []StageLogLine{
+		{Message: "stored", LineID: "1"},
+		{Message: "new", LineID: "2"},
+		{Message: "repeated", LineID: "2"},
+		{Message: "without id"},
+		{Message: "without id"},
+	}
+
+	pending := SkipStoredStageLogLines(lines, map[string]struct{}{"1": {}})
+
+	assert.Equal(t, []StageLogLine{
+		{Message: "new", LineID: "2"},
+		{Message: "without id"},
+		{Message: "without id"},
+	}, pending)
+}
@@ -0,0 +1,88 @@
+package repo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Partition is one of Count hash ranges of ProcessID. All events of a process belong to the same partition,
+// so partitions can be handled independently. A single partition (Count <= 1) contains all events.
+type Partition struct {
+	Index int
+	Count int
+}
+
+func (p Partition) IsSingle() bool {
+	return p.Count <= 1
+}
+
+// TokenKey returns the key of the change stream token of the partition.
+// The single partition uses the key as is, so it shares the token with unpartitioned consumers.
+func (p Partition) TokenKey(key string) string {
+	if p.IsSingle() {
+		return key
+	}
+
+	return fmt.Sprintf("%s/%s", key, p)
+}
+
+// TokenKeyPartitions returns the number of partitions of the group whose token is saved under the token key,
+// see TokenKey. It returns false if the token key is not a key of the group.
+func TokenKeyPartitions(key, tokenKey string) (int, bool) {
+	if tokenKey == key {
+		return 1, true
+	}
+
+	partition, ok := strings.CutPrefix(tokenKey, key+"/")
+	if !ok {
+		return 0, false
+	}
+
+	_, count, ok := strings.Cut(partition, "-of-")
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func (p Partition) String() string {
+	return fmt.Sprintf("%d-of-%d", p.Index, max(p.Count, 1))
+}
+
+// Contains reports whether events of the process belong to the partition.
+// It is used by storages which partition events themselves. The hash differs from the one MongoDB computes,
+// which is fine as long as all consumers of a group use the same storage.
+func (p Partition) Contains(processID string) bool {
+	if p.IsSingle() {
+		return true
+	}
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(processID))
+
+	return hash.Sum64()%uint64(p.Count) == uint64(p.Index) //nolint:gosec // Count and Index are not negative
+}
+
+// changeStreamFilter returns a `$match` stage of raw events of the partition or nil for the single partition.
+// The hash is computed by the server, so events inserted by any producer are partitioned the same way.
+func (p Partition) changeStreamFilter() bson.M {
+	if p.IsSingle() {
+		return nil
+	}
+
+	hash := bson.M{"$toHashedIndexKey": "$fullDocument." + RawEventProcessIDFieldName()}
+	// the hash is a signed long, so the remainder is made non-negative
+	remainder := bson.M{"$mod": bson.A{bson.M{"$add": bson.A{bson.M{"$mod": bson.A{hash, p.Count}}, p.Count}}, p.Count}}
+
+	return bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{remainder, p.Index}}}}
+}
@@ -0,0 +1,29 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenKeyPartitions(t *testing.T) {
+	tests := []struct {
+		tokenKey string
+		count    int
+		ok       bool
+	}{
+		{tokenKey: "group", count: 1, ok: true},
+		{tokenKey: Partition{Index: 2, Count: 4}.TokenKey("group"), count: 4, ok: true},
+		{tokenKey: "group/0-of-x", ok: false},
+		{tokenKey: "group/0-of-0", ok: false},
+		{tokenKey: "group/other", ok: false},
+		{tokenKey: "group2/0-of-2", ok: false},
+		{tokenKey: "other", ok: false},
+	}
+
+	for _, tt := range tests {
+		count, ok := TokenKeyPartitions("group", tt.tokenKey)
+		assert.Equal(t, tt.ok, ok, tt.tokenKey)
+		assert.Equal(t, tt.count, count, tt.tokenKey)
+	}
+}
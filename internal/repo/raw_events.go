@@ -2,8 +2,6 @@ package repo
 
 import (
 	"context"
-	"os"
-	"strconv"
 
 	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -14,42 +12,59 @@ import (
 const (
 	collectionNameRawEvents = "executions"
 
-	idxNameRawEventsTTL = "ttl_raw_events"
+	// idxNameRawEventsTTL is the replaced TTL index with a global period.
+	idxNameRawEventsTTL       = "ttl_raw_events"
+	idxNameRawEventsExecution = "raw_events_execution"
+	idxNameRawEventsTs        = "raw_events_ts"
 )
 
 func (r *Repo) createRawEventIndexes(ctx context.Context) error {
-	ttlSec, err := strconv.ParseInt(os.Getenv("RAW_EVENTS_TTL_SECONDS"), 10, 32)
-	if err != nil {
-		return oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
-	}
-
-	err = r.client.CreateOrUpdateTTLIndex(
-		ctx,
-		collectionNameRawEvents,
-		idxNameRawEventsTTL,
-		int32(ttlSec),
-		mongo.IndexModel{
-			Keys: bson.M{RawEventGetTsFieldName(): 1},
-			Options: options.Index().
-				SetExpireAfterSeconds(int32(ttlSec)).
-				SetName(idxNameRawEventsTTL),
-		},
-	)
+	err := r.createExpireAtIndex(ctx, collectionNameRawEvents, idxNameRawEventsExpireAt, idxNameRawEventsTTL)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// events of one execution are read by the rebuild of aggregates,
+	// ranges of Ts are read by the archiver and the rebuild (the replaced TTL index used to serve them)
+	return r.client.CreateIndexes(ctx, collectionNameRawEvents, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: RawEventProcessIDFieldName(), Value: 1},
+				{Key: RawEventExecutionIDFieldName(), Value: 1},
+				{Key: RawEventGetTsFieldName(), Value: 1},
+			},
+			Options: options.Index().SetName(idxNameRawEventsExecution),
+		},
+		{
+			Keys:    bson.D{{Key: RawEventGetTsFieldName(), Value: 1}},
+			Options: options.Index().SetName(idxNameRawEventsTs),
+		},
+	})
 }
 
-// AppendRawEvents appends events to the raw events collection
+// AppendRawEvents appends events to the raw events collection,
+// every event expires after the retention period of its process.
 // Errors:
+// - oerrs.ErrBadInput: if the default retention periods are not configured.
 // - oerrs.ErrInternal: if insertion failed or nif amount of inserted events is less than input.
 func (r *Repo) AppendRawEvents(ctx context.Context, events []Event) error {
+	retention, err := r.retentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+
+	docs := make([]expiring[Event], 0, len(events))
+	for _, event := range events {
+		docs = append(docs, expiring[Event]{
+			Doc:      event,
+			ExpireAt: event.Ts.Add(retention.of(event.ProcessID).RawEvents),
+		})
+	}
+
 	v, err := r.client.
 		DB().
 		Collection(collectionNameRawEvents).
-		InsertMany(ctx, events)
+		InsertMany(ctx, docs)
 	if err != nil {
 		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
 	}
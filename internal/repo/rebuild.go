@@ -0,0 +1,664 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameRebuildSingleStageExec     = collectionNameSingleStageExec + "_rebuild"
+	collectionNameRebuildExecutionAggregates = collectionNameExecutionAggregates + "_rebuild"
+	collectionNameRebuildScope               = "rebuild_scope"
+	collectionNameRebuilds                   = "rebuilds"
+
+	idxNameRebuildScopePending = "rebuild_scope_pending"
+
+	// rebuildID is the ID of the rebuild state, there is at most one rebuild at a time.
+	rebuildID = "current"
+
+	rebuildScopeIDField   = "_id"
+	rebuildScopeDoneField = "d"
+	rebuildScopeLookupAs  = "_rs"
+
+	rebuildSwapStartedAtField = "ssa"
+	rebuildSwappedField       = "sw"
+
+	// rebuildCopyRanges is how many key ranges between executions of the rebuild are copied by one command.
+	rebuildCopyRanges = 100
+)
+
+type rebuildScopeExecution struct {
+	ID   RebuildExecution `bson:"_id"`
+	Done bool             `bson:"d"`
+}
+
+// StartRebuild starts a rebuild of aggregates of the executions which have raw events matching the query.
+// It recreates the shadow collections with the indexes of the live ones and saves the executions to rebuild.
+// Errors:
+// - oerrs.ErrBadInput: if there is a rebuild already.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) StartRebuild(ctx context.Context, query RebuildQuery) (Rebuild, error) {
+	rebuild := Rebuild{ID: rebuildID, RebuildQuery: query, StartedAt: r.clock()}
+
+	_, err := r.GetRebuild(ctx)
+	if err == nil {
+		return rebuild, oerrs.NewTErrf(ctx, "a rebuild is already started, resume or abort it: %w", oerrs.ErrBadInput)
+	}
+
+	if !errors.Is(err, oerrs.ErrNotFound) {
+		return rebuild, err
+	}
+
+	err = r.dropRebuildCollections(ctx)
+	if err != nil {
+		return rebuild, err
+	}
+
+	for live, shadow := range rebuildShadowCollections() {
+		err = r.copyIndexes(ctx, live, shadow)
+		if err != nil {
+			return rebuild, err
+		}
+	}
+
+	err = r.client.CreateIndexes(ctx, collectionNameRebuildScope, []mongo.IndexModel{{
+		Keys:    bson.D{{Key: rebuildScopeDoneField, Value: 1}, {Key: rebuildScopeIDField, Value: 1}},
+		Options: options.Index().SetName(idxNameRebuildScopePending),
+	}})
+	if err != nil {
+		return rebuild, err
+	}
+
+	err = r.saveRebuildScope(ctx, query)
+	if err != nil {
+		return rebuild, err
+	}
+
+	// the state is saved last, so a rebuild which failed to start is started again from scratch
+	_, err = r.client.DB().Collection(collectionNameRebuilds).InsertOne(ctx, rebuild)
+	if mongo.IsDuplicateKeyError(err) {
+		return rebuild, oerrs.NewTErrf(ctx, "a rebuild is already started, resume or abort it: %w", oerrs.ErrBadInput)
+	}
+
+	if err != nil {
+		return rebuild, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return rebuild, nil
+}
+
+func rebuildShadowCollections() map[string]string {
+	return map[string]string{
+		collectionNameSingleStageExec:     collectionNameRebuildSingleStageExec,
+		collectionNameExecutionAggregates: collectionNameRebuildExecutionAggregates,
+	}
+}
+
+// saveRebuildScope saves every execution which has a raw event matching the query.
+func (r *Repo) saveRebuildScope(ctx context.Context, query RebuildQuery) error {
+	filter := bson.M{}
+
+	if len(query.ProcessID) > 0 {
+		filter[RawEventProcessIDFieldName()] = query.ProcessID
+	}
+
+	if tsFilter := timeRangeFilter(query.From, query.To); tsFilter != nil {
+		filter[RawEventGetTsFieldName()] = tsFilter
+	}
+
+	cur, err := r.client.DB().Collection(collectionNameRawEvents).Aggregate(ctx, bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$group": bson.M{"_id": bson.D{
+			// the order of keys matters, documents are compared with RebuildExecution
+			{Key: RawEventProcessIDFieldName(), Value: "$" + RawEventProcessIDFieldName()},
+			{Key: RawEventExecutionIDFieldName(), Value: "$" + RawEventExecutionIDFieldName()},
+		}}},
+		bson.M{"$set": bson.M{rebuildScopeDoneField: false}},
+		bson.M{"$merge": bson.M{"into": collectionNameRebuildScope, "whenMatched": "keepExisting"}},
+	})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return closeCursor(ctx, cur)
+}
+
+// copyIndexes creates indexes of the source collection in the target one.
+func (r *Repo) copyIndexes(ctx context.Context, source, target string) error {
+	cur, err := r.client.DB().Collection(source).Indexes().List(ctx)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var specs []bson.M
+
+	err = cur.All(ctx, &specs)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	specs = slices.DeleteFunc(specs, func(spec bson.M) bool {
+		return spec["name"] == "_id_"
+	})
+
+	if len(specs) == 0 {
+		return nil
+	}
+
+	err = r.client.DB().RunCommand(ctx, bson.D{
+		{Key: "createIndexes", Value: target},
+		{Key: "indexes", Value: specs},
+	}).Err()
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// GetRebuild returns the state of the rebuild.
+// Errors:
+// - oerrs.ErrNotFound: if there is no rebuild.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) GetRebuild(ctx context.Context) (Rebuild, error) {
+	var result Rebuild
+
+	err := r.client.DB().Collection(collectionNameRebuilds).FindOne(ctx, bson.M{"_id": rebuildID}).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, oerrs.NewTErrf(ctx, "no rebuild is started: %w", oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return result, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// NextRebuildExecution returns an execution which is not rebuilt yet.
+// Errors:
+// - oerrs.ErrNotFound: if all executions are rebuilt.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) NextRebuildExecution(ctx context.Context) (RebuildExecution, error) {
+	var result rebuildScopeExecution
+
+	err := r.client.
+		DB().
+		Collection(collectionNameRebuildScope).
+		FindOne(
+			ctx,
+			bson.M{rebuildScopeDoneField: false},
+			options.FindOne().SetSort(bson.D{{Key: rebuildScopeIDField, Value: 1}}),
+		).
+		Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result.ID, oerrs.NewTErrf(ctx, "all executions are rebuilt: %w", oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return result.ID, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result.ID, nil
+}
+
+// ResetRebuildExecution deletes shadow aggregates of the execution, so an interrupted rebuild of it can be repeated.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ResetRebuildExecution(ctx context.Context, execution RebuildExecution) error {
+	filter := bson.M{
+		SingleStageExecutionEventProcessIDFieldName():   execution.ProcessID,
+		SingleStageExecutionEventExecutionIDFieldName(): execution.ExecutionID,
+	}
+
+	for _, shadow := range rebuildShadowCollections() {
+		_, err := r.client.DB().Collection(shadow).DeleteMany(ctx, filter)
+		if err != nil {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+	}
+
+	return nil
+}
+
+// GetRawExecutionEvents returns raw events of the execution sorted by Ts.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) GetRawExecutionEvents(ctx context.Context, processID, executionID string) ([]Event, error) {
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameRawEvents).
+		Find(
+			ctx,
+			bson.M{
+				RawEventProcessIDFieldName():   processID,
+				RawEventExecutionIDFieldName(): executionID,
+			},
+			options.Find().SetSort(bson.D{{Key: RawEventGetTsFieldName(), Value: 1}}),
+		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []Event
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// WriteRebuildAggregates is WriteAggregates into the shadow collections of the rebuild.
+func (r *Repo) WriteRebuildAggregates(ctx context.Context, writes []AggregateWrite) error {
+	return r.writeAggregates(ctx, rebuildAggregateCollections, writes)
+}
+
+// FinishRebuildExecution marks the execution as rebuilt.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) FinishRebuildExecution(ctx context.Context, execution RebuildExecution) error {
+	_, err := r.client.
+		DB().
+		Collection(collectionNameRebuildScope).
+		UpdateOne(
+			ctx,
+			bson.M{rebuildScopeIDField: execution},
+			bson.M{"$set": bson.M{rebuildScopeDoneField: true}},
+		)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// GetRebuildStatus returns the progress of the rebuild and compares the shadow aggregates with the live ones.
+// Errors:
+// - oerrs.ErrNotFound: if there is no rebuild.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) GetRebuildStatus(ctx context.Context) (RebuildStatus, error) {
+	var (
+		result RebuildStatus
+		err    error
+	)
+
+	result.Rebuild, err = r.GetRebuild(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	finished := bson.M{SingleStageExecutionEventIsFinishedFieldName(): true}
+
+	counts := []struct {
+		target *int64
+		count  func() (int64, error)
+	}{
+		{&result.Executions, func() (int64, error) { return r.countDocuments(ctx, collectionNameRebuildScope, nil) }},
+		{&result.RebuiltExecutions, func() (int64, error) {
+			return r.countDocuments(ctx, collectionNameRebuildScope, bson.M{rebuildScopeDoneField: true})
+		}},
+		{&result.Live.StageExecutions, func() (int64, error) {
+			return r.countInRebuildScope(ctx, collectionNameSingleStageExec, nil)
+		}},
+		{&result.Live.FinishedStageExecutions, func() (int64, error) {
+			return r.countInRebuildScope(ctx, collectionNameSingleStageExec, finished)
+		}},
+		{&result.Live.Executions, func() (int64, error) {
+			return r.countInRebuildScope(ctx, collectionNameExecutionAggregates, nil)
+		}},
+		{&result.Shadow.StageExecutions, func() (int64, error) {
+			return r.countDocuments(ctx, collectionNameRebuildSingleStageExec, nil)
+		}},
+		{&result.Shadow.FinishedStageExecutions, func() (int64, error) {
+			return r.countDocuments(ctx, collectionNameRebuildSingleStageExec, finished)
+		}},
+		{&result.Shadow.Executions, func() (int64, error) {
+			return r.countDocuments(ctx, collectionNameRebuildExecutionAggregates, nil)
+		}},
+	}
+
+	for _, count := range counts {
+		*count.target, err = count.count()
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func (r *Repo) countDocuments(ctx context.Context, collection string, filter bson.M) (int64, error) {
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	result, err := r.client.DB().Collection(collection).CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// countInRebuildScope counts documents of the collection which belong to the executions of the rebuild.
+func (r *Repo) countInRebuildScope(ctx context.Context, collection string, filter bson.M) (int64, error) {
+	lookup := rebuildScopeLookup(filter)
+	lookup = append(lookup, bson.M{"$count": "n"})
+
+	cur, err := r.client.DB().Collection(collectionNameRebuildScope).Aggregate(ctx, bson.A{
+		bson.M{"$lookup": bson.M{
+			"from":     collection,
+			"let":      bson.M{"pid": "$_id.pid", "eid": "$_id.eid"},
+			"pipeline": lookup,
+			"as":       rebuildScopeLookupAs,
+		}},
+		bson.M{"$group": bson.M{"_id": nil, "n": bson.M{"$sum": bson.M{"$sum": "$" + rebuildScopeLookupAs + ".n"}}}},
+	})
+	if err != nil {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []struct {
+		N int64 `bson:"n"`
+	}
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	if len(result) == 0 {
+		return 0, nil
+	}
+
+	return result[0].N, nil
+}
+
+// rebuildScopeLookup returns a `$lookup` pipeline which matches aggregates of the execution
+// given by `$$pid` and `$$eid` and the filter, both aggregate collections use the same key fields.
+func rebuildScopeLookup(filter bson.M) bson.A {
+	match := bson.M{"$expr": bson.M{"$and": bson.A{
+		bson.M{"$eq": bson.A{"$" + SingleStageExecutionEventProcessIDFieldName(), "$$pid"}},
+		bson.M{"$eq": bson.A{"$" + SingleStageExecutionEventExecutionIDFieldName(), "$$eid"}},
+	}}}
+
+	maps.Copy(match, filter)
+
+	return bson.A{bson.M{"$match": match}}
+}
+
+// SwapRebuild replaces the live aggregates by the shadow ones and finishes the rebuild.
+// It pauses aggregate writers first (see AggregateWritesPaused) and waits for the drain,
+// so flushes which started before the pause are done. Then aggregates of executions out of the rebuild
+// are copied from every live collection into its shadow one, which is renamed to the live one atomically.
+// Swapped collections are recorded, so a failed swap is finished by calling it again, writers stay paused until then.
+// Errors:
+// - oerrs.ErrNotFound: if there is no rebuild.
+// - oerrs.ErrBadInput: if not all executions are rebuilt.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) SwapRebuild(ctx context.Context, drain time.Duration) error {
+	rebuild, err := r.GetRebuild(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.NextRebuildExecution(ctx)
+	if err == nil {
+		return oerrs.NewTErrf(ctx, "not all executions are rebuilt, resume the rebuild: %w", oerrs.ErrBadInput)
+	}
+
+	if !errors.Is(err, oerrs.ErrNotFound) {
+		return err
+	}
+
+	if rebuild.SwapStartedAt.IsZero() {
+		rebuild.SwapStartedAt = r.clock()
+
+		err = r.updateRebuild(ctx, bson.M{"$set": bson.M{rebuildSwapStartedAtField: rebuild.SwapStartedAt}})
+		if err != nil {
+			return err
+		}
+	}
+
+	if wait := rebuild.SwapStartedAt.Add(drain).Sub(r.clock()); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	shadows := rebuildShadowCollections()
+
+	for _, live := range slices.Sorted(maps.Keys(shadows)) {
+		if slices.Contains(rebuild.Swapped, live) {
+			continue
+		}
+
+		err = r.swapRebuildCollection(ctx, live, shadows[live])
+		if err != nil {
+			return err
+		}
+
+		err = r.updateRebuild(ctx, bson.M{"$addToSet": bson.M{rebuildSwappedField: live}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.finishRebuild(ctx)
+}
+
+// swapRebuildCollection copies aggregates out of the rebuild into the shadow collection
+// and renames it to the live one.
+func (r *Repo) swapRebuildCollection(ctx context.Context, live, shadow string) error {
+	names, err := r.client.DB().ListCollectionNames(ctx, bson.M{"name": shadow})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	// the collection is renamed by a previous call which failed before it was recorded
+	if len(names) == 0 {
+		return nil
+	}
+
+	err = r.copyOutOfRebuildScope(ctx, live, shadow)
+	if err != nil {
+		return err
+	}
+
+	err = r.client.Client().Database("admin").RunCommand(ctx, bson.D{
+		{Key: "renameCollection", Value: r.client.DB().Name() + "." + shadow},
+		{Key: "to", Value: r.client.DB().Name() + "." + live},
+		{Key: "dropTarget", Value: true},
+	}).Err()
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// copyOutOfRebuildScope copies aggregates of executions which are not rebuilt from the live collection
+// to the shadow one. Executions of the scope are read in the order of their keys, and the key ranges between them
+// are copied using the (ProcessID, ExecutionID) prefix of the key index, rebuildCopyRanges ranges per command.
+func (r *Repo) copyOutOfRebuildScope(ctx context.Context, live, shadow string) error {
+	cur, err := r.client.DB().Collection(collectionNameRebuildScope).Find(
+		ctx,
+		bson.M{},
+		options.Find().
+			SetSort(bson.D{{Key: rebuildScopeIDField, Value: 1}}).
+			SetProjection(bson.M{rebuildScopeIDField: 1}),
+	)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	defer func() { _ = cur.Close(context.WithoutCancel(ctx)) }()
+
+	var (
+		after  *RebuildExecution
+		ranges bson.A
+	)
+
+	for cur.Next(ctx) {
+		var execution rebuildScopeExecution
+
+		err = cur.Decode(&execution)
+		if err != nil {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		ranges = append(ranges, rebuildScopeGap(after, &execution.ID))
+		after = &execution.ID
+
+		if len(ranges) == rebuildCopyRanges {
+			err = r.copyRanges(ctx, live, shadow, ranges)
+			if err != nil {
+				return err
+			}
+
+			ranges = nil
+		}
+	}
+
+	err = cur.Err()
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return r.copyRanges(ctx, live, shadow, append(ranges, rebuildScopeGap(after, nil)))
+}
+
+func (r *Repo) copyRanges(ctx context.Context, live, shadow string, ranges bson.A) error {
+	cur, err := r.client.DB().Collection(live).Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"$or": ranges}},
+		bson.M{"$merge": bson.M{"into": shadow, "whenMatched": "keepExisting"}},
+	})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return closeCursor(ctx, cur)
+}
+
+// rebuildScopeGap returns a filter of aggregates whose key is between the keys of the executions (both exclusive),
+// nil after is the start of the collection and nil before is its end.
+// Both aggregate collections use the same key fields.
+func rebuildScopeGap(after, before *RebuildExecution) bson.M {
+	pid := SingleStageExecutionEventProcessIDFieldName()
+	eid := SingleStageExecutionEventExecutionIDFieldName()
+
+	switch {
+	case after == nil && before == nil:
+		return bson.M{}
+	case after == nil:
+		return bson.M{"$or": bson.A{
+			bson.M{pid: bson.M{"$lt": before.ProcessID}},
+			bson.M{pid: before.ProcessID, eid: bson.M{"$lt": before.ExecutionID}},
+		}}
+	case before == nil:
+		return bson.M{"$or": bson.A{
+			bson.M{pid: after.ProcessID, eid: bson.M{"$gt": after.ExecutionID}},
+			bson.M{pid: bson.M{"$gt": after.ProcessID}},
+		}}
+	case after.ProcessID == before.ProcessID:
+		return bson.M{pid: after.ProcessID, eid: bson.M{"$gt": after.ExecutionID, "$lt": before.ExecutionID}}
+	default:
+		return bson.M{"$or": bson.A{
+			bson.M{pid: after.ProcessID, eid: bson.M{"$gt": after.ExecutionID}},
+			bson.M{pid: bson.M{"$gt": after.ProcessID, "$lt": before.ProcessID}},
+			bson.M{pid: before.ProcessID, eid: bson.M{"$lt": before.ExecutionID}},
+		}}
+	}
+}
+
+func (r *Repo) updateRebuild(ctx context.Context, update bson.M) error {
+	_, err := r.client.DB().Collection(collectionNameRebuilds).UpdateOne(ctx, bson.M{"_id": rebuildID}, update)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// AggregateWritesPaused reports whether writers of aggregates must wait: a rebuild swaps the live aggregates.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) AggregateWritesPaused(ctx context.Context) (bool, error) {
+	n, err := r.countDocuments(ctx, collectionNameRebuilds, bson.M{
+		"_id":                     rebuildID,
+		rebuildSwapStartedAtField: bson.M{"$exists": true},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// AbortRebuild drops the shadow collections and the state of the rebuild.
+// Errors:
+// - oerrs.ErrBadInput: if the swap is started, it must be finished.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) AbortRebuild(ctx context.Context) error {
+	rebuild, err := r.GetRebuild(ctx)
+	if err != nil && !errors.Is(err, oerrs.ErrNotFound) {
+		return err
+	}
+
+	if !rebuild.SwapStartedAt.IsZero() {
+		return oerrs.NewTErrf(ctx, "the swap is started, run it again to finish it: %w", oerrs.ErrBadInput)
+	}
+
+	return r.finishRebuild(ctx)
+}
+
+// finishRebuild drops the shadow collections and the state of the rebuild, it unpauses aggregate writers.
+func (r *Repo) finishRebuild(ctx context.Context) error {
+	err := r.dropRebuildCollections(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.DB().Collection(collectionNameRebuilds).DeleteOne(ctx, bson.M{"_id": rebuildID})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+func (r *Repo) dropRebuildCollections(ctx context.Context) error {
+	for _, collection := range []string{
+		collectionNameRebuildSingleStageExec,
+		collectionNameRebuildExecutionAggregates,
+		collectionNameRebuildScope,
+	} {
+		err := r.client.DB().Collection(collection).Drop(ctx)
+		if err != nil {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+	}
+
+	return nil
+}
+
+func closeCursor(ctx context.Context, cur *mongo.Cursor) error {
+	err := cur.Close(ctx)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
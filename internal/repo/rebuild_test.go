@@ -0,0 +1,44 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestRebuildScopeLookup(t *testing.T) {
+	assert.Equal(t, bson.A{bson.M{"$match": bson.M{
+		"$expr": bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{"$pid", "$$pid"}},
+			bson.M{"$eq": bson.A{"$eid", "$$eid"}},
+		}},
+		"if": true,
+	}}}, rebuildScopeLookup(bson.M{"if": true}))
+}
+
+func TestRebuildScopeGap(t *testing.T) {
+	p1e1 := &RebuildExecution{ProcessID: "p1", ExecutionID: "e1"}
+	p1e3 := &RebuildExecution{ProcessID: "p1", ExecutionID: "e3"}
+	p3e1 := &RebuildExecution{ProcessID: "p3", ExecutionID: "e1"}
+
+	assert.Equal(t, bson.M{}, rebuildScopeGap(nil, nil))
+
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"pid": bson.M{"$lt": "p1"}},
+		bson.M{"pid": "p1", "eid": bson.M{"$lt": "e1"}},
+	}}, rebuildScopeGap(nil, p1e1))
+
+	assert.Equal(t, bson.M{"pid": "p1", "eid": bson.M{"$gt": "e1", "$lt": "e3"}}, rebuildScopeGap(p1e1, p1e3))
+
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"pid": "p1", "eid": bson.M{"$gt": "e3"}},
+		bson.M{"pid": bson.M{"$gt": "p1", "$lt": "p3"}},
+		bson.M{"pid": "p3", "eid": bson.M{"$lt": "e1"}},
+	}}, rebuildScopeGap(p1e3, p3e1))
+
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"pid": "p3", "eid": bson.M{"$gt": "e1"}},
+		bson.M{"pid": bson.M{"$gt": "p3"}},
+	}}, rebuildScopeGap(p3e1, nil))
+}
@@ -8,8 +8,9 @@ import (
 )
 
 type Repo struct {
-	client *mdb.Client
-	clock  utils.Clock
+	client    *mdb.Client
+	clock     utils.Clock
+	retention retentionCache
 }
 
 func NewRepo(
@@ -27,8 +28,22 @@ func NewRepo(
 	return r, err
 }
 
+// NewRepoWithoutIndexes returns a repo which doesn't create indexes, e.g. to restore archives
+// into a separate database where TTL indexes must not delete the restored documents.
+func NewRepoWithoutIndexes(client *mdb.Client, clock utils.Clock) *Repo {
+	return &Repo{
+		client: client,
+		clock:  clock,
+	}
+}
+
 func (r *Repo) registerIndexes(ctx context.Context) error {
-	err := r.createRawEventIndexes(ctx)
+	err := r.createRetentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.createRawEventIndexes(ctx)
 	if err != nil {
 		return err
 	}
@@ -38,5 +53,35 @@ func (r *Repo) registerIndexes(ctx context.Context) error {
 		return err
 	}
 
+	err = r.createStageLogIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.createExecutionAggregateIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.createWebhookIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.createDeadLetterIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.createConsumerLeaseIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.createArchiveIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,391 @@
+package repo
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameRetentionPolicies = "retention_policies"
+
+	idxNameRawEventsExpireAt           = "ttl_raw_events_expire_at"
+	idxNameSingleStageExpireAt         = "ttl_stage_exec_expire_at"
+	idxNameExecutionAggregatesExpireAt = "ttl_execution_aggregates_expire_at"
+
+	defaultRetentionPolicyID = ""
+
+	// RetentionRefreshPeriod is how often policies are reloaded by writers.
+	// A changed policy is stamped after this period, so documents written with its previous version are stamped too.
+	RetentionRefreshPeriod = time.Minute
+)
+
+// expiring adds the expiry of the retention policy to a document on insertion.
+type expiring[T any] struct {
+	Doc      T         `bson:",inline"`
+	ExpireAt time.Time `bson:"xa"`
+}
+
+// retentionPolicies are the policies of all processes.
+type retentionPolicies struct {
+	defaults  RetentionPolicy
+	processes map[string]RetentionPolicy
+}
+
+// of returns the effective policy of the process: its own periods or the default ones.
+func (p retentionPolicies) of(processID string) RetentionPolicy {
+	result := p.defaults
+	result.ProcessID = processID
+
+	policy, ok := p.processes[processID]
+	if !ok {
+		return result
+	}
+
+	if policy.RawEvents > 0 {
+		result.RawEvents = policy.RawEvents
+	}
+
+	if policy.StageExecutions > 0 {
+		result.StageExecutions = policy.StageExecutions
+	}
+
+	return result
+}
+
+// retentionCache keeps policies for RetentionRefreshPeriod, so writes don't read them every time.
+type retentionCache struct {
+	mu       sync.Mutex
+	loadedAt time.Time
+	policies retentionPolicies
+}
+
+// defaultRetentionPolicy reads periods of the default policy from the environment.
+func defaultRetentionPolicy() (RetentionPolicy, error) {
+	result := RetentionPolicy{ProcessID: defaultRetentionPolicyID}
+
+	rawEventsSec, err := strconv.ParseInt(os.Getenv("RAW_EVENTS_TTL_SECONDS"), 10, 32)
+	if err != nil {
+		return result, err
+	}
+
+	stageExecutionsSec, err := strconv.ParseInt(os.Getenv("STAGE_EXECUTIONS_TTL_SECONDS"), 10, 32)
+	if err != nil {
+		return result, err
+	}
+
+	result.RawEvents = time.Duration(rawEventsSec) * time.Second
+	result.StageExecutions = time.Duration(stageExecutionsSec) * time.Second
+
+	return result, nil
+}
+
+// createRetentionPolicies saves the default policy, so existing documents are stamped again if it changed.
+func (r *Repo) createRetentionPolicies(ctx context.Context) error {
+	defaults, err := defaultRetentionPolicy()
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
+	}
+
+	_, err = r.client.
+		DB().
+		Collection(collectionNameRetentionPolicies).
+		UpdateOne(
+			ctx,
+			bson.M{
+				"_id": defaultRetentionPolicyID,
+				"$or": bson.A{
+					bson.M{"re": bson.M{"$ne": defaults.RawEvents}},
+					bson.M{"se": bson.M{"$ne": defaults.StageExecutions}},
+				},
+			},
+			bson.M{"$set": bson.M{
+				"re":                                defaults.RawEvents,
+				"se":                                defaults.StageExecutions,
+				RetentionPolicyUpdatedAtFieldName(): r.clock(),
+			}},
+			options.UpdateOne().SetUpsert(true),
+		)
+	// the default policy exists and is not changed
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// createExpireAtIndex creates a TTL index which deletes documents at their ExpireAtFieldName
+// and drops the TTL index with a global period which it replaces.
+func (r *Repo) createExpireAtIndex(ctx context.Context, collection, name, replacedName string) error {
+	err := r.client.DropIndexIfExists(ctx, collection, replacedName)
+	if err != nil {
+		return err
+	}
+
+	return r.client.CreateOrUpdateTTLIndex(
+		ctx,
+		collection,
+		name,
+		0,
+		mongo.IndexModel{
+			Keys:    bson.M{ExpireAtFieldName(): 1},
+			Options: options.Index().SetExpireAfterSeconds(0).SetName(name),
+		},
+	)
+}
+
+// retentionPolicies returns the cached policies of all processes.
+// Errors:
+// - oerrs.ErrBadInput: if the default periods are not configured.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) retentionPolicies(ctx context.Context) (retentionPolicies, error) {
+	r.retention.mu.Lock()
+	defer r.retention.mu.Unlock()
+
+	now := r.clock()
+	if !r.retention.loadedAt.IsZero() && now.Sub(r.retention.loadedAt) < RetentionRefreshPeriod {
+		return r.retention.policies, nil
+	}
+
+	policies, err := r.loadRetentionPolicies(ctx)
+	if err != nil {
+		return policies, err
+	}
+
+	r.retention.policies = policies
+	r.retention.loadedAt = now
+
+	return policies, nil
+}
+
+func (r *Repo) loadRetentionPolicies(ctx context.Context) (retentionPolicies, error) {
+	result := retentionPolicies{processes: map[string]RetentionPolicy{}}
+
+	var err error
+
+	result.defaults, err = defaultRetentionPolicy()
+	if err != nil {
+		return result, oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
+	}
+
+	policies, err := r.ListRetentionPolicies(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, policy := range policies {
+		if policy.ProcessID != defaultRetentionPolicyID && !policy.Deleted {
+			result.processes[policy.ProcessID] = policy
+		}
+	}
+
+	return result, nil
+}
+
+// ListRetentionPolicies returns all policies including the default and the deleted ones sorted by ProcessID.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListRetentionPolicies(ctx context.Context) ([]RetentionPolicy, error) {
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameRetentionPolicies).
+		Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []RetentionPolicy
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// SetRetentionPolicy creates or replaces the policy of the process, existing documents are stamped later.
+// Errors:
+// - oerrs.ErrBadInput: if the policy is invalid.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) SetRetentionPolicy(ctx context.Context, policy RetentionPolicy) (RetentionPolicy, error) {
+	err := policy.Validate()
+	if err != nil {
+		return policy, oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
+	}
+
+	policy.Deleted = false
+	policy.UpdatedAt = r.clock()
+
+	_, err = r.client.
+		DB().
+		Collection(collectionNameRetentionPolicies).
+		UpdateOne(
+			ctx,
+			bson.M{"_id": policy.ProcessID},
+			bson.M{
+				"$set": bson.M{
+					"re":                                policy.RawEvents,
+					"se":                                policy.StageExecutions,
+					RetentionPolicyUpdatedAtFieldName(): policy.UpdatedAt,
+				},
+				"$unset": bson.M{"d": ""},
+			},
+			options.UpdateOne().SetUpsert(true),
+		)
+	if err != nil {
+		return policy, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return policy, nil
+}
+
+// DeleteRetentionPolicy makes the process use the default policy.
+// The policy is removed when documents of the process are stamped with the default one.
+// Errors:
+// - oerrs.ErrBadInput: if processID is empty, the default policy can't be deleted.
+// - oerrs.ErrNotFound: if the process has no policy.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) DeleteRetentionPolicy(ctx context.Context, processID string) error {
+	if processID == defaultRetentionPolicyID {
+		return oerrs.NewTErrf(ctx, "the default policy can't be deleted: %w", oerrs.ErrBadInput)
+	}
+
+	result, err := r.client.
+		DB().
+		Collection(collectionNameRetentionPolicies).
+		UpdateOne(
+			ctx,
+			bson.M{"_id": processID, "d": bson.M{"$ne": true}},
+			bson.M{"$set": bson.M{
+				"re":                                0,
+				"se":                                0,
+				"d":                                 true,
+				RetentionPolicyUpdatedAtFieldName(): r.clock(),
+			}},
+		)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	if result.MatchedCount == 0 {
+		return oerrs.NewTErrf(ctx, "no retention policy of %q: %w", processID, oerrs.ErrNotFound)
+	}
+
+	return nil
+}
+
+// retentionStampTarget is an update of expiries of one collection.
+type retentionStampTarget struct {
+	collection string
+	filter     bson.M
+	// the expiry is the value of the field plus the period
+	field  string
+	period time.Duration
+}
+
+func (t retentionStampTarget) update() bson.A {
+	return bson.A{bson.M{"$set": bson.M{
+		ExpireAtFieldName(): bson.M{"$add": bson.A{"$" + t.field, t.period.Milliseconds()}},
+	}}}
+}
+
+// retentionStampTargets returns updates which stamp documents of the policy.
+// Documents of the default policy are documents of processes which don't override the period.
+func retentionStampTargets(policies retentionPolicies, policy RetentionPolicy) []retentionStampTarget {
+	effective := policies.of(policy.ProcessID)
+	rawEventsFilter := bson.M{RawEventProcessIDFieldName(): policy.ProcessID}
+	stageExecutionsFilter := bson.M{RawEventProcessIDFieldName(): policy.ProcessID}
+
+	if policy.ProcessID == defaultRetentionPolicyID {
+		rawEventsOverridden, stageExecutionsOverridden := bson.A{}, bson.A{}
+
+		for processID, processPolicy := range policies.processes {
+			if processPolicy.RawEvents > 0 {
+				rawEventsOverridden = append(rawEventsOverridden, processID)
+			}
+
+			if processPolicy.StageExecutions > 0 {
+				stageExecutionsOverridden = append(stageExecutionsOverridden, processID)
+			}
+		}
+
+		rawEventsFilter = bson.M{RawEventProcessIDFieldName(): bson.M{"$nin": rawEventsOverridden}}
+		stageExecutionsFilter = bson.M{RawEventProcessIDFieldName(): bson.M{"$nin": stageExecutionsOverridden}}
+	}
+
+	return []retentionStampTarget{
+		{
+			collection: collectionNameRawEvents,
+			filter:     rawEventsFilter,
+			field:      RawEventGetTsFieldName(),
+			period:     effective.RawEvents,
+		},
+		{
+			collection: collectionNameSingleStageExec,
+			filter:     stageExecutionsFilter,
+			field:      SingleStageExecutionEventUpdateAtFieldName(),
+			period:     effective.StageExecutions,
+		},
+		{
+			collection: collectionNameExecutionAggregates,
+			filter:     stageExecutionsFilter,
+			field:      ExecutionAggregateUpdatedAtFieldName(),
+			period:     effective.StageExecutions,
+		},
+	}
+}
+
+// StampRetentionPolicy updates expiries of existing documents of the policy and marks it as stamped,
+// or removes it if it is deleted. It returns the number of updated documents.
+// If the policy changed since it was read, it is not marked, so it is stamped again.
+// Errors:
+// - oerrs.ErrBadInput: if the default periods are not configured.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) StampRetentionPolicy(ctx context.Context, policy RetentionPolicy) (int64, error) {
+	policies, err := r.loadRetentionPolicies(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var modified int64
+
+	for _, target := range retentionStampTargets(policies, policy) {
+		result, err := r.client.DB().Collection(target.collection).UpdateMany(ctx, target.filter, target.update())
+		if err != nil {
+			return modified, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		modified += result.ModifiedCount
+	}
+
+	filter := bson.M{"_id": policy.ProcessID, RetentionPolicyUpdatedAtFieldName(): policy.UpdatedAt}
+	collection := r.client.DB().Collection(collectionNameRetentionPolicies)
+
+	if policy.Deleted {
+		_, err = collection.DeleteOne(ctx, filter)
+	} else {
+		_, err = collection.UpdateOne(
+			ctx,
+			filter,
+			bson.M{"$set": bson.M{RetentionPolicyStampedAtFieldName(): policy.UpdatedAt}},
+		)
+	}
+
+	if err != nil {
+		return modified, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return modified, nil
+}
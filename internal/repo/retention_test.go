@@ -0,0 +1,82 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func testRetentionPolicies() retentionPolicies {
+	return retentionPolicies{
+		defaults: RetentionPolicy{RawEvents: time.Hour, StageExecutions: time.Hour * 2},
+		processes: map[string]RetentionPolicy{
+			"compliance": {ProcessID: "compliance", RawEvents: time.Hour * 24 * 365},
+			"noisy":      {ProcessID: "noisy", RawEvents: time.Minute, StageExecutions: time.Minute * 2},
+		},
+	}
+}
+
+func TestRetentionPoliciesOf(t *testing.T) {
+	policies := testRetentionPolicies()
+
+	// a zero period is taken from the default policy
+	assert.Equal(
+		t,
+		RetentionPolicy{ProcessID: "compliance", RawEvents: time.Hour * 24 * 365, StageExecutions: time.Hour * 2},
+		policies.of("compliance"),
+	)
+	assert.Equal(
+		t,
+		RetentionPolicy{ProcessID: "noisy", RawEvents: time.Minute, StageExecutions: time.Minute * 2},
+		policies.of("noisy"),
+	)
+	assert.Equal(
+		t,
+		RetentionPolicy{ProcessID: "other", RawEvents: time.Hour, StageExecutions: time.Hour * 2},
+		policies.of("other"),
+	)
+}
+
+func TestRetentionStampTargetsOfProcess(t *testing.T) {
+	targets := retentionStampTargets(testRetentionPolicies(), RetentionPolicy{ProcessID: "compliance"})
+	require.Len(t, targets, 3)
+
+	assert.Equal(t, collectionNameRawEvents, targets[0].collection)
+	assert.Equal(t, bson.M{"pid": "compliance"}, targets[0].filter)
+	assert.Equal(t, time.Hour*24*365, targets[0].period)
+
+	for _, target := range targets[1:] {
+		assert.Equal(t, bson.M{"pid": "compliance"}, target.filter)
+		assert.Equal(t, time.Hour*2, target.period)
+		assert.Equal(t, "ua", target.field)
+	}
+
+	assert.Equal(
+		t,
+		bson.A{bson.M{"$set": bson.M{"xa": bson.M{"$add": bson.A{"$ts", (time.Hour * 24 * 365).Milliseconds()}}}}},
+		targets[0].update(),
+	)
+}
+
+func TestRetentionStampTargetsOfDefaults(t *testing.T) {
+	targets := retentionStampTargets(testRetentionPolicies(), RetentionPolicy{ProcessID: defaultRetentionPolicyID})
+	require.Len(t, targets, 3)
+
+	// processes which override the period are excluded
+	rawEventsFilter, ok := targets[0].filter["pid"].(bson.M)
+	require.True(t, ok)
+	assert.ElementsMatch(t, bson.A{"compliance", "noisy"}, rawEventsFilter["$nin"])
+	assert.Equal(t, time.Hour, targets[0].period)
+
+	assert.Equal(t, bson.M{"pid": bson.M{"$nin": bson.A{"noisy"}}}, targets[1].filter)
+	assert.Equal(t, time.Hour*2, targets[1].period)
+}
+
+func TestRetentionPolicyValidate(t *testing.T) {
+	require.NoError(t, RetentionPolicy{ProcessID: "p1", RawEvents: time.Hour}.Validate())
+	require.Error(t, RetentionPolicy{RawEvents: time.Hour}.Validate())
+	require.Error(t, RetentionPolicy{ProcessID: "p1", StageExecutions: -time.Hour}.Validate())
+}
@@ -0,0 +1,145 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/aggregation"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// AggregateWritesPaused is always false, aggregates of the storage are not rebuilt.
+func (s *Storage) AggregateWritesPaused(context.Context) (bool, error) {
+	return false, nil
+}
+
+// WriteAggregates applies the writes in the given order in one transaction with the same semantics
+// as repo.Repo.WriteAggregates: writes before a failed one are applied, the following ones are not.
+// Errors:
+// - joined *repo.AggregateWriteError: the writes which failed or were not applied.
+func (s *Storage) WriteAggregates(ctx context.Context, writes []repo.AggregateWrite) error {
+	now := s.clock()
+
+	var errs []error
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		failedAt := -1
+
+		for i, write := range writes {
+			var err error
+
+			switch {
+			case failedAt >= 0:
+				err = oerrs.NewTErrf(ctx, "not applied because write %d failed: %w", failedAt, oerrs.ErrInternal)
+			case write.Kind == repo.AggregateWriteMergeExecution:
+				err = s.mergeExecution(ctx, tx, write.Execution, now)
+			case write.Kind == repo.AggregateWriteMergeStageExecution && len(write.Events) > 0:
+				err = s.mergeStageExecution(ctx, tx, write.Events, now)
+			default:
+				err = oerrs.NewTErrf(ctx, "invalid write %s: %w", write, oerrs.ErrBadInput)
+			}
+
+			if err != nil {
+				if failedAt < 0 {
+					failedAt = i
+				}
+
+				errs = append(errs, &repo.AggregateWriteError{Index: i, Write: write, Err: err})
+			}
+		}
+
+		// writes before the failed one are committed
+		return nil
+	})
+	if err != nil {
+		// nothing is committed
+		errs = errs[:0]
+
+		for i, write := range writes {
+			errs = append(errs, &repo.AggregateWriteError{Index: i, Write: write, Err: err})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Storage) mergeExecution(ctx context.Context, tx *sql.Tx, write repo.ExecutionAggregate, now time.Time) error {
+	stored, err := queryDoc[repo.ExecutionAggregate](
+		ctx,
+		tx,
+		`SELECT doc FROM executions WHERE process_id = ? AND execution_id = ?`,
+		write.ProcessID, write.ExecutionID,
+	)
+	if err != nil {
+		return err
+	}
+
+	execution := aggregation.MergeExecution(stored, write, now)
+
+	doc, err := bson.Marshal(execution)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT OR REPLACE INTO executions (process_id, execution_id, first_event_at, expire_at, doc)
+		VALUES (?, ?, ?, ?, ?)`,
+		execution.ProcessID, execution.ExecutionID, millis(execution.FirstEventAt),
+		expireAt(now, s.cfg.StageExecutionsTTLSeconds), doc,
+	)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+func (s *Storage) mergeStageExecution(ctx context.Context, tx *sql.Tx, events []repo.Event, now time.Time) error {
+	first := events[0]
+
+	stored, err := queryDoc[repo.SingleStageExecutionEvent](
+		ctx,
+		tx,
+		`SELECT doc FROM stage_executions WHERE process_id = ? AND execution_id = ? AND stage_execution_id = ?`,
+		first.ProcessID, first.ExecutionID, first.StageExecutionID,
+	)
+	if err != nil {
+		return err
+	}
+
+	stage := aggregation.MergeStageExecution(stored, events, now)
+
+	doc, err := bson.Marshal(stage)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT OR REPLACE INTO stage_executions
+		(process_id, execution_id, stage_execution_id, stage_name, start_ts, expire_at, doc)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		stage.ProcessID, stage.ExecutionID, stage.StageExecutionID, stage.RawStage.Name, millis(stage.Start.Ts),
+		expireAt(now, s.cfg.StageExecutionsTTLSeconds), doc,
+	)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// queryDoc returns the only selected document, nil if there is none.
+func queryDoc[T any](ctx context.Context, db querier, query string, args ...any) (*T, error) {
+	docs, err := queryDocs[T](ctx, db, query, args...)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+
+	return &docs[0], nil
+}
@@ -0,0 +1,173 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// SendToDeadLetters saves the events as dead letters of the consumer with the error which caused the failure.
+// An event which is already a dead letter gets the new error and one more attempt.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) SendToDeadLetters(ctx context.Context, consumerKey string, events []repo.Event, cause error) error {
+	now := millis(s.clock())
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, event := range events {
+			doc, err := bson.Marshal(event)
+			if err != nil {
+				return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+			}
+
+			_, err = tx.ExecContext(
+				ctx,
+				`INSERT INTO dead_letters
+				(consumer_key, event_id, error, attempts, first_failed_at, last_failed_at, event)
+				VALUES (?, ?, ?, 1, ?, ?, ?)
+				ON CONFLICT (consumer_key, event_id) DO UPDATE SET
+				error = excluded.error,
+				attempts = attempts + 1,
+				last_failed_at = excluded.last_failed_at,
+				event = excluded.event`,
+				consumerKey, event.ID.Hex(), cause.Error(), now, now, doc,
+			)
+			if err != nil {
+				return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+			}
+		}
+
+		return nil
+	})
+}
+
+// AcquireConsumerLease takes the lease of the partition for the owner, or renews it if the owner holds it already.
+// It returns false if another owner holds a not expired lease.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) AcquireConsumerLease(
+	ctx context.Context,
+	consumerKey string,
+	partition int,
+	owner string,
+	ttl time.Duration,
+) (bool, error) {
+	now := s.clock()
+
+	result, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO consumer_leases (consumer_key, partition, owner, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (consumer_key, partition) DO UPDATE SET
+		owner = excluded.owner,
+		expires_at = excluded.expires_at
+		WHERE owner = excluded.owner OR expires_at <= ?`,
+		consumerKey, partition, owner, millis(now.Add(ttl)), millis(now),
+	)
+	if err != nil {
+		return false, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	// the lease belongs to someone else if nothing is changed
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return false, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return changed > 0, nil
+}
+
+// ReleaseConsumerLease gives the lease up, so another instance may take it right away.
+// Nothing happens if the owner doesn't hold the lease.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) ReleaseConsumerLease(ctx context.Context, consumerKey string, partition int, owner string) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM consumer_leases WHERE consumer_key = ? AND partition = ? AND owner = ?`,
+		consumerKey, partition, owner,
+	)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// HeartbeatConsumerMember registers the instance in the consumer group or prolongs its membership.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) HeartbeatConsumerMember(
+	ctx context.Context,
+	consumerKey, instance string,
+	ttl time.Duration,
+) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT OR REPLACE INTO consumer_members (consumer_key, instance, expires_at) VALUES (?, ?, ?)`,
+		consumerKey, instance, millis(s.clock().Add(ttl)),
+	)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// ListConsumerMembers returns live instances of the consumer group ordered by instance.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) ListConsumerMembers(ctx context.Context, consumerKey string) ([]repo.ConsumerMember, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT instance, expires_at FROM consumer_members WHERE consumer_key = ? AND expires_at > ? ORDER BY instance`,
+		consumerKey, millis(s.clock()),
+	)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+	defer rows.Close()
+
+	var result []repo.ConsumerMember
+
+	for rows.Next() {
+		member := repo.ConsumerMember{ConsumerKey: consumerKey}
+
+		var expiresAt int64
+
+		err = rows.Scan(&member.Instance, &expiresAt)
+		if err != nil {
+			return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		member.ID = consumerKey + "/" + member.Instance
+		member.ExpiresAt = time.UnixMilli(expiresAt).UTC()
+		result = append(result, member)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// LeaveConsumerGroup removes the instance from the consumer group, so others rebalance without waiting for the TTL.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) LeaveConsumerGroup(ctx context.Context, consumerKey, instance string) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM consumer_members WHERE consumer_key = ? AND instance = ?`,
+		consumerKey, instance,
+	)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package sqlite
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/aggregation"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+)
+
+// GetSingleStageExecution returns the aggregate of a single stage execution
+// Errors:
+// - oerrs.ErrNotFound: if there is no such stage execution.
+// - oerrs.ErrInternal: on any other error.
+func (s *Storage) GetSingleStageExecution(
+	ctx context.Context,
+	processID, executionID, stageExecutionID string,
+) (repo.SingleStageExecutionEvent, error) {
+	stage, err := queryDoc[repo.SingleStageExecutionEvent](
+		ctx,
+		s.db,
+		`SELECT doc FROM stage_executions WHERE process_id = ? AND execution_id = ? AND stage_execution_id = ?`,
+		processID, executionID, stageExecutionID,
+	)
+	if err != nil {
+		return repo.SingleStageExecutionEvent{}, err
+	}
+
+	if stage == nil {
+		return repo.SingleStageExecutionEvent{}, oerrs.NewTErrf(ctx, "no such execution: %w", oerrs.ErrNotFound)
+	}
+
+	return *stage, nil
+}
+
+// ListStageExecutions returns stage executions matching the query ordered by start time, the latest first.
+// Labels are matched after reading, so a query with labels reads all stage executions matching the rest of it.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) ListStageExecutions(
+	ctx context.Context,
+	query repo.StageExecutionsQuery,
+) ([]repo.SingleStageExecutionEvent, error) {
+	var filter sqlFilter
+
+	filter.equal("process_id", query.ProcessID)
+	filter.equal("execution_id", query.ExecutionID)
+	filter.equal("stage_name", query.StageName)
+	filter.timeRange("start_ts", query.StartedFrom, query.StartedTo)
+
+	limit := query.Limit
+	if len(query.Labels) > 0 {
+		limit = 0
+	}
+
+	stages, err := queryDocs[repo.SingleStageExecutionEvent](
+		ctx,
+		s.db,
+		`SELECT doc FROM stage_executions`+filter.where()+` ORDER BY start_ts DESC`+limitClause(limit),
+		filter.args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stages[:0]
+
+	for _, stage := range stages {
+		if query.Labels.Matches(stage.Labels) {
+			result = append(result, stage)
+		}
+	}
+
+	return aggregation.Limit(result, query.Limit), nil
+}
+
+// ListExecutions returns executions matching the query ordered by repo.ExecutionAggregate.FirstEventAt,
+// the latest first. Labels are matched after reading as in ListStageExecutions.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) ListExecutions(ctx context.Context, query repo.ExecutionsQuery) ([]repo.ExecutionAggregate, error) {
+	var filter sqlFilter
+
+	filter.equal("process_id", query.ProcessID)
+	filter.timeRange("first_event_at", query.StartedFrom, query.StartedTo)
+
+	limit := query.Limit
+	if len(query.Labels) > 0 {
+		limit = 0
+	}
+
+	executions, err := queryDocs[repo.ExecutionAggregate](
+		ctx,
+		s.db,
+		`SELECT doc FROM executions`+filter.where()+` ORDER BY first_event_at DESC`+limitClause(limit),
+		filter.args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := executions[:0]
+
+	for _, execution := range executions {
+		if query.Labels.Matches(execution.Labels) {
+			result = append(result, execution)
+		}
+	}
+
+	return aggregation.Limit(result, query.Limit), nil
+}
+
+// SearchStageExecutions searches words and phrases in failures, metadata and stage descriptions
+// of stage executions, see aggregation.SearchStageExecutions. All stage executions of the process
+// within the time range are read and matched in Go.
+// Errors:
+// - oerrs.ErrBadInput: if the search text is empty.
+// - oerrs.ErrInternal: on any other error.
+func (s *Storage) SearchStageExecutions(
+	ctx context.Context,
+	query repo.StageExecutionsSearchQuery,
+) ([]repo.StageExecutionSearchResult, error) {
+	err := aggregation.ValidateSearchQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	stages, err := s.ListStageExecutions(ctx, repo.StageExecutionsQuery{
+		ProcessID:   query.ProcessID,
+		StartedFrom: query.StartedFrom,
+		StartedTo:   query.StartedTo,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregation.Limit(aggregation.SearchStageExecutions(query.Text, stages), query.Limit), nil
+}
+
+// AggregateStageMetrics aggregates metrics of stage executions of a process across executions
+// and groups them into time buckets, see repo.Repo.AggregateStageMetrics.
+// Errors:
+// - oerrs.ErrBadInput: if bucket size is less than a second or the time range is empty.
+// - oerrs.ErrInternal: on any other error.
+func (s *Storage) AggregateStageMetrics(
+	ctx context.Context,
+	query repo.StageMetricsQuery,
+) ([]repo.StageMetricBucket, error) {
+	err := aggregation.ValidateStageMetricsQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// as in MongoDB, the ProcessID is required
+	if len(query.ProcessID) == 0 {
+		return make([]repo.StageMetricBucket, 0), nil
+	}
+
+	stages, err := s.ListStageExecutions(ctx, repo.StageExecutionsQuery{
+		ProcessID:   query.ProcessID,
+		StageName:   query.StageName,
+		StartedFrom: query.From,
+		StartedTo:   query.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregation.StageMetricBuckets(stages, query.Bucket), nil
+}
+
+// sqlFilter builds a WHERE clause of optional conditions.
+type sqlFilter struct {
+	conditions []string
+	args       []any
+}
+
+// equal adds the condition if the value is set.
+func (f *sqlFilter) equal(column, value string) {
+	if len(value) > 0 {
+		f.conditions = append(f.conditions, column+" = ?")
+		f.args = append(f.args, value)
+	}
+}
+
+// timeRange adds conditions of aggregation.InTimeRange, a missing time is stored as 0.
+func (f *sqlFilter) timeRange(column string, from, to time.Time) {
+	if from.IsZero() && to.IsZero() {
+		return
+	}
+
+	f.conditions = append(f.conditions, column+" > 0")
+
+	if !from.IsZero() {
+		f.conditions = append(f.conditions, column+" >= ?")
+		f.args = append(f.args, millis(from))
+	}
+
+	if !to.IsZero() {
+		f.conditions = append(f.conditions, column+" < ?")
+		f.args = append(f.args, millis(to))
+	}
+}
+
+func (f *sqlFilter) where() string {
+	if len(f.conditions) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+// limitClause returns the LIMIT clause, not positive n means no limit.
+func limitClause(n int64) string {
+	if n <= 0 {
+		return ""
+	}
+
+	return " LIMIT " + strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,369 @@
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	tokenSeqField = "seq"
+
+	// watchBatchSize is how many raw events the change feed reads at once.
+	watchBatchSize = 1000
+)
+
+// token is a position in the raw events log, it resumes watching right after the event with seq.
+type token struct {
+	raw bson.Raw
+}
+
+func newToken(seq int64) token {
+	raw, _ := bson.Marshal(bson.D{{Key: tokenSeqField, Value: seq}})
+
+	return token{raw: raw}
+}
+
+func (t token) ResumeToken() bson.Raw {
+	return t.raw
+}
+
+// AppendRawEvents appends events to the raw events log in one transaction, events get new IDs if they have none.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) AppendRawEvents(ctx context.Context, events []repo.Event) error {
+	now := s.clock()
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, event := range events {
+			if event.ID.IsZero() {
+				event.ID = bson.NewObjectID()
+			}
+
+			doc, err := bson.Marshal(event)
+			if err != nil {
+				return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+			}
+
+			_, err = tx.ExecContext(
+				ctx,
+				`INSERT INTO raw_events (process_id, execution_id, ts, appended_at, aggregated, expire_at, doc)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				event.ProcessID, event.ExecutionID, millis(event.Ts), millis(now), event.Aggregated,
+				expireAt(event.Ts, s.cfg.RawEventsTTLSeconds), doc,
+			)
+			if err != nil {
+				return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	close(s.appended)
+	s.appended = make(chan struct{})
+	s.mu.Unlock()
+
+	return nil
+}
+
+// GetRawExecutionEvents returns raw events of the execution sorted by Ts.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) GetRawExecutionEvents(ctx context.Context, processID, executionID string) ([]repo.Event, error) {
+	return queryDocs[repo.Event](
+		ctx,
+		s.db,
+		`SELECT doc FROM raw_events WHERE process_id = ? AND execution_id = ? ORDER BY ts, seq`,
+		processID, executionID,
+	)
+}
+
+// WatchRawEvents calls the action for every appended raw event of the partition from the given position
+// until the context is done, events which are already aggregated (Event.Aggregated) are skipped.
+// Events appended by other processes are found within Config.PollPeriod.
+// The action gets an Idle model once the feed is read up to skipped events.
+// Errors:
+// - oerrs.ErrBadInput: if the token is not a token of this database.
+// - oerrs.ErrInternal: on any other error.
+func (s *Storage) WatchRawEvents(
+	ctx context.Context,
+	from repo.ChangeStreamPosition,
+	partition repo.Partition,
+	action common.CallbackFailable[repo.RawEventWatchModel],
+) error {
+	after, err := s.watchStart(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(s.cfg.PollPeriod)
+	defer ticker.Stop()
+
+	// delivered is the seq of the last token given to the action
+	delivered := after
+
+	for {
+		// taken before reading, so an append during the read wakes the watcher up
+		appended := s.appendedSignal()
+
+		events, err := s.rawEventsAfter(ctx, after)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			after = event.seq
+
+			if !partition.Contains(event.event.ProcessID) {
+				continue
+			}
+
+			delivered = after
+
+			err := action(ctx, repo.RawEventWatchModel{Record: event.event, Token: newToken(event.seq)})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(events) == watchBatchSize {
+			continue
+		}
+
+		// the last events are skipped, the action moves past them
+		if delivered != after {
+			delivered = after
+
+			err := action(ctx, repo.RawEventWatchModel{Token: newToken(after), Idle: true})
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Storage) appendedSignal() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.appended
+}
+
+// watchStart returns the seq the change feed starts after.
+func (s *Storage) watchStart(ctx context.Context, from repo.ChangeStreamPosition) (int64, error) {
+	var last int64
+
+	// sqlite_sequence has no row until the first event is appended
+	err := s.db.QueryRowContext(ctx, `SELECT seq FROM sqlite_sequence WHERE name = 'raw_events'`).Scan(&last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	if len(from.Token) > 0 {
+		seq, ok := from.Token.Lookup(tokenSeqField).AsInt64OK()
+		if !ok || seq < 0 || seq > last {
+			return 0, oerrs.NewTErrf(ctx, "unknown change stream token %s: %w", from.Token, oerrs.ErrBadInput)
+		}
+
+		return seq, nil
+	}
+
+	if from.StartAt.IsZero() {
+		return last, nil
+	}
+
+	var first sql.NullInt64
+
+	err = s.db.QueryRowContext(ctx, `SELECT MIN(seq) FROM raw_events WHERE appended_at >= ?`, millis(from.StartAt)).
+		Scan(&first)
+	if err != nil {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	if !first.Valid {
+		return last, nil
+	}
+
+	return first.Int64 - 1, nil
+}
+
+type sequencedEvent struct {
+	seq   int64
+	event repo.Event
+}
+
+// rawEventsAfter reads the next batch of not aggregated raw events after the seq.
+func (s *Storage) rawEventsAfter(ctx context.Context, after int64) ([]sequencedEvent, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT seq, doc FROM raw_events WHERE seq > ? AND aggregated = 0 ORDER BY seq LIMIT ?`,
+		after, watchBatchSize,
+	)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+	defer rows.Close()
+
+	var result []sequencedEvent
+
+	for rows.Next() {
+		var (
+			event sequencedEvent
+			doc   []byte
+		)
+
+		err = rows.Scan(&event.seq, &doc)
+		if err != nil {
+			return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		err = bson.Unmarshal(doc, &event.event)
+		if err != nil {
+			return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		result = append(result, event)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) SaveChangeStreamToken(ctx context.Context, key string, token bson.Raw) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO change_stream_tokens (key, token) VALUES (?, ?)`, key, token)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// LoadChangeStreamToken returns the token saved by SaveChangeStreamToken.
+// Errors:
+// - oerrs.ErrNotFound: if there is no token for the key.
+// - oerrs.ErrInternal: on any other error.
+func (s *Storage) LoadChangeStreamToken(ctx context.Context, key string) (bson.Raw, error) {
+	var token []byte
+
+	err := s.db.QueryRowContext(ctx, `SELECT token FROM change_stream_tokens WHERE key = ?`, key).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, oerrs.NewTErrf(ctx, "no change stream token for %q: %w", key, oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return token, nil
+}
+
+// LoadChangeStreamTokens returns tokens saved under the key and the keys of its partitions ("key/...").
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) LoadChangeStreamTokens(ctx context.Context, key string) (map[string]bson.Raw, error) {
+	prefix := key + "/"
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT key, token FROM change_stream_tokens WHERE key = ? OR substr(key, 1, length(?)) = ?`,
+		key, prefix, prefix,
+	)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+	defer rows.Close()
+
+	result := map[string]bson.Raw{}
+
+	for rows.Next() {
+		var (
+			tokenKey string
+			token    []byte
+		)
+
+		err = rows.Scan(&tokenKey, &token)
+		if err != nil {
+			return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		result[tokenKey] = token
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// CompareChangeStreamTokens orders tokens by the seq of the event they resume after.
+func (s *Storage) CompareChangeStreamTokens(a, b bson.Raw) int {
+	seqA, _ := a.Lookup(tokenSeqField).AsInt64OK()
+	seqB, _ := b.Lookup(tokenSeqField).AsInt64OK()
+
+	return cmp.Compare(seqA, seqB)
+}
+
+// querier is either the database or a transaction.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// queryDocs returns the documents of the only selected column decoded from BSON.
+func queryDocs[T any](ctx context.Context, db querier, query string, args ...any) ([]T, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+	defer rows.Close()
+
+	var result []T
+
+	for rows.Next() {
+		var doc []byte
+
+		err = rows.Scan(&doc)
+		if err != nil {
+			return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		var value T
+
+		err = bson.Unmarshal(doc, &value)
+		if err != nil {
+			return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		result = append(result, value)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package sqlite
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+)
+
+// expiringTables are tables whose rows are deleted after their expire_at.
+var expiringTables = []string{"raw_events", "stage_executions", "executions", "stage_logs", "stage_log_counters"}
+
+// DeleteExpired deletes rows whose retention period is over, it is what TTL indexes do in MongoDB.
+// Returns the amount of deleted rows.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) DeleteExpired(ctx context.Context) (int64, error) {
+	now := millis(s.clock())
+
+	var deleted int64
+
+	for _, table := range expiringTables {
+		result, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE expire_at > 0 AND expire_at <= ?`, now)
+		if err != nil {
+			return deleted, oerrs.NewTErrf(ctx, "failed to delete expired rows of %s: %w: %w", table, err, oerrs.ErrInternal)
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return deleted, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		deleted += count
+	}
+
+	return deleted, nil
+}
+
+// runCleanup deletes expired rows every Config.CleanupPeriod until the context is done.
+// Failures are logged, the next period tries again.
+func (s *Storage) runCleanup(ctx context.Context) {
+	defer close(s.cleanupDone)
+
+	if s.cfg.CleanupPeriod <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.CleanupPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := s.DeleteExpired(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to delete expired rows", slog.Any("error", err))
+			continue
+		}
+
+		if deleted > 0 {
+			slog.InfoContext(ctx, "deleted expired rows", slog.Int64("count", deleted))
+		}
+	}
+}
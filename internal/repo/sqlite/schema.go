@@ -0,0 +1,99 @@
+package sqlite
+
+// schema creates missing tables and indexes. Times are Unix milliseconds, expire_at is 0 for rows which never expire.
+const schema = `
+CREATE TABLE IF NOT EXISTS raw_events (
+	seq          INTEGER PRIMARY KEY AUTOINCREMENT,
+	process_id   TEXT    NOT NULL,
+	execution_id TEXT    NOT NULL,
+	ts           INTEGER NOT NULL,
+	appended_at  INTEGER NOT NULL,
+	aggregated   INTEGER NOT NULL,
+	expire_at    INTEGER NOT NULL,
+	doc          BLOB    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS raw_events_execution ON raw_events (process_id, execution_id, ts);
+CREATE INDEX IF NOT EXISTS raw_events_appended_at ON raw_events (appended_at);
+CREATE INDEX IF NOT EXISTS raw_events_expire_at ON raw_events (expire_at) WHERE expire_at > 0;
+
+CREATE TABLE IF NOT EXISTS stage_executions (
+	process_id         TEXT    NOT NULL,
+	execution_id       TEXT    NOT NULL,
+	stage_execution_id TEXT    NOT NULL,
+	stage_name         TEXT    NOT NULL,
+	start_ts           INTEGER NOT NULL,
+	expire_at          INTEGER NOT NULL,
+	doc                BLOB    NOT NULL,
+	PRIMARY KEY (process_id, execution_id, stage_execution_id)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS stage_executions_process_start ON stage_executions (process_id, start_ts);
+CREATE INDEX IF NOT EXISTS stage_executions_start ON stage_executions (start_ts);
+CREATE INDEX IF NOT EXISTS stage_executions_expire_at ON stage_executions (expire_at) WHERE expire_at > 0;
+
+CREATE TABLE IF NOT EXISTS executions (
+	process_id     TEXT    NOT NULL,
+	execution_id   TEXT    NOT NULL,
+	first_event_at INTEGER NOT NULL,
+	expire_at      INTEGER NOT NULL,
+	doc            BLOB    NOT NULL,
+	PRIMARY KEY (process_id, execution_id)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS executions_process_first_event ON executions (process_id, first_event_at);
+CREATE INDEX IF NOT EXISTS executions_first_event ON executions (first_event_at);
+CREATE INDEX IF NOT EXISTS executions_expire_at ON executions (expire_at) WHERE expire_at > 0;
+
+CREATE TABLE IF NOT EXISTS stage_logs (
+	process_id         TEXT    NOT NULL,
+	execution_id       TEXT    NOT NULL,
+	stage_execution_id TEXT    NOT NULL,
+	seq                INTEGER NOT NULL,
+	line_id            TEXT,
+	expire_at          INTEGER NOT NULL,
+	doc                BLOB    NOT NULL,
+	PRIMARY KEY (process_id, execution_id, stage_execution_id, seq)
+) WITHOUT ROWID;
+CREATE UNIQUE INDEX IF NOT EXISTS stage_logs_line_id
+	ON stage_logs (process_id, execution_id, stage_execution_id, line_id) WHERE line_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS stage_logs_expire_at ON stage_logs (expire_at) WHERE expire_at > 0;
+
+CREATE TABLE IF NOT EXISTS stage_log_counters (
+	process_id         TEXT    NOT NULL,
+	execution_id       TEXT    NOT NULL,
+	stage_execution_id TEXT    NOT NULL,
+	count              INTEGER NOT NULL,
+	expire_at          INTEGER NOT NULL,
+	PRIMARY KEY (process_id, execution_id, stage_execution_id)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS stage_log_counters_expire_at ON stage_log_counters (expire_at) WHERE expire_at > 0;
+
+CREATE TABLE IF NOT EXISTS change_stream_tokens (
+	key   TEXT PRIMARY KEY,
+	token BLOB NOT NULL
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+	consumer_key    TEXT    NOT NULL,
+	event_id        TEXT    NOT NULL,
+	error           TEXT    NOT NULL,
+	attempts        INTEGER NOT NULL,
+	first_failed_at INTEGER NOT NULL,
+	last_failed_at  INTEGER NOT NULL,
+	event           BLOB    NOT NULL,
+	PRIMARY KEY (consumer_key, event_id)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS consumer_leases (
+	consumer_key TEXT    NOT NULL,
+	partition    INTEGER NOT NULL,
+	owner        TEXT    NOT NULL,
+	expires_at   INTEGER NOT NULL,
+	PRIMARY KEY (consumer_key, partition)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS consumer_members (
+	consumer_key TEXT    NOT NULL,
+	instance     TEXT    NOT NULL,
+	expires_at   INTEGER NOT NULL,
+	PRIMARY KEY (consumer_key, instance)
+) WITHOUT ROWID;
+`
@@ -0,0 +1,174 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/storagetest"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStorage(t *testing.T, cfg Config, clock utils.Clock) *Storage {
+	t.Helper()
+
+	if len(cfg.Path) == 0 {
+		cfg.Path = filepath.Join(t.TempDir(), "pipetank.db")
+	}
+
+	if cfg.PollPeriod == 0 {
+		cfg.PollPeriod = time.Millisecond * 10
+	}
+
+	storage, err := Open(t.Context(), cfg, clock)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = storage.Close()
+	})
+
+	return storage
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, clock utils.Clock) repo.Storage {
+		return openTestStorage(t, Config{}, clock)
+	})
+}
+
+func testEvent(processID string, ts time.Time) repo.Event {
+	return repo.Event{
+		ProcessID:        processID,
+		ExecutionID:      "e1",
+		StageExecutionID: "s1",
+		WorkerID:         "w1",
+		Stage:            repo.RawStage{Name: "stage_1"},
+		Ts:               ts,
+		Kind:             repo.EventKindStageStarted,
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ts := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	clock := ts
+
+	storage := openTestStorage(t, Config{RawEventsTTLSeconds: 60, StageExecutionsTTLSeconds: 120}, func() time.Time {
+		return clock
+	})
+
+	event := testEvent("p1", ts)
+	require.NoError(t, storage.AppendRawEvents(t.Context(), []repo.Event{event}))
+	require.NoError(t, storage.WriteAggregates(t.Context(), []repo.AggregateWrite{
+		repo.MergeStageExecutionWrite([]repo.Event{event}),
+	}))
+
+	// raw events expire by Ts, aggregates by their last update
+	clock = ts.Add(time.Minute)
+
+	deleted, err := storage.DeleteExpired(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	events, err := storage.GetRawExecutionEvents(t.Context(), "p1", "e1")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	_, err = storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+
+	clock = ts.Add(time.Minute * 2)
+
+	deleted, err = storage.DeleteExpired(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	_, err = storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.Error(t, err)
+}
+
+func TestWatchRawEventsOfOtherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipetank.db")
+
+	// two storages of one file are what two processes sharing the database see
+	writer := openTestStorage(t, Config{Path: path}, utils.UTCClock())
+	reader := openTestStorage(t, Config{Path: path}, utils.UTCClock())
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+
+	received := make(chan repo.Event, 1)
+
+	go func() {
+		_ = reader.WatchRawEvents(ctx, repo.ChangeStreamPosition{}, repo.Partition{},
+			func(_ context.Context, event repo.RawEventWatchModel) error {
+				received <- event.Record
+				return nil
+			},
+		)
+	}()
+
+	// the watcher starts from now, so events are appended until it receives one
+	for {
+		require.NoError(t, writer.AppendRawEvents(ctx, []repo.Event{testEvent("p1", time.Now().UTC())}))
+
+		select {
+		case event := <-received:
+			assert.Equal(t, "p1", event.ProcessID)
+			return
+		case <-time.After(time.Millisecond * 50):
+		case <-ctx.Done():
+			t.Fatal("the event appended by another storage is not received")
+		}
+	}
+}
+
+func TestConsumerLeases(t *testing.T) {
+	clock := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	storage := openTestStorage(t, Config{}, func() time.Time {
+		return clock
+	})
+
+	acquired, err := storage.AcquireConsumerLease(t.Context(), "c", 0, "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = storage.AcquireConsumerLease(t.Context(), "c", 0, "b", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired, "the lease of another owner is not expired")
+
+	acquired, err = storage.AcquireConsumerLease(t.Context(), "c", 0, "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired, "the owner renews its lease")
+
+	clock = clock.Add(time.Minute)
+
+	acquired, err = storage.AcquireConsumerLease(t.Context(), "c", 0, "b", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired, "an expired lease is taken over")
+
+	require.NoError(t, storage.ReleaseConsumerLease(t.Context(), "c", 0, "b"))
+
+	acquired, err = storage.AcquireConsumerLease(t.Context(), "c", 0, "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	require.NoError(t, storage.HeartbeatConsumerMember(t.Context(), "c", "b", time.Minute))
+	require.NoError(t, storage.HeartbeatConsumerMember(t.Context(), "c", "a", time.Minute))
+
+	members, err := storage.ListConsumerMembers(t.Context(), "c")
+	require.NoError(t, err)
+	require.Len(t, members, 2)
+	assert.Equal(t, "a", members[0].Instance)
+
+	require.NoError(t, storage.LeaveConsumerGroup(t.Context(), "c", "a"))
+
+	members, err = storage.ListConsumerMembers(t.Context(), "c")
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, "b", members[0].Instance)
+}
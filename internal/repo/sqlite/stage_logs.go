@@ -0,0 +1,199 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type stageKey struct {
+	processID, executionID, stageExecutionID string
+}
+
+// AppendStageLogLines appends log lines to the logs of their stage executions in one transaction.
+// Lines of one stage execution are ordered by Ts and get sequential repo.StageLogLine.Seq.
+// Only the first maxLinesPerStage lines of a stage execution are stored, the rest is dropped.
+// Lines with a repo.StageLogLine.LineID which is already stored are skipped, see repo.SkipStoredStageLogLines.
+//
+// Returns the amount of dropped lines.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) AppendStageLogLines(
+	ctx context.Context,
+	lines []repo.StageLogLine,
+	maxLinesPerStage int64,
+) (int, error) {
+	grouped := map[stageKey][]repo.StageLogLine{}
+	for _, line := range lines {
+		key := stageKey{line.ProcessID, line.ExecutionID, line.StageExecutionID}
+		grouped[key] = append(grouped[key], line)
+	}
+
+	now := s.clock()
+	dropped := 0
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for key, group := range grouped {
+			slices.SortStableFunc(group, func(a, b repo.StageLogLine) int {
+				return a.Ts.Compare(b.Ts)
+			})
+
+			pending, err := s.skipStoredStageLogLines(ctx, tx, key, group)
+			if err != nil {
+				return err
+			}
+
+			if len(pending) == 0 {
+				continue
+			}
+
+			firstSeq, err := s.reserveStageLogSeqs(ctx, tx, key, int64(len(pending)))
+			if err != nil {
+				return err
+			}
+
+			for i, line := range pending {
+				seq := firstSeq + int64(i)
+				if seq >= maxLinesPerStage {
+					dropped += len(pending) - i
+					break
+				}
+
+				line.ID = bson.NewObjectID()
+				line.Seq = seq
+				line.CreatedAt = now
+
+				err = s.insertStageLogLine(ctx, tx, line)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return dropped, nil
+}
+
+// skipStoredStageLogLines returns the lines of the stage execution which repo.SkipStoredStageLogLines keeps.
+func (s *Storage) skipStoredStageLogLines(
+	ctx context.Context,
+	tx *sql.Tx,
+	key stageKey,
+	lines []repo.StageLogLine,
+) ([]repo.StageLogLine, error) {
+	storedIDs := map[string]struct{}{}
+
+	for _, line := range lines {
+		if len(line.LineID) == 0 {
+			continue
+		}
+
+		var stored bool
+
+		err := tx.QueryRowContext(
+			ctx,
+			`SELECT EXISTS (SELECT 1 FROM stage_logs
+			WHERE process_id = ? AND execution_id = ? AND stage_execution_id = ? AND line_id = ?)`,
+			key.processID, key.executionID, key.stageExecutionID, line.LineID,
+		).Scan(&stored)
+		if err != nil {
+			return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+
+		if stored {
+			storedIDs[line.LineID] = struct{}{}
+		}
+	}
+
+	return repo.SkipStoredStageLogLines(lines, storedIDs), nil
+}
+
+// reserveStageLogSeqs reserves n sequence numbers of the stage execution and returns the first of them.
+func (s *Storage) reserveStageLogSeqs(ctx context.Context, tx *sql.Tx, key stageKey, n int64) (int64, error) {
+	var count int64
+
+	err := tx.QueryRowContext(
+		ctx,
+		`SELECT count FROM stage_log_counters WHERE process_id = ? AND execution_id = ? AND stage_execution_id = ?`,
+		key.processID, key.executionID, key.stageExecutionID,
+	).Scan(&count)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT OR REPLACE INTO stage_log_counters (process_id, execution_id, stage_execution_id, count, expire_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		key.processID, key.executionID, key.stageExecutionID, count+n,
+		expireAt(s.clock(), s.cfg.StageLogsTTLSeconds),
+	)
+	if err != nil {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return count, nil
+}
+
+func (s *Storage) insertStageLogLine(ctx context.Context, tx *sql.Tx, line repo.StageLogLine) error {
+	doc, err := bson.Marshal(line)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO stage_logs (process_id, execution_id, stage_execution_id, seq, line_id, expire_at, doc)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		line.ProcessID, line.ExecutionID, line.StageExecutionID, line.Seq, nullString(line.LineID),
+		expireAt(line.CreatedAt, s.cfg.StageLogsTTLSeconds), doc,
+	)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// GetStageLogLines returns up to limit log lines of the stage execution with repo.StageLogLine.Seq >= fromSeq
+// ordered by repo.StageLogLine.Seq.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (s *Storage) GetStageLogLines(
+	ctx context.Context,
+	processID, executionID, stageExecutionID string,
+	fromSeq int64,
+	limit int64,
+) ([]repo.StageLogLine, error) {
+	lines, err := queryDocs[repo.StageLogLine](
+		ctx,
+		s.db,
+		`SELECT doc FROM stage_logs WHERE process_id = ? AND execution_id = ? AND stage_execution_id = ? AND seq >= ?
+		ORDER BY seq`+limitClause(limit),
+		processID, executionID, stageExecutionID, fromSeq,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if lines == nil {
+		return make([]repo.StageLogLine, 0), nil
+	}
+
+	return lines, nil
+}
+
+// nullString stores an empty string as NULL, unique indexes don't compare NULLs.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: len(s) > 0}
+}
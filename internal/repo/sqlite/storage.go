@@ -0,0 +1,144 @@
+// Package sqlite implements repo.Storage on an embedded SQLite database for small deployments
+// which don't want to run MongoDB. Documents are stored as BSON next to the columns they are
+// filtered and sorted by, aggregates are merged in Go (see aggregation) within write transactions.
+//
+// Several processes on one host may share the database file, e.g. `api` and `raw_events_collector`.
+// SQLite serializes write transactions, so raw events are committed in the order of their seq
+// and the change feed reads them by seq.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	// registers the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var _ repo.Storage = (*Storage)(nil)
+
+type Config struct {
+	// Path of the database file, it is created with its tables if it doesn't exist.
+	Path string `env:"SQLITE_PATH" envDefault:"pipetank.db"`
+	// PollPeriod is how often the change feed looks for raw events appended by other processes,
+	// events appended by this process are delivered at once.
+	PollPeriod time.Duration `env:"SQLITE_POLL_PERIOD" envDefault:"500ms"`
+	// CleanupPeriod is how often expired rows are deleted, zero disables the cleanup.
+	CleanupPeriod time.Duration `env:"SQLITE_CLEANUP_PERIOD" envDefault:"1m"`
+
+	// Retention periods are the ones of the MongoDB default policy, zero keeps rows forever.
+	// Raw events expire by Ts, aggregates by their last update and log lines by their creation.
+	RawEventsTTLSeconds       int64 `env:"RAW_EVENTS_TTL_SECONDS"`
+	StageExecutionsTTLSeconds int64 `env:"STAGE_EXECUTIONS_TTL_SECONDS"`
+	StageLogsTTLSeconds       int64 `env:"STAGE_LOGS_TTL_SECONDS"`
+}
+
+// Storage is safe for concurrent use.
+type Storage struct {
+	db    *sql.DB
+	cfg   Config
+	clock utils.Clock
+
+	mu sync.Mutex
+	// appended is closed and replaced on every append of this process, so watchers wake up.
+	appended chan struct{}
+
+	stopCleanup context.CancelFunc
+	cleanupDone chan struct{}
+}
+
+// Open opens the database, creates missing tables and starts deleting expired rows every Config.CleanupPeriod.
+// Errors:
+// - oerrs.ErrInternal: if the database can't be opened.
+func Open(ctx context.Context, cfg Config, clock utils.Clock) (*Storage, error) {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_busy_timeout", "10000")
+	// write transactions take the lock at once, so aggregates are read and written under it
+	params.Set("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?%s", cfg.Path, params.Encode()))
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	_, err = db.ExecContext(ctx, schema)
+	if err != nil {
+		_ = db.Close()
+		return nil, oerrs.NewTErrf(ctx, "failed to create tables of %s: %w: %w", cfg.Path, err, oerrs.ErrInternal)
+	}
+
+	cleanupCtx, stopCleanup := context.WithCancel(context.WithoutCancel(ctx))
+
+	storage := &Storage{
+		db:          db,
+		cfg:         cfg,
+		clock:       clock,
+		appended:    make(chan struct{}),
+		stopCleanup: stopCleanup,
+		cleanupDone: make(chan struct{}),
+	}
+
+	go storage.runCleanup(cleanupCtx)
+
+	return storage, nil
+}
+
+// Close stops the cleanup and closes the database.
+func (s *Storage) Close() error {
+	s.stopCleanup()
+	<-s.cleanupDone
+
+	return s.db.Close()
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// inTx runs the function in a write transaction and commits it if the function succeeds.
+func (s *Storage) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// millis returns the time as Unix milliseconds, the precision of BSON dates, and 0 for the zero time.
+func millis(ts time.Time) int64 {
+	if ts.IsZero() {
+		return 0
+	}
+
+	return ts.UnixMilli()
+}
+
+// expireAt returns the expiry of a row written at ts, 0 if rows never expire.
+func expireAt(ts time.Time, ttlSeconds int64) int64 {
+	if ttlSeconds <= 0 {
+		return 0
+	}
+
+	return millis(ts.Add(time.Duration(ttlSeconds) * time.Second))
+}
@@ -3,8 +3,9 @@ package repo
 import (
 	"context"
 	"errors"
-	"os"
-	"strconv"
+	"maps"
+	"slices"
+	"time"
 
 	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -14,7 +15,10 @@ import (
 
 const (
 	collectionNameSingleStageExec = "single_stage_exec"
-	idxNameSingleStageTTL         = "ttl_stage_exec"
+	// idxNameSingleStageTTL is the replaced TTL index with a global period.
+	idxNameSingleStageTTL        = "ttl_stage_exec"
+	idxNameSingleStageStageStart = "stage_exec_stage_start"
+	idxNameSingleStageKey        = "stage_exec_key"
 )
 
 func getSingleStageExecutionFilter(
@@ -28,133 +32,317 @@ func getSingleStageExecutionFilter(
 }
 
 func (r *Repo) createSingleStageIndexes(ctx context.Context) error {
-	ttlSec, err := strconv.ParseInt(os.Getenv("STAGE_EXECUTIONS_TTL_SECONDS"), 10, 32)
+	err := r.createExpireAtIndex(ctx, collectionNameSingleStageExec, idxNameSingleStageExpireAt, idxNameSingleStageTTL)
 	if err != nil {
-		return oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
-	}
-
-	err = r.client.CreateOrUpdateTTLIndex(
-		ctx,
-		collectionNameSingleStageExec,
-		idxNameSingleStageTTL,
-		int32(ttlSec),
-		mongo.IndexModel{
-			Keys: bson.M{SingleStageExecutionEventUpdateAtFieldName(): 1},
-			Options: options.Index().
-				SetExpireAfterSeconds(int32(ttlSec)).
-				SetName(idxNameSingleStageTTL),
+		return err
+	}
+
+	err = r.client.CreateIndexes(ctx, collectionNameSingleStageExec, []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: SingleStageExecutionEventProcessIDFieldName(), Value: 1},
+			{Key: SingleStageExecutionEventRawStageNameFieldName(), Value: 1},
+			{Key: SingleStageExecutionEventStartTsFieldName(), Value: 1},
 		},
-	)
+		Options: options.Index().SetName(idxNameSingleStageStageStart),
+	}, {
+		// upserts of aggregates and the copy of SwapRebuild select stage executions by their key
+		Keys: bson.D{
+			{Key: SingleStageExecutionEventProcessIDFieldName(), Value: 1},
+			{Key: SingleStageExecutionEventExecutionIDFieldName(), Value: 1},
+			{Key: SingleStageExecutionEventStageExecutionIDFieldName(), Value: 1},
+		},
+		Options: options.Index().SetName(idxNameSingleStageKey),
+	}})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	err = r.createSingleStageTextIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.createLabelIndexes(ctx, collectionNameSingleStageExec, SingleStageExecutionEventLabelsFieldName())
 }
 
-func (r *Repo) StartSingleStageExecution(
-	ctx context.Context,
-	event SingleStageExecutionEvent,
-) error {
-	if event.UpdatedAt.IsZero() {
-		event.UpdatedAt = r.clock()
+// stageExecutionUpdate returns an update pipeline which merges events of one stage execution
+// into its aggregate, the aggregate is created by any event kind.
+// The result doesn't depend on the order of batches: the earliest start and the latest finish win,
+// updates are kept sorted by Ts and IsFinished and IsSuccess are derived from the stored finish.
+// Events are expected to be sorted by Ts.
+func stageExecutionUpdate(events []Event, updatedAt, expireAt time.Time) bson.A {
+	set := stageMetricsUpdate(events...)
+	labelsUpdate(set, SingleStageExecutionEventLabelsFieldName(), events...)
+	maps.Copy(set, searchTextUpdate(events...))
+
+	set[SingleStageExecutionEventUpdateAtFieldName()] = updatedAt
+	set[ExpireAtFieldName()] = expireAt
+	set[SingleStageExecutionEventWorkerIDFieldName()] = ifMissing(
+		SingleStageExecutionEventWorkerIDFieldName(),
+		events[0].WorkerID,
+	)
+	set[SingleStageExecutionEventRawStageFieldName()] = ifMissing(
+		SingleStageExecutionEventRawStageFieldName(),
+		events[0].Stage,
+	)
+
+	var updates []Event
+
+	startField, endField := SingleStageExecutionEventStartFieldName(), SingleStageExecutionEventEndFieldName()
+
+	for _, event := range events {
+		switch event.Kind {
+		case EventKindStageStarted:
+			// events are sorted, so the first start of the batch is the earliest one
+			if _, ok := set[startField]; !ok {
+				set[startField] = replaceByTs(startField, event, "$lt")
+			}
+		case EventKindStageFinished:
+			set[endField] = replaceByTs(endField, event, "$gte")
+		case EventKindGenericUpdate:
+			updates = append(updates, event)
+		}
 	}
 
-	v, err := r.client.
-		DB().
-		Collection(collectionNameSingleStageExec).
-		UpdateOne(
-			ctx,
-			event,
-			options.
-				UpdateOne().
-				SetUpsert(true),
-		)
-	if err != nil {
-		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	if len(updates) > 0 {
+		field := SingleStageExecutionEventUpdatesFieldName()
+		set[field] = bson.M{"$sortArray": bson.M{
+			"input":  unionWith(field, updates),
+			"sortBy": bson.M{RawEventGetTsFieldName(): 1},
+		}}
+	}
+
+	end := "$" + endField
+
+	return bson.A{
+		bson.M{"$set": set},
+		bson.M{"$set": bson.M{
+			SingleStageExecutionEventIsFinishedFieldName(): bson.M{"$ne": bson.A{bson.M{"$type": end}, "missing"}},
+			SingleStageExecutionEventIsSuccessFieldName(): bson.M{
+				"$eq": bson.A{end + "." + RawEventStatusFieldName(), EventStatusSuccess},
+			},
+		}},
+	}
+}
+
+// replaceByTs returns an expression which replaces the stored event in the field by the given one
+// if there is no stored event or cmp (`$lt` or `$gte`) of the given and the stored Ts is true.
+func replaceByTs(field string, event Event, cmp string) bson.M {
+	storedTs := "$" + field + "." + RawEventGetTsFieldName()
+
+	return bson.M{"$cond": bson.A{
+		bson.M{"$or": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": storedTs}, "missing"}},
+			bson.M{cmp: bson.A{event.Ts, storedTs}},
+		}},
+		bson.M{"$literal": event},
+		"$" + field,
+	}}
+}
+
+// ifMissing returns an expression which keeps the stored value of the field or sets the given one.
+func ifMissing(field string, value any) bson.M {
+	return bson.M{"$ifNull": bson.A{"$" + field, bson.M{"$literal": value}}}
+}
+
+// unionWith returns an expression of the stored array in the field merged with the values without duplicates.
+func unionWith[T any](field string, values []T) bson.M {
+	return bson.M{"$setUnion": bson.A{bson.M{"$ifNull": bson.A{"$" + field, bson.A{}}}, bson.M{"$literal": values}}}
+}
+
+// labelsUpdate adds labels of the events to the `$set` part of an update,
+// so they are merged with labels which are already stored in the labelsField.
+// Events are expected to be sorted by Ts, so the last reported value wins.
+func labelsUpdate(set bson.M, labelsField string, events ...Event) {
+	for _, event := range events {
+		for key, value := range event.Labels {
+			set[labelsField+"."+key] = bson.M{"$literal": value}
+		}
+	}
+}
+
+// stageMetricsUpdate builds `$set` expressions of an update pipeline
+// which fold metrics of the events into SingleStageExecutionEvent.Metrics:
+// sums and counts are added, the last value is of the latest event of all batches.
+// Events whose keys are stored in SingleStageExecutionEvent.MetricEvents are summed already,
+// so redelivered events don't change sums and counts.
+// Events are expected to be sorted by Ts.
+func stageMetricsUpdate(events ...Event) bson.M {
+	set := bson.M{}
+
+	keysField := SingleStageExecutionEventMetricEventsFieldName()
+	storedKeys := bson.M{"$ifNull": bson.A{"$" + keysField, bson.A{}}}
+
+	sums := map[string]bson.A{}
+	counts := map[string]bson.A{}
+	last := map[string]Event{}
+
+	var keys []string
+
+	for _, event := range events {
+		if len(event.Metrics) == 0 {
+			continue
+		}
+
+		key := event.Key()
+		if slices.Contains(keys, key) {
+			continue
+		}
+
+		keys = append(keys, key)
+		isNew := bson.M{"$not": bson.A{bson.M{"$in": bson.A{key, storedKeys}}}}
+
+		for name, metric := range event.Metrics {
+			prefix := SingleStageExecutionEventMetricsFieldName() + "." + name + "."
+
+			if len(metric.Unit) > 0 {
+				set[prefix+"u"] = bson.M{"$literal": metric.Unit}
+			}
+
+			sums[prefix+"s"] = append(sums[prefix+"s"], bson.M{"$cond": bson.A{isNew, metric.Value, 0}})
+			counts[prefix+"c"] = append(counts[prefix+"c"], bson.M{"$cond": bson.A{isNew, int64(1), int64(0)}})
+			last[name] = event
+		}
+	}
+
+	for field, terms := range sums {
+		set[field] = bson.M{"$add": append(bson.A{bson.M{"$ifNull": bson.A{"$" + field, 0}}}, terms...)}
 	}
 
-	if v.ModifiedCount != 1 || v.UpsertedCount != 1 {
-		return oerrs.NewTErrf(ctx, "unexpected result of upsert: %v", v)
+	for field, terms := range counts {
+		set[field] = bson.M{"$add": append(bson.A{bson.M{"$ifNull": bson.A{"$" + field, 0}}}, terms...)}
 	}
 
-	return nil
+	if len(keys) > 0 {
+		set[keysField] = bson.M{"$sortArray": bson.M{
+			"input":  bson.M{"$setUnion": bson.A{storedKeys, bson.M{"$literal": keys}}},
+			"sortBy": 1,
+		}}
+	}
+
+	for name, event := range last {
+		prefix := SingleStageExecutionEventMetricsFieldName() + "." + name + "."
+		storedTs := "$" + prefix + "t"
+
+		isLatest := bson.M{"$or": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": storedTs}, "missing"}},
+			bson.M{"$gte": bson.A{event.Ts, storedTs}},
+		}}
+
+		set[prefix+"l"] = bson.M{"$cond": bson.A{isLatest, event.Metrics[name].Value, "$" + prefix + "l"}}
+		set[prefix+"t"] = bson.M{"$cond": bson.A{isLatest, event.Ts, storedTs}}
+	}
+
+	return set
 }
 
-func (r *Repo) UpdateSingleStageExecution(
+// GetSingleStageExecution returns the aggregate of a single stage execution
+// Errors:
+// - oerrs.ErrNotFound: if there is no such stage execution
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) GetSingleStageExecution(
 	ctx context.Context,
 	processID, executionID, stageExecutionID string,
-	events []Event,
-) error {
-	updateOperation := bson.M{
-		"$set":      bson.M{SingleStageExecutionEventUpdateAtFieldName(): r.clock()},
-		"$addToSet": bson.M{SingleStageExecutionEventUpdatesFieldName(): bson.M{"$each": events}},
-	}
+) (SingleStageExecutionEvent, error) {
+	var result SingleStageExecutionEvent
 
-	v, err := r.client.
+	err := r.client.
 		DB().
 		Collection(collectionNameSingleStageExec).
-		UpdateOne(ctx, getSingleStageExecutionFilter(processID, executionID, stageExecutionID), updateOperation)
-
+		FindOne(ctx, getSingleStageExecutionFilter(processID, executionID, stageExecutionID)).
+		Decode(&result)
 	if errors.Is(err, mongo.ErrNoDocuments) {
-		return oerrs.NewTErrf(ctx, "no such execution: %w", oerrs.ErrNotFound)
+		return result, oerrs.NewTErrf(ctx, "no such execution: %w", oerrs.ErrNotFound)
 	}
 
 	if err != nil {
-		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		return result, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// StageExecutionsQuery selects stage executions for ListStageExecutions.
+type StageExecutionsQuery struct {
+	// ProcessID, ExecutionID and StageName are optional.
+	ProcessID   string
+	ExecutionID string
+	StageName   string
+
+	Labels LabelSelector
+
+	// StartedFrom and StartedTo are optional and limit the start time of stage executions.
+	StartedFrom time.Time
+	StartedTo   time.Time
+
+	Limit int64
+}
+
+// ListStageExecutions returns stage executions matching the query ordered by start time, the latest first.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListStageExecutions(
+	ctx context.Context,
+	query StageExecutionsQuery,
+) ([]SingleStageExecutionEvent, error) {
+	filter := query.Labels.Filter(SingleStageExecutionEventLabelsFieldName())
+
+	if len(query.ProcessID) > 0 {
+		filter[SingleStageExecutionEventProcessIDFieldName()] = query.ProcessID
+	}
+
+	if len(query.ExecutionID) > 0 {
+		filter[SingleStageExecutionEventExecutionIDFieldName()] = query.ExecutionID
 	}
 
-	if v.MatchedCount != 1 {
-		return oerrs.NewTErrf(
+	if len(query.StageName) > 0 {
+		filter[SingleStageExecutionEventRawStageNameFieldName()] = query.StageName
+	}
+
+	if tsFilter := timeRangeFilter(query.StartedFrom, query.StartedTo); tsFilter != nil {
+		filter[SingleStageExecutionEventStartTsFieldName()] = tsFilter
+	}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameSingleStageExec).
+		Find(
 			ctx,
-			"expected to update 1 document, got %d:%w",
-			v.MatchedCount,
-			oerrs.ErrNotFound,
+			filter,
+			options.Find().
+				SetSort(bson.M{SingleStageExecutionEventStartTsFieldName(): -1}).
+				SetLimit(query.Limit),
 		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
 	}
 
-	if v.ModifiedCount != 1 {
-		return oerrs.NewTErrf(ctx, "expected to update 1 document, got %d", v.ModifiedCount)
-	}
+	var result []SingleStageExecutionEvent
 
-	if v.UpsertedCount != 0 {
-		return oerrs.NewTErrf(ctx, "expected to upsert 0 documents, got %d", v.UpsertedCount)
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
 	}
 
-	return err
+	return result, nil
 }
 
-func (r *Repo) FinishSingleStageExecution(
-	ctx context.Context,
-	event Event,
-	isSuccess bool,
-) error {
-	filter := getSingleStageExecutionFilter(
-		event.ProcessID,
-		event.ExecutionID,
-		event.StageExecutionID,
-	)
-	update := bson.M{
-		"$set": bson.M{
-			SingleStageExecutionEventUpdateAtFieldName():   r.clock(),
-			SingleStageExecutionEventEndFieldName():        event,
-			SingleStageExecutionEventIsFinishedFieldName(): true,
-			SingleStageExecutionEventIsSuccessFieldName():  isSuccess,
-		},
+// timeRangeFilter returns a filter for a time field or nil if both bounds are zero.
+// from is inclusive, to is exclusive.
+func timeRangeFilter(from, to time.Time) bson.M {
+	if from.IsZero() && to.IsZero() {
+		return nil
 	}
 
-	v, err := r.client.DB().Collection(collectionNameSingleStageExec).UpdateOne(ctx, filter, update)
-	if errors.Is(err, mongo.ErrNoDocuments) {
-		return oerrs.NewTErrf(ctx, "no such execution: %w", oerrs.ErrNotFound)
-	}
+	result := bson.M{}
 
-	if err != nil {
-		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	if !from.IsZero() {
+		result["$gte"] = from
 	}
 
-	if v.MatchedCount != 1 {
-		return oerrs.NewTErrf(ctx, "expected to update 1 document, got %d", v.MatchedCount)
+	if !to.IsZero() {
+		result["$lt"] = to
 	}
 
-	return nil
+	return result
 }
@@ -0,0 +1,125 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestStageMetricsUpdate(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	events := []Event{
+		{Ts: ts, Metrics: map[string]Metric{"rows": {Value: 10, Unit: "rows"}, "cost": {Value: 0.5}}},
+		{Ts: ts.Add(time.Second), Metrics: map[string]Metric{"rows": {Value: 15}}},
+		{Ts: ts.Add(time.Second * 2)},
+	}
+
+	// the redelivered event is folded once
+	set := stageMetricsUpdate(append(events, events[1])...)
+
+	isNew := func(event Event) bson.M {
+		return bson.M{"$not": bson.A{bson.M{"$in": bson.A{event.Key(), bson.M{"$ifNull": bson.A{"$mk", bson.A{}}}}}}}
+	}
+
+	assert.Equal(t, bson.M{"$literal": "rows"}, set["mt.rows.u"])
+	assert.Equal(t, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$mt.rows.s", 0}},
+		bson.M{"$cond": bson.A{isNew(events[0]), float64(10), 0}},
+		bson.M{"$cond": bson.A{isNew(events[1]), float64(15), 0}},
+	}}, set["mt.rows.s"])
+	assert.Equal(t, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$mt.cost.c", 0}},
+		bson.M{"$cond": bson.A{isNew(events[0]), int64(1), int64(0)}},
+	}}, set["mt.cost.c"])
+
+	keys := []string{events[0].Key(), events[1].Key()}
+	assert.Equal(t, bson.M{"$sortArray": bson.M{
+		"input":  bson.M{"$setUnion": bson.A{bson.M{"$ifNull": bson.A{"$mk", bson.A{}}}, bson.M{"$literal": keys}}},
+		"sortBy": 1,
+	}}, set["mk"])
+
+	// the last value is taken only if the event is later than the stored one
+	isLatest := bson.M{"$or": bson.A{
+		bson.M{"$eq": bson.A{bson.M{"$type": "$mt.rows.t"}, "missing"}},
+		bson.M{"$gte": bson.A{ts.Add(time.Second), "$mt.rows.t"}},
+	}}
+	assert.Equal(t, bson.M{"$cond": bson.A{isLatest, float64(15), "$mt.rows.l"}}, set["mt.rows.l"])
+	assert.Equal(t, bson.M{"$cond": bson.A{isLatest, ts.Add(time.Second), "$mt.rows.t"}}, set["mt.rows.t"])
+
+	assert.NotContains(t, set, "mt.cost.u")
+}
+
+func TestEventKey(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	event := Event{
+		ProcessID: "p1",
+		Ts:        ts,
+		Metrics:   map[string]Metric{"rows": {Value: 10}, "cost": {Value: 0.5}, "bytes": {Value: 1}},
+		Labels:    map[string]string{"env": "prod", "region": "eu", "team": "data"},
+	}
+
+	// the ID and the encoding order of maps don't matter
+	redelivered := event.Copy()
+	redelivered.ID = bson.NewObjectID()
+	redelivered.Aggregated = true
+
+	for range 10 {
+		assert.Equal(t, event.Key(), redelivered.Key())
+	}
+
+	other := event.Copy()
+	other.Metrics["rows"] = Metric{Value: 11}
+	assert.NotEqual(t, event.Key(), other.Key())
+}
+
+func TestStageMetricsUpdateWithoutMetrics(t *testing.T) {
+	assert.Empty(t, stageMetricsUpdate(Event{}))
+}
+
+func TestStageExecutionUpdate(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := ts.Add(time.Hour)
+
+	start := Event{Kind: EventKindStageStarted, Ts: ts, WorkerID: "w1"}
+	restart := Event{Kind: EventKindStageStarted, Ts: ts.Add(time.Second)}
+	update := Event{Kind: EventKindGenericUpdate, Ts: ts.Add(time.Second * 2)}
+	finish := Event{Kind: EventKindStageFinished, Ts: ts.Add(time.Second * 3), Status: EventStatusSuccess}
+
+	pipeline := stageExecutionUpdate([]Event{start, restart, update, finish}, now, now.Add(time.Hour))
+	require.Len(t, pipeline, 2)
+
+	set, ok := pipeline[0].(bson.M)["$set"].(bson.M)
+	require.True(t, ok)
+
+	assert.Equal(t, now, set["ua"])
+	assert.Equal(t, now.Add(time.Hour), set["xa"])
+
+	// the earliest start of the batch competes with the stored one
+	assert.Equal(t, replaceByTs("s", start, "$lt"), set["s"])
+	assert.Equal(t, replaceByTs("e", finish, "$gte"), set["e"])
+	assert.Equal(t, bson.M{"$sortArray": bson.M{
+		"input":  unionWith("u", []Event{update}),
+		"sortBy": bson.M{"ts": 1},
+	}}, set["u"])
+
+	derived, ok := pipeline[1].(bson.M)["$set"].(bson.M)
+	require.True(t, ok)
+	assert.Contains(t, derived, "if")
+	assert.Contains(t, derived, "is")
+}
+
+func TestStageExecutionUpdateWithoutStartAndFinish(t *testing.T) {
+	pipeline := stageExecutionUpdate([]Event{{Kind: EventKindGenericUpdate}}, time.Now(), time.Now())
+
+	set, ok := pipeline[0].(bson.M)["$set"].(bson.M)
+	require.True(t, ok)
+
+	assert.NotContains(t, set, "s")
+	assert.NotContains(t, set, "e")
+	assert.Contains(t, set, "u")
+}
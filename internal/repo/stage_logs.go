@@ -0,0 +1,297 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameStageLogs        = "stage_logs"
+	collectionNameStageLogCounters = "stage_log_counters"
+
+	idxNameStageLogsTTL        = "ttl_stage_logs"
+	idxNameStageLogsSeq        = "stage_logs_seq"
+	idxNameStageLogsLineID     = "stage_logs_line_id"
+	idxNameStageLogCountersTTL = "ttl_stage_log_counters"
+	idxNameStageLogCountersKey = "stage_log_counters_key"
+
+	stageLogCounterCountFieldName     = "n"
+	stageLogCounterUpdatedAtFieldName = "ua"
+)
+
+type stageLogCounter struct {
+	Count int64 `bson:"n"`
+}
+
+type stageLogKey struct {
+	processID, executionID, stageExecutionID string
+}
+
+func (r *Repo) createStageLogIndexes(ctx context.Context) error {
+	ttlSec, err := strconv.ParseInt(os.Getenv("STAGE_LOGS_TTL_SECONDS"), 10, 32)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
+	}
+
+	err = r.client.CreateOrUpdateTTLIndex(
+		ctx,
+		collectionNameStageLogs,
+		idxNameStageLogsTTL,
+		int32(ttlSec),
+		mongo.IndexModel{
+			Keys: bson.M{StageLogLineCreatedAtFieldName(): 1},
+			Options: options.Index().
+				SetExpireAfterSeconds(int32(ttlSec)).
+				SetName(idxNameStageLogsTTL),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = r.client.CreateOrUpdateTTLIndex(
+		ctx,
+		collectionNameStageLogCounters,
+		idxNameStageLogCountersTTL,
+		int32(ttlSec),
+		mongo.IndexModel{
+			Keys: bson.M{stageLogCounterUpdatedAtFieldName: 1},
+			Options: options.Index().
+				SetExpireAfterSeconds(int32(ttlSec)).
+				SetName(idxNameStageLogCountersTTL),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = r.client.CreateIndexes(ctx, collectionNameStageLogs, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: SingleStageExecutionEventProcessIDFieldName(), Value: 1},
+				{Key: SingleStageExecutionEventExecutionIDFieldName(), Value: 1},
+				{Key: SingleStageExecutionEventStageExecutionIDFieldName(), Value: 1},
+				{Key: StageLogLineSeqFieldName(), Value: 1},
+			},
+			Options: options.Index().SetName(idxNameStageLogsSeq).SetUnique(true),
+		},
+		{
+			Keys: bson.D{
+				{Key: SingleStageExecutionEventProcessIDFieldName(), Value: 1},
+				{Key: SingleStageExecutionEventExecutionIDFieldName(), Value: 1},
+				{Key: SingleStageExecutionEventStageExecutionIDFieldName(), Value: 1},
+				{Key: StageLogLineLineIDFieldName(), Value: 1},
+			},
+			// the line ID is optional
+			Options: options.Index().
+				SetName(idxNameStageLogsLineID).
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{StageLogLineLineIDFieldName(): bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.client.CreateIndexes(ctx, collectionNameStageLogCounters, []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: SingleStageExecutionEventProcessIDFieldName(), Value: 1},
+			{Key: SingleStageExecutionEventExecutionIDFieldName(), Value: 1},
+			{Key: SingleStageExecutionEventStageExecutionIDFieldName(), Value: 1},
+		},
+		Options: options.Index().SetName(idxNameStageLogCountersKey).SetUnique(true),
+	}})
+}
+
+// AppendStageLogLines appends log lines to the logs of their stage executions.
+// Lines of one stage execution are ordered by Ts and get sequential StageLogLine.Seq.
+// Only the first maxLinesPerStage lines of a stage execution are stored, the rest is dropped.
+//
+// Seq is the order of appending: a line appended later, e.g. by a retry, follows lines appended before it
+// whatever its Ts. Lines with a StageLogLine.LineID which is already stored are skipped, see SkipStoredStageLogLines,
+// so a retry stores only the missing lines. Sequence numbers reserved by a failed insert are not reused,
+// so Seq may have gaps.
+//
+// Returns the amount of dropped lines.
+// Errors:
+// - oerrs.ErrInternal: if reserving of sequence numbers or insertion failed.
+func (r *Repo) AppendStageLogLines(
+	ctx context.Context,
+	lines []StageLogLine,
+	maxLinesPerStage int64,
+) (int, error) {
+	grouped := map[stageLogKey][]StageLogLine{}
+	for _, line := range lines {
+		key := stageLogKey{line.ProcessID, line.ExecutionID, line.StageExecutionID}
+		grouped[key] = append(grouped[key], line)
+	}
+
+	now := r.clock()
+	toInsert := make([]StageLogLine, 0, len(lines))
+	dropped := 0
+
+	var errs error
+
+	for key, group := range grouped {
+		slices.SortStableFunc(group, func(a, b StageLogLine) int {
+			return a.Ts.Compare(b.Ts)
+		})
+
+		pending, err := r.skipStoredStageLogLines(ctx, key, group)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		if len(pending) == 0 {
+			continue
+		}
+
+		firstSeq, err := r.reserveStageLogSeq(ctx, key, int64(len(pending)))
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		for i, line := range pending {
+			seq := firstSeq + int64(i)
+			if seq >= maxLinesPerStage {
+				dropped += len(pending) - i
+				break
+			}
+
+			line.Seq = seq
+			line.CreatedAt = now
+			toInsert = append(toInsert, line)
+		}
+	}
+
+	if len(toInsert) == 0 {
+		return dropped, errs
+	}
+
+	_, err := r.client.
+		DB().
+		Collection(collectionNameStageLogs).
+		InsertMany(ctx, toInsert, options.InsertMany().SetOrdered(false))
+	// duplicates are lines stored by a concurrent retry of the same batch
+	if err != nil && !isOnlyDuplicateKeyErrors(err) {
+		errs = errors.Join(errs, oerrs.NewTErr(ctx, err, oerrs.ErrInternal))
+	}
+
+	return dropped, errs
+}
+
+// skipStoredStageLogLines returns the lines of the stage execution which SkipStoredStageLogLines keeps.
+func (r *Repo) skipStoredStageLogLines(
+	ctx context.Context,
+	key stageLogKey,
+	lines []StageLogLine,
+) ([]StageLogLine, error) {
+	lineIDs := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if len(line.LineID) > 0 {
+			lineIDs = append(lineIDs, line.LineID)
+		}
+	}
+
+	if len(lineIDs) == 0 {
+		return lines, nil
+	}
+
+	filter := getSingleStageExecutionFilter(key.processID, key.executionID, key.stageExecutionID)
+	filter[StageLogLineLineIDFieldName()] = bson.M{"$in": lineIDs}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameStageLogs).
+		Find(ctx, filter, options.Find().SetProjection(bson.M{StageLogLineLineIDFieldName(): 1}))
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var stored []StageLogLine
+
+	err = cur.All(ctx, &stored)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	storedIDs := make(map[string]struct{}, len(stored))
+	for _, line := range stored {
+		storedIDs[line.LineID] = struct{}{}
+	}
+
+	return SkipStoredStageLogLines(lines, storedIDs), nil
+}
+
+// reserveStageLogSeq reserves count sequence numbers for the stage execution and returns the first one.
+func (r *Repo) reserveStageLogSeq(ctx context.Context, key stageLogKey, count int64) (int64, error) {
+	var counter stageLogCounter
+
+	err := r.client.
+		DB().
+		Collection(collectionNameStageLogCounters).
+		FindOneAndUpdate(
+			ctx,
+			getSingleStageExecutionFilter(key.processID, key.executionID, key.stageExecutionID),
+			bson.M{
+				"$inc": bson.M{stageLogCounterCountFieldName: count},
+				"$set": bson.M{stageLogCounterUpdatedAtFieldName: r.clock()},
+			},
+			options.FindOneAndUpdate().
+				SetUpsert(true).
+				SetReturnDocument(options.After),
+		).
+		Decode(&counter)
+	if err != nil {
+		return 0, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return counter.Count - count, nil
+}
+
+// GetStageLogLines returns up to limit log lines of the stage execution with StageLogLine.Seq >= fromSeq
+// ordered by StageLogLine.Seq. Seq may have gaps, see AppendStageLogLines, so a next page starts after the last Seq.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) GetStageLogLines(
+	ctx context.Context,
+	processID, executionID, stageExecutionID string,
+	fromSeq int64,
+	limit int64,
+) ([]StageLogLine, error) {
+	filter := getSingleStageExecutionFilter(processID, executionID, stageExecutionID)
+	filter[StageLogLineSeqFieldName()] = bson.M{"$gte": fromSeq}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameStageLogs).
+		Find(
+			ctx,
+			filter,
+			options.Find().
+				SetSort(bson.M{StageLogLineSeqFieldName(): 1}).
+				SetLimit(limit),
+		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	result := make([]StageLogLine, 0, limit)
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
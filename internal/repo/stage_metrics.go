@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// StageMetricsQuery selects stage executions which metrics are aggregated by AggregateStageMetrics.
+type StageMetricsQuery struct {
+	ProcessID string
+	// StageName is optional. If it is empty, all stages of the process are aggregated.
+	StageName string
+
+	// From and To limit the start time of stage executions, From is inclusive and To is exclusive.
+	From time.Time
+	To   time.Time
+	// Bucket is the size of a time bucket. Stage executions are put into a bucket by their start time.
+	Bucket time.Duration
+}
+
+// StageMetricBucket is an aggregate of one metric of one stage within one time bucket.
+// Values are computed over per-execution sums (StageMetric.Sum).
+type StageMetricBucket struct {
+	Ts        time.Time `bson:"ts"`
+	StageName string    `bson:"sn"`
+	Name      string    `bson:"n"`
+	Unit      string    `bson:"u"`
+
+	Executions int64   `bson:"ex"`
+	Sum        float64 `bson:"s"`
+	Avg        float64 `bson:"a"`
+	Min        float64 `bson:"mn"`
+	Max        float64 `bson:"mx"`
+}
+
+// AggregateStageMetrics aggregates metrics of stage executions of a process across executions
+// and groups them into time buckets.
+//
+// Result is sorted by StageMetricBucket.Ts, StageMetricBucket.StageName and StageMetricBucket.Name.
+// Errors:
+// - oerrs.ErrBadInput: if bucket size is less than a second or the time range is empty
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) AggregateStageMetrics(
+	ctx context.Context,
+	query StageMetricsQuery,
+) ([]StageMetricBucket, error) {
+	if query.Bucket < time.Second {
+		return nil, oerrs.NewTErrf(ctx, "bucket must be at least 1s: %w", oerrs.ErrBadInput)
+	}
+
+	if !query.From.Before(query.To) {
+		return nil, oerrs.NewTErrf(ctx, "from must be before to: %w", oerrs.ErrBadInput)
+	}
+
+	match := bson.M{
+		SingleStageExecutionEventProcessIDFieldName(): query.ProcessID,
+		SingleStageExecutionEventStartTsFieldName(): bson.M{
+			"$gte": query.From,
+			"$lt":  query.To,
+		},
+		SingleStageExecutionEventMetricsFieldName(): bson.M{"$exists": true},
+	}
+
+	if len(query.StageName) > 0 {
+		match[SingleStageExecutionEventRawStageNameFieldName()] = query.StageName
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$project": bson.M{
+			"ts": bson.M{"$dateTrunc": bson.M{
+				"date":    "$" + SingleStageExecutionEventStartTsFieldName(),
+				"unit":    "second",
+				"binSize": int64(query.Bucket / time.Second),
+			}},
+			"sn": "$" + SingleStageExecutionEventRawStageNameFieldName(),
+			"mt": bson.M{"$objectToArray": "$" + SingleStageExecutionEventMetricsFieldName()},
+		}},
+		{"$unwind": "$mt"},
+		{"$group": bson.M{
+			"_id": bson.M{"ts": "$ts", "sn": "$sn", "n": "$mt.k"},
+			"u":   bson.M{"$last": "$mt.v.u"},
+			"ex":  bson.M{"$sum": 1},
+			"s":   bson.M{"$sum": "$mt.v.s"},
+			"a":   bson.M{"$avg": "$mt.v.s"},
+			"mn":  bson.M{"$min": "$mt.v.s"},
+			"mx":  bson.M{"$max": "$mt.v.s"},
+		}},
+		{"$project": bson.M{
+			"_id": 0,
+			"ts":  "$_id.ts",
+			"sn":  "$_id.sn",
+			"n":   "$_id.n",
+			"u":   1,
+			"ex":  1,
+			"s":   1,
+			"a":   1,
+			"mn":  1,
+			"mx":  1,
+		}},
+		{"$sort": bson.D{{Key: "ts", Value: 1}, {Key: "sn", Value: 1}, {Key: "n", Value: 1}}},
+	}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameSingleStageExec).
+		Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []StageMetricBucket
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
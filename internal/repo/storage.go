@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/LastSprint/pipetank/pkg/common"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// StorageBackend names an implementation of Storage apps can be configured with.
+type StorageBackend string
+
+const (
+	StorageMongoDB StorageBackend = "mongodb"
+	// StorageMemory keeps everything in the memory of the process, see memory.Storage.
+	StorageMemory StorageBackend = "memory"
+	// StorageSQLite keeps everything in an embedded database file, see sqlite.Storage.
+	StorageSQLite StorageBackend = "sqlite"
+)
+
+// Storage keeps raw events, their aggregates and the change stream tokens of their consumers.
+// Repo is the MongoDB implementation, memory.Storage keeps everything in memory
+// and sqlite.Storage in an embedded database.
+// Every implementation must pass the storagetest suite.
+type Storage interface {
+	RawEventsStorage
+	AggregatesStorage
+	TokensStorage
+	QueryStorage
+	StageLogsStorage
+}
+
+var _ Storage = (*Repo)(nil)
+
+// RawEventsStorage is the raw events log and its change feed.
+type RawEventsStorage interface {
+	AppendRawEvents(ctx context.Context, events []Event) error
+	GetRawExecutionEvents(ctx context.Context, processID, executionID string) ([]Event, error)
+	WatchRawEvents(
+		ctx context.Context,
+		from ChangeStreamPosition,
+		partition Partition,
+		action common.CallbackFailable[RawEventWatchModel],
+	) error
+}
+
+// AggregatesStorage writes stage execution and execution aggregates.
+type AggregatesStorage interface {
+	WriteAggregates(ctx context.Context, writes []AggregateWrite) error
+	// AggregateWritesPaused reports whether writers of aggregates must wait, e.g. while Repo.SwapRebuild runs.
+	AggregateWritesPaused(ctx context.Context) (bool, error)
+}
+
+// TokensStorage keeps positions of the raw events consumers.
+type TokensStorage interface {
+	SaveChangeStreamToken(ctx context.Context, key string, token bson.Raw) error
+	LoadChangeStreamToken(ctx context.Context, key string) (bson.Raw, error)
+	// LoadChangeStreamTokens returns tokens saved under the key and the keys of its partitions, see Partition.TokenKey.
+	LoadChangeStreamTokens(ctx context.Context, key string) (map[string]bson.Raw, error)
+	// CompareChangeStreamTokens orders tokens of WatchRawEvents by their position in the feed.
+	CompareChangeStreamTokens(a, b bson.Raw) int
+}
+
+// QueryStorage reads the aggregates.
+type QueryStorage interface {
+	GetSingleStageExecution(
+		ctx context.Context,
+		processID, executionID, stageExecutionID string,
+	) (SingleStageExecutionEvent, error)
+	ListStageExecutions(ctx context.Context, query StageExecutionsQuery) ([]SingleStageExecutionEvent, error)
+	ListExecutions(ctx context.Context, query ExecutionsQuery) ([]ExecutionAggregate, error)
+	SearchStageExecutions(ctx context.Context, query StageExecutionsSearchQuery) ([]StageExecutionSearchResult, error)
+	AggregateStageMetrics(ctx context.Context, query StageMetricsQuery) ([]StageMetricBucket, error)
+}
+
+// StageLogsStorage keeps log lines of stage executions.
+type StageLogsStorage interface {
+	AppendStageLogLines(ctx context.Context, lines []StageLogLine, maxLinesPerStage int64) (int, error)
+	GetStageLogLines(
+		ctx context.Context,
+		processID, executionID, stageExecutionID string,
+		fromSeq int64,
+		limit int64,
+	) ([]StageLogLine, error)
+}
@@ -0,0 +1,200 @@
+package storagetest
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// stageEvents returns a start, two updates and a finish of the stage execution with metrics, labels and texts.
+func stageEvents(t *testing.T, stageExecutionID string) []repo.Event {
+	t.Helper()
+
+	start := event("e1", stageExecutionID, repo.EventKindStageStarted, baseTs)
+	start.Stage.Description = "loads the orders"
+	start.Metadata = document(t, bson.D{{Key: "source", Value: "warehouse"}})
+	start.Labels = map[string]string{"env": "prod", "region": "eu"}
+
+	first := event("e1", stageExecutionID, repo.EventKindGenericUpdate, baseTs.Add(time.Second))
+	first.Metrics = map[string]repo.Metric{"rows": {Value: 10, Unit: "rows"}}
+
+	second := event("e1", stageExecutionID, repo.EventKindGenericUpdate, baseTs.Add(time.Second*2))
+	second.Metrics = map[string]repo.Metric{"rows": {Value: 5}}
+	second.Labels = map[string]string{"region": "us"}
+
+	finish := event("e1", stageExecutionID, repo.EventKindStageFinished, baseTs.Add(time.Second*3))
+	finish.Status = repo.EventStatusFailure
+	finish.Failure = document(t, bson.D{{Key: "error", Value: "timeout"}, {Key: "list", Value: bson.A{"retry"}}})
+
+	return []repo.Event{start, first, second, finish}
+}
+
+func testMergeStageExecution(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+	events := stageEvents(t, "s1")
+
+	writeStage(t, storage, events...)
+
+	stage, err := storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"timeout", "retry"}, stage.FailureText)
+	assert.Equal(t, []string{"warehouse"}, stage.MetadataText)
+
+	stage.FailureText, stage.MetadataText = nil, nil
+
+	assert.Equal(t, repo.SingleStageExecutionEvent{
+		ProcessID:        "p1",
+		WorkerID:         "w1",
+		ExecutionID:      "e1",
+		StageExecutionID: "s1",
+		RawStage:         events[0].Stage,
+		Start:            events[0],
+		Updates:          events[1:3],
+		End:              events[3],
+		IsFinished:       true,
+		IsSuccess:        false,
+		Metrics: map[string]repo.StageMetric{
+			"rows": {Last: 5, LastAt: events[2].Ts, Sum: 15, Count: 2, Unit: "rows"},
+		},
+		MetricEvents: sortedKeys(events[1], events[2]),
+		Labels:       map[string]string{"env": "prod", "region": "us"},
+		UpdatedAt:    now,
+	}, stage)
+
+	_, err = storage.GetSingleStageExecution(t.Context(), "p1", "e1", "unknown")
+	require.ErrorIs(t, err, oerrs.ErrNotFound)
+}
+
+// testMergeStageExecutionOrder checks that the aggregate doesn't depend on the order of batches
+// and that a redelivered update is not duplicated.
+func testMergeStageExecutionOrder(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	inOrder := stageEvents(t, "s1")
+	writeStage(t, storage, inOrder[:2]...)
+	writeStage(t, storage, inOrder[2:]...)
+
+	reversed := stageEvents(t, "s2")
+	// a later start and an earlier finish lose
+	lateStart := reversed[0]
+	lateStart.Ts = baseTs.Add(time.Second * 2)
+	earlyFinish := reversed[3]
+	earlyFinish.Ts = baseTs.Add(time.Second * 2)
+	earlyFinish.Status = repo.EventStatusSuccess
+
+	writeStage(t, storage, reversed[3])
+	writeStage(t, storage, reversed[2])
+	writeStage(t, storage, lateStart, earlyFinish)
+	writeStage(t, storage, reversed[:2]...)
+
+	expected, err := storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+
+	actual, err := storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s2")
+	require.NoError(t, err)
+
+	assert.Equal(t, reversed[0], actual.Start)
+	assert.Equal(t, reversed[1:3], actual.Updates)
+	assert.Equal(t, reversed[3], actual.End)
+	assert.True(t, actual.IsFinished)
+	assert.False(t, actual.IsSuccess)
+	assert.Equal(t, expected.Metrics, actual.Metrics)
+	// labels of the latest batch win
+	assert.Equal(t, map[string]string{"env": "prod", "region": "eu"}, actual.Labels)
+	// the stage and the worker of the first batch are kept
+	assert.Equal(t, reversed[3].Stage, actual.RawStage)
+	assert.Equal(t, expected.WorkerID, actual.WorkerID)
+
+}
+
+// testMergeStageExecutionRedelivery checks that redelivered events, e.g. after a consumer restart,
+// don't change the aggregate: updates are not duplicated and metrics are not summed twice.
+func testMergeStageExecutionRedelivery(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	once := stageEvents(t, "s1")
+	writeStage(t, storage, once...)
+
+	twice := stageEvents(t, "s2")
+	writeStage(t, storage, twice...)
+	writeStage(t, storage, twice...)
+
+	expected, err := storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+
+	actual, err := storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s2")
+	require.NoError(t, err)
+
+	assert.Equal(t, twice[1:3], actual.Updates)
+	assert.Equal(t, expected.Metrics, actual.Metrics)
+	assert.Equal(t, sortedKeys(twice[1], twice[2]), actual.MetricEvents)
+
+	// a replayed event may come in another batch and with another ID, its metrics are still summed once
+	replayed := twice[2]
+	replayed.ID = bson.NewObjectID()
+	writeStage(t, storage, twice[1], replayed)
+
+	actual, err = storage.GetSingleStageExecution(t.Context(), "p1", "e1", "s2")
+	require.NoError(t, err)
+
+	rows := repo.StageMetric{Last: 5, LastAt: twice[2].Ts, Sum: 15, Count: 2, Unit: "rows"}
+	assert.Equal(t, rows, actual.Metrics["rows"])
+	assert.Equal(t, sortedKeys(twice[1], twice[2]), actual.MetricEvents)
+}
+
+func sortedKeys(events ...repo.Event) []string {
+	keys := make([]string, 0, len(events))
+	for _, event := range events {
+		keys = append(keys, event.Key())
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+func testMergeExecution(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	// nothing pauses writers of a new storage
+	paused, err := storage.AggregateWritesPaused(t.Context())
+	require.NoError(t, err)
+	assert.False(t, paused)
+
+	write := func(workerID string, first, last time.Duration, labels map[string]string) {
+		require.NoError(t, storage.WriteAggregates(t.Context(), []repo.AggregateWrite{
+			repo.MergeExecutionWrite(repo.ExecutionAggregate{
+				ProcessID:    "p1",
+				ExecutionID:  "e1",
+				WorkerID:     workerID,
+				Labels:       labels,
+				FirstEventAt: baseTs.Add(first),
+				LastEventAt:  baseTs.Add(last),
+			}),
+		}))
+	}
+
+	write("w1", time.Second, time.Second*2, map[string]string{"env": "prod"})
+	write("w2", 0, time.Second, nil)
+	write("w3", time.Second*2, time.Second*3, map[string]string{"env": "stage", "team": "data"})
+
+	executions, err := storage.ListExecutions(t.Context(), repo.ExecutionsQuery{ProcessID: "p1"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []repo.ExecutionAggregate{{
+		ProcessID:    "p1",
+		ExecutionID:  "e1",
+		WorkerID:     "w3",
+		Labels:       map[string]string{"env": "stage", "team": "data"},
+		FirstEventAt: baseTs,
+		LastEventAt:  baseTs.Add(time.Second * 3),
+		UpdatedAt:    now,
+	}}, executions)
+}
@@ -0,0 +1,155 @@
+package storagetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAggregateStageMetrics(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	write := func(processID, executionID, stageName string, startedAfter time.Duration, metric string, value float64) {
+		event := event(executionID, "s1", repo.EventKindStageStarted, baseTs.Add(startedAfter))
+		event.ProcessID = processID
+		event.Stage.Name = stageName
+		event.StageExecutionID = stageName
+		event.Metrics = map[string]repo.Metric{metric: {Value: value, Unit: metric}}
+
+		writeStage(t, storage, event)
+	}
+
+	write("p1", "e1", "stage_1", 0, "rows", 10)
+	write("p1", "e2", "stage_1", time.Second*30, "rows", 20)
+	write("p1", "e3", "stage_1", time.Second*90, "rows", 5)
+	write("p1", "e1", "stage_2", time.Second*10, "bytes", 100)
+	// other processes and stage executions started out of the range are not aggregated
+	write("p2", "e1", "stage_1", 0, "rows", 1000)
+	write("p1", "e4", "stage_1", time.Minute*5, "rows", 1000)
+	// stage executions without metrics are skipped
+	writeStage(t, storage, event("e5", "s1", repo.EventKindStageStarted, baseTs))
+
+	query := repo.StageMetricsQuery{ProcessID: "p1", From: baseTs, To: baseTs.Add(time.Minute * 2), Bucket: time.Minute}
+
+	buckets, err := storage.AggregateStageMetrics(t.Context(), query)
+	require.NoError(t, err)
+
+	rows := repo.StageMetricBucket{
+		Ts: baseTs, StageName: "stage_1", Name: "rows", Unit: "rows", Executions: 2, Sum: 30, Avg: 15, Min: 10, Max: 20,
+	}
+	bytes := repo.StageMetricBucket{
+		Ts: baseTs, StageName: "stage_2", Name: "bytes", Unit: "bytes", Executions: 1, Sum: 100, Avg: 100, Min: 100, Max: 100,
+	}
+	lateRows := repo.StageMetricBucket{
+		Ts: baseTs.Add(time.Minute), StageName: "stage_1", Name: "rows", Unit: "rows",
+		Executions: 1, Sum: 5, Avg: 5, Min: 5, Max: 5,
+	}
+
+	assert.Equal(t, []repo.StageMetricBucket{rows, bytes, lateRows}, buckets)
+
+	query.StageName = "stage_2"
+
+	buckets, err = storage.AggregateStageMetrics(t.Context(), query)
+	require.NoError(t, err)
+	assert.Equal(t, []repo.StageMetricBucket{bytes}, buckets)
+
+	_, err = storage.AggregateStageMetrics(t.Context(), repo.StageMetricsQuery{ProcessID: "p1", From: baseTs, To: now})
+	require.ErrorIs(t, err, oerrs.ErrBadInput)
+
+	_, err = storage.AggregateStageMetrics(
+		t.Context(),
+		repo.StageMetricsQuery{ProcessID: "p1", From: now, To: now, Bucket: time.Minute},
+	)
+	require.ErrorIs(t, err, oerrs.ErrBadInput)
+}
+
+func testStageLogs(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	line := func(stageExecutionID, message string, ts time.Duration) repo.StageLogLine {
+		return repo.StageLogLine{
+			ProcessID:        "p1",
+			ExecutionID:      "e1",
+			StageExecutionID: stageExecutionID,
+			WorkerID:         "w1",
+			Level:            repo.LogLevelInfo,
+			Message:          message,
+			Ts:               baseTs.Add(ts),
+			Attributes:       map[string]string{"stream": "stdout"},
+		}
+	}
+
+	// lines of a batch are ordered by Ts
+	dropped, err := storage.AppendStageLogLines(t.Context(), []repo.StageLogLine{
+		line("s1", "second", time.Second),
+		line("s2", "other", 0),
+		line("s1", "first", 0),
+	}, 3)
+	require.NoError(t, err)
+	assert.Zero(t, dropped)
+
+	// lines over the limit are dropped
+	dropped, err = storage.AppendStageLogLines(t.Context(), []repo.StageLogLine{
+		line("s1", "third", time.Second*2),
+		line("s1", "fourth", time.Second*3),
+	}, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+
+	lines, err := storage.GetStageLogLines(t.Context(), "p1", "e1", "s1", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, lines, 3)
+
+	for i, message := range []string{"first", "second", "third"} {
+		expected := line("s1", message, time.Second*time.Duration(i))
+		expected.ID = lines[i].ID
+		expected.Seq = int64(i)
+		expected.CreatedAt = now
+
+		assert.False(t, lines[i].ID.IsZero())
+		assert.Equal(t, expected, lines[i])
+	}
+
+	lines, err = storage.GetStageLogLines(t.Context(), "p1", "e1", "s1", 1, 1)
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "second", lines[0].Message)
+
+	lines, err = storage.GetStageLogLines(t.Context(), "p1", "e1", "unknown", 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, lines)
+
+	// a retried batch stores only the lines whose IDs are missing, lines of the same content are kept
+	withID := func(line repo.StageLogLine, lineID string) repo.StageLogLine {
+		line.LineID = lineID
+		return line
+	}
+
+	_, err = storage.AppendStageLogLines(t.Context(), []repo.StageLogLine{
+		withID(line("s3", "retrying", 0), "1"),
+	}, 10)
+	require.NoError(t, err)
+
+	_, err = storage.AppendStageLogLines(t.Context(), []repo.StageLogLine{
+		withID(line("s3", "retrying", 0), "1"),
+		withID(line("s3", "retrying", 0), "2"),
+		line("s3", "without id", 0),
+	}, 10)
+	require.NoError(t, err)
+
+	_, err = storage.AppendStageLogLines(t.Context(), []repo.StageLogLine{line("s3", "without id", 0)}, 10)
+	require.NoError(t, err)
+
+	lines, err = storage.GetStageLogLines(t.Context(), "p1", "e1", "s3", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, lines, 4)
+
+	for i, lineID := range []string{"1", "2", "", ""} {
+		assert.Equal(t, int64(i), lines[i].Seq)
+		assert.Equal(t, lineID, lines[i].LineID)
+	}
+}
@@ -0,0 +1,170 @@
+package storagetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func testListStageExecutions(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	withLabels := func(event repo.Event, labels map[string]string) repo.Event {
+		event.Labels = labels
+		return event
+	}
+
+	other := event("e4", "s1", repo.EventKindStageStarted, baseTs.Add(time.Minute*3))
+	other.ProcessID = "p2"
+
+	secondStage := event("e1", "s2", repo.EventKindStageStarted, baseTs.Add(time.Minute))
+	secondStage.Stage.Name = "stage_2"
+
+	firstStage := withLabels(event("e1", "s1", repo.EventKindStageStarted, baseTs), map[string]string{"env": "prod"})
+	writeStage(t, storage, firstStage)
+	writeStage(t, storage, withLabels(secondStage, map[string]string{"env": "dev"}))
+	writeStage(t, storage, event("e2", "s1", repo.EventKindStageStarted, baseTs.Add(time.Minute*2)))
+	writeStage(t, storage, other)
+	// a stage execution without a start is the last one and has no start time
+	writeStage(t, storage, event("e3", "s1", repo.EventKindStageFinished, baseTs.Add(time.Minute*4)))
+
+	selector, err := repo.ParseLabelSelector("!env")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		query    repo.StageExecutionsQuery
+		expected []string
+	}{
+		"process":   {repo.StageExecutionsQuery{ProcessID: "p1"}, []string{"e2/s1", "e1/s2", "e1/s1", "e3/s1"}},
+		"execution": {repo.StageExecutionsQuery{ProcessID: "p1", ExecutionID: "e1"}, []string{"e1/s2", "e1/s1"}},
+		"stage": {
+			repo.StageExecutionsQuery{ProcessID: "p1", StageName: "stage_1"},
+			[]string{"e2/s1", "e1/s1", "e3/s1"},
+		},
+		"labels":      {repo.StageExecutionsQuery{ProcessID: "p1", Labels: selector}, []string{"e2/s1", "e3/s1"}},
+		"limit":       {repo.StageExecutionsQuery{ProcessID: "p1", Limit: 1}, []string{"e2/s1"}},
+		"any process": {repo.StageExecutionsQuery{Limit: 2}, []string{"e4/s1", "e2/s1"}},
+		"time range": {
+			repo.StageExecutionsQuery{StartedFrom: baseTs.Add(time.Minute), StartedTo: baseTs.Add(time.Minute * 2)},
+			[]string{"e1/s2"},
+		},
+		"started before": {repo.StageExecutionsQuery{StartedTo: baseTs.Add(time.Minute)}, []string{"e1/s1"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stages, err := storage.ListStageExecutions(t.Context(), tc.query)
+			require.NoError(t, err)
+
+			actual := make([]string, 0, len(stages))
+			for _, stage := range stages {
+				actual = append(actual, stage.ExecutionID+"/"+stage.StageExecutionID)
+			}
+
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func testListExecutions(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	for i, executionID := range []string{"e1", "e2", "e3"} {
+		event := event(executionID, "s1", repo.EventKindStageStarted, baseTs.Add(time.Minute*time.Duration(i)))
+		if executionID != "e2" {
+			event.Labels = map[string]string{"env": "prod"}
+		}
+
+		writeStage(t, storage, event)
+	}
+
+	other := event("e4", "s1", repo.EventKindStageStarted, baseTs.Add(time.Hour))
+	other.ProcessID = "p2"
+	writeStage(t, storage, other)
+
+	selector, err := repo.ParseLabelSelector("env=prod")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		query    repo.ExecutionsQuery
+		expected []string
+	}{
+		"process":     {repo.ExecutionsQuery{ProcessID: "p1"}, []string{"e3", "e2", "e1"}},
+		"labels":      {repo.ExecutionsQuery{ProcessID: "p1", Labels: selector}, []string{"e3", "e1"}},
+		"limit":       {repo.ExecutionsQuery{ProcessID: "p1", Limit: 2}, []string{"e3", "e2"}},
+		"any process": {repo.ExecutionsQuery{Limit: 2}, []string{"e4", "e3"}},
+		"time range": {
+			repo.ExecutionsQuery{StartedFrom: baseTs.Add(time.Minute), StartedTo: baseTs.Add(time.Minute * 2)},
+			[]string{"e2"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			executions, err := storage.ListExecutions(t.Context(), tc.query)
+			require.NoError(t, err)
+
+			actual := make([]string, 0, len(executions))
+			for _, execution := range executions {
+				actual = append(actual, execution.ExecutionID)
+			}
+
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func testSearchStageExecutions(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	// texts have the same number of words, so only the weights of the fields rank them
+	failure := event("e1", "failure", repo.EventKindStageFinished, baseTs)
+	failure.Failure = document(t, bson.D{{Key: "error", Value: "connection timeout"}})
+
+	metadata := event("e1", "metadata", repo.EventKindStageStarted, baseTs)
+	metadata.Metadata = document(t, bson.D{{Key: "note", Value: "timeout raised"}})
+
+	description := event("e1", "description", repo.EventKindStageStarted, baseTs)
+	description.Stage.Description = "timeout handling"
+
+	disk := event("e1", "disk", repo.EventKindStageFinished, baseTs)
+	disk.Failure = document(t, bson.D{{Key: "error", Value: "disk full"}})
+
+	for _, event := range []repo.Event{failure, metadata, description, disk} {
+		writeStage(t, storage, event)
+	}
+
+	tests := map[string]struct {
+		query    repo.StageExecutionsSearchQuery
+		expected []string
+	}{
+		"ranked":   {repo.StageExecutionsSearchQuery{Text: "timeout"}, []string{"failure", "metadata", "description"}},
+		"negation": {repo.StageExecutionsSearchQuery{Text: "timeout -raised"}, []string{"failure", "description"}},
+		"phrase":   {repo.StageExecutionsSearchQuery{Text: `"disk full"`}, []string{"disk"}},
+		"limit":    {repo.StageExecutionsSearchQuery{Text: "timeout", Limit: 1}, []string{"failure"}},
+		"process":  {repo.StageExecutionsSearchQuery{Text: "timeout", ProcessID: "p2"}, []string{}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			results, err := storage.SearchStageExecutions(t.Context(), tc.query)
+			require.NoError(t, err)
+
+			actual := make([]string, 0, len(results))
+			for _, result := range results {
+				assert.Positive(t, result.Score)
+				actual = append(actual, result.Stage.StageExecutionID)
+			}
+
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+
+	_, err := storage.SearchStageExecutions(t.Context(), repo.StageExecutionsSearchQuery{Text: " "})
+	require.ErrorIs(t, err, oerrs.ErrBadInput)
+}
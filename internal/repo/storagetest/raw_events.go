@@ -0,0 +1,327 @@
+package storagetest
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// watchTimeout limits waiting for watched events.
+const watchTimeout = time.Second * 10
+
+func testRawEvents(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	start := event("e1", "s1", repo.EventKindStageStarted, baseTs)
+	start.Input = document(t, bson.D{{Key: "rows", Value: int32(10)}})
+	start.Labels = map[string]string{"env": "prod"}
+	start.Metrics = map[string]repo.Metric{"rows": {Value: 10, Unit: "rows"}}
+
+	finish := event("e1", "s1", repo.EventKindStageFinished, baseTs.Add(time.Second))
+	finish.Status = repo.EventStatusSuccess
+
+	// events are appended out of order
+	require.NoError(t, storage.AppendRawEvents(t.Context(), []repo.Event{
+		finish,
+		event("e2", "s1", repo.EventKindStageStarted, baseTs),
+		start,
+	}))
+
+	events, err := storage.GetRawExecutionEvents(t.Context(), "p1", "e1")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	for i := range events {
+		assert.False(t, events[i].ID.IsZero())
+		events[i].ID = bson.ObjectID{}
+	}
+
+	assert.Equal(t, []repo.Event{start, finish}, events)
+
+	events, err = storage.GetRawExecutionEvents(t.Context(), "p1", "unknown")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func testTokens(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, fixedClock)
+
+	_, err := storage.LoadChangeStreamToken(t.Context(), "key")
+	require.ErrorIs(t, err, oerrs.ErrNotFound)
+
+	first := document(t, bson.D{{Key: "token", Value: "1"}})
+	second := document(t, bson.D{{Key: "token", Value: "2"}})
+
+	require.NoError(t, storage.SaveChangeStreamToken(t.Context(), "key", first))
+	require.NoError(t, storage.SaveChangeStreamToken(t.Context(), "other", first))
+	require.NoError(t, storage.SaveChangeStreamToken(t.Context(), "key", second))
+
+	token, err := storage.LoadChangeStreamToken(t.Context(), "key")
+	require.NoError(t, err)
+	assert.Equal(t, second, token)
+
+	token, err = storage.LoadChangeStreamToken(t.Context(), "other")
+	require.NoError(t, err)
+	assert.Equal(t, first, token)
+
+	// tokens of the group are the token of the key and the tokens of its partitions
+	require.NoError(t, storage.SaveChangeStreamToken(t.Context(), "key/0-of-2", first))
+	require.NoError(t, storage.SaveChangeStreamToken(t.Context(), "key2/0-of-2", first))
+
+	tokens, err := storage.LoadChangeStreamTokens(t.Context(), "key")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bson.Raw{"key": second, "key/0-of-2": first}, tokens)
+
+	tokens, err = storage.LoadChangeStreamTokens(t.Context(), "unknown")
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+func testWatchRawEvents(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, utils.UTCClock())
+	// MongoDB starts change streams at seconds
+	startAt := time.Now().Add(-time.Second)
+
+	aggregated := event("e1", "s1", repo.EventKindStageStarted, baseTs)
+	aggregated.Aggregated = true
+
+	require.NoError(t, storage.AppendRawEvents(t.Context(), []repo.Event{
+		event("e1", "s1", repo.EventKindStageStarted, baseTs),
+		aggregated,
+		event("e2", "s1", repo.EventKindStageStarted, baseTs),
+	}))
+
+	// aggregated events are skipped
+	watched := watch(t, storage, repo.ChangeStreamPosition{StartAt: startAt}, repo.Partition{}, 2)
+	assert.Equal(t, []string{"e1", "e2"}, executionIDs(watched))
+
+	// watching resumes after the token, events appended meanwhile are not lost
+	require.NoError(t, storage.AppendRawEvents(t.Context(), []repo.Event{
+		event("e3", "s1", repo.EventKindStageStarted, baseTs),
+	}))
+
+	watched = watch(t, storage, repo.ChangeStreamPosition{Token: watched[0].Token.ResumeToken()}, repo.Partition{}, 2)
+	assert.Equal(t, []string{"e2", "e3"}, executionIDs(watched))
+
+	// tokens are ordered by the position of their events
+	first, second := watched[0].Token.ResumeToken(), watched[1].Token.ResumeToken()
+	assert.Negative(t, storage.CompareChangeStreamTokens(first, second))
+	assert.Positive(t, storage.CompareChangeStreamTokens(second, first))
+	assert.Zero(t, storage.CompareChangeStreamTokens(first, slices.Clone(first)))
+}
+
+func testWatchRawEventsIdle(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, utils.UTCClock())
+	startAt := time.Now().Add(-time.Second)
+	partition := repo.Partition{Index: 0, Count: 2}
+
+	var events []repo.Event
+
+	for _, processID := range []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8"} {
+		event := event("e1", "s1", repo.EventKindStageStarted, baseTs)
+		event.ProcessID = processID
+		events = append(events, event)
+	}
+
+	require.NoError(t, storage.AppendRawEvents(t.Context(), events))
+
+	processID, idle := watchIdle(t, storage, repo.ChangeStreamPosition{StartAt: startAt}, partition)
+
+	// the idle token is after all appended events, so resuming from it gets only new events
+	appended := event("e2", "s1", repo.EventKindStageStarted, baseTs)
+	appended.ProcessID = processID
+	require.NoError(t, storage.AppendRawEvents(t.Context(), []repo.Event{appended}))
+
+	watched := watch(t, storage, repo.ChangeStreamPosition{Token: idle}, partition, 1)
+	assert.Equal(t, []string{"e2"}, executionIDs(watched))
+}
+
+func testWatchRawEventsPartitions(t *testing.T, newStorage Factory) {
+	storage := newStorage(t, utils.UTCClock())
+	startAt := time.Now().Add(-time.Second)
+
+	var events []repo.Event
+
+	processIDs := []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8"}
+	for _, processID := range processIDs {
+		for _, executionID := range []string{"e1", "e2"} {
+			event := event(executionID, "s1", repo.EventKindStageStarted, baseTs)
+			event.ProcessID = processID
+			events = append(events, event)
+		}
+	}
+
+	require.NoError(t, storage.AppendRawEvents(t.Context(), events))
+
+	partitionOf := map[string]int{}
+	watchedCount := 0
+
+	for index := range 2 {
+		partition := repo.Partition{Index: index, Count: 2}
+
+		// the partition is watched until all events are received, so it gets at most all of them
+		for _, watched := range watchAll(t, storage, repo.ChangeStreamPosition{StartAt: startAt}, partition) {
+			watchedCount++
+
+			processID := watched.Record.ProcessID
+			if other, ok := partitionOf[processID]; ok {
+				assert.Equal(t, other, index, "events of %s are in several partitions", processID)
+			}
+
+			partitionOf[processID] = index
+		}
+	}
+
+	// every event is in exactly one partition
+	assert.Equal(t, len(events), watchedCount)
+	assert.Len(t, partitionOf, len(processIDs))
+}
+
+// watch returns the first count watched events.
+func watch(
+	t *testing.T,
+	storage repo.Storage,
+	from repo.ChangeStreamPosition,
+	partition repo.Partition,
+	count int,
+) []repo.RawEventWatchModel {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(t.Context(), watchTimeout)
+	defer cancel()
+
+	var result []repo.RawEventWatchModel
+
+	_ = storage.WatchRawEvents(ctx, from, partition, func(_ context.Context, event repo.RawEventWatchModel) error {
+		if event.Idle {
+			return nil
+		}
+
+		result = append(result, repo.RawEventWatchModel{
+			Record: event.Record,
+			Token:  ResumeToken(slices.Clone(event.Token.ResumeToken())),
+		})
+
+		if len(result) == count {
+			cancel()
+		}
+
+		return nil
+	})
+
+	require.Len(t, result, count)
+
+	return result
+}
+
+// watchAll returns events watched until no event arrives for a second.
+func watchAll(
+	t *testing.T,
+	storage repo.Storage,
+	from repo.ChangeStreamPosition,
+	partition repo.Partition,
+) []repo.RawEventWatchModel {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		result []repo.RawEventWatchModel
+	)
+
+	received := make(chan struct{}, 1)
+
+	go func() {
+		_ = storage.WatchRawEvents(ctx, from, partition, func(_ context.Context, event repo.RawEventWatchModel) error {
+			if event.Idle {
+				return nil
+			}
+
+			mu.Lock()
+			result = append(result, repo.RawEventWatchModel{Record: event.Record})
+			mu.Unlock()
+
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+
+			return nil
+		})
+	}()
+
+	for {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			cancel()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			return slices.Clone(result)
+		}
+	}
+}
+
+// watchIdle watches until the feed is idle after an event, it returns the process of the event and the idle token.
+func watchIdle(
+	t *testing.T,
+	storage repo.Storage,
+	from repo.ChangeStreamPosition,
+	partition repo.Partition,
+) (string, bson.Raw) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(t.Context(), watchTimeout)
+	defer cancel()
+
+	var (
+		processID string
+		token     bson.Raw
+	)
+
+	_ = storage.WatchRawEvents(ctx, from, partition, func(_ context.Context, event repo.RawEventWatchModel) error {
+		switch {
+		case !event.Idle:
+			processID = event.Record.ProcessID
+		case processID != "":
+			token = slices.Clone(event.Token.ResumeToken())
+			cancel()
+		}
+
+		return nil
+	})
+
+	require.NotEmpty(t, token, "the feed is not idle after events")
+
+	return processID, token
+}
+
+// ResumeToken is a fixed mdb.ResumeTokenProvider for the events a test builds.
+type ResumeToken bson.Raw
+
+// ResumeToken returns the token itself.
+func (p ResumeToken) ResumeToken() bson.Raw {
+	return bson.Raw(p)
+}
+
+func executionIDs(events []repo.RawEventWatchModel) []string {
+	result := make([]string, 0, len(events))
+	for _, event := range events {
+		result = append(result, event.Record.ExecutionID)
+	}
+
+	return result
+}
@@ -0,0 +1,108 @@
+// Package storagetest is the conformance suite of repo.Storage. Every implementation runs it,
+// so all of them behave as the MongoDB one.
+package storagetest
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Factory returns a new empty storage which uses the clock for the times it sets.
+type Factory func(t *testing.T, clock utils.Clock) repo.Storage
+
+var (
+	// baseTs is the time of the test events, times are in UTC and in milliseconds as MongoDB keeps them.
+	baseTs = time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	// now is the time of the fixed clock.
+	now = baseTs.Add(time.Hour)
+)
+
+func fixedClock() time.Time {
+	return now
+}
+
+// Run runs the suite, every test gets a new storage.
+func Run(t *testing.T, newStorage Factory) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, newStorage Factory)
+	}{
+		{"RawEvents", testRawEvents},
+		{"Tokens", testTokens},
+		{"WatchRawEvents", testWatchRawEvents},
+		{"WatchRawEventsPartitions", testWatchRawEventsPartitions},
+		{"WatchRawEventsIdle", testWatchRawEventsIdle},
+		{"MergeStageExecution", testMergeStageExecution},
+		{"MergeStageExecutionOrder", testMergeStageExecutionOrder},
+		{"MergeStageExecutionRedelivery", testMergeStageExecutionRedelivery},
+		{"MergeExecution", testMergeExecution},
+		{"ListStageExecutions", testListStageExecutions},
+		{"ListExecutions", testListExecutions},
+		{"SearchStageExecutions", testSearchStageExecutions},
+		{"AggregateStageMetrics", testAggregateStageMetrics},
+		{"StageLogs", testStageLogs},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStorage)
+		})
+	}
+}
+
+func event(executionID, stageExecutionID string, kind repo.EventKind, ts time.Time) repo.Event {
+	return repo.Event{
+		ProcessID:        "p1",
+		ExecutionID:      executionID,
+		StageExecutionID: stageExecutionID,
+		WorkerID:         "w1",
+		Stage:            repo.RawStage{Name: "stage_1"},
+		Ts:               ts,
+		Kind:             kind,
+	}
+}
+
+func document(t *testing.T, doc bson.D) bson.Raw {
+	t.Helper()
+
+	result, err := bson.Marshal(doc)
+	require.NoError(t, err)
+
+	return result
+}
+
+// writeStage writes the aggregates of events of one stage execution sorted by Ts.
+func writeStage(t *testing.T, storage repo.Storage, events ...repo.Event) {
+	t.Helper()
+
+	first, last := events[0], events[len(events)-1]
+
+	execution := repo.ExecutionAggregate{
+		ProcessID:    first.ProcessID,
+		ExecutionID:  first.ExecutionID,
+		WorkerID:     last.WorkerID,
+		FirstEventAt: first.Ts,
+		LastEventAt:  last.Ts,
+	}
+
+	for _, event := range events {
+		if len(event.Labels) > 0 && execution.Labels == nil {
+			execution.Labels = map[string]string{}
+		}
+
+		maps.Copy(execution.Labels, event.Labels)
+	}
+
+	require.NoError(t, storage.WriteAggregates(t.Context(), []repo.AggregateWrite{
+		repo.MergeExecutionWrite(execution),
+		repo.MergeStageExecutionWrite(events),
+	}))
+}
@@ -0,0 +1,191 @@
+package repo
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	idxNameSingleStageText = "stage_exec_text"
+
+	textScoreFieldName = "sc"
+
+	// weights of text index fields, a match in a failure is more relevant than in metadata or description.
+	textWeightFailure     = 10
+	textWeightMetadata    = 5
+	textWeightDescription = 1
+)
+
+func (r *Repo) createSingleStageTextIndex(ctx context.Context) error {
+	return r.client.CreateIndexes(ctx, collectionNameSingleStageExec, []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: SingleStageExecutionEventFailureTextFieldName(), Value: "text"},
+			{Key: SingleStageExecutionEventMetadataTextFieldName(), Value: "text"},
+			{Key: SingleStageExecutionEventRawStageDescriptionFieldName(), Value: "text"},
+		},
+		Options: options.Index().
+			SetName(idxNameSingleStageText).
+			SetWeights(bson.D{
+				{Key: SingleStageExecutionEventFailureTextFieldName(), Value: textWeightFailure},
+				{Key: SingleStageExecutionEventMetadataTextFieldName(), Value: textWeightMetadata},
+				{Key: SingleStageExecutionEventRawStageDescriptionFieldName(), Value: textWeightDescription},
+			}),
+	}})
+}
+
+// searchTextUpdate builds `$set` expressions of an update pipeline which add strings
+// of failures and metadata of the events to the text search fields.
+func searchTextUpdate(events ...Event) bson.M {
+	failureText := make([]string, 0)
+	metadataText := make([]string, 0)
+
+	for _, event := range events {
+		failureText = append(failureText, extractStrings(event.Failure)...)
+		metadataText = append(metadataText, extractStrings(event.Metadata)...)
+	}
+
+	result := bson.M{}
+
+	if len(failureText) > 0 {
+		result[SingleStageExecutionEventFailureTextFieldName()] = unionWith(
+			SingleStageExecutionEventFailureTextFieldName(),
+			failureText,
+		)
+	}
+
+	if len(metadataText) > 0 {
+		result[SingleStageExecutionEventMetadataTextFieldName()] = unionWith(
+			SingleStageExecutionEventMetadataTextFieldName(),
+			metadataText,
+		)
+	}
+
+	return result
+}
+
+// SearchText returns sorted unique strings of failures and metadata of the events,
+// the values of SingleStageExecutionEvent.FailureText and SingleStageExecutionEvent.MetadataText.
+func SearchText(events ...Event) ([]string, []string) {
+	var failureText, metadataText []string
+
+	for _, event := range events {
+		failureText = append(failureText, extractStrings(event.Failure)...)
+		metadataText = append(metadataText, extractStrings(event.Metadata)...)
+	}
+
+	slices.Sort(failureText)
+	slices.Sort(metadataText)
+
+	return slices.Compact(failureText), slices.Compact(metadataText)
+}
+
+// extractStrings returns all non-empty string values of a document including nested documents and arrays.
+func extractStrings(doc bson.Raw) []string {
+	if len(doc) == 0 {
+		return nil
+	}
+
+	values, err := doc.Values()
+	if err != nil {
+		return nil
+	}
+
+	return appendStrings(nil, values)
+}
+
+func appendStrings(result []string, values []bson.RawValue) []string {
+	for _, value := range values {
+		switch value.Type { //nolint:exhaustive
+		case bson.TypeString:
+			if str := strings.TrimSpace(value.StringValue()); len(str) > 0 {
+				result = append(result, str)
+			}
+		case bson.TypeEmbeddedDocument, bson.TypeArray:
+			nested, err := bson.Raw(value.Value).Values()
+			if err != nil {
+				continue
+			}
+
+			result = appendStrings(result, nested)
+		}
+	}
+
+	return result
+}
+
+// StageExecutionsSearchQuery describes a full-text search over stage executions.
+type StageExecutionsSearchQuery struct {
+	// Text is a MongoDB $text search string: words, "exact phrases" and -negations.
+	Text string
+
+	// ProcessID is optional.
+	ProcessID string
+
+	// StartedFrom and StartedTo are optional and limit the start time of stage executions.
+	StartedFrom time.Time
+	StartedTo   time.Time
+
+	Limit int64
+}
+
+type StageExecutionSearchResult struct {
+	Stage SingleStageExecutionEvent `bson:",inline"`
+	Score float64                   `bson:"sc"`
+}
+
+// SearchStageExecutions performs full-text search across failures, metadata and stage descriptions
+// of stage executions. Results are ranked by relevance, the most relevant first.
+// Errors:
+// - oerrs.ErrBadInput: if the search text is empty
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) SearchStageExecutions(
+	ctx context.Context,
+	query StageExecutionsSearchQuery,
+) ([]StageExecutionSearchResult, error) {
+	if len(strings.TrimSpace(query.Text)) == 0 {
+		return nil, oerrs.NewTErrf(ctx, "search text must be set: %w", oerrs.ErrBadInput)
+	}
+
+	filter := bson.M{"$text": bson.M{"$search": query.Text}}
+
+	if len(query.ProcessID) > 0 {
+		filter[SingleStageExecutionEventProcessIDFieldName()] = query.ProcessID
+	}
+
+	if tsFilter := timeRangeFilter(query.StartedFrom, query.StartedTo); tsFilter != nil {
+		filter[SingleStageExecutionEventStartTsFieldName()] = tsFilter
+	}
+
+	score := bson.M{textScoreFieldName: bson.M{"$meta": "textScore"}}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameSingleStageExec).
+		Find(
+			ctx,
+			filter,
+			options.Find().
+				SetProjection(score).
+				SetSort(score).
+				SetLimit(query.Limit),
+		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []StageExecutionSearchResult
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,45 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestExtractStrings(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{
+		{Key: "error", Value: "connection refused"},
+		{Key: "code", Value: 111},
+		{Key: "empty", Value: "  "},
+		{Key: "details", Value: bson.D{
+			{Key: "host", Value: "db-1"},
+			{Key: "attempts", Value: bson.A{"first timeout", 2, bson.D{{Key: "msg", Value: "reset by peer"}}}},
+		}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(
+		t,
+		[]string{"connection refused", "db-1", "first timeout", "reset by peer"},
+		extractStrings(doc),
+	)
+
+	assert.Empty(t, extractStrings(nil))
+}
+
+func TestSearchTextUpdate(t *testing.T) {
+	failure, err := bson.Marshal(bson.M{"error": "disk full"})
+	require.NoError(t, err)
+
+	metadata, err := bson.Marshal(bson.M{"host": "worker-1"})
+	require.NoError(t, err)
+
+	assert.Equal(t, bson.M{
+		"ft": unionWith("ft", []string{"disk full"}),
+		"mx": unionWith("mx", []string{"worker-1"}),
+	}, searchTextUpdate(Event{Failure: failure}, Event{Metadata: metadata}))
+
+	assert.Empty(t, searchTextUpdate(Event{}))
+}
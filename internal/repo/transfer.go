@@ -0,0 +1,151 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// ExecutionSnapshot is everything stored about one execution, executions are exported and imported as a whole.
+type ExecutionSnapshot struct {
+	ProcessID   string
+	ExecutionID string
+
+	// Aggregate is nil if the execution has no aggregate.
+	Aggregate       *ExecutionAggregate
+	StageExecutions []SingleStageExecutionEvent
+	// Events are raw events sorted by Ts, they may be expired while the aggregates are not.
+	Events []Event
+}
+
+// GetExecutionSnapshot returns raw events and aggregates of the execution.
+// Errors:
+// - oerrs.ErrNotFound: if nothing is stored about the execution.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) GetExecutionSnapshot(ctx context.Context, processID, executionID string) (ExecutionSnapshot, error) {
+	result := ExecutionSnapshot{ProcessID: processID, ExecutionID: executionID}
+
+	var aggregate ExecutionAggregate
+
+	err := r.client.
+		DB().
+		Collection(collectionNameExecutionAggregates).
+		FindOne(ctx, executionAggregateFilter(processID, executionID)).
+		Decode(&aggregate)
+
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+	case err != nil:
+		return result, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	default:
+		result.Aggregate = &aggregate
+	}
+
+	result.StageExecutions, err = r.ListStageExecutions(ctx, StageExecutionsQuery{
+		ProcessID:   processID,
+		ExecutionID: executionID,
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// ListStageExecutions returns the latest first
+	slices.Reverse(result.StageExecutions)
+
+	result.Events, err = r.GetRawExecutionEvents(ctx, processID, executionID)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Aggregate == nil && len(result.StageExecutions) == 0 && len(result.Events) == 0 {
+		return result, oerrs.NewTErrf(ctx, "no execution %s/%s: %w", processID, executionID, oerrs.ErrNotFound)
+	}
+
+	return result, nil
+}
+
+// ReplaceExecutionSnapshot deletes everything stored about the execution and writes the snapshot instead.
+// Raw events get new IDs and are marked as aggregated, so the consumer doesn't aggregate them again,
+// aggregates get the current UpdatedAt, so they are not expired right away.
+// The replacement is not atomic, but it can be repeated if it fails.
+// Errors:
+// - oerrs.ErrBadInput: if the default retention periods are not configured.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) ReplaceExecutionSnapshot(ctx context.Context, snapshot ExecutionSnapshot) error {
+	retention, err := r.retentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := executionAggregateFilter(snapshot.ProcessID, snapshot.ExecutionID)
+	now := r.clock()
+	expireAt := now.Add(retention.of(snapshot.ProcessID).StageExecutions)
+
+	// all collections use the same names of the ProcessID and the ExecutionID fields
+	for _, collection := range []string{
+		collectionNameRawEvents,
+		collectionNameSingleStageExec,
+		collectionNameExecutionAggregates,
+	} {
+		_, err := r.client.DB().Collection(collection).DeleteMany(ctx, filter)
+		if err != nil {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+	}
+
+	if len(snapshot.Events) > 0 {
+		events := make([]Event, 0, len(snapshot.Events))
+
+		for _, event := range snapshot.Events {
+			event = event.Copy()
+			event.ID = bson.ObjectID{}
+			event.Aggregated = true
+			events = append(events, event)
+		}
+
+		err := r.AppendRawEvents(ctx, events)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(snapshot.StageExecutions) > 0 {
+		stages := make([]expiring[SingleStageExecutionEvent], 0, len(snapshot.StageExecutions))
+
+		for _, stage := range snapshot.StageExecutions {
+			stage.UpdatedAt = now
+			stage.FailureText, stage.MetadataText = stageSearchText(stage)
+			stages = append(stages, expiring[SingleStageExecutionEvent]{Doc: stage, ExpireAt: expireAt})
+		}
+
+		_, err := r.client.DB().Collection(collectionNameSingleStageExec).InsertMany(ctx, stages)
+		if err != nil {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+	}
+
+	if snapshot.Aggregate != nil {
+		aggregate := *snapshot.Aggregate
+		aggregate.UpdatedAt = now
+
+		_, err := r.client.
+			DB().
+			Collection(collectionNameExecutionAggregates).
+			InsertOne(ctx, expiring[ExecutionAggregate]{Doc: aggregate, ExpireAt: expireAt})
+		if err != nil {
+			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+		}
+	}
+
+	return nil
+}
+
+// stageSearchText returns the text search fields of the stage execution computed from its events,
+// the same values searchTextUpdate accumulates.
+func stageSearchText(stage SingleStageExecutionEvent) ([]string, []string) {
+	return SearchText(append([]Event{stage.Start, stage.End}, stage.Updates...)...)
+}
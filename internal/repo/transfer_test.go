@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestStageSearchText(t *testing.T) {
+	failure, err := bson.Marshal(bson.M{"error": "disk full"})
+	require.NoError(t, err)
+
+	metadata, err := bson.Marshal(bson.M{"host": "worker-1"})
+	require.NoError(t, err)
+
+	otherMetadata, err := bson.Marshal(bson.M{"host": "worker-1", "zone": "eu"})
+	require.NoError(t, err)
+
+	failureText, metadataText := stageSearchText(SingleStageExecutionEvent{
+		Start:   Event{Metadata: metadata},
+		Updates: []Event{{Metadata: otherMetadata}},
+		End:     Event{Failure: failure},
+	})
+
+	assert.Equal(t, []string{"disk full"}, failureText)
+	// strings are unique like in searchTextUpdate
+	assert.Equal(t, []string{"eu", "worker-1"}, metadataText)
+
+	failureText, metadataText = stageSearchText(SingleStageExecutionEvent{})
+	assert.Empty(t, failureText)
+	assert.Empty(t, metadataText)
+}
@@ -0,0 +1,372 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	collectionNameWebhookSubscriptions = "webhook_subscriptions"
+	collectionNameWebhookDeliveries    = "webhook_deliveries"
+
+	idxNameWebhookDeliveriesTTL   = "ttl_webhook_deliveries"
+	idxNameWebhookDeliveriesQueue = "webhook_deliveries_queue"
+	idxNameWebhookDeliveriesLog   = "webhook_deliveries_log"
+)
+
+// createWebhookIndexes creates indexes of webhook deliveries.
+// Deliveries live as long as stage executions they are about.
+func (r *Repo) createWebhookIndexes(ctx context.Context) error {
+	ttlSec, err := strconv.ParseInt(os.Getenv("STAGE_EXECUTIONS_TTL_SECONDS"), 10, 32)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrBadInput)
+	}
+
+	err = r.client.CreateOrUpdateTTLIndex(
+		ctx,
+		collectionNameWebhookDeliveries,
+		idxNameWebhookDeliveriesTTL,
+		int32(ttlSec),
+		mongo.IndexModel{
+			Keys: bson.M{WebhookDeliveryCreatedAtFieldName(): 1},
+			Options: options.Index().
+				SetExpireAfterSeconds(int32(ttlSec)).
+				SetName(idxNameWebhookDeliveriesTTL),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return r.client.CreateIndexes(ctx, collectionNameWebhookDeliveries, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: WebhookDeliveryStatusFieldName(), Value: 1},
+				{Key: WebhookDeliveryNextAttemptAtFieldName(), Value: 1},
+			},
+			Options: options.Index().SetName(idxNameWebhookDeliveriesQueue),
+		},
+		{
+			Keys: bson.D{
+				{Key: WebhookDeliverySubscriptionIDFieldName(), Value: 1},
+				{Key: WebhookDeliveryCreatedAtFieldName(), Value: -1},
+			},
+			Options: options.Index().SetName(idxNameWebhookDeliveriesLog),
+		},
+	})
+}
+
+// CreateWebhookSubscription validates and saves a new subscription.
+// Errors:
+// - oerrs.ErrBadInput: if the subscription is invalid.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) CreateWebhookSubscription(
+	ctx context.Context,
+	subscription WebhookSubscription,
+) (WebhookSubscription, error) {
+	err := subscription.Validate()
+	if err != nil {
+		return subscription, oerrs.NewTErrf(ctx, "invalid subscription: %w: %w", err, oerrs.ErrBadInput)
+	}
+
+	subscription.ID = bson.NewObjectID()
+	subscription.CreatedAt = r.clock()
+
+	_, err = r.client.
+		DB().
+		Collection(collectionNameWebhookSubscriptions).
+		InsertOne(ctx, subscription)
+	if err != nil {
+		return subscription, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return subscription, nil
+}
+
+// ListWebhookSubscriptions returns all subscriptions.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameWebhookSubscriptions).
+		Find(ctx, bson.M{})
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []WebhookSubscription
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// GetWebhookSubscription returns a subscription by its ID.
+// Errors:
+// - oerrs.ErrNotFound: if there is no such subscription.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) GetWebhookSubscription(ctx context.Context, id bson.ObjectID) (WebhookSubscription, error) {
+	var result WebhookSubscription
+
+	err := r.client.
+		DB().
+		Collection(collectionNameWebhookSubscriptions).
+		FindOne(ctx, bson.M{"_id": id}).
+		Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, oerrs.NewTErrf(ctx, "no such subscription %s: %w", id.Hex(), oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return result, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// DeleteWebhookSubscription deletes a subscription. Its delivery log is kept until it expires.
+// Errors:
+// - oerrs.ErrNotFound: if there is no such subscription.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) DeleteWebhookSubscription(ctx context.Context, id bson.ObjectID) error {
+	res, err := r.client.
+		DB().
+		Collection(collectionNameWebhookSubscriptions).
+		DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	if res.DeletedCount == 0 {
+		return oerrs.NewTErrf(ctx, "no such subscription %s: %w", id.Hex(), oerrs.ErrNotFound)
+	}
+
+	return nil
+}
+
+// EnqueueWebhookDeliveries saves pending deliveries.
+// Deliveries which already exist are skipped, so enqueueing the same event twice is a no-op.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) EnqueueWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	_, err := r.client.
+		DB().
+		Collection(collectionNameWebhookDeliveries).
+		InsertMany(ctx, deliveries, options.InsertMany().SetOrdered(false))
+	if err != nil && !isOnlyDuplicateKeyErrors(err) {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+func isOnlyDuplicateKeyErrors(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		return mongo.IsDuplicateKeyError(err)
+	}
+
+	if bulkErr.WriteConcernError != nil {
+		return false
+	}
+
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !writeErr.HasErrorCode(11000) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ClaimWebhookDelivery takes the pending delivery which is due first
+// and postpones its next attempt by lockFor, so other workers don't take it at the same time.
+// Errors:
+// - oerrs.ErrNotFound: if there is no due delivery.
+// - oerrs.ErrInternal: on any other error.
+func (r *Repo) ClaimWebhookDelivery(ctx context.Context, lockFor time.Duration) (WebhookDelivery, error) {
+	var result WebhookDelivery
+
+	now := r.clock()
+
+	err := r.client.
+		DB().
+		Collection(collectionNameWebhookDeliveries).
+		FindOneAndUpdate(
+			ctx,
+			bson.M{
+				WebhookDeliveryStatusFieldName():        WebhookDeliveryPending,
+				WebhookDeliveryNextAttemptAtFieldName(): bson.M{"$lte": now},
+			},
+			bson.M{"$set": bson.M{WebhookDeliveryNextAttemptAtFieldName(): now.Add(lockFor)}},
+			options.FindOneAndUpdate().
+				SetSort(bson.M{WebhookDeliveryNextAttemptAtFieldName(): 1}).
+				SetReturnDocument(options.After),
+		).
+		Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, oerrs.NewTErrf(ctx, "no due webhook deliveries: %w", oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return result, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// WebhookDeliveryAttempt is a result of one attempt to deliver a webhook.
+type WebhookDeliveryAttempt struct {
+	ID         string
+	StatusCode int
+	Error      string
+	// Delivered is true if the endpoint accepted the webhook.
+	Delivered bool
+	// NextAttemptAt is used if the attempt failed. Zero value means the delivery won't be retried.
+	NextAttemptAt time.Time
+}
+
+// SaveWebhookDeliveryAttempt records the attempt in the delivery log and updates the delivery status.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) SaveWebhookDeliveryAttempt(ctx context.Context, attempt WebhookDeliveryAttempt) error {
+	set := bson.M{
+		WebhookDeliveryLastStatusCodeFieldName(): attempt.StatusCode,
+		WebhookDeliveryLastErrorFieldName():      attempt.Error,
+	}
+
+	switch {
+	case attempt.Delivered:
+		set[WebhookDeliveryStatusFieldName()] = WebhookDeliveryDelivered
+		set[WebhookDeliveryDeliveredAtFieldName()] = r.clock()
+	case attempt.NextAttemptAt.IsZero():
+		set[WebhookDeliveryStatusFieldName()] = WebhookDeliveryFailed
+	default:
+		set[WebhookDeliveryNextAttemptAtFieldName()] = attempt.NextAttemptAt
+	}
+
+	_, err := r.client.
+		DB().
+		Collection(collectionNameWebhookDeliveries).
+		UpdateOne(
+			ctx,
+			bson.M{"_id": attempt.ID},
+			bson.M{
+				"$set": set,
+				"$inc": bson.M{WebhookDeliveryAttemptsFieldName(): 1},
+			},
+		)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+// ListWebhookDeliveries returns the delivery log of the subscription, the latest first.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) ListWebhookDeliveries(
+	ctx context.Context,
+	subscriptionID bson.ObjectID,
+	limit int64,
+) ([]WebhookDelivery, error) {
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameWebhookDeliveries).
+		Find(
+			ctx,
+			bson.M{WebhookDeliverySubscriptionIDFieldName(): subscriptionID},
+			options.Find().
+				SetSort(bson.M{WebhookDeliveryCreatedAtFieldName(): -1}).
+				SetLimit(limit),
+		)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []WebhookDelivery
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return result, nil
+}
+
+// ExecutionStageCounts counts stage executions of the execution.
+type ExecutionStageCounts struct {
+	Total    int64 `bson:"t"`
+	Finished int64 `bson:"fn"`
+	Failed   int64 `bson:"fl"`
+}
+
+func (c ExecutionStageCounts) IsFinished() bool {
+	return c.Total > 0 && c.Total == c.Finished
+}
+
+// CountExecutionStages counts stage executions of the execution by their state.
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (r *Repo) CountExecutionStages(
+	ctx context.Context,
+	processID, executionID string,
+) (ExecutionStageCounts, error) {
+	var (
+		isFinished = "$" + SingleStageExecutionEventIsFinishedFieldName()
+		isSuccess  = "$" + SingleStageExecutionEventIsSuccessFieldName()
+	)
+
+	pipeline := []bson.M{
+		{"$match": bson.M{
+			SingleStageExecutionEventProcessIDFieldName():   processID,
+			SingleStageExecutionEventExecutionIDFieldName(): executionID,
+		}},
+		{"$group": bson.M{
+			"_id": nil,
+			"t":   bson.M{"$sum": 1},
+			"fn":  bson.M{"$sum": bson.M{"$cond": bson.A{isFinished, 1, 0}}},
+			"fl": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$and": bson.A{isFinished, bson.M{"$not": bson.A{isSuccess}}}}, 1, 0,
+			}}},
+		}},
+	}
+
+	cur, err := r.client.
+		DB().
+		Collection(collectionNameSingleStageExec).
+		Aggregate(ctx, pipeline)
+	if err != nil {
+		return ExecutionStageCounts{}, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var result []ExecutionStageCounts
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return ExecutionStageCounts{}, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	if len(result) == 0 {
+		return ExecutionStageCounts{}, nil
+	}
+
+	return result[0], nil
+}
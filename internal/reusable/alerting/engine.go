@@ -0,0 +1,171 @@
+// Package alerting evaluates alerting rules against stage aggregates
+// and delivers firing and resolved alerts through a Notifier.
+//
+// Alerts are deduplicated by a fingerprint of the rule, the process and the stage:
+// a notification is sent only when an alert starts firing and when it is resolved.
+// An alert is resolved automatically once its rule stops firing.
+package alerting
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+type store interface {
+	StageStats(ctx context.Context, query repo.StageStatsQuery) ([]repo.StageStat, error)
+	ListActiveAlerts(ctx context.Context) ([]repo.Alert, error)
+	SaveAlert(ctx context.Context, alert repo.Alert) error
+}
+
+// Notifier delivers an alert when it starts firing or gets resolved.
+type Notifier interface {
+	Notify(ctx context.Context, alert repo.Alert) error
+}
+
+type Engine struct {
+	store    store
+	notifier Notifier
+	rules    []Rule
+	clock    utils.Clock
+}
+
+func NewEngine(s store, notifier Notifier, rules []Rule, clock utils.Clock) *Engine {
+	return &Engine{
+		store:    s,
+		notifier: notifier,
+		rules:    rules,
+		clock:    clock,
+	}
+}
+
+// Run evaluates rules every period until the context is done.
+// Evaluation errors are logged and do not stop the engine.
+func (e *Engine) Run(ctx context.Context, period time.Duration) error {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		err := e.Evaluate(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to evaluate alerting rules", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate evaluates all rules once, notifies about new and resolved alerts and saves their state.
+//
+// If a rule can not be evaluated, its active alerts are kept as is.
+// If a notification fails, the alert state is not saved, so the notification is retried on the next evaluation.
+func (e *Engine) Evaluate(ctx context.Context) error {
+	now := e.clock()
+
+	active, err := e.store.ListActiveAlerts(ctx)
+	if err != nil {
+		return err
+	}
+
+	firing := map[string]repo.Alert{}
+	failedRules := map[string]struct{}{}
+
+	var errs error
+
+	for _, rule := range e.rules {
+		stats, err := e.store.StageStats(ctx, rule.statsQuery(now))
+		if err != nil {
+			failedRules[rule.Name] = struct{}{}
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		for _, stat := range stats {
+			value, threshold, isFiring := rule.evaluate(stat, now)
+			if !isFiring {
+				continue
+			}
+
+			alert := repo.Alert{
+				Fingerprint:     fingerprint(rule.Name, stat.ProcessID, stat.StageName),
+				Rule:            rule.Name,
+				RuleType:        string(rule.Type),
+				ProcessID:       stat.ProcessID,
+				StageName:       stat.StageName,
+				State:           repo.AlertStateFiring,
+				Value:           value,
+				Threshold:       threshold,
+				Message:         rule.message(stat, value),
+				StartedAt:       now,
+				LastEvaluatedAt: now,
+			}
+
+			firing[alert.Fingerprint] = alert
+		}
+	}
+
+	activeByFingerprint := make(map[string]repo.Alert, len(active))
+	for _, alert := range active {
+		activeByFingerprint[alert.Fingerprint] = alert
+	}
+
+	for fp, alert := range firing {
+		prev, ok := activeByFingerprint[fp]
+		if ok {
+			// already notified, only refresh the state
+			alert.StartedAt = prev.StartedAt
+			errs = errors.Join(errs, e.store.SaveAlert(ctx, alert))
+			continue
+		}
+
+		errs = errors.Join(errs, e.notifyAndSave(ctx, alert))
+	}
+
+	for fp, alert := range activeByFingerprint {
+		if _, ok := firing[fp]; ok {
+			continue
+		}
+
+		if _, ok := failedRules[alert.Rule]; ok {
+			continue
+		}
+
+		alert.State = repo.AlertStateResolved
+		alert.ResolvedAt = now
+		alert.LastEvaluatedAt = now
+
+		errs = errors.Join(errs, e.notifyAndSave(ctx, alert))
+	}
+
+	return errs
+}
+
+func (e *Engine) notifyAndSave(ctx context.Context, alert repo.Alert) error {
+	err := e.notifier.Notify(ctx, alert)
+	if err != nil {
+		return err
+	}
+
+	return e.store.SaveAlert(ctx, alert)
+}
+
+func fingerprint(rule, processID, stageName string) string {
+	hash := sha256.New()
+
+	for _, part := range []string{rule, processID, stageName} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,206 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStore struct {
+	stats    []repo.StageStat
+	statsErr error
+	alerts   map[string]repo.Alert
+}
+
+func (s *fakeStore) StageStats(_ context.Context, query repo.StageStatsQuery) ([]repo.StageStat, error) {
+	if s.statsErr != nil {
+		return nil, s.statsErr
+	}
+
+	result := make([]repo.StageStat, 0, len(s.stats))
+	for _, stat := range s.stats {
+		if len(query.ProcessID) > 0 && stat.ProcessID != query.ProcessID {
+			continue
+		}
+
+		result = append(result, stat)
+	}
+
+	return result, nil
+}
+
+func (s *fakeStore) ListActiveAlerts(_ context.Context) ([]repo.Alert, error) {
+	result := make([]repo.Alert, 0, len(s.alerts))
+	for _, alert := range s.alerts {
+		if alert.State == repo.AlertStateFiring {
+			result = append(result, alert)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *fakeStore) SaveAlert(_ context.Context, alert repo.Alert) error {
+	s.alerts[alert.Fingerprint] = alert
+	return nil
+}
+
+type fakeNotifier struct {
+	notified []repo.Alert
+	err      error
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, alert repo.Alert) error {
+	if n.err != nil {
+		return n.err
+	}
+
+	n.notified = append(n.notified, alert)
+
+	return nil
+}
+
+func failedStat(processID, stageName string) repo.StageStat {
+	stat := repo.StageStat{ProcessID: processID, StageName: stageName, Total: 1, Finished: 1, Failed: 1}
+	stat.LastFinished.IsFinished = true
+
+	return stat
+}
+
+func TestEngineDeduplicatesAndResolves(t *testing.T) {
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	store := &fakeStore{
+		stats:  []repo.StageStat{failedStat("p1", "s1")},
+		alerts: map[string]repo.Alert{},
+	}
+	notifier := &fakeNotifier{}
+
+	rules := []Rule{{Name: "failures", Type: RuleTypeStageFailure, Window: Duration(time.Hour)}}
+	engine := NewEngine(store, notifier, rules, clock)
+
+	// fires
+	require.NoError(t, engine.Evaluate(t.Context()))
+	require.Len(t, notifier.notified, 1)
+	assert.Equal(t, repo.AlertStateFiring, notifier.notified[0].State)
+	assert.Equal(t, "p1", notifier.notified[0].ProcessID)
+
+	// still firing, not notified again
+	now = now.Add(time.Minute)
+	require.NoError(t, engine.Evaluate(t.Context()))
+	require.Len(t, notifier.notified, 1)
+
+	fp := notifier.notified[0].Fingerprint
+	assert.Equal(t, now, store.alerts[fp].LastEvaluatedAt)
+	assert.Equal(t, now.Add(-time.Minute), store.alerts[fp].StartedAt)
+
+	// a later execution succeeded
+	store.stats[0].LastFinished.IsSuccess = true
+	now = now.Add(time.Minute)
+	require.NoError(t, engine.Evaluate(t.Context()))
+	require.Len(t, notifier.notified, 2)
+	assert.Equal(t, repo.AlertStateResolved, notifier.notified[1].State)
+	assert.Equal(t, now, notifier.notified[1].ResolvedAt)
+	assert.Equal(t, repo.AlertStateResolved, store.alerts[fp].State)
+}
+
+func TestEngineRetriesFailedNotifications(t *testing.T) {
+	store := &fakeStore{
+		stats:  []repo.StageStat{failedStat("p1", "s1")},
+		alerts: map[string]repo.Alert{},
+	}
+	notifier := &fakeNotifier{err: errors.New("unavailable")}
+
+	rules := []Rule{{Name: "failures", Type: RuleTypeStageFailure, Window: Duration(time.Hour)}}
+	engine := NewEngine(store, notifier, rules, time.Now)
+
+	require.Error(t, engine.Evaluate(t.Context()))
+	assert.Empty(t, store.alerts)
+
+	notifier.err = nil
+	require.NoError(t, engine.Evaluate(t.Context()))
+	assert.Len(t, notifier.notified, 1)
+	assert.Len(t, store.alerts, 1)
+}
+
+func TestEngineKeepsAlertsOfFailedRules(t *testing.T) {
+	store := &fakeStore{
+		stats:  []repo.StageStat{failedStat("p1", "s1")},
+		alerts: map[string]repo.Alert{},
+	}
+	notifier := &fakeNotifier{}
+
+	rules := []Rule{{Name: "failures", Type: RuleTypeStageFailure, Window: Duration(time.Hour)}}
+	engine := NewEngine(store, notifier, rules, time.Now)
+
+	require.NoError(t, engine.Evaluate(t.Context()))
+
+	store.statsErr = errors.New("mongo is down")
+	require.Error(t, engine.Evaluate(t.Context()))
+
+	assert.Len(t, notifier.notified, 1)
+	for _, alert := range store.alerts {
+		assert.Equal(t, repo.AlertStateFiring, alert.State)
+	}
+}
+
+func TestRuleEvaluate(t *testing.T) {
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name   string
+		rule   Rule
+		stat   repo.StageStat
+		firing bool
+	}{
+		{
+			name:   "failure rate above threshold",
+			rule:   Rule{Type: RuleTypeFailureRate, Threshold: 0.5, MinExecutions: 2},
+			stat:   repo.StageStat{Finished: 4, Failed: 2},
+			firing: true,
+		},
+		{
+			name:   "failure rate below min executions",
+			rule:   Rule{Type: RuleTypeFailureRate, Threshold: 0.5, MinExecutions: 5},
+			stat:   repo.StageStat{Finished: 4, Failed: 4},
+			firing: false,
+		},
+		{
+			name:   "duration over threshold",
+			rule:   Rule{Type: RuleTypeDuration, MaxDuration: Duration(time.Minute)},
+			stat:   repo.StageStat{MaxDurationMs: (2 * time.Minute).Milliseconds()},
+			firing: true,
+		},
+		{
+			name:   "duration within threshold",
+			rule:   Rule{Type: RuleTypeDuration, MaxDuration: Duration(time.Minute)},
+			stat:   repo.StageStat{MaxDurationMs: time.Second.Milliseconds()},
+			firing: false,
+		},
+		{
+			name:   "no execution for too long",
+			rule:   Rule{Type: RuleTypeNoExecution, NoExecutionFor: Duration(time.Hour)},
+			stat:   repo.StageStat{LastStartedAt: now.Add(-2 * time.Hour)},
+			firing: true,
+		},
+		{
+			name:   "recently executed",
+			rule:   Rule{Type: RuleTypeNoExecution, NoExecutionFor: Duration(time.Hour)},
+			stat:   repo.StageStat{LastStartedAt: now.Add(-time.Minute)},
+			firing: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, firing := tc.rule.evaluate(tc.stat, now)
+			assert.Equal(t, tc.firing, firing)
+		})
+	}
+}
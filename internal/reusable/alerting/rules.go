@@ -0,0 +1,228 @@
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+)
+
+type RuleType string
+
+const (
+	// RuleTypeStageFailure fires when the last finished execution of a stage has failed.
+	RuleTypeStageFailure RuleType = "stage_failure"
+	// RuleTypeFailureRate fires when the share of failed stage executions within Rule.Window
+	// reaches Rule.Threshold (0..1).
+	RuleTypeFailureRate RuleType = "failure_rate"
+	// RuleTypeDuration fires when a stage execution within Rule.Window runs (or has run) longer than Rule.MaxDuration.
+	RuleTypeDuration RuleType = "duration"
+	// RuleTypeNoExecution fires when a stage has not been started for Rule.NoExecutionFor.
+	RuleTypeNoExecution RuleType = "no_execution"
+)
+
+// Duration is a time.Duration which is represented as a string like "5m" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Rule describes when alerts must be fired. Every rule is evaluated per process and stage.
+type Rule struct {
+	Name string   `json:"name"`
+	Type RuleType `json:"type"`
+
+	// ProcessID and StageName are optional and limit the rule to a process and/or a stage.
+	ProcessID string `json:"processId,omitempty"`
+	StageName string `json:"stageName,omitempty"`
+
+	// Window limits stage executions which are taken into account to the ones updated within it.
+	// Used by all rule types except RuleTypeNoExecution.
+	Window Duration `json:"window,omitempty"`
+
+	// Threshold is a failure rate (0..1) for RuleTypeFailureRate.
+	Threshold float64 `json:"threshold,omitempty"`
+	// MinExecutions is a minimal amount of finished stage executions required by RuleTypeFailureRate.
+	MinExecutions int64 `json:"minExecutions,omitempty"`
+
+	// MaxDuration is used by RuleTypeDuration.
+	MaxDuration Duration `json:"maxDuration,omitempty"`
+	// NoExecutionFor is used by RuleTypeNoExecution.
+	NoExecutionFor Duration `json:"noExecutionFor,omitempty"`
+}
+
+func (r Rule) Validate() error {
+	var resultErr error
+
+	if len(r.Name) == 0 {
+		resultErr = errors.Join(resultErr, errors.New("rule name must be set"))
+	}
+
+	switch r.Type {
+	case RuleTypeStageFailure:
+		if r.Window <= 0 {
+			resultErr = errors.Join(resultErr, errors.New("window must be set"))
+		}
+	case RuleTypeFailureRate:
+		if r.Window <= 0 {
+			resultErr = errors.Join(resultErr, errors.New("window must be set"))
+		}
+
+		if r.Threshold <= 0 || r.Threshold > 1 {
+			resultErr = errors.Join(resultErr, errors.New("threshold must be in (0, 1]"))
+		}
+	case RuleTypeDuration:
+		if r.Window <= 0 {
+			resultErr = errors.Join(resultErr, errors.New("window must be set"))
+		}
+
+		if r.MaxDuration <= 0 {
+			resultErr = errors.Join(resultErr, errors.New("maxDuration must be set"))
+		}
+	case RuleTypeNoExecution:
+		if r.NoExecutionFor <= 0 {
+			resultErr = errors.Join(resultErr, errors.New("noExecutionFor must be set"))
+		}
+	default:
+		resultErr = errors.Join(resultErr, fmt.Errorf("unknown rule type %q", r.Type))
+	}
+
+	if resultErr != nil {
+		return fmt.Errorf("rule %q: %w", r.Name, resultErr)
+	}
+
+	return nil
+}
+
+// LoadRules reads a JSON array of rules from a file and validates them.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	var rules []Rule
+
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+
+	return rules, ValidateRules(rules)
+}
+
+// ValidateRules validates every rule and checks that rule names are unique.
+func ValidateRules(rules []Rule) error {
+	var resultErr error
+
+	names := map[string]struct{}{}
+
+	for _, rule := range rules {
+		resultErr = errors.Join(resultErr, rule.Validate())
+
+		if _, ok := names[rule.Name]; ok {
+			resultErr = errors.Join(resultErr, fmt.Errorf("rule name %q is not unique", rule.Name))
+		}
+
+		names[rule.Name] = struct{}{}
+	}
+
+	return resultErr
+}
+
+func (r Rule) statsQuery(now time.Time) repo.StageStatsQuery {
+	query := repo.StageStatsQuery{
+		ProcessID: r.ProcessID,
+		StageName: r.StageName,
+		Now:       now,
+	}
+
+	if r.Type != RuleTypeNoExecution {
+		query.Since = now.Add(-time.Duration(r.Window))
+	}
+
+	return query
+}
+
+// evaluate checks the rule against the stat of one stage.
+// Returns the observed value, the threshold and whether the rule fires.
+func (r Rule) evaluate(stat repo.StageStat, now time.Time) (value, threshold float64, firing bool) {
+	switch r.Type {
+	case RuleTypeStageFailure:
+		failed := stat.LastFinished.IsFinished && !stat.LastFinished.IsSuccess
+		if failed {
+			return 1, 1, true
+		}
+
+		return 0, 1, false
+	case RuleTypeFailureRate:
+		if stat.Finished == 0 || stat.Finished < r.MinExecutions {
+			return 0, r.Threshold, false
+		}
+
+		rate := float64(stat.Failed) / float64(stat.Finished)
+
+		return rate, r.Threshold, rate >= r.Threshold
+	case RuleTypeDuration:
+		maxDuration := time.Duration(r.MaxDuration)
+
+		return stat.MaxDuration().Seconds(), maxDuration.Seconds(), stat.MaxDuration() > maxDuration
+	case RuleTypeNoExecution:
+		if stat.LastStartedAt.IsZero() {
+			return 0, 0, false
+		}
+
+		silence := now.Sub(stat.LastStartedAt)
+		noExecutionFor := time.Duration(r.NoExecutionFor)
+
+		return silence.Seconds(), noExecutionFor.Seconds(), silence > noExecutionFor
+	}
+
+	return 0, 0, false
+}
+
+func (r Rule) message(stat repo.StageStat, value float64) string {
+	switch r.Type {
+	case RuleTypeStageFailure:
+		return fmt.Sprintf("stage %s of process %s has failed", stat.StageName, stat.ProcessID)
+	case RuleTypeFailureRate:
+		return fmt.Sprintf(
+			"failure rate of stage %s of process %s is %.2f (%d of %d) within %s",
+			stat.StageName, stat.ProcessID, value, stat.Failed, stat.Finished, time.Duration(r.Window),
+		)
+	case RuleTypeDuration:
+		return fmt.Sprintf(
+			"stage %s of process %s has been running for %s, more than %s",
+			stat.StageName, stat.ProcessID, stat.MaxDuration(), time.Duration(r.MaxDuration),
+		)
+	case RuleTypeNoExecution:
+		return fmt.Sprintf(
+			"stage %s of process %s has not been executed since %s",
+			stat.StageName, stat.ProcessID, stat.LastStartedAt.Format(time.RFC3339),
+		)
+	}
+
+	return ""
+}
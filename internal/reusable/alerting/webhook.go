@@ -0,0 +1,101 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+)
+
+const (
+	webhookStatusFiring   = "firing"
+	webhookStatusResolved = "resolved"
+)
+
+// WebhookPayload is a JSON body which WebhookNotifier sends.
+type WebhookPayload struct {
+	Status      string    `json:"status"`
+	Fingerprint string    `json:"fingerprint"`
+	Rule        string    `json:"rule"`
+	RuleType    string    `json:"ruleType"`
+	ProcessID   string    `json:"processId"`
+	StageName   string    `json:"stageName"`
+	Value       float64   `json:"value"`
+	Threshold   float64   `json:"threshold"`
+	Message     string    `json:"message"`
+	StartedAt   time.Time `json:"startedAt"`
+	ResolvedAt  time.Time `json:"resolvedAt,omitzero"`
+}
+
+// WebhookNotifier POSTs a WebhookPayload to a generic HTTP endpoint.
+// Any non 2xx response is considered a failure.
+type WebhookNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhookNotifier(url string, headers map[string]string, client *http.Client) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:     url,
+		headers: headers,
+		client:  client,
+	}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alert repo.Alert) error {
+	payload := WebhookPayload{
+		Status:      webhookStatusFiring,
+		Fingerprint: alert.Fingerprint,
+		Rule:        alert.Rule,
+		RuleType:    alert.RuleType,
+		ProcessID:   alert.ProcessID,
+		StageName:   alert.StageName,
+		Value:       alert.Value,
+		Threshold:   alert.Threshold,
+		Message:     alert.Message,
+		StartedAt:   alert.StartedAt,
+		ResolvedAt:  alert.ResolvedAt,
+	}
+
+	if alert.State == repo.AlertStateResolved {
+		payload.Status = webhookStatusResolved
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for key, value := range n.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
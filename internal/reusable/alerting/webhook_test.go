@@ -0,0 +1,77 @@
+package alerting
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan WebhookPayload, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+
+		var payload WebhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- payload
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	notifier := NewWebhookNotifier(srv.URL, map[string]string{"X-Token": "secret"}, srv.Client())
+
+	startedAt := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	resolvedAt := startedAt.Add(time.Minute)
+
+	err := notifier.Notify(t.Context(), repo.Alert{
+		Fingerprint: "fp",
+		Rule:        "rule",
+		RuleType:    string(RuleTypeStageFailure),
+		ProcessID:   "p1",
+		StageName:   "s1",
+		State:       repo.AlertStateResolved,
+		Value:       1,
+		Threshold:   1,
+		Message:     "msg",
+		StartedAt:   startedAt,
+		ResolvedAt:  resolvedAt,
+	})
+	require.NoError(t, err)
+
+	payload := <-received
+	assert.Equal(t, WebhookPayload{
+		Status:      webhookStatusResolved,
+		Fingerprint: "fp",
+		Rule:        "rule",
+		RuleType:    string(RuleTypeStageFailure),
+		ProcessID:   "p1",
+		StageName:   "s1",
+		Value:       1,
+		Threshold:   1,
+		Message:     "msg",
+		StartedAt:   startedAt,
+		ResolvedAt:  resolvedAt,
+	}, payload)
+}
+
+func TestWebhookNotifierFailsOnNon2xx(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(srv.Close)
+
+	notifier := NewWebhookNotifier(srv.URL, nil, srv.Client())
+
+	err := notifier.Notify(t.Context(), repo.Alert{State: repo.AlertStateFiring})
+	require.ErrorContains(t, err, "status 502")
+}
@@ -0,0 +1,246 @@
+// Package archive exports raw events and finished aggregates into compressed files before they expire
+// and restores them back.
+//
+// Documents are archived by UTC days: every day gets a file per kind and process
+// (`2025-01-31/<ProcessID>/raw_events.jsonl.zst`) with zstd compressed JSON lines of canonical
+// MongoDB Extended JSON, and a manifest (`2025-01-31/manifest.json`) which is written last,
+// so a day without a manifest is not archived completely.
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	day = time.Hour * 24
+
+	dayLayout        = time.DateOnly
+	manifestFileName = "manifest.json"
+	fileExtension    = ".jsonl.zst"
+)
+
+// Manifest describes the files of one archived day.
+type Manifest struct {
+	Day       string         `json:"day"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Files     []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Kind      repo.ArchiveKind `json:"kind"`
+	ProcessID string           `json:"processId"`
+	Key       string           `json:"key"`
+	Documents int              `json:"documents"`
+	Bytes     int              `json:"bytes"`
+	SHA256    string           `json:"sha256"`
+}
+
+type store interface {
+	FirstArchiveTs(ctx context.Context, kind repo.ArchiveKind) (time.Time, error)
+	ListArchiveProcesses(ctx context.Context, kind repo.ArchiveKind, from, to time.Time) ([]string, error)
+	ReadArchiveDocuments(
+		ctx context.Context,
+		kind repo.ArchiveKind,
+		processID string,
+		from, to time.Time,
+		action common.CallbackFailable[bson.Raw],
+	) error
+	LoadArchiveProgress(ctx context.Context, key string) (time.Time, error)
+	SaveArchiveProgress(ctx context.Context, key string, archivedTo time.Time) error
+}
+
+type Archiver struct {
+	store store
+	blobs BlobStore
+	key   string
+	after time.Duration
+	clock utils.Clock
+}
+
+// NewArchiver creates an archiver which archives days older than after and saves its progress under key.
+func NewArchiver(s store, blobs BlobStore, key string, after time.Duration, clock utils.Clock) *Archiver {
+	return &Archiver{
+		store: s,
+		blobs: blobs,
+		key:   key,
+		after: after,
+		clock: clock,
+	}
+}
+
+// Run archives new days every period.
+func (a *Archiver) Run(ctx context.Context, period time.Duration) error {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		err := a.Archive(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to archive", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Archive archives every day after the last archived one which ended before now minus after.
+// The first run starts from the day of the earliest document.
+func (a *Archiver) Archive(ctx context.Context) error {
+	from, err := a.firstDay(ctx)
+	if errors.Is(err, oerrs.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	cutoff := a.clock().Add(-a.after)
+
+	for next := from; !next.Add(day).After(cutoff); next = next.Add(day) {
+		_, err = a.ArchiveDay(ctx, next)
+		if err != nil {
+			return err
+		}
+
+		err = a.store.SaveArchiveProgress(ctx, a.key, next.Add(day))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *Archiver) firstDay(ctx context.Context) (time.Time, error) {
+	archivedTo, err := a.store.LoadArchiveProgress(ctx, a.key)
+	if err == nil {
+		return archivedTo, nil
+	}
+
+	if !errors.Is(err, oerrs.ErrNotFound) {
+		return time.Time{}, err
+	}
+
+	var first time.Time
+
+	for _, kind := range repo.ArchiveKinds() {
+		ts, err := a.store.FirstArchiveTs(ctx, kind)
+		if errors.Is(err, oerrs.ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if first.IsZero() || ts.Before(first) {
+			first = ts
+		}
+	}
+
+	if first.IsZero() {
+		return first, oerrs.NewTErrf(ctx, "nothing to archive: %w", oerrs.ErrNotFound)
+	}
+
+	return first.UTC().Truncate(day), nil
+}
+
+// ArchiveDay writes the files and the manifest of the UTC day which starts at from.
+// Archiving a day again replaces its files.
+func (a *Archiver) ArchiveDay(ctx context.Context, from time.Time) (Manifest, error) {
+	to := from.Add(day)
+	manifest := Manifest{Day: from.Format(dayLayout), CreatedAt: a.clock(), Files: []ManifestFile{}}
+
+	for _, kind := range repo.ArchiveKinds() {
+		processes, err := a.store.ListArchiveProcesses(ctx, kind, from, to)
+		if err != nil {
+			return manifest, err
+		}
+
+		for _, processID := range processes {
+			file, err := a.archiveFile(ctx, kind, processID, from, to)
+			if err != nil {
+				return manifest, fmt.Errorf("failed to archive %s of %s on %s: %w", kind, processID, manifest.Day, err)
+			}
+
+			manifest.Files = append(manifest.Files, file)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	err = a.blobs.Put(ctx, manifest.Day+"/"+manifestFileName, data)
+	if err != nil {
+		return manifest, err
+	}
+
+	slog.InfoContext(ctx, "archived day", slog.String("day", manifest.Day), slog.Int("files", len(manifest.Files)))
+
+	return manifest, nil
+}
+
+func (a *Archiver) archiveFile(
+	ctx context.Context,
+	kind repo.ArchiveKind,
+	processID string,
+	from, to time.Time,
+) (ManifestFile, error) {
+	file := ManifestFile{
+		Kind:      kind,
+		ProcessID: processID,
+		Key:       from.Format(dayLayout) + "/" + escapeKeySegment(processID) + "/" + string(kind) + fileExtension,
+	}
+
+	writer, err := newJSONLWriter()
+	if err != nil {
+		return file, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	err = a.store.ReadArchiveDocuments(ctx, kind, processID, from, to, func(_ context.Context, doc bson.Raw) error {
+		return writer.Write(doc)
+	})
+	if err != nil {
+		return file, err
+	}
+
+	data, err := writer.Close()
+	if err != nil {
+		return file, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	sum := sha256.Sum256(data)
+
+	file.Documents = writer.count
+	file.Bytes = len(data)
+	file.SHA256 = hex.EncodeToString(sum[:])
+
+	return file, a.blobs.Put(ctx, file.Key, data)
+}
+
+// escapeKeySegment makes a ProcessID safe to be one segment of a key.
+func escapeKeySegment(value string) string {
+	return strings.ReplaceAll(url.PathEscape(value), ".", "%2E")
+}
@@ -0,0 +1,161 @@
+package archive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type testDoc struct {
+	kind      repo.ArchiveKind
+	processID string
+	ts        time.Time
+	doc       bson.Raw
+}
+
+type fakeStore struct {
+	docs     []testDoc
+	progress map[string]time.Time
+	restored map[repo.ArchiveKind][]bson.Raw
+}
+
+func (s *fakeStore) FirstArchiveTs(ctx context.Context, kind repo.ArchiveKind) (time.Time, error) {
+	var first time.Time
+
+	for _, doc := range s.docs {
+		if doc.kind == kind && (first.IsZero() || doc.ts.Before(first)) {
+			first = doc.ts
+		}
+	}
+
+	if first.IsZero() {
+		return first, oerrs.NewTErrf(ctx, "no docs: %w", oerrs.ErrNotFound)
+	}
+
+	return first, nil
+}
+
+func (s *fakeStore) ListArchiveProcesses(
+	_ context.Context,
+	kind repo.ArchiveKind,
+	from, to time.Time,
+) ([]string, error) {
+	var result []string
+
+	for _, doc := range s.docs {
+		if doc.kind == kind && !doc.ts.Before(from) && doc.ts.Before(to) {
+			result = append(result, doc.processID)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *fakeStore) ReadArchiveDocuments(
+	ctx context.Context,
+	kind repo.ArchiveKind,
+	processID string,
+	from, to time.Time,
+	action common.CallbackFailable[bson.Raw],
+) error {
+	for _, doc := range s.docs {
+		if doc.kind == kind && doc.processID == processID && !doc.ts.Before(from) && doc.ts.Before(to) {
+			err := action(ctx, doc.doc)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *fakeStore) LoadArchiveProgress(ctx context.Context, key string) (time.Time, error) {
+	archivedTo, ok := s.progress[key]
+	if !ok {
+		return archivedTo, oerrs.NewTErrf(ctx, "no progress: %w", oerrs.ErrNotFound)
+	}
+
+	return archivedTo, nil
+}
+
+func (s *fakeStore) SaveArchiveProgress(_ context.Context, key string, archivedTo time.Time) error {
+	s.progress[key] = archivedTo
+	return nil
+}
+
+func (s *fakeStore) RestoreArchiveDocuments(_ context.Context, kind repo.ArchiveKind, docs []bson.Raw) error {
+	s.restored[kind] = append(s.restored[kind], docs...)
+	return nil
+}
+
+func newTestDoc(t *testing.T, kind repo.ArchiveKind, processID string, ts time.Time) testDoc {
+	t.Helper()
+
+	doc, err := bson.Marshal(bson.D{{Key: "_id", Value: bson.NewObjectID()}, {Key: "pid", Value: processID}})
+	require.NoError(t, err)
+
+	return testDoc{kind: kind, processID: processID, ts: ts, doc: doc}
+}
+
+func TestArchiveAndRestore(t *testing.T) {
+	ctx := t.Context()
+	day1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s := &fakeStore{
+		docs: []testDoc{
+			newTestDoc(t, repo.ArchiveKindRawEvents, "p1", day1.Add(time.Hour)),
+			newTestDoc(t, repo.ArchiveKindStageExecutions, "p1", day1.Add(time.Hour*2)),
+			newTestDoc(t, repo.ArchiveKindRawEvents, "p2", day1.Add(day+time.Hour)),
+			// the day is not older than the threshold yet
+			newTestDoc(t, repo.ArchiveKindRawEvents, "p1", day1.Add(day*2+time.Hour)),
+		},
+		progress: map[string]time.Time{},
+		restored: map[repo.ArchiveKind][]bson.Raw{},
+	}
+	blobs := NewDirStore(t.TempDir())
+	now := day1.Add(day*3 + time.Hour*12)
+
+	archiver := NewArchiver(s, blobs, "archiver", day, func() time.Time { return now })
+
+	require.NoError(t, archiver.Archive(ctx))
+	assert.Equal(t, day1.Add(day*2), s.progress["archiver"])
+
+	keys, err := blobs.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"2025-01-01/manifest.json",
+		"2025-01-01/p1/raw_events.jsonl.zst",
+		"2025-01-01/p1/stage_executions.jsonl.zst",
+		"2025-01-02/manifest.json",
+		"2025-01-02/p2/raw_events.jsonl.zst",
+	}, keys)
+
+	// archived days are not archived again
+	require.NoError(t, archiver.Archive(ctx))
+	assert.Equal(t, day1.Add(day*2), s.progress["archiver"])
+
+	result, err := Restore(ctx, blobs, s, RestoreQuery{ProcessID: "p1"}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Days: 2, Files: 2, Documents: 2}, result)
+	assert.Equal(t, []bson.Raw{s.docs[0].doc}, s.restored[repo.ArchiveKindRawEvents])
+	assert.Equal(t, []bson.Raw{s.docs[1].doc}, s.restored[repo.ArchiveKindStageExecutions])
+
+	query := RestoreQuery{FromDay: "2025-01-02", Kinds: []repo.ArchiveKind{repo.ArchiveKindRawEvents}}
+
+	result, err = Restore(ctx, blobs, s, query, 10)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Days: 1, Files: 1, Documents: 1}, result)
+
+	require.NoError(t, blobs.Put(ctx, "2025-01-02/p2/raw_events.jsonl.zst", []byte("broken")))
+
+	_, err = Restore(ctx, blobs, s, RestoreQuery{}, 10)
+	require.ErrorIs(t, err, oerrs.ErrBadInput)
+}
@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+)
+
+// BlobStore keeps archive files by keys, keys are slash separated paths.
+type BlobStore interface {
+	// Put saves the data under the key, it replaces the existing data.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the data of the key or oerrs.ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns keys which start with the prefix in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// DirStore is a BlobStore which keeps files in a directory.
+type DirStore struct {
+	root string
+}
+
+func NewDirStore(root string) *DirStore {
+	return &DirStore{root: root}
+}
+
+// Put writes the data to a temporary file and renames it, so a reader never sees a partial file.
+func (s *DirStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := s.path(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o750)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	err = errors.Join(err, tmp.Close())
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return nil
+}
+
+func (s *DirStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, oerrs.NewTErrf(ctx, "no archive file %q: %w", key, oerrs.ErrNotFound)
+	}
+
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	return data, nil
+}
+
+func (s *DirStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var result []string
+
+	err := filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	slices.Sort(result)
+
+	return result, nil
+}
+
+// path returns the path of the key, keys must not point out of the root.
+func (s *DirStore) path(ctx context.Context, key string) (string, error) {
+	local := filepath.FromSlash(key)
+	if !filepath.IsLocal(local) {
+		return "", oerrs.NewTErrf(ctx, "invalid archive key %q: %w", key, oerrs.ErrBadInput)
+	}
+
+	return filepath.Join(s.root, local), nil
+}
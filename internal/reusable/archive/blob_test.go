@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"testing"
+
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirStore(t *testing.T) {
+	ctx := t.Context()
+	blobs := NewDirStore(t.TempDir())
+
+	keys, err := blobs.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	require.NoError(t, blobs.Put(ctx, "2025-01-02/p1/raw_events.jsonl.zst", []byte("b")))
+	require.NoError(t, blobs.Put(ctx, "2025-01-01/manifest.json", []byte("a")))
+	require.NoError(t, blobs.Put(ctx, "2025-01-01/manifest.json", []byte("c")))
+
+	data, err := blobs.Get(ctx, "2025-01-01/manifest.json")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("c"), data)
+
+	keys, err = blobs.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025-01-01/manifest.json", "2025-01-02/p1/raw_events.jsonl.zst"}, keys)
+
+	keys, err = blobs.List(ctx, "2025-01-02/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025-01-02/p1/raw_events.jsonl.zst"}, keys)
+
+	_, err = blobs.Get(ctx, "2025-01-03/manifest.json")
+	require.ErrorIs(t, err, oerrs.ErrNotFound)
+
+	_, err = blobs.Get(ctx, "../manifest.json")
+	require.ErrorIs(t, err, oerrs.ErrBadInput)
+}
+
+func TestEscapeKeySegment(t *testing.T) {
+	assert.Equal(t, "billing", escapeKeySegment("billing"))
+	assert.Equal(t, "%2E%2E", escapeKeySegment(".."))
+	assert.Equal(t, "a%2Fb", escapeKeySegment("a/b"))
+}
@@ -0,0 +1,105 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// jsonlWriter collects documents as zstd compressed JSON lines of canonical MongoDB Extended JSON,
+// so restored documents keep their BSON types.
+type jsonlWriter struct {
+	buf     bytes.Buffer
+	encoder *zstd.Encoder
+	count   int
+}
+
+func newJSONLWriter() (*jsonlWriter, error) {
+	w := &jsonlWriter{}
+
+	encoder, err := zstd.NewWriter(&w.buf, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	w.encoder = encoder
+
+	return w, nil
+}
+
+func (w *jsonlWriter) Write(doc bson.Raw) error {
+	line, err := bson.MarshalExtJSON(doc, true, false)
+	if err != nil {
+		return fmt.Errorf("failed to marshal document: %w", err)
+	}
+
+	_, err = w.encoder.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	w.count++
+
+	return nil
+}
+
+// Close finishes the compressed stream and returns it.
+func (w *jsonlWriter) Close() ([]byte, error) {
+	err := w.encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return w.buf.Bytes(), nil
+}
+
+// readJSONL calls action for every document of data written by jsonlWriter.
+func readJSONL(data []byte, action func(bson.Raw) error) error {
+	decoder, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+
+	defer decoder.Close()
+
+	reader := bufio.NewReader(decoder)
+
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return readErr
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			doc, err := parseJSONLine(line)
+			if err != nil {
+				return err
+			}
+
+			err = action(doc)
+			if err != nil {
+				return err
+			}
+		}
+
+		if readErr != nil {
+			return nil
+		}
+	}
+}
+
+func parseJSONLine(line []byte) (bson.Raw, error) {
+	var doc bson.D
+
+	err := bson.UnmarshalExtJSON(bytes.TrimSpace(line), true, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse document: %w", err)
+	}
+
+	return bson.Marshal(doc)
+}
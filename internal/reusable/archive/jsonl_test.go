@@ -0,0 +1,50 @@
+package archive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestJSONLRoundTrip(t *testing.T) {
+	docs := []bson.D{
+		{
+			{Key: "_id", Value: bson.NewObjectID()},
+			{Key: "ts", Value: bson.NewDateTimeFromTime(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))},
+			{Key: "n", Value: int64(1)},
+			{Key: "v", Value: 0.5},
+		},
+		{{Key: "_id", Value: "id"}, {Key: "s", Value: "line\nbreak"}},
+	}
+
+	writer, err := newJSONLWriter()
+	require.NoError(t, err)
+
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		require.NoError(t, err)
+		require.NoError(t, writer.Write(raw))
+	}
+
+	data, err := writer.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 2, writer.count)
+
+	var restored []bson.D
+
+	err = readJSONL(data, func(doc bson.Raw) error {
+		var result bson.D
+		require.NoError(t, bson.Unmarshal(doc, &result))
+
+		restored = append(restored, result)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// types are kept, e.g. int64 doesn't become a double
+	assert.Equal(t, docs, restored)
+}
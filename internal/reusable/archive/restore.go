@@ -0,0 +1,152 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// RestoreQuery selects archived files to restore, all fields are optional.
+type RestoreQuery struct {
+	// FromDay and ToDay (both inclusive, YYYY-MM-DD) limit archived days.
+	FromDay string
+	ToDay   string
+
+	ProcessID string
+	// Kinds are restored kinds, all kinds if it is empty.
+	Kinds []repo.ArchiveKind
+}
+
+func (q RestoreQuery) matchesDay(day string) bool {
+	return (len(q.FromDay) == 0 || day >= q.FromDay) && (len(q.ToDay) == 0 || day <= q.ToDay)
+}
+
+func (q RestoreQuery) matchesFile(file ManifestFile) bool {
+	return (len(q.ProcessID) == 0 || file.ProcessID == q.ProcessID) &&
+		(len(q.Kinds) == 0 || slices.Contains(q.Kinds, file.Kind))
+}
+
+type RestoreResult struct {
+	Days      int `json:"days"`
+	Files     int `json:"files"`
+	Documents int `json:"documents"`
+}
+
+type restoreStore interface {
+	RestoreArchiveDocuments(ctx context.Context, kind repo.ArchiveKind, docs []bson.Raw) error
+}
+
+// Restore loads the archived files matching the query into the store, days in order,
+// writing up to batchSize documents at once. A document which exists already is replaced.
+// Errors:
+// - oerrs.ErrBadInput: if a file doesn't match the checksum of its manifest.
+// - any error of the blobs or the store.
+func Restore(
+	ctx context.Context,
+	blobs BlobStore,
+	s restoreStore,
+	query RestoreQuery,
+	batchSize int,
+) (RestoreResult, error) {
+	var result RestoreResult
+
+	keys, err := blobs.List(ctx, "")
+	if err != nil {
+		return result, err
+	}
+
+	for _, key := range keys {
+		day, ok := strings.CutSuffix(key, "/"+manifestFileName)
+		if !ok || strings.Contains(day, "/") || !query.matchesDay(day) {
+			continue
+		}
+
+		manifest, err := loadManifest(ctx, blobs, key)
+		if err != nil {
+			return result, err
+		}
+
+		result.Days++
+
+		for _, file := range manifest.Files {
+			if !query.matchesFile(file) {
+				continue
+			}
+
+			documents, err := restoreFile(ctx, blobs, s, file, batchSize)
+			if err != nil {
+				return result, err
+			}
+
+			result.Files++
+			result.Documents += documents
+		}
+	}
+
+	return result, nil
+}
+
+func loadManifest(ctx context.Context, blobs BlobStore, key string) (Manifest, error) {
+	var manifest Manifest
+
+	data, err := blobs.Get(ctx, key)
+	if err != nil {
+		return manifest, err
+	}
+
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return manifest, oerrs.NewTErrf(ctx, "invalid manifest %q: %w: %w", key, err, oerrs.ErrBadInput)
+	}
+
+	return manifest, nil
+}
+
+func restoreFile(ctx context.Context, blobs BlobStore, s restoreStore, file ManifestFile, batchSize int) (int, error) {
+	data, err := blobs.Get(ctx, file.Key)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != file.SHA256 {
+		return 0, oerrs.NewTErrf(ctx, "checksum of %q doesn't match the manifest: %w", file.Key, oerrs.ErrBadInput)
+	}
+
+	documents := 0
+	batch := make([]bson.Raw, 0, batchSize)
+
+	flush := func() error {
+		err := s.RestoreArchiveDocuments(ctx, file.Kind, batch)
+		documents += len(batch)
+		batch = batch[:0]
+
+		return err
+	}
+
+	err = readJSONL(data, func(doc bson.Raw) error {
+		batch = append(batch, doc)
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return documents, oerrs.NewTErrf(ctx, "failed to restore %q: %w", file.Key, err)
+	}
+
+	err = flush()
+	if err != nil {
+		return documents, err
+	}
+
+	return documents, nil
+}
@@ -0,0 +1,348 @@
+// Package bundle converts executions to a portable JSONL bundle and back,
+// so executions can be copied between environments, e.g. from production to staging.
+//
+// Every line of a bundle is one Execution with its raw events and aggregates.
+// Payloads (input, output, failure and metadata) are relaxed MongoDB Extended JSON,
+// so their types survive the round trip.
+package bundle
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Execution is one line of a bundle.
+type Execution struct {
+	ProcessID   string `json:"processId"`
+	ExecutionID string `json:"executionId"`
+
+	// Aggregate is nil if the execution has no aggregate.
+	Aggregate       *ExecutionAggregate `json:"aggregate,omitempty"`
+	StageExecutions []StageExecution    `json:"stageExecutions"`
+	Events          []Event             `json:"events"`
+}
+
+type ExecutionAggregate struct {
+	WorkerID     string            `json:"workerId"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	FirstEventAt time.Time         `json:"firstEventAt"`
+	LastEventAt  time.Time         `json:"lastEventAt"`
+}
+
+type StageExecution struct {
+	StageExecutionID string `json:"stageExecutionId"`
+	WorkerID         string `json:"workerId"`
+	Stage            Stage  `json:"stage"`
+
+	Start   Event   `json:"start"`
+	Updates []Event `json:"updates,omitempty"`
+	// End is nil if the stage execution is not finished.
+	End *Event `json:"end,omitempty"`
+
+	IsFinished bool `json:"isFinished"`
+	IsSuccess  bool `json:"isSuccess"`
+
+	Metrics map[string]StageMetric `json:"metrics,omitempty"`
+	Labels  map[string]string      `json:"labels,omitempty"`
+}
+
+type StageMetric struct {
+	Last   float64   `json:"last"`
+	LastAt time.Time `json:"lastAt,omitzero"`
+	Sum    float64   `json:"sum"`
+	Count  int64     `json:"count"`
+	Unit   string    `json:"unit,omitempty"`
+}
+
+type Stage struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type Event struct {
+	ProcessID        string `json:"processId"`
+	ExecutionID      string `json:"executionId"`
+	StageExecutionID string `json:"stageExecutionId"`
+	WorkerID         string `json:"workerId"`
+
+	Stage  Stage            `json:"stage"`
+	Ts     time.Time        `json:"ts"`
+	Kind   repo.EventKind   `json:"kind"`
+	Status repo.EventStatus `json:"status"`
+
+	Input    json.RawMessage `json:"input,omitempty"`
+	Output   json.RawMessage `json:"output,omitempty"`
+	Failure  json.RawMessage `json:"failure,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	Metrics map[string]Metric `json:"metrics,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type Metric struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+// FromSnapshot converts a stored execution to its bundle line.
+func FromSnapshot(snapshot repo.ExecutionSnapshot) (Execution, error) {
+	result := Execution{
+		ProcessID:       snapshot.ProcessID,
+		ExecutionID:     snapshot.ExecutionID,
+		StageExecutions: make([]StageExecution, 0, len(snapshot.StageExecutions)),
+		Events:          make([]Event, 0, len(snapshot.Events)),
+	}
+
+	if aggregate := snapshot.Aggregate; aggregate != nil {
+		result.Aggregate = &ExecutionAggregate{
+			WorkerID:     aggregate.WorkerID,
+			Labels:       aggregate.Labels,
+			FirstEventAt: aggregate.FirstEventAt,
+			LastEventAt:  aggregate.LastEventAt,
+		}
+	}
+
+	for _, stage := range snapshot.StageExecutions {
+		converted, err := fromStageExecution(stage)
+		if err != nil {
+			return result, fmt.Errorf("stage execution %s: %w", stage.StageExecutionID, err)
+		}
+
+		result.StageExecutions = append(result.StageExecutions, converted)
+	}
+
+	for _, event := range snapshot.Events {
+		converted, err := fromEvent(event)
+		if err != nil {
+			return result, fmt.Errorf("raw event %s: %w", event.ID.Hex(), err)
+		}
+
+		result.Events = append(result.Events, converted)
+	}
+
+	return result, nil
+}
+
+func fromStageExecution(stage repo.SingleStageExecutionEvent) (StageExecution, error) {
+	result := StageExecution{
+		StageExecutionID: stage.StageExecutionID,
+		WorkerID:         stage.WorkerID,
+		Stage:            Stage{Name: stage.RawStage.Name, Description: stage.RawStage.Description},
+		IsFinished:       stage.IsFinished,
+		IsSuccess:        stage.IsSuccess,
+		Labels:           stage.Labels,
+	}
+
+	var err error
+
+	result.Start, err = fromEvent(stage.Start)
+	if err != nil {
+		return result, err
+	}
+
+	for _, update := range stage.Updates {
+		converted, err := fromEvent(update)
+		if err != nil {
+			return result, err
+		}
+
+		result.Updates = append(result.Updates, converted)
+	}
+
+	if !stage.End.Ts.IsZero() {
+		end, err := fromEvent(stage.End)
+		if err != nil {
+			return result, err
+		}
+
+		result.End = &end
+	}
+
+	if len(stage.Metrics) > 0 {
+		result.Metrics = make(map[string]StageMetric, len(stage.Metrics))
+
+		for name, metric := range stage.Metrics {
+			result.Metrics[name] = StageMetric(metric)
+		}
+	}
+
+	return result, nil
+}
+
+func fromEvent(event repo.Event) (Event, error) {
+	result := Event{
+		ProcessID:        event.ProcessID,
+		ExecutionID:      event.ExecutionID,
+		StageExecutionID: event.StageExecutionID,
+		WorkerID:         event.WorkerID,
+		Stage:            Stage{Name: event.Stage.Name, Description: event.Stage.Description},
+		Ts:               event.Ts,
+		Kind:             event.Kind,
+		Status:           event.Status,
+		Labels:           event.Labels,
+	}
+
+	var err error
+
+	for _, payload := range []struct {
+		name   string
+		input  bson.Raw
+		output *json.RawMessage
+	}{
+		{name: "input", input: event.Input, output: &result.Input},
+		{name: "output", input: event.Output, output: &result.Output},
+		{name: "failure", input: event.Failure, output: &result.Failure},
+		{name: "metadata", input: event.Metadata, output: &result.Metadata},
+	} {
+		*payload.output, err = mdb.BsonToJSON(payload.input)
+		if err != nil {
+			return result, fmt.Errorf("invalid %s: %w", payload.name, err)
+		}
+	}
+
+	if len(event.Metrics) > 0 {
+		result.Metrics = make(map[string]Metric, len(event.Metrics))
+
+		for name, metric := range event.Metrics {
+			result.Metrics[name] = Metric(metric)
+		}
+	}
+
+	return result, nil
+}
+
+// ToSnapshot converts a bundle line to the stored execution.
+func ToSnapshot(execution Execution) (repo.ExecutionSnapshot, error) {
+	result := repo.ExecutionSnapshot{
+		ProcessID:   execution.ProcessID,
+		ExecutionID: execution.ExecutionID,
+	}
+
+	if aggregate := execution.Aggregate; aggregate != nil {
+		result.Aggregate = &repo.ExecutionAggregate{
+			ProcessID:    execution.ProcessID,
+			ExecutionID:  execution.ExecutionID,
+			WorkerID:     aggregate.WorkerID,
+			Labels:       aggregate.Labels,
+			FirstEventAt: aggregate.FirstEventAt,
+			LastEventAt:  aggregate.LastEventAt,
+		}
+	}
+
+	for _, stage := range execution.StageExecutions {
+		converted, err := toStageExecution(execution, stage)
+		if err != nil {
+			return result, fmt.Errorf("stage execution %s: %w", stage.StageExecutionID, err)
+		}
+
+		result.StageExecutions = append(result.StageExecutions, converted)
+	}
+
+	for i, event := range execution.Events {
+		converted, err := toEvent(event)
+		if err == nil {
+			err = converted.Validate()
+		}
+
+		if err != nil {
+			return result, fmt.Errorf("raw event %d: %w", i, err)
+		}
+
+		result.Events = append(result.Events, converted)
+	}
+
+	return result, nil
+}
+
+func toStageExecution(execution Execution, stage StageExecution) (repo.SingleStageExecutionEvent, error) {
+	result := repo.SingleStageExecutionEvent{
+		ProcessID:        execution.ProcessID,
+		WorkerID:         stage.WorkerID,
+		ExecutionID:      execution.ExecutionID,
+		StageExecutionID: stage.StageExecutionID,
+		RawStage:         repo.RawStage{Name: stage.Stage.Name, Description: stage.Stage.Description},
+		IsFinished:       stage.IsFinished,
+		IsSuccess:        stage.IsSuccess,
+		Labels:           stage.Labels,
+	}
+
+	var err error
+
+	result.Start, err = toEvent(stage.Start)
+	if err != nil {
+		return result, err
+	}
+
+	for _, update := range stage.Updates {
+		converted, err := toEvent(update)
+		if err != nil {
+			return result, err
+		}
+
+		result.Updates = append(result.Updates, converted)
+	}
+
+	if stage.End != nil {
+		result.End, err = toEvent(*stage.End)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if len(stage.Metrics) > 0 {
+		result.Metrics = make(map[string]repo.StageMetric, len(stage.Metrics))
+
+		for name, metric := range stage.Metrics {
+			result.Metrics[name] = repo.StageMetric(metric)
+		}
+	}
+
+	return result, nil
+}
+
+func toEvent(event Event) (repo.Event, error) {
+	result := repo.Event{
+		ProcessID:        event.ProcessID,
+		ExecutionID:      event.ExecutionID,
+		StageExecutionID: event.StageExecutionID,
+		WorkerID:         event.WorkerID,
+		Stage:            repo.RawStage{Name: event.Stage.Name, Description: event.Stage.Description},
+		Ts:               event.Ts,
+		Kind:             event.Kind,
+		Status:           event.Status,
+		Labels:           event.Labels,
+	}
+
+	var err error
+
+	for _, payload := range []struct {
+		name   string
+		input  json.RawMessage
+		output *bson.Raw
+	}{
+		{name: "input", input: event.Input, output: &result.Input},
+		{name: "output", input: event.Output, output: &result.Output},
+		{name: "failure", input: event.Failure, output: &result.Failure},
+		{name: "metadata", input: event.Metadata, output: &result.Metadata},
+	} {
+		*payload.output, err = mdb.JSONtoBSON(payload.input)
+		if err != nil {
+			return result, fmt.Errorf("invalid %s: %w", payload.name, err)
+		}
+	}
+
+	if len(event.Metrics) > 0 {
+		result.Metrics = make(map[string]repo.Metric, len(event.Metrics))
+
+		for name, metric := range event.Metrics {
+			result.Metrics[name] = repo.Metric(metric)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	ts := time.Date(2025, 1, 31, 10, 0, 0, 0, time.UTC)
+
+	input, err := bson.Marshal(bson.D{
+		{Key: "id", Value: bson.NewObjectID()},
+		{Key: "at", Value: bson.NewDateTimeFromTime(ts)},
+		{Key: "rows", Value: int32(10)},
+		{Key: "ratio", Value: 0.5},
+		{Key: "tags", Value: bson.A{"a", bson.D{{Key: "b", Value: true}}}},
+	})
+	require.NoError(t, err)
+
+	start := repo.Event{
+		ProcessID:        "p1",
+		ExecutionID:      "e1",
+		StageExecutionID: "s1",
+		WorkerID:         "w1",
+		Stage:            repo.RawStage{Name: "stage_1"},
+		Ts:               ts,
+		Kind:             repo.EventKindStageStarted,
+		Input:            input,
+		Metrics:          map[string]repo.Metric{"rows": {Value: 10, Unit: "rows"}},
+		Labels:           map[string]string{"env": "prod"},
+	}
+
+	snapshot := repo.ExecutionSnapshot{
+		ProcessID:   "p1",
+		ExecutionID: "e1",
+		Aggregate: &repo.ExecutionAggregate{
+			ProcessID:    "p1",
+			ExecutionID:  "e1",
+			WorkerID:     "w1",
+			FirstEventAt: ts,
+			LastEventAt:  ts,
+		},
+		StageExecutions: []repo.SingleStageExecutionEvent{{
+			ProcessID:        "p1",
+			WorkerID:         "w1",
+			ExecutionID:      "e1",
+			StageExecutionID: "s1",
+			RawStage:         repo.RawStage{Name: "stage_1"},
+			Start:            start,
+			Metrics:          map[string]repo.StageMetric{"rows": {Last: 10, LastAt: ts, Sum: 10, Count: 1}},
+		}},
+		Events: []repo.Event{start},
+	}
+
+	execution, err := FromSnapshot(snapshot)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	require.NoError(t, NewWriter(&buf).Write(execution))
+
+	var restored []repo.ExecutionSnapshot
+
+	err = Read(context.Background(), &buf, func(_ context.Context, execution Execution) error {
+		snapshot, err := ToSnapshot(execution)
+		restored = append(restored, snapshot)
+
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, restored, 1)
+
+	// payload types survive the round trip
+	assert.Equal(t, snapshot, restored[0])
+}
+
+func TestToSnapshotValidatesRawEvents(t *testing.T) {
+	_, err := ToSnapshot(Execution{ProcessID: "p1", ExecutionID: "e1", Events: []Event{{ProcessID: "p1"}}})
+	require.Error(t, err)
+}
+
+func TestReadInvalidLine(t *testing.T) {
+	err := Read(context.Background(), bytes.NewBufferString("{}\nnot json\n"), func(context.Context, Execution) error {
+		return nil
+	})
+	require.ErrorContains(t, err, "invalid execution 2")
+}
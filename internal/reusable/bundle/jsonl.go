@@ -0,0 +1,47 @@
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/LastSprint/pipetank/pkg/common"
+)
+
+// Writer writes executions as lines of a bundle.
+type Writer struct {
+	encoder *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{encoder: json.NewEncoder(w)}
+}
+
+func (w *Writer) Write(execution Execution) error {
+	return w.encoder.Encode(execution)
+}
+
+// Read calls action for every execution of the bundle in order.
+func Read(ctx context.Context, r io.Reader, action common.CallbackFailable[Execution]) error {
+	decoder := json.NewDecoder(r)
+
+	for line := 1; ; line++ {
+		var execution Execution
+
+		err := decoder.Decode(&execution)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid execution %d of the bundle: %w", line, err)
+		}
+
+		err = action(ctx, execution)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package bundle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// anonymizedPrefix marks string values replaced by Transform.AnonymizeKey.
+const anonymizedPrefix = "anon:"
+
+// Transform changes executions on export or import, the zero value changes nothing.
+type Transform struct {
+	// ProcessIDs and WorkerIDs replace the keys by the values, other IDs are kept.
+	ProcessIDs map[string]string
+	WorkerIDs  map[string]string
+	// Shift is added to all timestamps.
+	Shift time.Duration
+	// AnonymizeKey, if set, replaces every string of every payload by its HMAC-SHA256 with the key,
+	// so equal strings stay equal, while the structure and values of other types are kept.
+	AnonymizeKey []byte
+}
+
+// Apply transforms the execution in place.
+func (t Transform) Apply(execution *Execution) error {
+	execution.ProcessID = remap(t.ProcessIDs, execution.ProcessID)
+
+	if aggregate := execution.Aggregate; aggregate != nil {
+		aggregate.WorkerID = remap(t.WorkerIDs, aggregate.WorkerID)
+		aggregate.FirstEventAt = t.shift(aggregate.FirstEventAt)
+		aggregate.LastEventAt = t.shift(aggregate.LastEventAt)
+	}
+
+	for i := range execution.StageExecutions {
+		err := t.applyStageExecution(&execution.StageExecutions[i])
+		if err != nil {
+			return fmt.Errorf("stage execution %s: %w", execution.StageExecutions[i].StageExecutionID, err)
+		}
+	}
+
+	for i := range execution.Events {
+		err := t.applyEvent(&execution.Events[i])
+		if err != nil {
+			return fmt.Errorf("raw event %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (t Transform) applyStageExecution(stage *StageExecution) error {
+	stage.WorkerID = remap(t.WorkerIDs, stage.WorkerID)
+
+	events := []*Event{&stage.Start}
+	if stage.End != nil {
+		events = append(events, stage.End)
+	}
+
+	for i := range stage.Updates {
+		events = append(events, &stage.Updates[i])
+	}
+
+	for _, event := range events {
+		err := t.applyEvent(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, metric := range stage.Metrics {
+		metric.LastAt = t.shift(metric.LastAt)
+		stage.Metrics[name] = metric
+	}
+
+	return nil
+}
+
+func (t Transform) applyEvent(event *Event) error {
+	event.ProcessID = remap(t.ProcessIDs, event.ProcessID)
+	event.WorkerID = remap(t.WorkerIDs, event.WorkerID)
+	event.Ts = t.shift(event.Ts)
+
+	if len(t.AnonymizeKey) == 0 {
+		return nil
+	}
+
+	for _, payload := range []*json.RawMessage{&event.Input, &event.Output, &event.Failure, &event.Metadata} {
+		anonymized, err := t.anonymizePayload(*payload)
+		if err != nil {
+			return err
+		}
+
+		*payload = anonymized
+	}
+
+	return nil
+}
+
+func (t Transform) shift(ts time.Time) time.Time {
+	if ts.IsZero() {
+		return ts
+	}
+
+	return ts.Add(t.Shift)
+}
+
+func remap(ids map[string]string, id string) string {
+	if mapped, ok := ids[id]; ok {
+		return mapped
+	}
+
+	return id
+}
+
+// anonymizePayload goes through BSON, so Extended JSON types of the payload are kept.
+func (t Transform) anonymizePayload(payload json.RawMessage) (json.RawMessage, error) {
+	doc, err := mdb.JSONtoBSON(payload)
+	if err != nil || len(doc) == 0 {
+		return payload, err
+	}
+
+	anonymized, err := t.anonymizeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := bson.Marshal(anonymized)
+	if err != nil {
+		return nil, err
+	}
+
+	return mdb.BsonToJSON(raw)
+}
+
+func (t Transform) anonymizeDocument(doc bson.Raw) (bson.D, error) {
+	elements, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(bson.D, 0, len(elements))
+
+	for _, element := range elements {
+		value, err := t.anonymizeValue(element.Value())
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, bson.E{Key: element.Key(), Value: value})
+	}
+
+	return result, nil
+}
+
+func (t Transform) anonymizeValue(value bson.RawValue) (any, error) {
+	switch value.Type { //nolint:exhaustive
+	case bson.TypeString:
+		mac := hmac.New(sha256.New, t.AnonymizeKey)
+		mac.Write([]byte(value.StringValue()))
+
+		return anonymizedPrefix + hex.EncodeToString(mac.Sum(nil)), nil
+	case bson.TypeEmbeddedDocument:
+		return t.anonymizeDocument(value.Document())
+	case bson.TypeArray:
+		values, err := value.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+
+		result := make(bson.A, 0, len(values))
+
+		for _, item := range values {
+			anonymized, err := t.anonymizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, anonymized)
+		}
+
+		return result, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,90 @@
+package bundle
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/pkg/mdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestTransformRemapsAndShifts(t *testing.T) {
+	ts := time.Date(2025, 1, 31, 10, 0, 0, 0, time.UTC)
+	event := Event{ProcessID: "p1", WorkerID: "w1", Ts: ts}
+	end := event
+
+	execution := Execution{
+		ProcessID: "p1",
+		Aggregate: &ExecutionAggregate{WorkerID: "w1", FirstEventAt: ts, LastEventAt: ts},
+		Events:    []Event{event, {ProcessID: "p1", WorkerID: "w2", Ts: ts}},
+		StageExecutions: []StageExecution{{
+			WorkerID: "w1",
+			Start:    event,
+			End:      &end,
+			Metrics:  map[string]StageMetric{"rows": {LastAt: ts}, "bytes": {}},
+		}},
+	}
+
+	transform := Transform{
+		ProcessIDs: map[string]string{"p1": "staging"},
+		WorkerIDs:  map[string]string{"w1": "worker"},
+		Shift:      time.Hour,
+	}
+
+	require.NoError(t, transform.Apply(&execution))
+
+	shifted := ts.Add(time.Hour)
+
+	assert.Equal(t, "staging", execution.ProcessID)
+	assert.Equal(t, ExecutionAggregate{WorkerID: "worker", FirstEventAt: shifted, LastEventAt: shifted},
+		*execution.Aggregate)
+	assert.Equal(t, Event{ProcessID: "staging", WorkerID: "worker", Ts: shifted}, execution.Events[0])
+	// unmapped IDs are kept
+	assert.Equal(t, "w2", execution.Events[1].WorkerID)
+
+	stage := execution.StageExecutions[0]
+	assert.Equal(t, "worker", stage.WorkerID)
+	assert.Equal(t, shifted, stage.Start.Ts)
+	assert.Equal(t, shifted, stage.End.Ts)
+	assert.Equal(t, shifted, stage.Metrics["rows"].LastAt)
+	// a missing time stays missing
+	assert.True(t, stage.Metrics["bytes"].LastAt.IsZero())
+}
+
+func TestTransformAnonymizesStrings(t *testing.T) {
+	id := bson.NewObjectID()
+
+	payload, err := bson.Marshal(bson.D{
+		{Key: "user", Value: "alice"},
+		{Key: "id", Value: id},
+		{Key: "rows", Value: int32(3)},
+		{Key: "nested", Value: bson.D{{Key: "owner", Value: "alice"}, {Key: "list", Value: bson.A{"bob", 1.5}}}},
+	})
+	require.NoError(t, err)
+
+	input, err := mdb.BsonToJSON(payload)
+	require.NoError(t, err)
+
+	execution := Execution{Events: []Event{{Input: input, Failure: json.RawMessage(nil)}}}
+
+	require.NoError(t, Transform{AnonymizeKey: []byte("key")}.Apply(&execution))
+	assert.Nil(t, execution.Events[0].Failure)
+
+	anonymized, err := mdb.JSONtoBSON(execution.Events[0].Input)
+	require.NoError(t, err)
+
+	user := anonymized.Lookup("user").StringValue()
+	assert.NotEqual(t, "alice", user)
+	assert.Contains(t, user, anonymizedPrefix)
+	// equal strings stay equal
+	assert.Equal(t, user, anonymized.Lookup("nested", "owner").StringValue())
+	assert.NotEqual(t, user, anonymized.Lookup("nested", "list", "0").StringValue())
+
+	// other values and their types are kept
+	assert.Equal(t, id, anonymized.Lookup("id").ObjectID())
+	assert.Equal(t, int32(3), anonymized.Lookup("rows").Int32())
+	assert.InDelta(t, 1.5, anonymized.Lookup("nested", "list", "1").Double(), 0)
+}
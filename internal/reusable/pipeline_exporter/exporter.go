@@ -0,0 +1,256 @@
+// Package pipelineexporter publishes Prometheus metrics of the pipelines themselves:
+// started and finished stage executions, finished executions, in-flight stage executions and stage durations.
+//
+// Counters and durations are driven by the change stream of stage executions, so they count transitions
+// which happened while the exporter runs. In-flight stage executions are counted in MongoDB periodically.
+package pipelineexporter
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"golang.org/x/sync/errgroup"
+)
+
+const subsystem = "pipeline"
+
+type store interface {
+	WatchStageExecutions(
+		ctx context.Context,
+		token bson.Raw,
+		action common.CallbackFailable[repo.StageExecutionWatchModel],
+	) error
+	CountExecutionStages(ctx context.Context, processID, executionID string) (repo.ExecutionStageCounts, error)
+	CountInFlightStageExecutions(ctx context.Context, labelKeys []string) ([]repo.InFlightStageExecutions, error)
+}
+
+type Exporter struct {
+	store   store
+	cfg     LabelsConfig
+	labeler *labeler
+
+	stagesStarted      *prometheus.CounterVec
+	stagesFinished     *prometheus.CounterVec
+	executionsFinished *prometheus.CounterVec
+	stageDuration      *prometheus.HistogramVec
+	inFlight           *inFlightCollector
+}
+
+// NewExporter creates an exporter and registers its collectors in the registerer.
+func NewExporter(
+	s store,
+	registerer prometheus.Registerer,
+	cfg LabelsConfig,
+	durationBuckets []float64,
+) (*Exporter, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	stageLabels := cfg.names(true)
+	executionLabels := cfg.names(false)
+
+	e := &Exporter{
+		store:   s,
+		cfg:     cfg,
+		labeler: newLabeler(cfg),
+
+		stagesStarted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: subsystem,
+			Name:      "stage_executions_started_total",
+			Help:      "Started stage executions.",
+		}, stageLabels),
+		stagesFinished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: subsystem,
+			Name:      "stage_executions_finished_total",
+			Help:      "Finished stage executions by status.",
+		}, slices.Concat(stageLabels, []string{labelStatus})),
+		executionsFinished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: subsystem,
+			Name:      "executions_finished_total",
+			Help:      "Finished executions by status, an execution is failed if any of its stages failed.",
+		}, slices.Concat(executionLabels, []string{labelStatus})),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: subsystem,
+			Name:      "stage_execution_duration_seconds",
+			Help:      "Duration of finished stage executions by status.",
+			Buckets:   durationBuckets,
+		}, slices.Concat(stageLabels, []string{labelStatus})),
+		inFlight: newInFlightCollector(prometheus.NewDesc(
+			prometheus.BuildFQName(metrics.Namespace, subsystem, "stage_executions_in_flight"),
+			"Stage executions which are started but not finished yet.",
+			stageLabels,
+			nil,
+		)),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		e.stagesStarted,
+		e.stagesFinished,
+		e.executionsFinished,
+		e.stageDuration,
+		e.inFlight,
+	} {
+		err = registerer.Register(collector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// Run watches stage executions and refreshes in-flight stage executions every inFlightPeriod
+// until the context is done or the change stream fails.
+func (e *Exporter) Run(ctx context.Context, inFlightPeriod time.Duration) error {
+	group, ctx := errgroup.WithContext(ctx)
+
+	group.Go(func() error {
+		return e.store.WatchStageExecutions(ctx, nil, e.handleChange)
+	})
+
+	group.Go(func() error {
+		ticker := time.NewTicker(inFlightPeriod)
+		defer ticker.Stop()
+
+		for {
+			err := e.refreshInFlight(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "failed to count in-flight stage executions", slog.Any("error", err))
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	})
+
+	return group.Wait()
+}
+
+func (e *Exporter) handleChange(ctx context.Context, change repo.StageExecutionWatchModel) error {
+	stage := change.Record
+
+	if !e.cfg.exported(stage.ProcessID) {
+		return nil
+	}
+
+	labels := e.labeler.values(stage.ProcessID, stage.RawStage.Name, stage.Labels, true)
+
+	if change.Started() {
+		e.stagesStarted.WithLabelValues(labels...).Inc()
+	}
+
+	if !change.Finished() {
+		return nil
+	}
+
+	status := statusOf(stage.IsSuccess)
+	labels = append(labels, status)
+
+	e.stagesFinished.WithLabelValues(labels...).Inc()
+
+	if !stage.Start.Ts.IsZero() && !stage.End.Ts.IsZero() {
+		e.stageDuration.WithLabelValues(labels...).Observe(stage.End.Ts.Sub(stage.Start.Ts).Seconds())
+	}
+
+	counts, err := e.store.CountExecutionStages(ctx, stage.ProcessID, stage.ExecutionID)
+	if err != nil {
+		return err
+	}
+
+	if counts.IsFinished() {
+		executionLabels := e.labeler.values(stage.ProcessID, "", stage.Labels, false)
+		e.executionsFinished.WithLabelValues(append(executionLabels, statusOf(counts.Failed == 0))...).Inc()
+	}
+
+	return nil
+}
+
+func (e *Exporter) refreshInFlight(ctx context.Context) error {
+	counts, err := e.store.CountInFlightStageExecutions(ctx, e.cfg.ExecutionLabels)
+	if err != nil {
+		return err
+	}
+
+	snapshot := map[string]inFlightSeries{}
+
+	for _, count := range counts {
+		if !e.cfg.exported(count.ProcessID) {
+			continue
+		}
+
+		labels := e.labeler.values(count.ProcessID, count.StageName, count.Labels, true)
+		key := strings.Join(labels, "\x00")
+
+		series := snapshot[key]
+		series.labels = labels
+		series.value += float64(count.Count)
+		snapshot[key] = series
+	}
+
+	e.inFlight.set(snapshot)
+
+	return nil
+}
+
+func statusOf(isSuccess bool) string {
+	if isSuccess {
+		return statusSuccess
+	}
+
+	return statusFailure
+}
+
+type inFlightSeries struct {
+	labels []string
+	value  float64
+}
+
+// inFlightCollector exposes the last counted snapshot, so a scrape never sees a partially updated gauge.
+type inFlightCollector struct {
+	desc *prometheus.Desc
+
+	mu       sync.RWMutex
+	snapshot map[string]inFlightSeries
+}
+
+func newInFlightCollector(desc *prometheus.Desc) *inFlightCollector {
+	return &inFlightCollector{desc: desc}
+}
+
+func (c *inFlightCollector) set(snapshot map[string]inFlightSeries) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.snapshot = snapshot
+}
+
+func (c *inFlightCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *inFlightCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, series := range c.snapshot {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, series.value, series.labels...)
+	}
+}
@@ -0,0 +1,141 @@
+package pipelineexporter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type fakeStore struct {
+	counts   repo.ExecutionStageCounts
+	inFlight []repo.InFlightStageExecutions
+}
+
+func (s *fakeStore) WatchStageExecutions(
+	context.Context,
+	bson.Raw,
+	common.CallbackFailable[repo.StageExecutionWatchModel],
+) error {
+	return nil
+}
+
+func (s *fakeStore) CountExecutionStages(context.Context, string, string) (repo.ExecutionStageCounts, error) {
+	return s.counts, nil
+}
+
+func (s *fakeStore) CountInFlightStageExecutions(context.Context, []string) ([]repo.InFlightStageExecutions, error) {
+	return s.inFlight, nil
+}
+
+func finishedChange(processID, stageName string, isSuccess bool) repo.StageExecutionWatchModel {
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	return repo.StageExecutionWatchModel{
+		Record: repo.SingleStageExecutionEvent{
+			ProcessID:   processID,
+			ExecutionID: "e1",
+			RawStage:    repo.RawStage{Name: stageName},
+			Start:       repo.Event{Ts: start},
+			End:         repo.Event{Ts: start.Add(90 * time.Second)},
+			IsFinished:  true,
+			IsSuccess:   isSuccess,
+			Labels:      map[string]string{"env": "prod"},
+		},
+		Inserted: true,
+	}
+}
+
+func TestExporterCountsTransitions(t *testing.T) {
+	store := &fakeStore{counts: repo.ExecutionStageCounts{Total: 2, Finished: 2, Failed: 1}}
+	registry := prometheus.NewRegistry()
+
+	exporter, err := NewExporter(
+		store,
+		registry,
+		LabelsConfig{Process: true, Stage: true, ExecutionLabels: []string{"env"}},
+		[]float64{60, 120},
+	)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	require.NoError(t, exporter.handleChange(ctx, finishedChange("p1", "build", false)))
+	require.NoError(t, exporter.handleChange(ctx, repo.StageExecutionWatchModel{
+		Record:        finishedChange("p1", "build", false).Record,
+		UpdatedFields: []string{"u"},
+	}))
+
+	expected := `
+# HELP pipetank_pipeline_stage_executions_finished_total Finished stage executions by status.
+# TYPE pipetank_pipeline_stage_executions_finished_total counter
+pipetank_pipeline_stage_executions_finished_total{label_env="prod",process="p1",stage="build",status="failure"} 1
+# HELP pipetank_pipeline_stage_executions_started_total Started stage executions.
+# TYPE pipetank_pipeline_stage_executions_started_total counter
+pipetank_pipeline_stage_executions_started_total{label_env="prod",process="p1",stage="build"} 1
+# HELP pipetank_pipeline_executions_finished_total Finished executions by status, an execution is failed if any of its stages failed.
+# TYPE pipetank_pipeline_executions_finished_total counter
+pipetank_pipeline_executions_finished_total{label_env="prod",process="p1",status="failure"} 1
+`
+
+	require.NoError(t, testutil.GatherAndCompare(
+		registry,
+		strings.NewReader(expected),
+		"pipetank_pipeline_stage_executions_finished_total",
+		"pipetank_pipeline_stage_executions_started_total",
+		"pipetank_pipeline_executions_finished_total",
+	))
+
+	assert.Equal(t, 1, testutil.CollectAndCount(exporter.stageDuration))
+}
+
+func TestExporterLimitsCardinality(t *testing.T) {
+	store := &fakeStore{
+		inFlight: []repo.InFlightStageExecutions{
+			{ProcessID: "p1", StageName: "a", Count: 1},
+			{ProcessID: "p1", StageName: "b", Count: 2},
+			{ProcessID: "p1", StageName: "c", Count: 3},
+			{ProcessID: "p2", StageName: "a", Count: 4},
+		},
+	}
+	registry := prometheus.NewRegistry()
+
+	exporter, err := NewExporter(
+		store,
+		registry,
+		LabelsConfig{Stage: true, MaxValuesPerLabel: 2, Processes: []string{"p1"}},
+		prometheus.DefBuckets,
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, exporter.refreshInFlight(context.Background()))
+
+	expected := `
+# HELP pipetank_pipeline_stage_executions_in_flight Stage executions which are started but not finished yet.
+# TYPE pipetank_pipeline_stage_executions_in_flight gauge
+pipetank_pipeline_stage_executions_in_flight{stage="__other__"} 3
+pipetank_pipeline_stage_executions_in_flight{stage="a"} 1
+pipetank_pipeline_stage_executions_in_flight{stage="b"} 2
+`
+
+	require.NoError(t, testutil.GatherAndCompare(
+		registry,
+		strings.NewReader(expected),
+		"pipetank_pipeline_stage_executions_in_flight",
+	))
+}
+
+func TestLabelsConfigValidate(t *testing.T) {
+	assert.NoError(t, LabelsConfig{ExecutionLabels: []string{"env", "team"}}.Validate())
+	assert.ErrorContains(t, LabelsConfig{ExecutionLabels: []string{"a-b", "a_b"}}.Validate(), "both exported as")
+	assert.Error(t, LabelsConfig{ExecutionLabels: []string{"a.b"}}.Validate())
+	assert.Error(t, LabelsConfig{MaxValuesPerLabel: -1}.Validate())
+}
@@ -0,0 +1,155 @@
+package pipelineexporter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+)
+
+const (
+	labelProcess = "process"
+	labelStage   = "stage"
+	labelStatus  = "status"
+
+	executionLabelPrefix = "label_"
+
+	// OtherValue replaces values of a label which exceed LabelsConfig.MaxValuesPerLabel.
+	OtherValue = "__other__"
+
+	statusSuccess = "success"
+	statusFailure = "failure"
+)
+
+var invalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// LabelsConfig controls labels of exported series and so their cardinality.
+type LabelsConfig struct {
+	// Process and Stage enable `process` and `stage` labels.
+	Process bool
+	Stage   bool
+	// ExecutionLabels are keys of execution labels (repo.Event.Labels) exported as `label_<key>`.
+	ExecutionLabels []string
+	// MaxValuesPerLabel limits the number of distinct values of every label,
+	// values seen after the limit is reached are exported as OtherValue. Zero means no limit.
+	MaxValuesPerLabel int
+	// Processes is an optional allow list, stage executions of other processes are not exported.
+	Processes []string
+}
+
+func (c LabelsConfig) Validate() error {
+	var err error
+
+	if c.MaxValuesPerLabel < 0 {
+		err = errors.Join(err, errors.New("max values per label must not be negative"))
+	}
+
+	names := map[string]string{}
+
+	for _, key := range c.ExecutionLabels {
+		keyErr := repo.ValidateLabelKey(key)
+		if keyErr != nil {
+			err = errors.Join(err, keyErr)
+			continue
+		}
+
+		name := executionLabelName(key)
+		if other, ok := names[name]; ok {
+			err = errors.Join(err, fmt.Errorf("labels %q and %q are both exported as %q", other, key, name))
+		}
+
+		names[name] = key
+	}
+
+	return err
+}
+
+func (c LabelsConfig) exported(processID string) bool {
+	return len(c.Processes) == 0 || slices.Contains(c.Processes, processID)
+}
+
+// names returns names of the configured labels in the order of values returned by labeler.values.
+func (c LabelsConfig) names(withStage bool) []string {
+	var result []string
+
+	if c.Process {
+		result = append(result, labelProcess)
+	}
+
+	if c.Stage && withStage {
+		result = append(result, labelStage)
+	}
+
+	for _, key := range c.ExecutionLabels {
+		result = append(result, executionLabelName(key))
+	}
+
+	return result
+}
+
+func executionLabelName(key string) string {
+	return executionLabelPrefix + invalidLabelNameChars.ReplaceAllString(key, "_")
+}
+
+// labeler maps stage executions to label values and enforces LabelsConfig.MaxValuesPerLabel.
+type labeler struct {
+	cfg LabelsConfig
+
+	mu   sync.Mutex
+	seen map[string]map[string]struct{}
+}
+
+func newLabeler(cfg LabelsConfig) *labeler {
+	return &labeler{
+		cfg:  cfg,
+		seen: map[string]map[string]struct{}{},
+	}
+}
+
+func (l *labeler) values(processID, stageName string, labels map[string]string, withStage bool) []string {
+	var result []string
+
+	if l.cfg.Process {
+		result = append(result, l.limit(labelProcess, processID))
+	}
+
+	if l.cfg.Stage && withStage {
+		result = append(result, l.limit(labelStage, stageName))
+	}
+
+	for _, key := range l.cfg.ExecutionLabels {
+		result = append(result, l.limit(executionLabelName(key), labels[key]))
+	}
+
+	return result
+}
+
+func (l *labeler) limit(name, value string) string {
+	if l.cfg.MaxValuesPerLabel == 0 {
+		return value
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seen, ok := l.seen[name]
+	if !ok {
+		seen = map[string]struct{}{}
+		l.seen[name] = seen
+	}
+
+	if _, ok := seen[value]; ok {
+		return value
+	}
+
+	if len(seen) >= l.cfg.MaxValuesPerLabel {
+		return OtherValue
+	}
+
+	seen[value] = struct{}{}
+
+	return value
+}
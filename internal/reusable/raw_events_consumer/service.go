@@ -7,29 +7,19 @@ package raweventsconsumer
 
 import (
 	"context"
-	"errors"
+	"maps"
 	"slices"
 
 	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type store interface {
-	StartSingleStageExecution(
-		ctx context.Context,
-		event repo.SingleStageExecutionEvent,
-	) error
-
-	UpdateSingleStageExecution(
-		ctx context.Context,
-		processID, executionID, stageExecutionID string,
-		events []repo.Event,
-	) error
-
-	FinishSingleStageExecution(
-		ctx context.Context,
-		event repo.Event,
-		isSuccess bool,
-	) error
+	// WriteAggregates applies the writes in the given order in one round trip,
+	// failed writes are reported as repo.AggregateWriteError.
+	WriteAggregates(ctx context.Context, writes []repo.AggregateWrite) error
 }
 
 type Service struct {
@@ -47,95 +37,90 @@ func NewService(store store) *Service {
 //
 // It is done this way to save some CPU cycles, improve cache and avoid unnecessary allocations
 // (because you have to map events from your source to repo.Event anyway).
+//
+// All aggregates of the batch are written at once, repo.FailedEvents returns events of the failed writes.
 func (s *Service) HandleEvents(
 	ctx context.Context,
 	events []repo.Event,
-) error {
+) (err error) {
 	if len(events) == 0 {
 		return nil
 	}
 
-	ne := normalizeEvents(events)
+	ctx, span := tracing.Tracer().Start(
+		ctx,
+		"raweventsconsumer.HandleEvents",
+		trace.WithAttributes(attribute.Int("pipetank.events.count", len(events))),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	writes := aggregateWrites(normalizeEvents(events))
+
+	span.SetAttributes(attribute.Int("pipetank.writes.count", len(writes)))
+
+	return s.store.WriteAggregates(ctx, writes)
+}
 
-	var errs error
+// aggregateWrites returns writes of all aggregates of the events:
+// a merge of the execution and a merge of every stage execution of it. Every event is in one write,
+// so a failed batch reports it once.
+func aggregateWrites(ne normalizedEvents) []repo.AggregateWrite {
+	var writes []repo.AggregateWrite
 
 	for processID, executions := range ne {
 		for executionID, stages := range executions {
+			writes = append(writes, repo.MergeExecutionWrite(executionAggregate(processID, executionID, stages)))
+
 			for _, stageExecutions := range stages {
-				for stageExecutionID, events := range stageExecutions {
-					err := s.actOnEvents(ctx, events, processID, executionID, stageExecutionID)
-					if err != nil {
-						errs = errors.Join(errs, err)
-					}
+				for _, events := range stageExecutions {
+					writes = append(writes, repo.MergeStageExecutionWrite(events))
 				}
 			}
 		}
 	}
 
-	return errs
+	return writes
 }
 
-func (s *Service) actOnEvents(
-	ctx context.Context,
-	events []repo.Event,
+// executionAggregate folds events of all stages of one execution into repo.ExecutionAggregate.
+func executionAggregate(
 	processID processID,
 	executionID executionID,
-	stageExecutionID stageExecutionID,
-) error {
-	updatesToSave := make([]repo.Event, 0)
-	needToEndEvent := false
-	var endingEvent repo.Event
+	stages map[stageName]map[stageExecutionID][]repo.Event,
+) repo.ExecutionAggregate {
+	events := make([]repo.Event, 0)
+	for _, stageExecutions := range stages {
+		for _, stageEvents := range stageExecutions {
+			events = append(events, stageEvents...)
+		}
+	}
+
+	slices.SortFunc(events, func(a, b repo.Event) int {
+		return a.Ts.Compare(b.Ts)
+	})
 
-	var errs error
+	result := repo.ExecutionAggregate{
+		ProcessID:    processID,
+		ExecutionID:  executionID,
+		FirstEventAt: events[0].Ts,
+		LastEventAt:  events[len(events)-1].Ts,
+	}
 
 	for _, event := range events {
-		switch event.Kind {
-		case repo.EventKindStageStarted:
-			err := s.store.StartSingleStageExecution(
-				ctx,
-				repo.SingleStageExecutionEvent{
-					ProcessID:        event.ProcessID,
-					ExecutionID:      event.ExecutionID,
-					StageExecutionID: event.StageExecutionID,
-					RawStage:         event.Stage,
-					Start:            event,
-				},
-			)
-			if err != nil {
-				errs = errors.Join(errs, err)
-			}
+		result.WorkerID = event.WorkerID
 
-		case repo.EventKindStageFinished:
-			endingEvent = event
-			needToEndEvent = true
-		case repo.EventKindGenericUpdate:
-			updatesToSave = append(updatesToSave, event)
+		if len(event.Labels) == 0 {
+			continue
 		}
-	}
 
-	if len(updatesToSave) > 0 {
-		err := s.store.UpdateSingleStageExecution(
-			ctx,
-			processID, executionID, stageExecutionID,
-			updatesToSave,
-		)
-		if err != nil {
-			errs = errors.Join(errs, err)
+		if result.Labels == nil {
+			result.Labels = map[string]string{}
 		}
-	}
 
-	if needToEndEvent {
-		err := s.store.FinishSingleStageExecution(
-			ctx,
-			endingEvent,
-			endingEvent.Kind == repo.EventKindStageFinished,
-		)
-		if err != nil {
-			errs = errors.Join(errs, err)
-		}
+		maps.Copy(result.Labels, event.Labels)
 	}
 
-	return errs
+	return result
 }
 
 type (
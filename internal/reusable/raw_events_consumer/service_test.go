@@ -0,0 +1,112 @@
+package raweventsconsumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/memory"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvent(executionID, stageExecutionID string, kind repo.EventKind, ts time.Time) repo.Event {
+	return repo.Event{
+		ProcessID:        "p1",
+		ExecutionID:      executionID,
+		StageExecutionID: stageExecutionID,
+		WorkerID:         "w1",
+		Stage:            repo.RawStage{Name: stageExecutionID},
+		Ts:               ts,
+		Kind:             kind,
+	}
+}
+
+func TestAggregateWrites(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// events of a batch come in any order
+	events := []repo.Event{
+		testEvent("e1", "s1", repo.EventKindStageFinished, ts.Add(time.Second*3)),
+		testEvent("e1", "s1", repo.EventKindGenericUpdate, ts.Add(time.Second*2)),
+		testEvent("e1", "s1", repo.EventKindStageStarted, ts),
+		testEvent("e1", "s1", repo.EventKindGenericUpdate, ts.Add(time.Second)),
+		testEvent("e2", "s1", repo.EventKindGenericUpdate, ts),
+	}
+
+	writes := aggregateWrites(normalizeEvents(events))
+	require.Len(t, writes, 4)
+
+	byExecution := map[string][]repo.AggregateWrite{}
+	writtenEvents := 0
+
+	for _, write := range writes {
+		executionID := write.Execution.ExecutionID
+		if write.Kind == repo.AggregateWriteMergeStageExecution {
+			executionID = write.Events[0].ExecutionID
+		}
+
+		byExecution[executionID] = append(byExecution[executionID], write)
+		writtenEvents += len(write.Events)
+	}
+
+	// every event is in one write, so a failed batch reports it once
+	assert.Equal(t, len(events), writtenEvents)
+
+	e1 := byExecution["e1"]
+	require.Len(t, e1, 2)
+
+	assert.Equal(t, repo.AggregateWriteMergeExecution, e1[0].Kind)
+	assert.Equal(t, ts, e1[0].Execution.FirstEventAt)
+	assert.Equal(t, ts.Add(time.Second*3), e1[0].Execution.LastEventAt)
+	assert.Empty(t, e1[0].Events)
+
+	assert.Equal(t, repo.AggregateWriteMergeStageExecution, e1[1].Kind)
+	require.Len(t, e1[1].Events, 4)
+
+	for i, event := range e1[1].Events {
+		assert.Equal(t, ts.Add(time.Second*time.Duration(i)), event.Ts)
+	}
+
+	e2 := byExecution["e2"]
+	require.Len(t, e2, 2)
+	assert.Equal(t, repo.AggregateWriteMergeExecution, e2[0].Kind)
+	assert.Equal(t, repo.AggregateWriteMergeStageExecution, e2[1].Kind)
+}
+
+func TestHandleEventsInAnyOrder(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	events := []repo.Event{
+		testEvent("e1", "s1", repo.EventKindStageStarted, ts),
+		testEvent("e1", "s1", repo.EventKindGenericUpdate, ts.Add(time.Second)),
+		testEvent("e1", "s1", repo.EventKindStageFinished, ts.Add(time.Second*2)),
+	}
+
+	inOrder := memory.New(utils.UTCClock())
+	require.NoError(t, NewService(inOrder).HandleEvents(t.Context(), events))
+
+	// the finish comes first and the start is redelivered
+	reordered := memory.New(utils.UTCClock())
+	for _, batch := range [][]repo.Event{events[2:], events[:2], events[:1]} {
+		require.NoError(t, NewService(reordered).HandleEvents(t.Context(), batch))
+	}
+
+	expected, err := inOrder.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+
+	actual, err := reordered.GetSingleStageExecution(t.Context(), "p1", "e1", "s1")
+	require.NoError(t, err)
+
+	expected.UpdatedAt, actual.UpdatedAt = time.Time{}, time.Time{}
+	assert.Equal(t, expected, actual)
+	assert.True(t, actual.IsFinished)
+	assert.Len(t, actual.Updates, 1)
+
+	executions, err := reordered.ListExecutions(t.Context(), repo.ExecutionsQuery{ProcessID: "p1"})
+	require.NoError(t, err)
+	require.Len(t, executions, 1)
+	assert.Equal(t, ts, executions[0].FirstEventAt)
+	assert.Equal(t, ts.Add(time.Second*2), executions[0].LastEventAt)
+}
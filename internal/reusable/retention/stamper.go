@@ -0,0 +1,81 @@
+// Package retention applies changed retention policies to documents which are stored already.
+package retention
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/utils"
+)
+
+type store interface {
+	ListRetentionPolicies(ctx context.Context) ([]repo.RetentionPolicy, error)
+	StampRetentionPolicy(ctx context.Context, policy repo.RetentionPolicy) (int64, error)
+}
+
+type Stamper struct {
+	store store
+	clock utils.Clock
+}
+
+func NewStamper(s store, clock utils.Clock) *Stamper {
+	return &Stamper{store: s, clock: clock}
+}
+
+// Run stamps changed policies every period.
+func (s *Stamper) Run(ctx context.Context, period time.Duration) error {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		err := s.Stamp(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to stamp retention policies", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stamp stamps documents of every policy which changed at least repo.RetentionRefreshPeriod ago,
+// so all writers use the changed policy already.
+func (s *Stamper) Stamp(ctx context.Context) error {
+	policies, err := s.store.ListRetentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+
+	settledBefore := s.clock().Add(-repo.RetentionRefreshPeriod)
+
+	var errs error
+
+	for _, policy := range policies {
+		if policy.IsStamped() || policy.UpdatedAt.After(settledBefore) {
+			continue
+		}
+
+		modified, err := s.store.StampRetentionPolicy(ctx, policy)
+		if err != nil {
+			// a failed policy doesn't block the others, it is stamped again on the next run
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		slog.InfoContext(
+			ctx,
+			"stamped retention policy",
+			slog.String("process_id", policy.ProcessID),
+			slog.Bool("deleted", policy.Deleted),
+			slog.Int64("documents", modified),
+		)
+	}
+
+	return errs
+}
@@ -0,0 +1,55 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStore struct {
+	policies []repo.RetentionPolicy
+	stamped  []string
+	failing  string
+}
+
+func (s *fakeStore) ListRetentionPolicies(context.Context) ([]repo.RetentionPolicy, error) {
+	return s.policies, nil
+}
+
+func (s *fakeStore) StampRetentionPolicy(_ context.Context, policy repo.RetentionPolicy) (int64, error) {
+	if policy.ProcessID == s.failing {
+		return 0, errors.New("failed")
+	}
+
+	s.stamped = append(s.stamped, policy.ProcessID)
+
+	return 1, nil
+}
+
+func TestStampSettledPolicies(t *testing.T) {
+	now := time.Date(2025, 1, 31, 10, 0, 0, 0, time.UTC)
+	settled := now.Add(-repo.RetentionRefreshPeriod)
+
+	store := &fakeStore{
+		policies: []repo.RetentionPolicy{
+			{ProcessID: "", UpdatedAt: settled},
+			{ProcessID: "stamped", UpdatedAt: settled, StampedAt: settled},
+			// writers may still use the previous version
+			{ProcessID: "recent", UpdatedAt: now.Add(-time.Second)},
+			{ProcessID: "failing", UpdatedAt: settled},
+			{ProcessID: "deleted", UpdatedAt: settled, StampedAt: settled.Add(-time.Hour), Deleted: true},
+		},
+		failing: "failing",
+	}
+
+	err := NewStamper(store, func() time.Time { return now }).Stamp(context.Background())
+	require.Error(t, err)
+
+	// a failed policy doesn't block the following ones
+	assert.Equal(t, []string{"", "deleted"}, store.stamped)
+}
@@ -0,0 +1,283 @@
+// Package traceexporter exports finished executions as OpenTelemetry traces.
+//
+// An execution becomes one trace with a root span of the execution and a child span per stage execution,
+// timed by Start.Ts and End.Ts. Updates of a stage execution become span events.
+// Trace and span IDs are derived from the execution and stage execution IDs,
+// so an execution which is exported twice (e.g. after a restart) produces the same trace.
+package traceexporter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/LastSprint/pipetank/trace_exporter"
+
+type store interface {
+	LoadChangeStreamToken(ctx context.Context, key string) (bson.Raw, error)
+	SaveChangeStreamToken(ctx context.Context, key string, token bson.Raw) error
+	WatchStageExecutions(
+		ctx context.Context,
+		token bson.Raw,
+		action common.CallbackFailable[repo.StageExecutionWatchModel],
+	) error
+	CountExecutionStages(ctx context.Context, processID, executionID string) (repo.ExecutionStageCounts, error)
+	ListStageExecutions(ctx context.Context, query repo.StageExecutionsQuery) ([]repo.SingleStageExecutionEvent, error)
+}
+
+type Exporter struct {
+	store    store
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	tokenKey string
+}
+
+// NewExporter creates an exporter which sends traces to the spanExporter
+// and saves its change stream token under tokenKey.
+func NewExporter(
+	s store,
+	spanExporter sdktrace.SpanExporter,
+	res *resource.Resource,
+	tokenKey string,
+) *Exporter {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithIDGenerator(idGenerator{}),
+	)
+
+	return &Exporter{
+		store:    s,
+		provider: provider,
+		tracer:   provider.Tracer(instrumentationName),
+		tokenKey: tokenKey,
+	}
+}
+
+// Run watches stage executions from the saved token (or from now, if there is no token)
+// and exports every execution once its last stage execution finishes.
+func (e *Exporter) Run(ctx context.Context) error {
+	token, err := e.store.LoadChangeStreamToken(ctx, e.tokenKey)
+	if err != nil && !errors.Is(err, oerrs.ErrNotFound) {
+		return err
+	}
+
+	return e.store.WatchStageExecutions(ctx, token, e.handleChange)
+}
+
+// Shutdown exports buffered spans and stops the exporter.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	return e.provider.Shutdown(ctx)
+}
+
+// handleChange saves the token only after an execution is exported,
+// changes replayed after a restart are exported again with the same IDs.
+func (e *Exporter) handleChange(ctx context.Context, change repo.StageExecutionWatchModel) error {
+	if !change.Finished() {
+		return nil
+	}
+
+	stage := change.Record
+
+	counts, err := e.store.CountExecutionStages(ctx, stage.ProcessID, stage.ExecutionID)
+	if err != nil {
+		return err
+	}
+
+	if !counts.IsFinished() {
+		return nil
+	}
+
+	err = e.ExportExecution(ctx, stage.ProcessID, stage.ExecutionID)
+	if err != nil {
+		return err
+	}
+
+	return e.store.SaveChangeStreamToken(ctx, e.tokenKey, change.Token.ResumeToken())
+}
+
+// ExportExecution exports all stage executions of the execution as one trace and waits until it is sent.
+func (e *Exporter) ExportExecution(ctx context.Context, processID, executionID string) error {
+	stages, err := e.store.ListStageExecutions(ctx, repo.StageExecutionsQuery{
+		ProcessID:   processID,
+		ExecutionID: executionID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(stages) == 0 {
+		return nil
+	}
+
+	e.exportExecution(ctx, processID, executionID, stages)
+
+	err = e.provider.ForceFlush(ctx)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	slog.InfoContext(
+		ctx,
+		"execution exported",
+		slog.String("process_id", processID),
+		slog.String("execution_id", executionID),
+		slog.String("trace_id", executionTraceID(processID, executionID).String()),
+		slog.Int("stages", len(stages)),
+	)
+
+	return nil
+}
+
+func (e *Exporter) exportExecution(
+	ctx context.Context,
+	processID, executionID string,
+	stages []repo.SingleStageExecutionEvent,
+) {
+	var start, end time.Time
+	isSuccess := true
+	labels := map[string]string{}
+
+	for _, stage := range stages {
+		stageStart, stageEnd := stageBounds(stage)
+
+		if stageStart.Before(start) || start.IsZero() {
+			start = stageStart
+		}
+
+		if stageEnd.After(end) {
+			end = stageEnd
+		}
+
+		isSuccess = isSuccess && stage.IsSuccess
+
+		for key, value := range stage.Labels {
+			labels[key] = value
+		}
+	}
+
+	rootCtx := withSpanID(
+		withTraceID(ctx, executionTraceID(processID, executionID)),
+		stageSpanID(processID, executionID, ""),
+	)
+
+	rootCtx, root := e.tracer.Start(
+		rootCtx,
+		processID,
+		trace.WithNewRoot(),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("pipetank.process_id", processID),
+			attribute.String("pipetank.execution_id", executionID),
+			attribute.String("pipetank.worker_id", stages[0].WorkerID),
+			attribute.Int("pipetank.stages.count", len(stages)),
+		),
+		trace.WithAttributes(labelAttributes(labels)...),
+	)
+
+	for _, stage := range stages {
+		e.exportStage(withSpanID(rootCtx, stageSpanID(processID, executionID, stage.StageExecutionID)), stage)
+	}
+
+	if !isSuccess {
+		root.SetStatus(codes.Error, "some stages failed")
+	}
+
+	root.End(trace.WithTimestamp(end))
+}
+
+func (e *Exporter) exportStage(ctx context.Context, stage repo.SingleStageExecutionEvent) {
+	start, end := stageBounds(stage)
+
+	attributes := []attribute.KeyValue{
+		attribute.String("pipetank.stage_execution_id", stage.StageExecutionID),
+		attribute.String("pipetank.stage.name", stage.RawStage.Name),
+		attribute.String("pipetank.stage.description", stage.RawStage.Description),
+		attribute.String("pipetank.worker_id", stage.WorkerID),
+	}
+
+	attributes = append(attributes, labelAttributes(stage.Labels)...)
+
+	for name, metric := range stage.Metrics {
+		attributes = append(attributes, attribute.Float64("pipetank.metric."+name, metric.Last))
+	}
+
+	_, span := e.tracer.Start(
+		ctx,
+		stage.RawStage.Name,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attributes...),
+	)
+
+	for _, update := range stage.Updates {
+		eventAttributes := []attribute.KeyValue{}
+
+		if metadata := extJSON(update.Metadata); len(metadata) > 0 {
+			eventAttributes = append(eventAttributes, attribute.String("pipetank.metadata", metadata))
+		}
+
+		span.AddEvent("update", trace.WithTimestamp(update.Ts), trace.WithAttributes(eventAttributes...))
+	}
+
+	switch {
+	case !stage.IsFinished:
+		span.SetStatus(codes.Unset, "")
+	case stage.IsSuccess:
+		span.SetStatus(codes.Ok, "")
+	default:
+		span.SetStatus(codes.Error, extJSON(stage.End.Failure))
+	}
+
+	span.End(trace.WithTimestamp(end))
+}
+
+// stageBounds returns the start and the end of the stage execution,
+// missing timestamps (e.g. if the start event was lost) are replaced with known ones.
+func stageBounds(stage repo.SingleStageExecutionEvent) (time.Time, time.Time) {
+	start, end := stage.Start.Ts, stage.End.Ts
+
+	if end.IsZero() {
+		end = stage.UpdatedAt
+	}
+
+	if start.IsZero() {
+		start = end
+	}
+
+	return start, end
+}
+
+func labelAttributes(labels map[string]string) []attribute.KeyValue {
+	result := make([]attribute.KeyValue, 0, len(labels))
+	for key, value := range labels {
+		result = append(result, attribute.String("pipetank.label."+key, value))
+	}
+
+	return result
+}
+
+func extJSON(raw bson.Raw) string {
+	if len(raw) == 0 {
+		return ""
+	}
+
+	result, err := bson.MarshalExtJSON(raw, false, false)
+	if err != nil {
+		return ""
+	}
+
+	return string(result)
+}
@@ -0,0 +1,140 @@
+package traceexporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/storagetest"
+	"github.com/LastSprint/pipetank/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type fakeStore struct {
+	counts repo.ExecutionStageCounts
+	stages []repo.SingleStageExecutionEvent
+	token  bson.Raw
+}
+
+func (s *fakeStore) LoadChangeStreamToken(context.Context, string) (bson.Raw, error) {
+	return s.token, nil
+}
+
+func (s *fakeStore) SaveChangeStreamToken(_ context.Context, _ string, token bson.Raw) error {
+	s.token = token
+	return nil
+}
+
+func (s *fakeStore) WatchStageExecutions(
+	context.Context,
+	bson.Raw,
+	common.CallbackFailable[repo.StageExecutionWatchModel],
+) error {
+	return nil
+}
+
+func (s *fakeStore) CountExecutionStages(context.Context, string, string) (repo.ExecutionStageCounts, error) {
+	return s.counts, nil
+}
+
+func (s *fakeStore) ListStageExecutions(
+	context.Context,
+	repo.StageExecutionsQuery,
+) ([]repo.SingleStageExecutionEvent, error) {
+	return s.stages, nil
+}
+
+var start = time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+func stage(id string, offset, duration time.Duration, isSuccess bool) repo.SingleStageExecutionEvent {
+	return repo.SingleStageExecutionEvent{
+		ProcessID:        "p1",
+		ExecutionID:      "e1",
+		StageExecutionID: id,
+		RawStage:         repo.RawStage{Name: "stage-" + id},
+		Start:            repo.Event{Ts: start.Add(offset)},
+		Updates:          []repo.Event{{Ts: start.Add(offset + duration/2)}},
+		End:              repo.Event{Ts: start.Add(offset + duration)},
+		IsFinished:       true,
+		IsSuccess:        isSuccess,
+		Labels:           map[string]string{"env": "prod"},
+	}
+}
+
+func TestExportExecutionBuildsTrace(t *testing.T) {
+	store := &fakeStore{stages: []repo.SingleStageExecutionEvent{
+		stage("s1", 0, time.Minute, true),
+		stage("s2", time.Minute, 2*time.Minute, false),
+	}}
+	spans := tracetest.NewInMemoryExporter()
+	exporter := NewExporter(store, spans, resource.Empty(), "key")
+
+	ctx := context.Background()
+
+	require.NoError(t, exporter.ExportExecution(ctx, "p1", "e1"))
+
+	result := spans.GetSpans()
+	require.Len(t, result, 3)
+
+	root := result[2]
+	assert.Equal(t, "p1", root.Name)
+	assert.Equal(t, executionTraceID("p1", "e1"), root.SpanContext.TraceID())
+	assert.Equal(t, stageSpanID("p1", "e1", ""), root.SpanContext.SpanID())
+	assert.False(t, root.Parent.IsValid())
+	assert.Equal(t, start, root.StartTime)
+	assert.Equal(t, start.Add(3*time.Minute), root.EndTime)
+	assert.Equal(t, codes.Error, root.Status.Code)
+
+	for i, span := range result[:2] {
+		expected := store.stages[i]
+
+		assert.Equal(t, expected.RawStage.Name, span.Name)
+		assert.Equal(t, root.SpanContext.TraceID(), span.SpanContext.TraceID())
+		assert.Equal(t, stageSpanID("p1", "e1", expected.StageExecutionID), span.SpanContext.SpanID())
+		assert.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID())
+		assert.Equal(t, expected.Start.Ts, span.StartTime)
+		assert.Equal(t, expected.End.Ts, span.EndTime)
+		require.Len(t, span.Events, 1)
+		assert.Equal(t, expected.Updates[0].Ts, span.Events[0].Time)
+	}
+
+	assert.Equal(t, codes.Ok, result[0].Status.Code)
+	assert.Equal(t, codes.Error, result[1].Status.Code)
+
+	// an exported again execution has the same IDs
+	spans.Reset()
+	require.NoError(t, exporter.ExportExecution(ctx, "p1", "e1"))
+	assert.Equal(t, root.SpanContext, spans.GetSpans()[2].SpanContext)
+}
+
+func TestHandleChangeExportsFinishedExecutions(t *testing.T) {
+	store := &fakeStore{
+		counts: repo.ExecutionStageCounts{Total: 2, Finished: 1},
+		stages: []repo.SingleStageExecutionEvent{stage("s1", 0, time.Minute, true)},
+	}
+	spans := tracetest.NewInMemoryExporter()
+	exporter := NewExporter(store, spans, resource.Empty(), "key")
+
+	ctx := context.Background()
+	change := repo.StageExecutionWatchModel{
+		Record:   store.stages[0],
+		Inserted: true,
+		Token:    storagetest.ResumeToken(bson.Raw{1}),
+	}
+
+	require.NoError(t, exporter.handleChange(ctx, change))
+	assert.Empty(t, spans.GetSpans())
+	assert.Nil(t, store.token)
+
+	store.counts.Finished = 2
+
+	require.NoError(t, exporter.handleChange(ctx, change))
+	assert.Len(t, spans.GetSpans(), 2)
+	assert.Equal(t, bson.Raw{1}, store.token)
+}
@@ -0,0 +1,64 @@
+package traceexporter
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	traceIDKey struct{}
+	spanIDKey  struct{}
+)
+
+func withTraceID(ctx context.Context, id trace.TraceID) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+func withSpanID(ctx context.Context, id trace.SpanID) context.Context {
+	return context.WithValue(ctx, spanIDKey{}, id)
+}
+
+// idGenerator takes IDs of the next span from the context, so they are derived from pipetank IDs.
+type idGenerator struct{}
+
+func (idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	traceID, _ := ctx.Value(traceIDKey{}).(trace.TraceID)
+	spanID, _ := ctx.Value(spanIDKey{}).(trace.SpanID)
+
+	return traceID, spanID
+}
+
+func (idGenerator) NewSpanID(ctx context.Context, _ trace.TraceID) trace.SpanID {
+	spanID, _ := ctx.Value(spanIDKey{}).(trace.SpanID)
+	return spanID
+}
+
+func executionTraceID(processID, executionID string) trace.TraceID {
+	var result trace.TraceID
+
+	copy(result[:], hash(processID, executionID))
+
+	return result
+}
+
+// stageSpanID returns the span ID of the stage execution, the root span has the empty stageExecutionID.
+func stageSpanID(processID, executionID, stageExecutionID string) trace.SpanID {
+	var result trace.SpanID
+
+	copy(result[:], hash(processID, executionID, stageExecutionID))
+
+	return result
+}
+
+func hash(parts ...string) []byte {
+	h := sha256.New()
+
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+
+	return h.Sum(nil)
+}
@@ -0,0 +1,277 @@
+// Package webhooks sends webhooks about stage and execution state transitions.
+//
+// Dispatcher watches stage executions and enqueues one delivery per matching subscription
+// before it saves the change stream token, so no transition is lost on restart.
+// Sender takes pending deliveries, signs and sends them and retries failed ones with backoff.
+package webhooks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/pkg/common"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type dispatcherStore interface {
+	LoadChangeStreamToken(ctx context.Context, key string) (bson.Raw, error)
+	SaveChangeStreamToken(ctx context.Context, key string, token bson.Raw) error
+	WatchStageExecutions(
+		ctx context.Context,
+		token bson.Raw,
+		action common.CallbackFailable[repo.StageExecutionWatchModel],
+	) error
+	ListWebhookSubscriptions(ctx context.Context) ([]repo.WebhookSubscription, error)
+	CountExecutionStages(ctx context.Context, processID, executionID string) (repo.ExecutionStageCounts, error)
+	EnqueueWebhookDeliveries(ctx context.Context, deliveries []repo.WebhookDelivery) error
+}
+
+type Dispatcher struct {
+	store dispatcherStore
+	clock utils.Clock
+
+	tokenKey string
+
+	subscriptionsRefreshPeriod time.Duration
+	subscriptionsMu            sync.Mutex
+	subscriptions              []subscription
+	subscriptionsLoadedAt      time.Time
+}
+
+type subscription struct {
+	repo.WebhookSubscription
+
+	selector repo.LabelSelector
+}
+
+// NewDispatcher creates a dispatcher which saves its change stream token under tokenKey
+// and reloads subscriptions not more often than once per subscriptionsRefreshPeriod.
+func NewDispatcher(
+	s dispatcherStore,
+	clock utils.Clock,
+	tokenKey string,
+	subscriptionsRefreshPeriod time.Duration,
+) *Dispatcher {
+	return &Dispatcher{
+		store:                      s,
+		clock:                      clock,
+		tokenKey:                   tokenKey,
+		subscriptionsRefreshPeriod: subscriptionsRefreshPeriod,
+	}
+}
+
+// Run watches stage executions from the saved token (or from now, if there is no token)
+// until the context is done or the change stream fails.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	token, err := d.store.LoadChangeStreamToken(ctx, d.tokenKey)
+	if err != nil && !errors.Is(err, oerrs.ErrNotFound) {
+		return err
+	}
+
+	if len(token) == 0 {
+		slog.InfoContext(ctx, "no saved change stream token, watching stage executions from now")
+	}
+
+	return d.store.WatchStageExecutions(ctx, token, d.handleChange)
+}
+
+func (d *Dispatcher) handleChange(ctx context.Context, change repo.StageExecutionWatchModel) error {
+	deliveries, err := d.deliveries(ctx, change)
+	if err != nil {
+		return err
+	}
+
+	err = d.store.EnqueueWebhookDeliveries(ctx, deliveries)
+	if err != nil {
+		return err
+	}
+
+	return d.store.SaveChangeStreamToken(ctx, d.tokenKey, change.Token.ResumeToken())
+}
+
+func (d *Dispatcher) deliveries(
+	ctx context.Context,
+	change repo.StageExecutionWatchModel,
+) ([]repo.WebhookDelivery, error) {
+	events := stageTransitions(change)
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	stage := change.Record
+
+	if slices.Contains(events, repo.WebhookEventStageSucceeded) || slices.Contains(events, repo.WebhookEventStageFailed) {
+		counts, err := d.store.CountExecutionStages(ctx, stage.ProcessID, stage.ExecutionID)
+		if err != nil {
+			return nil, err
+		}
+
+		if counts.IsFinished() {
+			if counts.Failed > 0 {
+				events = append(events, repo.WebhookEventExecutionFailed)
+			} else {
+				events = append(events, repo.WebhookEventExecutionSucceeded)
+			}
+		}
+	}
+
+	subscriptions, err := d.loadSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := d.clock()
+
+	var result []repo.WebhookDelivery
+
+	for _, event := range events {
+		payload := newPayload(event, stage, now)
+
+		for _, sub := range subscriptions {
+			if !sub.matches(event, stage) {
+				continue
+			}
+
+			delivery, err := newDelivery(sub.ID, payload, now)
+			if err != nil {
+				return nil, oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+			}
+
+			result = append(result, delivery)
+		}
+	}
+
+	return result, nil
+}
+
+func (d *Dispatcher) loadSubscriptions(ctx context.Context) ([]subscription, error) {
+	d.subscriptionsMu.Lock()
+	defer d.subscriptionsMu.Unlock()
+
+	if d.subscriptions != nil && d.clock().Sub(d.subscriptionsLoadedAt) < d.subscriptionsRefreshPeriod {
+		return d.subscriptions, nil
+	}
+
+	stored, err := d.store.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]subscription, 0, len(stored))
+
+	for _, sub := range stored {
+		selector, err := repo.ParseLabelSelector(sub.LabelSelector)
+		if err != nil {
+			slog.ErrorContext(
+				ctx,
+				"skip webhook subscription with invalid label selector",
+				slog.String("subscription", sub.ID.Hex()),
+				slog.Any("error", err),
+			)
+
+			continue
+		}
+
+		result = append(result, subscription{WebhookSubscription: sub, selector: selector})
+	}
+
+	d.subscriptions = result
+	d.subscriptionsLoadedAt = d.clock()
+
+	return result, nil
+}
+
+// stageTransitions returns stage events caused by the change.
+func stageTransitions(change repo.StageExecutionWatchModel) []repo.WebhookEventType {
+	var result []repo.WebhookEventType
+
+	if change.Started() {
+		result = append(result, repo.WebhookEventStageStarted)
+	}
+
+	if change.Finished() {
+		if change.Record.IsSuccess {
+			result = append(result, repo.WebhookEventStageSucceeded)
+		} else {
+			result = append(result, repo.WebhookEventStageFailed)
+		}
+	}
+
+	return result
+}
+
+// matches checks subscription filters. Execution events match only subscriptions without a stage filter,
+// their labels are labels of the stage execution which finished the execution.
+func (s subscription) matches(event repo.WebhookEventType, stage repo.SingleStageExecutionEvent) bool {
+	if len(s.Events) > 0 && !slices.Contains(s.Events, event) {
+		return false
+	}
+
+	if len(s.ProcessID) > 0 && s.ProcessID != stage.ProcessID {
+		return false
+	}
+
+	if len(s.StageName) > 0 {
+		if isExecutionEvent(event) || s.StageName != stage.RawStage.Name {
+			return false
+		}
+	}
+
+	return s.selector.Matches(stage.Labels)
+}
+
+func isExecutionEvent(event repo.WebhookEventType) bool {
+	return event == repo.WebhookEventExecutionSucceeded || event == repo.WebhookEventExecutionFailed
+}
+
+func newDelivery(subscriptionID bson.ObjectID, payload Payload, now time.Time) (repo.WebhookDelivery, error) {
+	payload.ID = deliveryID(subscriptionID, payload)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return repo.WebhookDelivery{}, fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	return repo.WebhookDelivery{
+		ID:               payload.ID,
+		SubscriptionID:   subscriptionID,
+		Event:            payload.Event,
+		ProcessID:        payload.ProcessID,
+		ExecutionID:      payload.ExecutionID,
+		StageExecutionID: payload.StageExecutionID,
+		Payload:          body,
+		Status:           repo.WebhookDeliveryPending,
+		NextAttemptAt:    now,
+		CreatedAt:        now,
+	}, nil
+}
+
+// deliveryID is the same for the same subscription and transition,
+// so a transition which is seen twice (e.g. after a restart) is delivered once.
+func deliveryID(subscriptionID bson.ObjectID, payload Payload) string {
+	hash := sha256.New()
+
+	for _, part := range []string{
+		subscriptionID.Hex(),
+		string(payload.Event),
+		payload.ProcessID,
+		payload.ExecutionID,
+		payload.StageExecutionID,
+	} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
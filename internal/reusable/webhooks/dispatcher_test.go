@@ -0,0 +1,175 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"github.com/LastSprint/pipetank/internal/repo/storagetest"
+	"github.com/LastSprint/pipetank/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type fakeDispatcherStore struct {
+	subscriptions []repo.WebhookSubscription
+	counts        repo.ExecutionStageCounts
+	enqueued      []repo.WebhookDelivery
+	token         bson.Raw
+}
+
+func (s *fakeDispatcherStore) LoadChangeStreamToken(context.Context, string) (bson.Raw, error) {
+	return s.token, nil
+}
+
+func (s *fakeDispatcherStore) SaveChangeStreamToken(_ context.Context, _ string, token bson.Raw) error {
+	s.token = token
+	return nil
+}
+
+func (s *fakeDispatcherStore) WatchStageExecutions(
+	context.Context,
+	bson.Raw,
+	common.CallbackFailable[repo.StageExecutionWatchModel],
+) error {
+	return nil
+}
+
+func (s *fakeDispatcherStore) ListWebhookSubscriptions(context.Context) ([]repo.WebhookSubscription, error) {
+	return s.subscriptions, nil
+}
+
+func (s *fakeDispatcherStore) CountExecutionStages(context.Context, string, string) (repo.ExecutionStageCounts, error) {
+	return s.counts, nil
+}
+
+func (s *fakeDispatcherStore) EnqueueWebhookDeliveries(_ context.Context, deliveries []repo.WebhookDelivery) error {
+	s.enqueued = append(s.enqueued, deliveries...)
+	return nil
+}
+
+func finishedStage(isSuccess bool) repo.SingleStageExecutionEvent {
+	ts := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	return repo.SingleStageExecutionEvent{
+		ProcessID:        "p1",
+		ExecutionID:      "e1",
+		StageExecutionID: "se1",
+		RawStage:         repo.RawStage{Name: "build"},
+		Start:            repo.Event{Ts: ts},
+		End:              repo.Event{Ts: ts.Add(time.Minute)},
+		IsFinished:       true,
+		IsSuccess:        isSuccess,
+		Labels:           map[string]string{"env": "prod"},
+	}
+}
+
+func TestStageTransitions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		change   repo.StageExecutionWatchModel
+		expected []repo.WebhookEventType
+	}{
+		{
+			name:     "insert of a finished stage",
+			change:   repo.StageExecutionWatchModel{Record: finishedStage(false), Inserted: true},
+			expected: []repo.WebhookEventType{repo.WebhookEventStageStarted, repo.WebhookEventStageFailed},
+		},
+		{
+			name:     "finish",
+			change:   repo.StageExecutionWatchModel{Record: finishedStage(true), UpdatedFields: []string{"e", "if", "is", "ua"}},
+			expected: []repo.WebhookEventType{repo.WebhookEventStageSucceeded},
+		},
+		{
+			name:   "update after finish",
+			change: repo.StageExecutionWatchModel{Record: finishedStage(true), UpdatedFields: []string{"u", "ua"}},
+		},
+		{
+			name: "update without start",
+			change: repo.StageExecutionWatchModel{
+				Record:   repo.SingleStageExecutionEvent{ProcessID: "p1"},
+				Inserted: true,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, stageTransitions(tc.change))
+		})
+	}
+}
+
+func TestDispatcherEnqueuesMatchingDeliveries(t *testing.T) {
+	now := time.Date(2025, 1, 1, 10, 5, 0, 0, time.UTC)
+
+	all := repo.WebhookSubscription{ID: bson.NewObjectID(), Name: "all"}
+	failures := repo.WebhookSubscription{
+		ID:     bson.NewObjectID(),
+		Name:   "failures",
+		Events: []repo.WebhookEventType{repo.WebhookEventStageFailed, repo.WebhookEventExecutionFailed},
+	}
+	otherStage := repo.WebhookSubscription{ID: bson.NewObjectID(), Name: "deploy", StageName: "deploy"}
+	otherEnv := repo.WebhookSubscription{ID: bson.NewObjectID(), Name: "dev", LabelSelector: "env=dev"}
+
+	store := &fakeDispatcherStore{
+		subscriptions: []repo.WebhookSubscription{all, failures, otherStage, otherEnv},
+		counts:        repo.ExecutionStageCounts{Total: 2, Finished: 2, Failed: 1},
+	}
+
+	d := NewDispatcher(store, func() time.Time { return now }, "webhooks", time.Minute)
+
+	change := repo.StageExecutionWatchModel{
+		Record:        finishedStage(false),
+		UpdatedFields: []string{"e", "if", "ua"},
+		Token:         storagetest.ResumeToken(bson.Raw("token")),
+	}
+
+	require.NoError(t, d.handleChange(context.Background(), change))
+
+	type key struct {
+		subscription string
+		event        repo.WebhookEventType
+	}
+
+	got := map[key]repo.WebhookDelivery{}
+	for _, delivery := range store.enqueued {
+		got[key{delivery.SubscriptionID.Hex(), delivery.Event}] = delivery
+	}
+
+	assert.Len(t, got, 4)
+	assert.Contains(t, got, key{all.ID.Hex(), repo.WebhookEventStageFailed})
+	assert.Contains(t, got, key{all.ID.Hex(), repo.WebhookEventExecutionFailed})
+	assert.Contains(t, got, key{failures.ID.Hex(), repo.WebhookEventStageFailed})
+	assert.Contains(t, got, key{failures.ID.Hex(), repo.WebhookEventExecutionFailed})
+
+	assert.Equal(t, bson.Raw("token"), store.token)
+
+	delivery := got[key{all.ID.Hex(), repo.WebhookEventStageFailed}]
+	assert.Equal(t, repo.WebhookDeliveryPending, delivery.Status)
+	assert.Equal(t, now, delivery.NextAttemptAt)
+
+	var payload Payload
+	require.NoError(t, json.Unmarshal(delivery.Payload, &payload))
+	assert.Equal(t, delivery.ID, payload.ID)
+	assert.Equal(t, "build", payload.StageName)
+	assert.Equal(t, "se1", payload.StageExecutionID)
+
+	execution := got[key{all.ID.Hex(), repo.WebhookEventExecutionFailed}]
+	var executionPayload Payload
+	require.NoError(t, json.Unmarshal(execution.Payload, &executionPayload))
+	assert.Empty(t, executionPayload.StageExecutionID)
+
+	// The same change seen again (e.g. after a restart) produces the same delivery IDs.
+	enqueued := store.enqueued
+	store.enqueued = nil
+
+	require.NoError(t, d.handleChange(context.Background(), change))
+
+	for i := range enqueued {
+		assert.Equal(t, enqueued[i].ID, store.enqueued[i].ID)
+	}
+}
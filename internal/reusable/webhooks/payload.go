@@ -0,0 +1,67 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Payload is a JSON body of a webhook.
+type Payload struct {
+	// ID is the same for all attempts of one delivery, receivers may use it to deduplicate webhooks.
+	ID         string                `json:"id"`
+	Event      repo.WebhookEventType `json:"event"`
+	OccurredAt time.Time             `json:"occurredAt"`
+
+	ProcessID   string `json:"processId"`
+	ExecutionID string `json:"executionId"`
+	WorkerID    string `json:"workerId,omitempty"`
+
+	// StageExecutionID and StageName are set only for stage events.
+	StageExecutionID string `json:"stageExecutionId,omitempty"`
+	StageName        string `json:"stageName,omitempty"`
+
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+
+	// Failure is the failure reported by the stage as relaxed extended JSON, it is set only for stage.failed.
+	Failure json.RawMessage `json:"failure,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func newPayload(event repo.WebhookEventType, stage repo.SingleStageExecutionEvent, now time.Time) Payload {
+	payload := Payload{
+		Event:       event,
+		OccurredAt:  now,
+		ProcessID:   stage.ProcessID,
+		ExecutionID: stage.ExecutionID,
+		WorkerID:    stage.WorkerID,
+		Labels:      stage.Labels,
+	}
+
+	if isExecutionEvent(event) {
+		return payload
+	}
+
+	payload.StageExecutionID = stage.StageExecutionID
+	payload.StageName = stage.RawStage.Name
+	payload.StartedAt = stage.Start.Ts
+
+	if event == repo.WebhookEventStageStarted {
+		return payload
+	}
+
+	payload.FinishedAt = stage.End.Ts
+
+	if event == repo.WebhookEventStageFailed && len(stage.End.Failure) > 0 {
+		failure, err := bson.MarshalExtJSON(stage.End.Failure, false, false)
+		if err == nil {
+			payload.Failure = failure
+		}
+	}
+
+	return payload
+}
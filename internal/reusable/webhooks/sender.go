@@ -0,0 +1,198 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/LastSprint/pipetank/pkg/utils"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type senderStore interface {
+	ClaimWebhookDelivery(ctx context.Context, lockFor time.Duration) (repo.WebhookDelivery, error)
+	GetWebhookSubscription(ctx context.Context, id bson.ObjectID) (repo.WebhookSubscription, error)
+	SaveWebhookDeliveryAttempt(ctx context.Context, attempt repo.WebhookDeliveryAttempt) error
+}
+
+// Backoff is an exponential backoff: Initial, 2*Initial, 4*Initial, ... but not more than Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Delay returns the delay after the attempt-th failed attempt (starting from 1).
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+
+	for i := 1; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+
+	return min(delay, b.Max)
+}
+
+type Sender struct {
+	store  senderStore
+	client *http.Client
+	clock  utils.Clock
+
+	backoff     Backoff
+	maxAttempts int
+	// lockFor is how long a claimed delivery is hidden from other workers,
+	// it must be longer than the request timeout.
+	lockFor time.Duration
+}
+
+func NewSender(
+	s senderStore,
+	client *http.Client,
+	clock utils.Clock,
+	backoff Backoff,
+	maxAttempts int,
+	lockFor time.Duration,
+) *Sender {
+	return &Sender{
+		store:       s,
+		client:      client,
+		clock:       clock,
+		backoff:     backoff,
+		maxAttempts: maxAttempts,
+		lockFor:     lockFor,
+	}
+}
+
+// Run sends due deliveries with the given number of workers until the context is done.
+// A worker which has nothing to send waits for pollPeriod.
+func (s *Sender) Run(ctx context.Context, workers int, pollPeriod time.Duration) error {
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Go(func() {
+			s.work(ctx, pollPeriod)
+		})
+	}
+
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func (s *Sender) work(ctx context.Context, pollPeriod time.Duration) {
+	for {
+		sent, err := s.SendNext(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "failed to send webhook", slog.Any("error", err))
+		}
+
+		if sent && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollPeriod):
+		}
+	}
+}
+
+// SendNext sends one due delivery and records the attempt.
+// It returns false if there is nothing to send.
+// A failed request is not an error, it is recorded and retried later.
+func (s *Sender) SendNext(ctx context.Context) (bool, error) {
+	delivery, err := s.store.ClaimWebhookDelivery(ctx, s.lockFor)
+	if errors.Is(err, oerrs.ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	attempt := s.send(ctx, delivery)
+
+	return true, s.store.SaveWebhookDeliveryAttempt(ctx, attempt)
+}
+
+func (s *Sender) send(ctx context.Context, delivery repo.WebhookDelivery) repo.WebhookDeliveryAttempt {
+	attempt := repo.WebhookDeliveryAttempt{ID: delivery.ID}
+
+	subscription, err := s.store.GetWebhookSubscription(ctx, delivery.SubscriptionID)
+	if errors.Is(err, oerrs.ErrNotFound) {
+		attempt.Error = "subscription is deleted"
+		return attempt
+	}
+
+	if err == nil {
+		attempt.StatusCode, err = s.post(ctx, subscription, delivery)
+	}
+
+	if err == nil {
+		attempt.Delivered = true
+		return attempt
+	}
+
+	attempt.Error = err.Error()
+
+	attemptNumber := delivery.Attempts + 1
+	if attemptNumber < s.maxAttempts {
+		attempt.NextAttemptAt = s.clock().Add(s.backoff.Delay(attemptNumber))
+	}
+
+	slog.WarnContext(
+		ctx,
+		"webhook delivery attempt failed",
+		slog.String("delivery", delivery.ID),
+		slog.String("subscription", delivery.SubscriptionID.Hex()),
+		slog.Int("attempt", attemptNumber),
+		slog.Bool("will_retry", !attempt.NextAttemptAt.IsZero()),
+		slog.Any("error", err),
+	)
+
+	return attempt
+}
+
+// post sends the delivery, any non 2xx response is considered a failure.
+func (s *Sender) post(
+	ctx context.Context,
+	subscription repo.WebhookSubscription,
+	delivery repo.WebhookDelivery,
+) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	timestamp := s.clock().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDeliveryID, delivery.ID)
+	req.Header.Set(HeaderEvent, string(delivery.Event))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(subscription.Secret, timestamp, delivery.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send webhook: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook endpoint responded with %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,163 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/LastSprint/pipetank/internal/repo"
+	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type fakeSenderStore struct {
+	deliveries   []repo.WebhookDelivery
+	subscription repo.WebhookSubscription
+	attempts     []repo.WebhookDeliveryAttempt
+}
+
+func (s *fakeSenderStore) ClaimWebhookDelivery(ctx context.Context, _ time.Duration) (repo.WebhookDelivery, error) {
+	if len(s.deliveries) == 0 {
+		return repo.WebhookDelivery{}, oerrs.NewTErrf(ctx, "empty: %w", oerrs.ErrNotFound)
+	}
+
+	delivery := s.deliveries[0]
+	s.deliveries = s.deliveries[1:]
+
+	return delivery, nil
+}
+
+func (s *fakeSenderStore) GetWebhookSubscription(ctx context.Context, id bson.ObjectID) (repo.WebhookSubscription, error) {
+	if id != s.subscription.ID {
+		return repo.WebhookSubscription{}, oerrs.NewTErrf(ctx, "no such subscription: %w", oerrs.ErrNotFound)
+	}
+
+	return s.subscription, nil
+}
+
+func (s *fakeSenderStore) SaveWebhookDeliveryAttempt(_ context.Context, attempt repo.WebhookDeliveryAttempt) error {
+	s.attempts = append(s.attempts, attempt)
+	return nil
+}
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+
+	signature := Sign("secret", 1700000000, body)
+
+	assert.Equal(t, "sha256=", signature[:7])
+	assert.True(t, Verify("secret", 1700000000, body, signature))
+	assert.False(t, Verify("other", 1700000000, body, signature))
+	assert.False(t, Verify("secret", 1700000001, body, signature))
+	assert.False(t, Verify("secret", 1700000000, []byte(`{"id":"2"}`), signature))
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Initial: time.Second, Max: 10 * time.Second}
+
+	assert.Equal(t, time.Second, backoff.Delay(1))
+	assert.Equal(t, 2*time.Second, backoff.Delay(2))
+	assert.Equal(t, 8*time.Second, backoff.Delay(4))
+	assert.Equal(t, 10*time.Second, backoff.Delay(5))
+	assert.Equal(t, 10*time.Second, backoff.Delay(100))
+}
+
+func TestSenderSendsSignedPayloadAndRetries(t *testing.T) {
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	statusCode := http.StatusInternalServerError
+
+	var received []*http.Request
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		assert.NoError(t, err)
+		assert.True(t, Verify("secret", timestamp, body, r.Header.Get(HeaderSignature)))
+		assert.Equal(t, `{"id":"d1"}`, string(body))
+
+		received = append(received, r)
+
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	subscription := repo.WebhookSubscription{ID: bson.NewObjectID(), URL: server.URL, Secret: "secret"}
+	delivery := repo.WebhookDelivery{
+		ID:             "d1",
+		SubscriptionID: subscription.ID,
+		Event:          repo.WebhookEventStageFailed,
+		Payload:        []byte(`{"id":"d1"}`),
+		Attempts:       1,
+	}
+
+	store := &fakeSenderStore{subscription: subscription}
+	sender := NewSender(
+		store,
+		server.Client(),
+		func() time.Time { return now },
+		Backoff{Initial: time.Second, Max: time.Minute},
+		3,
+		time.Minute,
+	)
+
+	// The 2nd attempt fails and is retried after backoff.
+	store.deliveries = []repo.WebhookDelivery{delivery}
+
+	sent, err := sender.SendNext(context.Background())
+	require.NoError(t, err)
+	assert.True(t, sent)
+
+	require.Len(t, store.attempts, 1)
+	assert.False(t, store.attempts[0].Delivered)
+	assert.Equal(t, http.StatusInternalServerError, store.attempts[0].StatusCode)
+	assert.Equal(t, now.Add(2*time.Second), store.attempts[0].NextAttemptAt)
+
+	// The last attempt fails and is not retried.
+	delivery.Attempts = 2
+	store.deliveries = []repo.WebhookDelivery{delivery}
+
+	_, err = sender.SendNext(context.Background())
+	require.NoError(t, err)
+	assert.True(t, store.attempts[1].NextAttemptAt.IsZero())
+
+	// A successful attempt.
+	statusCode = http.StatusNoContent
+	store.deliveries = []repo.WebhookDelivery{delivery}
+
+	_, err = sender.SendNext(context.Background())
+	require.NoError(t, err)
+	assert.True(t, store.attempts[2].Delivered)
+
+	require.Len(t, received, 3)
+	assert.Equal(t, "d1", received[2].Header.Get(HeaderDeliveryID))
+	assert.Equal(t, string(repo.WebhookEventStageFailed), received[2].Header.Get(HeaderEvent))
+
+	// Nothing to send.
+	sent, err = sender.SendNext(context.Background())
+	require.NoError(t, err)
+	assert.False(t, sent)
+}
+
+func TestSenderFailsDeliveryOfDeletedSubscription(t *testing.T) {
+	store := &fakeSenderStore{
+		deliveries: []repo.WebhookDelivery{{ID: "d1", SubscriptionID: bson.NewObjectID()}},
+	}
+
+	sender := NewSender(store, http.DefaultClient, time.Now, Backoff{Initial: time.Second, Max: time.Minute}, 3, time.Minute)
+
+	_, err := sender.SendNext(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, store.attempts, 1)
+	assert.False(t, store.attempts[0].Delivered)
+	assert.True(t, store.attempts[0].NextAttemptAt.IsZero())
+	assert.Equal(t, "subscription is deleted", store.attempts[0].Error)
+}
@@ -0,0 +1,34 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+const (
+	HeaderDeliveryID = "X-Pipetank-Delivery"
+	HeaderEvent      = "X-Pipetank-Event"
+	// HeaderTimestamp is a unix time (seconds) of the attempt, it is a part of the signed message.
+	HeaderTimestamp = "X-Pipetank-Timestamp"
+	// HeaderSignature is `sha256=<hex>` of HMAC-SHA256 over `<timestamp>.<body>` keyed by the subscription secret.
+	HeaderSignature = "X-Pipetank-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// Sign returns the value of HeaderSignature.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature in constant time. Receivers written in Go may use it as is.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
@@ -1 +1,139 @@
+// Package app manages the lifecycle of components which share one process.
+//
+// Components start in the order they are added and stop in reverse, so every component may use
+// the ones added before it during its whole life: e.g. the storage is added first and closed last,
+// after the components which write to it are drained.
 package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Component is a part of the process, every function is optional.
+type Component struct {
+	Name string
+	// Start prepares the component, components added after it start only if it succeeds.
+	Start func(ctx context.Context) error
+	// Run does the job of the component until its context is canceled, the app stops once any Run returns.
+	Run func(ctx context.Context) error
+	// Stop is called on shutdown before the context of Run is canceled, e.g. to drain in-flight requests.
+	Stop func(ctx context.Context) error
+}
+
+type App struct {
+	components      []Component
+	shutdownTimeout time.Duration
+}
+
+// New creates an app of the components. The shutdownTimeout limits the whole shutdown, zero means no limit.
+func New(shutdownTimeout time.Duration, components ...Component) *App {
+	return &App{
+		components:      components,
+		shutdownTimeout: shutdownTimeout,
+	}
+}
+
+type running struct {
+	Component
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	// err is the result of Run, it may be read once done is closed
+	err error
+}
+
+// Run starts the components and runs them until the context is done or any of them stops on its own.
+// Then components are stopped in reverse order: Stop is called, the context of Run is canceled
+// and Run is awaited before the previous component is stopped.
+// If a component fails to start, only the components started before it are stopped.
+// Returns errors of all components, a Run canceled on shutdown is not an error.
+func (a *App) Run(ctx context.Context) error {
+	started := make([]*running, 0, len(a.components))
+	exited := make(chan string, len(a.components))
+
+	for _, component := range a.components {
+		if component.Start != nil {
+			err := component.Start(ctx)
+			if err != nil {
+				return errors.Join(fmt.Errorf("failed to start %s: %w", component.Name, err), a.stop(ctx, started))
+			}
+		}
+
+		started = append(started, run(ctx, component, exited))
+	}
+
+	slog.InfoContext(ctx, "all components are started", slog.Int("count", len(started)))
+
+	select {
+	case <-ctx.Done():
+	case name := <-exited:
+		slog.WarnContext(ctx, "component stopped on its own, shutting down", slog.String("component", name))
+	}
+
+	return a.stop(ctx, started)
+}
+
+// run runs the component in background with a context which is canceled only on its stop.
+func run(ctx context.Context, component Component, exited chan<- string) *running {
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	r := &running{
+		Component: component,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	if component.Run == nil {
+		close(r.done)
+		return r
+	}
+
+	go func() {
+		defer close(r.done)
+
+		r.err = component.Run(runCtx)
+		exited <- component.Name
+	}()
+
+	return r
+}
+
+func (a *App) stop(ctx context.Context, started []*running) error {
+	stopCtx, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+	if a.shutdownTimeout > 0 {
+		stopCtx, cancel = context.WithTimeout(stopCtx, a.shutdownTimeout)
+	}
+	defer cancel()
+
+	var errs []error
+
+	for i := len(started) - 1; i >= 0; i-- {
+		r := started[i]
+
+		slog.InfoContext(ctx, "stopping component", slog.String("component", r.Name))
+
+		if r.Stop != nil {
+			err := r.Stop(stopCtx)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to stop %s: %w", r.Name, err))
+			}
+		}
+
+		r.cancel()
+
+		select {
+		case <-r.done:
+			if r.err != nil && !errors.Is(r.err, context.Canceled) {
+				errs = append(errs, fmt.Errorf("%s failed: %w", r.Name, r.err))
+			}
+		case <-stopCtx.Done():
+			errs = append(errs, fmt.Errorf("%s didn't stop in time: %w", r.Name, stopCtx.Err()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// journal records lifecycle calls of components in the order they happen.
+type journal struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (j *journal) add(entry string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries = append(j.entries, entry)
+}
+
+func (j *journal) get() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return append([]string(nil), j.entries...)
+}
+
+func (j *journal) component(name string) Component {
+	return Component{
+		Name: name,
+		Start: func(context.Context) error {
+			j.add("start " + name)
+			return nil
+		},
+		Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			j.add("canceled " + name)
+
+			return ctx.Err()
+		},
+		Stop: func(context.Context) error {
+			j.add("stop " + name)
+			return nil
+		},
+	}
+}
+
+func TestRunStopsComponentsInReverseOrder(t *testing.T) {
+	j := &journal{}
+
+	err := New(time.Second, j.component("storage"), j.component("consumer"), j.component("api")).Run(canceledContext())
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"start storage",
+		"start consumer",
+		"start api",
+		"stop api",
+		"canceled api",
+		"stop consumer",
+		"canceled consumer",
+		"stop storage",
+		"canceled storage",
+	}, j.get())
+}
+
+func TestRunStopsStartedComponentsIfStartFails(t *testing.T) {
+	j := &journal{}
+
+	failing := j.component("consumer")
+	failing.Start = func(context.Context) error {
+		return errors.New("no storage")
+	}
+
+	err := New(time.Second, j.component("storage"), failing, j.component("api")).Run(context.Background())
+	require.EqualError(t, err, "failed to start consumer: no storage")
+
+	assert.Equal(t, []string{"start storage", "stop storage", "canceled storage"}, j.get())
+}
+
+func TestRunStopsAllComponentsIfOneExits(t *testing.T) {
+	j := &journal{}
+
+	failing := j.component("consumer")
+	failing.Run = func(context.Context) error {
+		return errors.New("stream lost")
+	}
+
+	err := New(time.Second, j.component("storage"), failing, j.component("api")).Run(context.Background())
+	require.EqualError(t, err, "consumer failed: stream lost")
+
+	assert.Equal(t, []string{
+		"start storage",
+		"start consumer",
+		"start api",
+		"stop api",
+		"canceled api",
+		"stop consumer",
+		"stop storage",
+		"canceled storage",
+	}, j.get())
+}
+
+func TestRunLimitsShutdown(t *testing.T) {
+	stuck := Component{
+		Name: "stuck",
+		Run: func(context.Context) error {
+			select {}
+		},
+	}
+
+	err := New(10*time.Millisecond, stuck).Run(canceledContext())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return ctx
+}
@@ -0,0 +1,56 @@
+package health
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const defaultGRPCPeriod = 5 * time.Second
+
+// UpdateGRPC sets the readiness as the serving status of the services every period until the context is done.
+// The empty service name is the status of the whole server.
+// Call server.Shutdown on graceful shutdown, after that the status is NOT_SERVING and is not updated anymore.
+func (c *Checker) UpdateGRPC(ctx context.Context, server *health.Server, period time.Duration, services ...string) {
+	if period <= 0 {
+		period = defaultGRPCPeriod
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	var last healthpb.HealthCheckResponse_ServingStatus
+
+	for {
+		report := c.Ready(ctx)
+
+		status := healthpb.HealthCheckResponse_SERVING
+		if !report.OK() {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+
+		if status != last && ctx.Err() == nil {
+			slog.InfoContext(
+				ctx,
+				"serving status changed",
+				slog.String("status", status.String()),
+				slog.Any("checks", report.Checks),
+			)
+		}
+
+		last = status
+
+		for _, service := range append([]string{""}, services...) {
+			server.SetServingStatus(service, status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package health implements liveness and readiness checks of the services.
+//
+// Liveness tells whether the process works at all and should be restarted otherwise,
+// readiness tells whether it is able to do its job right now. Every liveness check is a readiness check too.
+// After SetShuttingDown the service is never ready, so it is removed from load balancing before it stops.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+
+	checkShutdown = "shutdown"
+)
+
+// Check returns an error if the checked dependency is not healthy.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name     string
+	check    Check
+	liveness bool
+}
+
+// Checker runs registered checks, each with the given timeout.
+type Checker struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks []namedCheck
+
+	shuttingDown atomic.Bool
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// AddLiveness registers a check which affects both liveness and readiness.
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.add(namedCheck{name: name, check: check, liveness: true})
+}
+
+// AddReadiness registers a check which affects only readiness.
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.add(namedCheck{name: name, check: check})
+}
+
+func (c *Checker) add(check namedCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, check)
+}
+
+// SetShuttingDown makes the service not ready until the process exits.
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+// Report is a result of checks, Checks contains StatusOK or an error text by the check name.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// Err returns an error which lists failed checks, or nil if all checks passed.
+func (r Report) Err() error {
+	if r.OK() {
+		return nil
+	}
+
+	var err error
+
+	for name, result := range r.Checks {
+		if result != StatusOK {
+			err = errors.Join(err, fmt.Errorf("%s: %s", name, result))
+		}
+	}
+
+	return err
+}
+
+// Live runs liveness checks.
+func (c *Checker) Live(ctx context.Context) Report {
+	return c.run(ctx, true)
+}
+
+// Ready runs all checks and fails if the service is shutting down.
+func (c *Checker) Ready(ctx context.Context) Report {
+	report := c.run(ctx, false)
+
+	if c.shuttingDown.Load() {
+		report.Status = StatusError
+		report.Checks[checkShutdown] = "service is shutting down"
+	}
+
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, livenessOnly bool) Report {
+	c.mu.RLock()
+	checks := make([]namedCheck, 0, len(c.checks))
+	for _, check := range c.checks {
+		if check.liveness || !livenessOnly {
+			checks = append(checks, check)
+		}
+	}
+	c.mu.RUnlock()
+
+	results := make([]error, len(checks))
+
+	var wg sync.WaitGroup
+
+	for i, check := range checks {
+		wg.Go(func() {
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			results[i] = check.check(checkCtx)
+		})
+	}
+
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]string, len(checks))}
+
+	for i, check := range checks {
+		if results[i] != nil {
+			report.Status = StatusError
+			report.Checks[check.name] = results[i].Error()
+
+			continue
+		}
+
+		report.Checks[check.name] = StatusOK
+	}
+
+	return report
+}
@@ -0,0 +1,76 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckerSeparatesLivenessAndReadiness(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.AddLiveness("loop", func(context.Context) error { return nil })
+	checker.AddReadiness("db", func(context.Context) error { return errors.New("down") })
+
+	ctx := context.Background()
+
+	live := checker.Live(ctx)
+	assert.True(t, live.OK())
+	assert.Equal(t, map[string]string{"loop": StatusOK}, live.Checks)
+
+	ready := checker.Ready(ctx)
+	assert.False(t, ready.OK())
+	assert.Equal(t, map[string]string{"loop": StatusOK, "db": "down"}, ready.Checks)
+	assert.EqualError(t, ready.Err(), "db: down")
+}
+
+func TestCheckerIsNotReadyDuringShutdown(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.AddReadiness("db", func(context.Context) error { return nil })
+
+	ctx := context.Background()
+
+	require.True(t, checker.Ready(ctx).OK())
+
+	checker.SetShuttingDown()
+
+	assert.False(t, checker.Ready(ctx).OK())
+	assert.True(t, checker.Live(ctx).OK())
+}
+
+func TestCheckerTimesOutChecks(t *testing.T) {
+	checker := NewChecker(10 * time.Millisecond)
+	checker.AddReadiness("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	assert.Equal(t, context.DeadlineExceeded.Error(), checker.Ready(context.Background()).Checks["slow"])
+}
+
+func TestHandler(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.AddReadiness("db", func(context.Context) error { return errors.New("down") })
+
+	handler := checker.Handler()
+
+	for path, code := range map[string]int{
+		LivenessPath:  http.StatusOK,
+		ReadinessPath: http.StatusServiceUnavailable,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		assert.Equal(t, code, rec.Code, path)
+
+		var report Report
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		assert.Equal(t, code == http.StatusOK, report.OK(), path)
+	}
+}
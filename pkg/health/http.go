@@ -0,0 +1,82 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// Handler serves LivenessPath and ReadinessPath, it responds 200 if checks passed and 503 otherwise.
+// The body is a JSON Report.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Live(r.Context()))
+	})
+
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Ready(r.Context()))
+	})
+
+	return mux
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !report.OK() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Start serves the Handler on the addr in background and returns a function which stops the server.
+// Unlike metrics the server is not bound to a context, so it keeps responding during graceful shutdown.
+// Empty addr disables the endpoint.
+func Start(ctx context.Context, addr string, c *Checker) (func(context.Context) error, error) {
+	if len(addr) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var lc net.ListenConfig
+
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen health checks on %s: %w", addr, err)
+	}
+
+	srv := &http.Server{
+		Handler:           c.Handler(),
+		ReadHeaderTimeout: shutdownTimeout,
+	}
+
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to serve health checks", slog.String("addr", addr), slog.Any("error", err))
+		}
+	}()
+
+	slog.InfoContext(ctx, "serving health checks", slog.String("addr", addr))
+
+	return func(ctx context.Context) error {
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+
+		return srv.Shutdown(shutdownCtx)
+	}, nil
+}
@@ -2,23 +2,112 @@ package mdb
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"time"
 
 	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
+// Server error codes which mean that the requested change stream position is not in the oplog anymore.
+const (
+	errCodeCappedPositionLost      = 136
+	errCodeChangeStreamFatalError  = 280
+	errCodeChangeStreamHistoryLost = 286
+)
+
 type ResumeTokenProvider interface {
 	ResumeToken() bson.Raw
 }
 
+// ChangeStreamOption customizes a change stream.
+type ChangeStreamOption func(cfg *changeStreamConfig)
+
+type changeStreamConfig struct {
+	opts   *options.ChangeStreamOptionsBuilder
+	onIdle func(ctx context.Context, token ResumeTokenProvider) error
+}
+
+// WithResumeAfter resumes the change stream right after the event with the given resume token.
+// Empty token is ignored, so the stream starts from now.
+func WithResumeAfter(token bson.Raw) ChangeStreamOption {
+	return func(cfg *changeStreamConfig) {
+		if len(token) == 0 {
+			return
+		}
+
+		cfg.opts.SetResumeAfter(token)
+	}
+}
+
+// WithStartAtOperationTime starts the change stream from the first operation at or after the given time.
+// Zero time is ignored, so the stream starts from now.
+func WithStartAtOperationTime(ts time.Time) ChangeStreamOption {
+	return func(cfg *changeStreamConfig) {
+		if ts.IsZero() {
+			return
+		}
+
+		cfg.opts.SetStartAtOperationTime(&bson.Timestamp{T: uint32(ts.Unix())}) //nolint:gosec
+	}
+}
+
+// WithIdle calls onIdle every time the server returns an empty batch. The token is the post batch resume token,
+// it moves forward with the oplog even if no change matches the pipeline, so saving it keeps a quiet stream
+// inside the oplog window.
+func WithIdle(onIdle func(ctx context.Context, token ResumeTokenProvider) error) ChangeStreamOption {
+	return func(cfg *changeStreamConfig) {
+		cfg.onIdle = onIdle
+	}
+}
+
+// IsHistoryLost reports whether the change stream failed because its resume token or start time
+// is older than the oplog, so it can't be resumed from there.
+func IsHistoryLost(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+
+	return serverErr.HasErrorCode(errCodeChangeStreamHistoryLost) ||
+		serverErr.HasErrorCode(errCodeChangeStreamFatalError) ||
+		serverErr.HasErrorCode(errCodeCappedPositionLost)
+}
+
+// ChangeEvent is a change stream event with the full document after the change.
+type ChangeEvent[T any] struct {
+	OperationType     string `bson:"operationType"`
+	FullDocument      T      `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+// UpdatedFieldNames returns names (dot notation) of fields changed by an update operation.
+func (e ChangeEvent[T]) UpdatedFieldNames() []string {
+	elements, err := e.UpdateDescription.UpdatedFields.Elements()
+	if err != nil {
+		return nil
+	}
+
+	result := make([]string, 0, len(elements))
+	for _, element := range elements {
+		result = append(result, element.Key())
+	}
+
+	return result
+}
+
 func RunChangeStream[T any](
 	ctx context.Context,
 	c *Client,
 	colName string,
 	pipeline any,
 	action func(ctx context.Context, token ResumeTokenProvider, doc T) error,
+	opts ...ChangeStreamOption,
 ) error {
 	return c.changeStream(
 		ctx,
@@ -39,6 +128,35 @@ func RunChangeStream[T any](
 
 			return action(ctx, token, dt)
 		},
+		opts...,
+	)
+}
+
+// RunChangeStreamEvents is the same as RunChangeStream, but passes the whole change event to the action,
+// so it is possible to know what kind of change happened and which fields were updated.
+func RunChangeStreamEvents[T any](
+	ctx context.Context,
+	c *Client,
+	colName string,
+	pipeline any,
+	action func(ctx context.Context, token ResumeTokenProvider, event ChangeEvent[T]) error,
+	opts ...ChangeStreamOption,
+) error {
+	return c.changeStream(
+		ctx,
+		colName,
+		pipeline,
+		func(ctx context.Context, token ResumeTokenProvider, doc bson.Raw) error {
+			var event ChangeEvent[T]
+
+			err := bson.Unmarshal(doc, &event)
+			if err != nil {
+				return err
+			}
+
+			return action(ctx, token, event)
+		},
+		opts...,
 	)
 }
 
@@ -47,24 +165,40 @@ func (c *Client) changeStream(
 	colName string,
 	pipeline any,
 	action func(ctx context.Context, token ResumeTokenProvider, doc bson.Raw) error,
+	opts ...ChangeStreamOption,
 ) error {
+	cfg := changeStreamConfig{opts: options.ChangeStream().SetFullDocument(options.UpdateLookup)}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	cs, err := c.DB().
 		Collection(colName).
-		Watch(ctx, pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+		Watch(ctx, pipeline, cfg.opts)
 	if err != nil {
 		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
 	}
 
 	defer func() {
-		err = cs.Close(ctx)
-		slog.Error("Failed to close change stream", "error", err)
+		closeErr := cs.Close(context.WithoutCancel(ctx))
+		if closeErr != nil {
+			slog.Error("Failed to close change stream", "error", closeErr)
+		}
 	}()
 
-	for cs.Next(ctx) {
-		select {
-		case <-ctx.Done():
+	for {
+		// TryNext returns false on an empty batch instead of waiting for the next one, so idle batches are seen
+		if cs.TryNext(ctx) {
+			err = action(ctx, cs, cs.Current)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if ctx.Err() != nil {
 			return ctx.Err()
-		default:
 		}
 
 		err = cs.Err()
@@ -72,11 +206,16 @@ func (c *Client) changeStream(
 			return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
 		}
 
-		err = action(ctx, cs, cs.Current)
-		if err != nil {
-			return err
+		// the cursor is closed by the server, e.g. the collection is dropped
+		if cs.ID() == 0 {
+			return nil
 		}
-	}
 
-	return nil
+		if cfg.onIdle != nil {
+			err = cfg.onIdle(ctx, cs)
+			if err != nil {
+				return err
+			}
+		}
+	}
 }
@@ -4,14 +4,15 @@ import (
 	"fmt"
 
 	"github.com/LastSprint/pipetank/pkg/mdb/registry"
-	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 	"go.mongodb.org/mongo-driver/v2/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/v2/mongo/writeconcern"
 )
 
-var _registry *bson.Registry
+// _registry is replaced by every new client, it is set from the start,
+// so JSONtoBSON and BsonToJSON work without a client.
+var _registry = registry.CreateRegistry()
 
 type Client struct {
 	dbName    string
@@ -50,7 +51,8 @@ func NewClientWithConfig(cfg Config) (*Client, error) {
 		SetWriteConcern(writeconcern.Journaled()).
 		SetRetryReads(true).
 		SetRetryWrites(true).
-		SetRegistry(newRegistry)
+		SetRegistry(newRegistry).
+		SetMonitor(newCommandMonitor())
 
 	cl, err := mongo.Connect(clientOptions)
 	if err != nil {
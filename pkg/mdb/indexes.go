@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"strings"
 
 	octx "github.com/LastSprint/pipetank/pkg/observability/ctx"
 	oerrs "github.com/LastSprint/pipetank/pkg/observability/errors"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 type MGOIndex struct {
@@ -121,3 +123,105 @@ func (c *Client) CreateOrUpdateTTLIndex(
 		[]mongo.IndexModel{newIndex},
 	)
 }
+
+// SyncIndexes makes indexes with a given name prefix in a given collection match indexes
+// (keyed by index name, which must start with the prefix): missing indexes are created
+// and indexes with the prefix which are not in the set are dropped.
+//
+// It is useful for indexes driven by configuration, where removing an item from the configuration
+// must remove the index.
+// Errors:
+// - oerrs.ErrBadInput: if an index name does not start with the prefix
+// - oerrs.ErrInternal: on any other error.
+func (c *Client) SyncIndexes(
+	ctx context.Context,
+	collection, prefix string,
+	indexes map[string]mongo.IndexModel,
+) error {
+	for name := range indexes {
+		if !strings.HasPrefix(name, prefix) {
+			return oerrs.NewTErrf(ctx, "index %s must start with %s: %w", name, prefix, oerrs.ErrBadInput)
+		}
+	}
+
+	indexesCur, err := c.DB().Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	var existing []MGOIndex
+
+	err = indexesCur.All(ctx, &existing)
+	if err != nil {
+		return oerrs.NewTErr(ctx, err, oerrs.ErrInternal)
+	}
+
+	existingNames := map[string]struct{}{}
+
+	for _, idx := range existing {
+		if !strings.HasPrefix(idx.Name, prefix) {
+			continue
+		}
+
+		if _, ok := indexes[idx.Name]; ok {
+			existingNames[idx.Name] = struct{}{}
+			continue
+		}
+
+		err = c.DB().Collection(collection).Indexes().DropOne(ctx, idx.Name)
+		if err != nil {
+			return oerrs.NewTErrf(ctx, "failed to drop index %s: %w: %w", idx.Name, err, oerrs.ErrInternal)
+		}
+
+		octx.Logger(ctx).
+			WithGroup("SyncIndexes").
+			With(slog.String("index", idx.Name)).
+			Info("dropped index")
+	}
+
+	toCreate := make([]mongo.IndexModel, 0, len(indexes))
+
+	for name, idx := range indexes {
+		if _, ok := existingNames[name]; ok {
+			continue
+		}
+
+		if idx.Options == nil {
+			idx.Options = options.Index()
+		}
+
+		toCreate = append(toCreate, mongo.IndexModel{Keys: idx.Keys, Options: idx.Options.SetName(name)})
+	}
+
+	if len(toCreate) == 0 {
+		return nil
+	}
+
+	return c.CreateIndexes(ctx, collection, toCreate)
+}
+
+// DropIndexIfExists drops an index with a given name from a given collection if it exists
+// Errors:
+// - oerrs.ErrInternal: on any error.
+func (c *Client) DropIndexIfExists(ctx context.Context, collection, indexName string) error {
+	_, err := c.GetIndexByName(ctx, collection, indexName)
+	if errors.Is(err, oerrs.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = c.DB().Collection(collection).Indexes().DropOne(ctx, indexName)
+	if err != nil {
+		return oerrs.NewTErrf(ctx, "failed to drop index %s: %w: %w", indexName, err, oerrs.ErrInternal)
+	}
+
+	octx.Logger(ctx).
+		WithGroup("DropIndexIfExists").
+		With(slog.String("index", indexName)).
+		Info("dropped index")
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package mdb
+
+import (
+	"context"
+
+	"github.com/LastSprint/pipetank/pkg/observability/metrics"
+	"github.com/LastSprint/pipetank/pkg/observability/tracing"
+	"go.mongodb.org/mongo-driver/v2/event"
+)
+
+// newCommandMonitor measures and traces every command sent to MongoDB.
+func newCommandMonitor() *event.CommandMonitor {
+	return combineMonitors(
+		metrics.NewMongoCommandMonitor(),
+		tracing.NewMongoCommandMonitor(),
+	)
+}
+
+// combineMonitors calls every monitor in order, because the driver accepts only one.
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, monitor := range monitors {
+				if monitor.Started != nil {
+					monitor.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, monitor := range monitors {
+				if monitor.Succeeded != nil {
+					monitor.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, monitor := range monitors {
+				if monitor.Failed != nil {
+					monitor.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
@@ -31,13 +31,8 @@ func BsonToJSON(input bson.Raw) (json.RawMessage, error) {
 		return nil, nil
 	}
 
-	var vl any
-	err := UnmarshalBson(input, &vl)
-	if err != nil {
-		return nil, err
-	}
-
-	return bson.MarshalExtJSON(vl, false, true)
+	// decoding into any would turn documents into maps and shuffle their fields
+	return bson.MarshalExtJSON(bson.Raw(input), false, true)
 }
 
 func MarshalBson(input any) ([]byte, error) {
@@ -47,7 +42,10 @@ func MarshalBson(input any) ([]byte, error) {
 	enc := bson.NewEncoder(vw)
 	enc.SetRegistry(_registry)
 
-	return w.Bytes(), enc.Encode(input)
+	// the buffer must be read after the encoding
+	err := enc.Encode(input)
+
+	return w.Bytes(), err
 }
 
 func UnmarshalBson(input []byte, output any) error {
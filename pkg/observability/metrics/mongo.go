@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+var (
+	mongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "mongo",
+		Name:      "command_duration_seconds",
+		Help:      "Duration of MongoDB commands sent by the repo, by collection, command and status.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"collection", "command", "status"})
+
+	mongoCommandErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "mongo",
+		Name:      "command_errors_total",
+		Help:      "Failed MongoDB commands by collection, command and server error code (0 for network and client errors).",
+	}, []string{"collection", "command", "code"})
+)
+
+// NewMongoCommandMonitor returns a monitor which records duration and errors of every command.
+// The collection is taken from the started event because finished events don't have it.
+func NewMongoCommandMonitor() *event.CommandMonitor {
+	var collections sync.Map
+
+	collection := func(requestID int64) string {
+		value, ok := collections.LoadAndDelete(requestID)
+		if !ok {
+			return ""
+		}
+
+		return value.(string)
+	}
+
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			name, ok := e.Command.Lookup(e.CommandName).StringValueOK()
+			if !ok {
+				// e.g. getMore keeps the collection in a separate field
+				name, _ = e.Command.Lookup("collection").StringValueOK()
+			}
+
+			collections.Store(e.RequestID, name)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoCommandDuration.
+				WithLabelValues(collection(e.RequestID), e.CommandName, StatusOK).
+				Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			coll := collection(e.RequestID)
+
+			mongoCommandDuration.
+				WithLabelValues(coll, e.CommandName, StatusError).
+				Observe(e.Duration.Seconds())
+
+			code := 0
+
+			var serverErr mongo.ServerError
+			if errors.As(e.Failure, &serverErr) && len(serverErr.ErrorCodes()) > 0 {
+				code = serverErr.ErrorCodes()[0]
+			}
+
+			mongoCommandErrors.WithLabelValues(coll, e.CommandName, strconv.Itoa(code)).Inc()
+		},
+	}
+}
+
+// ObserveDuration records the time since start in the histogram with the status label derived from err.
+// The histogram must have `status` as its last label.
+func ObserveDuration(histogram *prometheus.HistogramVec, start time.Time, err error, labels ...string) {
+	status := StatusOK
+	if err != nil {
+		status = StatusError
+	}
+
+	histogram.WithLabelValues(append(labels, status)...).Observe(time.Since(start).Seconds())
+}
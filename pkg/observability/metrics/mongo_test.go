@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestMongoCommandMonitor(t *testing.T) {
+	monitor := NewMongoCommandMonitor()
+	ctx := context.Background()
+
+	insert, err := bson.Marshal(bson.D{{Key: "insert", Value: "test_raw_events"}})
+	assert.NoError(t, err)
+
+	getMore, err := bson.Marshal(bson.D{{Key: "getMore", Value: int64(1)}, {Key: "collection", Value: "test_raw_events"}})
+	assert.NoError(t, err)
+
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: insert, CommandName: "insert", RequestID: 1})
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: getMore, CommandName: "getMore", RequestID: 2})
+
+	monitor.Succeeded(ctx, &event.CommandSucceededEvent{
+		CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "insert", RequestID: 1, Duration: time.Millisecond},
+	})
+	monitor.Failed(ctx, &event.CommandFailedEvent{
+		CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "getMore", RequestID: 2, Duration: time.Millisecond},
+		Failure:              mongo.CommandError{Code: 43},
+	})
+
+	assert.InDelta(t, 1, testutil.ToFloat64(mongoCommandErrors.WithLabelValues("test_raw_events", "getMore", "43")), 0)
+
+	assert.Equal(t, uint64(1), histogramCount(t, mongoCommandDuration.WithLabelValues("test_raw_events", "insert", StatusOK)))
+	assert.Equal(t, uint64(1), histogramCount(t, mongoCommandDuration.WithLabelValues("test_raw_events", "getMore", StatusError)))
+}
+
+func TestObserveDuration(t *testing.T) {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_duration_seconds"}, []string{"type", "status"})
+
+	ObserveDuration(histogram, time.Now(), nil, "a")
+	ObserveDuration(histogram, time.Now(), errors.New("failed"), "a")
+	ObserveDuration(histogram, time.Now(), errors.New("failed"), "a")
+
+	assert.Equal(t, uint64(1), histogramCount(t, histogram.WithLabelValues("a", StatusOK)))
+	assert.Equal(t, uint64(2), histogramCount(t, histogram.WithLabelValues("a", StatusError)))
+}
+
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+
+	collector, ok := observer.(prometheus.Metric)
+	if !ok {
+		t.Fatalf("observer is not a metric")
+	}
+
+	var metric dto.Metric
+	if err := collector.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+
+	return metric.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,63 @@
+// Package metrics exposes Prometheus metrics of the service internals.
+//
+// Collectors are registered in the default registry by packages which own them,
+// this package serves the registry and instruments the MongoDB driver.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	Namespace = "pipetank"
+
+	Path = "/metrics"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// Serve serves Path on the addr in Prometheus exposition format until the context is done.
+// Empty addr disables the endpoint.
+func Serve(ctx context.Context, addr string) error {
+	if len(addr) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(Path, promhttp.Handler())
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: shutdownTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("failed to shutdown metrics server", slog.Any("error", err))
+		}
+	}()
+
+	slog.InfoContext(ctx, "serving metrics", slog.String("addr", addr), slog.String("path", Path))
+
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve metrics on %s: %w", addr, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"github.com/caarlos0/env/v11"
+)
+
+type Exporter string
+
+const (
+	// ExporterNone records spans without exporting them, so trace IDs still exist in logs and errors.
+	ExporterNone   Exporter = "none"
+	ExporterStdout Exporter = "stdout"
+	// ExporterFile writes spans as JSON lines to Config.File.
+	ExporterFile Exporter = "file"
+	ExporterOTLP Exporter = "otlp"
+)
+
+type Config struct {
+	Exporter Exporter `env:"TRACING_EXPORTER" envDefault:"none"`
+	File     string   `env:"TRACING_FILE"`
+
+	// OTLPEndpoint is `host:port` of an OTLP gRPC collector.
+	OTLPEndpoint string `env:"TRACING_OTLP_ENDPOINT" envDefault:"localhost:4317"`
+	OTLPInsecure bool   `env:"TRACING_OTLP_INSECURE" envDefault:"false"`
+
+	// SampleRatio is a ratio of sampled root spans, child spans follow their parent.
+	SampleRatio float64 `env:"TRACING_SAMPLE_RATIO" envDefault:"1"`
+}
+
+func ParseConfig() (Config, error) {
+	return env.ParseAs[Config]()
+}
@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewMongoCommandMonitor returns a monitor which wraps every MongoDB command into a client span,
+// the span is a child of the span in the context of the operation.
+func NewMongoCommandMonitor() *event.CommandMonitor {
+	var spans sync.Map
+
+	end := func(requestID int64, err error) {
+		value, ok := spans.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+
+		span, _ := value.(trace.Span)
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			collection, ok := e.Command.Lookup(e.CommandName).StringValueOK()
+			if !ok {
+				collection, _ = e.Command.Lookup("collection").StringValueOK()
+			}
+
+			name := e.CommandName
+			if len(collection) > 0 {
+				name += " " + collection
+			}
+
+			_, span := Tracer().Start(
+				ctx,
+				name,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.DBSystemNameMongoDB,
+					semconv.DBNamespace(e.DatabaseName),
+					semconv.DBOperationName(e.CommandName),
+					semconv.DBCollectionName(collection),
+					attribute.Int64("db.mongodb.request_id", e.RequestID),
+				),
+			)
+
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			end(e.RequestID, nil)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			end(e.RequestID, e.Failure)
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traces.jsonl")
+	ctx := context.Background()
+
+	shutdown, err := Setup(ctx, Config{Exporter: ExporterFile, File: file, SampleRatio: 1}, "test")
+	require.NoError(t, err)
+
+	_, span := Tracer().Start(ctx, "test-span")
+	End(span, errors.New("boom"))
+
+	require.NoError(t, shutdown(ctx))
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"Name":"test-span"`)
+	assert.Contains(t, string(content), "boom")
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	_, err := Setup(context.Background(), Config{Exporter: "jaeger"}, "test")
+	assert.ErrorContains(t, err, "unknown trace exporter")
+
+	_, err = Setup(context.Background(), Config{Exporter: ExporterFile}, "test")
+	assert.ErrorContains(t, err, "TRACING_FILE")
+}
+
+func TestMongoCommandMonitor(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+
+	monitor := NewMongoCommandMonitor()
+	ctx, parent := Tracer().Start(context.Background(), "parent")
+
+	command, err := bson.Marshal(bson.D{{Key: "find", Value: "raw_events"}})
+	require.NoError(t, err)
+
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: command, CommandName: "find", RequestID: 1})
+	monitor.Started(ctx, &event.CommandStartedEvent{Command: command, CommandName: "find", RequestID: 2})
+	monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 1}})
+	monitor.Failed(ctx, &event.CommandFailedEvent{
+		CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 2},
+		Failure:              errors.New("failed"),
+	})
+
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+
+	assert.Equal(t, "find raw_events", spans[0].Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}